@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// AgentAddressStats holds counters for agent address rewriting
+type AgentAddressStats struct {
+	DatagramsRewritten uint64
+}
+
+var agentAddressStats AgentAddressStats
+
+// rewriteAgentAddress puts the configured agent address in the datagram header.
+// It runs after all samples were processed: a change between IPv4 and IPv6
+// resizes the header and moves every sample.
+func rewriteAgentAddress(packet []byte, current net.IP, agent *config.AgentConfig) []byte {
+	if agent.AgentAddress == nil || agent.AgentAddress.Equal(current) {
+		return packet
+	}
+	newPacket, ok := sflow.SetAgentAddress(packet, agent.AgentAddress)
+	if !ok {
+		return packet
+	}
+	atomic.AddUint64(&agentAddressStats.DatagramsRewritten, 1)
+	return newPacket
+}
+
+func agentAddressStatus() map[string]interface{} {
+	var agents []map[string]interface{}
+	for _, agent := range cfg.GetAgents() {
+		if agent.SetAgentAddress == "" {
+			continue
+		}
+		agents = append(agents, map[string]interface{}{
+			"address":           agent.Address,
+			"source":            agent.Source,
+			"set_agent_address": agent.SetAgentAddress,
+		})
+	}
+	return map[string]interface{}{
+		"agents":              agents,
+		"datagrams_rewritten": atomic.LoadUint64(&agentAddressStats.DatagramsRewritten),
+	}
+}
+
+func writeAgentAddressMetrics(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_agent_address_rewritten_total Datagrams forwarded with a rewritten agent address\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_agent_address_rewritten_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_agent_address_rewritten_total %d\n", atomic.LoadUint64(&agentAddressStats.DatagramsRewritten))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sflow-enricher/internal/sflow"
+)
+
+// startReceiver runs the receive loop on a local socket until the test ends
+// and returns a socket sending to it
+func startReceiver(t *testing.T) *net.UDPConn {
+	t.Helper()
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		processPackets(listener, stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		listener.Close()
+		wg.Wait()
+	})
+
+	conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// The whitelist applies to the UDP source the datagram came from, not to the
+// agent address in its header before or after set_agent_address
+func TestWhitelistBeforeAgentAddressRewrite(t *testing.T) {
+	sample := []sflow.FlowRecord{rawHeaderRecord(t, 1500, testSrc, testDst)}
+	data := testDatagram(t, sample)
+	agents := `
+agents:
+  - {source: "127.0.0.1", set_agent_address: "10.255.0.1"}
+`
+
+	t.Run("source whitelisted", func(t *testing.T) {
+		loadTestConfig(t, "security: {whitelist_enabled: true, whitelist_sources: [\"127.0.0.1/32\"]}\n"+agents)
+		read := captureDestinations(t)
+		conn := startReceiver(t)
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		d, err := sflow.Parse(read(1)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.AgentAddr.Equal(net.IP{10, 255, 0, 1}) {
+			t.Errorf("agent address %v, want 10.255.0.1", d.AgentAddr)
+		}
+	})
+
+	t.Run("agent addresses whitelisted", func(t *testing.T) {
+		loadTestConfig(t, "security: {whitelist_enabled: true, whitelist_sources: [\"10.255.0.1/32\", \"192.0.2.1/32\"]}\n"+agents)
+		captureDestinations(t)
+		filtered := atomic.LoadUint64(&stats.PacketsFiltered)
+		forwarded := atomic.LoadUint64(&stats.PacketsForwarded)
+		conn := startReceiver(t)
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadUint64(&stats.PacketsFiltered) == filtered {
+			if time.Now().After(deadline) {
+				t.Fatal("datagram not filtered")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if atomic.LoadUint64(&stats.PacketsForwarded) != forwarded {
+			t.Error("datagram forwarded")
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"sflow-enricher/internal/bgp"
+)
+
+// bgpSpeaker is the passive BGP speaker, nil unless bgp.enabled
+var bgpSpeaker *bgp.Speaker
+
+// startBGPSpeaker listens for BGP sessions from the configured peers. Their
+// routes go to routeRIB.
+func startBGPSpeaker() error {
+	bc := cfg.BGP
+	listener, err := net.Listen("tcp", cfg.BGPAddr())
+	if err != nil {
+		return err
+	}
+
+	speakerCfg := bgp.SpeakerConfig{
+		LocalAS:  bc.LocalAS,
+		RouterID: bc.RouterIDAddr,
+		HoldTime: uint16(bc.HoldTime),
+		AddPath:  bc.AddPath,
+	}
+	for _, peer := range bc.Peers {
+		speakerCfg.Peers = append(speakerCfg.Peers, bgp.PeerConfig{Address: peer.Addr, AS: peer.AS})
+	}
+	bgpSpeaker = bgp.NewSpeaker(speakerCfg, routeRIB)
+	bgpSpeaker.OnStateChange = func(peer netip.Addr, state string, err error) {
+		fields := map[string]interface{}{"peer": peer.String(), "state": state}
+		if err != nil {
+			logError("BGP session down", err, fields)
+			return
+		}
+		logInfo("BGP session "+state, fields)
+	}
+
+	logInfo("BGP speaker listening", map[string]interface{}{
+		"address":  cfg.BGPAddr(),
+		"local_as": bc.LocalAS,
+		"peers":    len(bc.Peers),
+	})
+	go func() {
+		if err := bgpSpeaker.Serve(listener); err != nil {
+			logError("BGP speaker stopped", err, nil)
+		}
+	}()
+	return nil
+}
+
+func bgpStatus() map[string]interface{} {
+	if bgpSpeaker == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	var sessions []map[string]interface{}
+	for _, st := range bgpSpeaker.Sessions() {
+		session := map[string]interface{}{
+			"peer":          st.Peer.String(),
+			"peer_as":       st.PeerAS,
+			"state":         st.State,
+			"hold_time":     st.HoldTime,
+			"four_octet_as": st.FourOctetAS,
+			"add_path":      st.AddPath,
+			"updates":       st.Updates,
+			"routes":        st.Routes,
+			"last_error":    st.LastError,
+		}
+		if st.RouterID.IsValid() {
+			session["router_id"] = st.RouterID.String()
+		}
+		if !st.Since.IsZero() {
+			session["since"] = st.Since.Format(time.RFC3339)
+		}
+		sessions = append(sessions, session)
+	}
+	return map[string]interface{}{
+		"enabled":  true,
+		"local_as": cfg.BGP.LocalAS,
+		"sessions": sessions,
+	}
+}
+
+func writeBGPMetrics(w http.ResponseWriter) {
+	if bgpSpeaker == nil {
+		return
+	}
+	sessions := bgpSpeaker.Sessions()
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_bgp_session_established BGP session state (1=Established)\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_bgp_session_established gauge\n")
+	for _, st := range sessions {
+		established := 0
+		if st.State == bgp.StateEstablished {
+			established = 1
+		}
+		fmt.Fprintf(w, "sflow_asn_enricher_bgp_session_established{peer=\"%s\"} %d\n", st.Peer, established)
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_bgp_session_routes Routes received from a BGP peer\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_bgp_session_routes gauge\n")
+	for _, st := range sessions {
+		fmt.Fprintf(w, "sflow_asn_enricher_bgp_session_routes{peer=\"%s\"} %d\n", st.Peer, st.Routes)
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_bgp_session_updates_total UPDATE messages received in the current BGP session\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_bgp_session_updates_total counter\n")
+	for _, st := range sessions {
+		fmt.Fprintf(w, "sflow_asn_enricher_bgp_session_updates_total{peer=\"%s\"} %d\n", st.Peer, st.Updates)
+	}
+}
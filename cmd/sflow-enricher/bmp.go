@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"sflow-enricher/internal/bmp"
+	"sflow-enricher/internal/config"
+)
+
+// bmpCollector is the BMP collector, nil unless bmp.enabled
+var bmpCollector *bmp.Collector
+
+// startBMPCollector listens for BMP connections from monitored routers. The
+// routes of their peers go to routeRIB.
+func startBMPCollector() error {
+	bc := cfg.BMP
+	listener, err := net.Listen("tcp", cfg.BMPAddr())
+	if err != nil {
+		return err
+	}
+
+	bmpCollector = bmp.NewCollector(bmp.Config{
+		PostPolicy: bc.Policy == config.BMPPolicyPost,
+		Routers:    bc.RouterAddrs,
+	}, routeRIB)
+	bmpCollector.OnRouterChange = func(router netip.Addr, up bool, err error) {
+		fields := map[string]interface{}{"router": router.String()}
+		switch {
+		case up:
+			logInfo("BMP router connected", fields)
+		case err != nil:
+			logError("BMP router disconnected", err, fields)
+		default:
+			logInfo("BMP router disconnected", fields)
+		}
+	}
+
+	logInfo("BMP collector listening", map[string]interface{}{
+		"address": cfg.BMPAddr(),
+		"policy":  bc.Policy,
+		"routers": len(bc.RouterAddrs),
+	})
+	go func() {
+		if err := bmpCollector.Serve(listener); err != nil {
+			logError("BMP collector stopped", err, nil)
+		}
+	}()
+	return nil
+}
+
+func bmpStatus() map[string]interface{} {
+	if bmpCollector == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	var routers []map[string]interface{}
+	for _, r := range bmpCollector.Routers() {
+		routers = append(routers, map[string]interface{}{
+			"address":    r.Address.String(),
+			"sys_name":   r.SysName,
+			"sys_descr":  r.SysDescr,
+			"since":      r.Since.Format(time.RFC3339),
+			"messages":   r.Messages,
+			"errors":     r.Errors,
+			"last_error": r.LastError,
+			"peers":      r.Peers,
+		})
+	}
+	return map[string]interface{}{
+		"enabled": true,
+		"policy":  cfg.BMP.Policy,
+		"routers": routers,
+	}
+}
+
+// bmpPeersHandler lists the peers of the connected routers
+func bmpPeersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	peers := []map[string]interface{}{}
+	if bmpCollector != nil {
+		for _, st := range bmpCollector.Peers() {
+			peer := map[string]interface{}{
+				"router":           st.Router.String(),
+				"router_name":      st.RouterName,
+				"peer":             st.Peer.String(),
+				"peer_type":        st.PeerType,
+				"distinguisher":    bmp.FormatDistinguisher(st.Distinguisher),
+				"peer_as":          st.PeerAS,
+				"local_as":         st.LocalAS,
+				"bgp_id":           st.BGPID.String(),
+				"state":            st.State,
+				"since":            st.Since.Format(time.RFC3339),
+				"four_octet_as":    st.FourOctetAS,
+				"add_path":         st.AddPath,
+				"route_monitoring": st.RouteMonitoring,
+				"skipped":          st.Skipped,
+				"routes":           st.Routes,
+				"stats":            st.Stats,
+			}
+			if st.DownReason != "" {
+				peer["down_reason"] = st.DownReason
+			}
+			peers = append(peers, peer)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": bmpCollector != nil,
+		"peers":   peers,
+	})
+}
+
+func writeBMPMetrics(w http.ResponseWriter) {
+	if bmpCollector == nil {
+		return
+	}
+	peers := bmpCollector.Peers()
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_bmp_routers Routers connected to the BMP collector\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_bmp_routers gauge\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_bmp_routers %d\n", len(bmpCollector.Routers()))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_bmp_peer_up BMP peer state (1=up)\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_bmp_peer_up gauge\n")
+	for _, st := range peers {
+		up := 0
+		if st.State == bmp.PeerUpState {
+			up = 1
+		}
+		fmt.Fprintf(w, "sflow_asn_enricher_bmp_peer_up{%s} %d\n", bmpPeerLabels(&st), up)
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_bmp_peer_routes Routes of a BMP peer in the RIB\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_bmp_peer_routes gauge\n")
+	for _, st := range peers {
+		fmt.Fprintf(w, "sflow_asn_enricher_bmp_peer_routes{%s} %d\n", bmpPeerLabels(&st), st.Routes)
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_bmp_peer_route_monitoring_total Route Monitoring messages used for a BMP peer\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_bmp_peer_route_monitoring_total counter\n")
+	for _, st := range peers {
+		fmt.Fprintf(w, "sflow_asn_enricher_bmp_peer_route_monitoring_total{%s} %d\n", bmpPeerLabels(&st), st.RouteMonitoring)
+	}
+}
+
+func bmpPeerLabels(st *bmp.PeerStatus) string {
+	return fmt.Sprintf("router=\"%s\",peer=\"%s\",distinguisher=\"%s\"",
+		st.Router, st.Peer, bmp.FormatDistinguisher(st.Distinguisher))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"sflow-enricher/internal/bgp"
+	"sflow-enricher/internal/bmp"
+)
+
+// bmpMessage returns a BMP message about an IPv4 peer with 4-byte ASNs
+func bmpMessage(msgType uint8, peer string, as uint32, body []byte) []byte {
+	b := []byte{bmp.PeerTypeGlobal, 0}
+	b = binary.BigEndian.AppendUint64(b, 0)
+	addr := netip.MustParseAddr(peer).As4()
+	b = append(b, make([]byte, 12)...)
+	b = append(b, addr[:]...)
+	b = binary.BigEndian.AppendUint32(b, as)
+	b = append(b, 192, 0, 2, 9)
+	b = append(b, make([]byte, 8)...)
+	b = append(b, body...)
+
+	m := []byte{bmp.Version}
+	m = binary.BigEndian.AppendUint32(m, uint32(bmp.CommonHeaderLen+len(b)))
+	return append(append(m, msgType), b...)
+}
+
+// bmpOpen returns an OPEN of a unicast speaker with the ADD-PATH flags of
+// IPv4 unicast
+func bmpOpen(as uint32, addPath uint8) *bgp.Open {
+	o := &bgp.Open{
+		AS:          as,
+		HoldTime:    90,
+		RouterID:    netip.MustParseAddr("192.0.2.9"),
+		FourOctetAS: true,
+		Families:    []bgp.Family{bgp.IPv4Unicast},
+	}
+	if addPath != 0 {
+		o.AddPath = map[bgp.Family]uint8{bgp.IPv4Unicast: addPath}
+	}
+	return o
+}
+
+// bmpPeers returns the peers listed by /bmp/peers
+func bmpPeers(t *testing.T) (bool, []map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	bmpPeersHandler(w, httptest.NewRequest("GET", "/bmp/peers", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var body struct {
+		Enabled bool                     `json:"enabled"`
+		Peers   []map[string]interface{} `json:"peers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if body.Peers == nil {
+		t.Errorf("peers is not a list: %s", w.Body)
+	}
+	return body.Enabled, body.Peers
+}
+
+func TestBMPPeersHandler(t *testing.T) {
+	if enabled, peers := bmpPeers(t); enabled || len(peers) != 0 {
+		t.Errorf("without a collector: enabled %v, peers %v", enabled, peers)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmpCollector = bmp.NewCollector(bmp.Config{}, routeRIB)
+	go bmpCollector.Serve(listener)
+	t.Cleanup(func() {
+		bmpCollector.Close()
+		bmpCollector = nil
+	})
+
+	router, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	up := append(make([]byte, 12), 10, 0, 0, 1)
+	up = binary.BigEndian.AppendUint16(up, 179)
+	up = binary.BigEndian.AppendUint16(up, 50000)
+	up = bmpOpen(65001, bgp.AddPathReceive).Append(up)
+	up = bmpOpen(65002, bgp.AddPathSend).Append(up)
+	for _, m := range [][]byte{
+		{bmp.Version, 0, 0, 0, 15, bmp.MsgInitiation, 0, 2, 0, 5, 'e', 'd', 'g', 'e', '1'},
+		bmpMessage(bmp.MsgPeerUp, "10.0.0.2", 65002, up),
+		bmpMessage(bmp.MsgPeerDown, "10.0.0.3", 65003, []byte{4}),
+	} {
+		if _, err := router.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(bmpCollector.Routers()) == 0 || bmpCollector.Routers()[0].Messages < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("messages not handled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	enabled, peers := bmpPeers(t)
+	if !enabled || len(peers) != 2 {
+		t.Fatalf("enabled %v, peers %v", enabled, peers)
+	}
+	want := []map[string]interface{}{
+		{"router": "127.0.0.1", "router_name": "edge1", "peer": "10.0.0.2", "peer_type": "global",
+			"distinguisher": "0:0", "peer_as": 65002.0, "local_as": 65001.0, "bgp_id": "192.0.2.9", "state": "up",
+			"four_octet_as": true, "add_path": "[ipv4-unicast]", "route_monitoring": 0.0, "skipped": 0.0, "routes": 0.0},
+		{"peer": "10.0.0.3", "peer_as": 65003.0, "state": "down", "down_reason": "remote close", "add_path": "<nil>"},
+	}
+	for i, fields := range want {
+		for name, value := range fields {
+			got := peers[i][name]
+			if name == "add_path" {
+				got = fmt.Sprint(got)
+			}
+			if got != value {
+				t.Errorf("peer %d: %s = %v, want %v", i, name, got, value)
+			}
+		}
+	}
+	if _, ok := peers[0]["down_reason"]; ok {
+		t.Error("down_reason of an up peer")
+	}
+	if _, err := time.Parse(time.RFC3339, peers[0]["since"].(string)); err != nil {
+		t.Error(err)
+	}
+}
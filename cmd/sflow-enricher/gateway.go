@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// synthesizeGateway appends an extended_gateway record to a flow sample that has
+// none, when a rule with synthesize_gateway matches its source or destination IP.
+// The most specific rule on each side fills in the fields the enrichment would
+// set on an existing record: SrcAS, SrcPeerAS and RouterAS for the source,
+// DstAS (set_as_path) and RouterAS for the destination. Next hop, communities
+// and local_pref come from the more specific of the two. match_as is not
+// checked, as there is no current AS to compare.
+// Returns the modified packet (may be resized) and whether a record was added.
+func synthesizeGateway(packet []byte, sampleOffset int, rules *config.RuleTable, addrs *flowAddresses) ([]byte, bool) {
+	synthesizes := func(rule *config.EnrichmentRule) bool {
+		return rule.SynthesizeGateway
+	}
+	src := matchRule(rules, addrs, false, synthesizes)
+	dst := matchRule(rules, addrs, true, synthesizes)
+	attr := src
+	if dst.better(src) {
+		attr = dst
+	}
+	if attr.rule == nil {
+		return packet, false
+	}
+	srcRule, dstRule, attrRule := src.rule, dst.rule, attr.rule
+
+	eg := &sflow.ExtendedGateway{NextHopType: sflow.AddressTypeUnknown}
+	if srcRule != nil {
+		eg.SrcAS = srcRule.SetAS
+		eg.SrcPeerAS = srcRule.SetAS
+		eg.AS = srcRule.SetAS
+	}
+	if dstRule != nil {
+		eg.DstASPath = dstRule.SetASPath
+		if eg.AS == 0 {
+			eg.AS = dstRule.SetAS
+		}
+	}
+	eg.Communities = attrRule.Communities
+	if attrRule.SetLocalPref != nil {
+		eg.LocalPref = *attrRule.SetLocalPref
+	}
+	if attrRule.NextHop != nil {
+		eg.NextHopType = sflow.AddressType(attrRule.NextHop)
+		eg.NextHop = attrRule.NextHop
+	}
+
+	data, err := eg.Encode()
+	if err != nil {
+		if debugMode {
+			logError("Extended gateway encode error", err, nil)
+		}
+		return packet, false
+	}
+
+	newPacket, ok := sflow.AppendFlowRecord(packet, sampleOffset, sflow.FlowRecordExtendedGateway, data)
+	if !ok {
+		return packet, false
+	}
+
+	if debugMode {
+		fields := map[string]interface{}{"router_as": eg.AS}
+		if srcRule != nil {
+			fields["src_as"] = eg.SrcAS
+			fields["src_rule"] = srcRule.Name
+		}
+		if dstRule != nil {
+			fields["dst_as_path"] = dstRule.SetASPath.String()
+			fields["dst_rule"] = dstRule.Name
+		}
+		logDebug("Synthesized extended gateway", fields)
+	}
+	return newPacket, true
+}
+
+// enrichGatewayAttributes writes the next hop, BGP communities and local_pref of
+// the most specific rule with such actions whose network contains the source or
+// destination IP. With overwrite=false the next hop is only set when UNKNOWN or
+// unspecified, communities are only added to a record without any, and
+// local_pref is only set when 0; with overwrite=true the next hop and local_pref
+// are always set and communities are added to the existing ones. As with SrcAS
+// and match_as, communities the router exported count as set: a rule only tags
+// records without any unless it overwrites.
+// Returns the modified packet (may be resized) and whether it was changed.
+func enrichGatewayAttributes(packet []byte, sampleOffset, recordOffset int, rules *config.RuleTable, addrs *flowAddresses, eg *sflow.ExtendedGatewayHeader) ([]byte, bool) {
+	hasAttributes := func(rule *config.EnrichmentRule) bool {
+		return len(rule.Communities) > 0 || rule.SetLocalPref != nil || rule.NextHop != nil
+	}
+	m := matchRule(rules, addrs, false, hasAttributes)
+	if dst := matchRule(rules, addrs, true, hasAttributes); dst.better(m) {
+		m = dst
+	}
+	if m.rule == nil {
+		return packet, false
+	}
+	rule := m.rule
+
+	enriched := false
+	if rule.NextHop != nil && (rule.Overwrite || eg.NextHop == nil || eg.NextHop.IsUnspecified()) {
+		if newPacket, ok := sflow.SetNextHop(packet, sampleOffset, recordOffset, rule.NextHop); ok {
+			packet = newPacket
+			enriched = true
+		}
+	}
+	if len(rule.Communities) > 0 && (rule.Overwrite || eg.CommunitiesLen == 0) {
+		if newPacket, ok := sflow.AddCommunities(packet, sampleOffset, recordOffset, rule.Communities); ok {
+			packet = newPacket
+			enriched = true
+		}
+	}
+	if rule.SetLocalPref != nil && (rule.Overwrite || eg.LocalPref == 0) {
+		if sflow.SetLocalPref(packet, sampleOffset, recordOffset, *rule.SetLocalPref) {
+			enriched = true
+		}
+	}
+
+	if enriched && debugMode {
+		fields := map[string]interface{}{
+			"communities": rule.AddCommunities,
+			"rule":        rule.Name,
+		}
+		if rule.SetLocalPref != nil {
+			fields["local_pref"] = *rule.SetLocalPref
+		}
+		if rule.NextHop != nil {
+			fields["next_hop"] = rule.NextHop.String()
+		}
+		logDebug("Enriching BGP attributes", fields)
+	}
+	return packet, enriched
+}
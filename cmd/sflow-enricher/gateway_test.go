@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"sflow-enricher/internal/sflow"
+)
+
+// flowSamples returns the flow samples of a datagram and their lengths
+func flowSamples(t *testing.T, data []byte) ([]*sflow.FlowSample, []uint32) {
+	t.Helper()
+	d, err := sflow.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []*sflow.FlowSample
+	var lengths []uint32
+	for _, s := range d.Samples {
+		fs, err := sflow.ParseFlowSample(s.Data, s.Format == sflow.SampleTypeExpandedFlowSample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, fs)
+		lengths = append(lengths, s.Length)
+	}
+	return samples, lengths
+}
+
+func TestEnrichSynthesizeGateway(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: src, network: "198.51.100.0/24", match_as: 0, set_as: 64501, synthesize_gateway: true,
+       add_communities: ["64501:1"], set_local_pref: 150}
+    - {name: dst, network: "203.0.113.0/24", match_as: 0, set_as: 64999, synthesize_gateway: true}
+    - {name: dst-more-specific, network: "203.0.113.0/25", match_as: 0, set_as: 64998, set_as_path: [64998, [65010, 65011]],
+       synthesize_gateway: true, add_communities: ["64998:2"], set_local_pref: 200, set_next_hop: "2001:db8::1"}
+    - {name: no-synthesize, network: "192.0.2.0/24", match_as: 0, set_as: 64777}
+`)
+	other := net.IP{192, 0, 2, 10}
+	outside := net.IP{233, 252, 0, 1}
+
+	tests := []struct {
+		name     string
+		src, dst net.IP
+		want     *sflow.ExtendedGateway // nil: no record appended
+	}{
+		{"source only", testSrc, outside, &sflow.ExtendedGateway{
+			NextHopType: sflow.AddressTypeUnknown, AS: 64501, SrcAS: 64501, SrcPeerAS: 64501,
+			Communities: []uint32{64501<<16 | 1}, LocalPref: 150,
+		}},
+		{"destination only", outside, net.IP{203, 0, 113, 200}, &sflow.ExtendedGateway{
+			NextHopType: sflow.AddressTypeUnknown, AS: 64999,
+			DstASPath: []sflow.ASPathSegment{{Type: sflow.ASPathSegmentSequence, ASNs: []uint32{64999}}},
+		}},
+		// The /25 is more specific than the source /24, so its attributes win;
+		// RouterAS comes from the source rule
+		{"both", testSrc, testDst, &sflow.ExtendedGateway{
+			NextHopType: sflow.AddressTypeIPv6, NextHop: net.ParseIP("2001:db8::1"), AS: 64501, SrcAS: 64501, SrcPeerAS: 64501,
+			DstASPath: []sflow.ASPathSegment{
+				{Type: sflow.ASPathSegmentSequence, ASNs: []uint32{64998}},
+				{Type: sflow.ASPathSegmentSet, ASNs: []uint32{65010, 65011}},
+			},
+			Communities: []uint32{64998<<16 | 2}, LocalPref: 200,
+		}},
+		{"rule without synthesize_gateway", other, outside, nil},
+		{"no rule", outside, outside, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The sample after the synthesized one moves with the growth
+			gateway := gatewayRecord(t, &sflow.ExtendedGateway{AS: 65000, SrcAS: 65001})
+			data := testDatagram(t,
+				[]sflow.FlowRecord{rawHeaderRecord(t, 1500, tt.src, tt.dst)},
+				[]sflow.FlowRecord{gateway, sampledIPv4Record(t, 1500, outside, outside)},
+			)
+			before, beforeLengths := flowSamples(t, data)
+
+			out, ok := enrich(t, data)
+			if ok != (tt.want != nil) {
+				t.Fatalf("enriched = %v", ok)
+			}
+			after, afterLengths := flowSamples(t, out)
+			if len(after) != 2 {
+				t.Fatalf("%d samples after enrichment", len(after))
+			}
+			if afterLengths[1] != beforeLengths[1] || len(after[1].Records) != 2 {
+				t.Errorf("second sample changed: length %d, %d records", afterLengths[1], len(after[1].Records))
+			}
+			if eg := gateways(t, out)[1]; eg.AS != 65000 || eg.SrcAS != 65001 {
+				t.Errorf("second sample's gateway %+v", *eg)
+			}
+
+			fs := after[0]
+			if tt.want == nil {
+				if fs.NumRecords != 1 || afterLengths[0] != beforeLengths[0] || len(out) != len(data) {
+					t.Errorf("sample changed without a synthesize_gateway rule: %d records, length %d", fs.NumRecords, afterLengths[0])
+				}
+				return
+			}
+
+			if fs.NumRecords != before[0].NumRecords+1 || len(fs.Records) != 2 {
+				t.Fatalf("num_records %d with %d records, want 2", fs.NumRecords, len(fs.Records))
+			}
+			record := fs.Records[1]
+			if record.Format != sflow.FlowRecordExtendedGateway {
+				t.Fatalf("appended record format %d", record.Format)
+			}
+			if growth := 8 + len(record.Data); afterLengths[0] != beforeLengths[0]+uint32(growth) || len(out) != len(data)+growth {
+				t.Errorf("sample_length %d and datagram %d bytes, want %d and %d",
+					afterLengths[0], len(out), beforeLengths[0]+uint32(growth), len(data)+growth)
+			}
+
+			eg, err := sflow.ParseExtendedGateway(record.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if eg.NextHopType != want.NextHopType || !eg.NextHop.Equal(want.NextHop) ||
+				eg.AS != want.AS || eg.SrcAS != want.SrcAS || eg.SrcPeerAS != want.SrcPeerAS ||
+				fmt.Sprint(eg.DstASPath) != fmt.Sprint(want.DstASPath) ||
+				!equalUint32s(eg.Communities, want.Communities) || eg.LocalPref != want.LocalPref {
+				t.Errorf("synthesized %+v\nwant %+v", *eg, *want)
+			}
+		})
+	}
+}
+
+// overwrite applies to each attribute as to SrcAS: without it only unset
+// values are written, so communities the router exported are kept as they are
+func TestEnrichGatewayAttributes(t *testing.T) {
+	const tag = 64512<<16 | 100
+	routerCommunity := uint32(65000<<16 | 1)
+	nextHop := net.IP{192, 0, 2, 254}
+	routerNextHop := net.IP{10, 0, 0, 1}
+	// A record the router filled in
+	set := func(communities ...uint32) sflow.ExtendedGateway {
+		return sflow.ExtendedGateway{NextHopType: sflow.AddressTypeIPv4, NextHop: routerNextHop, Communities: communities, LocalPref: 50}
+	}
+
+	tests := []struct {
+		name        string
+		overwrite   bool
+		record      sflow.ExtendedGateway
+		nextHop     net.IP
+		communities []uint32
+		localPref   uint32
+	}{
+		{"unset, overwrite false", false, sflow.ExtendedGateway{NextHopType: sflow.AddressTypeUnknown},
+			nextHop, []uint32{tag}, 200},
+		{"unset, overwrite true", true, sflow.ExtendedGateway{NextHopType: sflow.AddressTypeUnknown},
+			nextHop, []uint32{tag}, 200},
+		{"unspecified next hop, overwrite false", false, sflow.ExtendedGateway{NextHopType: sflow.AddressTypeIPv4, NextHop: net.IPv4zero.To4()},
+			nextHop, []uint32{tag}, 200},
+		{"set, overwrite false", false, set(routerCommunity),
+			routerNextHop, []uint32{routerCommunity}, 50},
+		{"set, overwrite true", true, set(routerCommunity),
+			nextHop, []uint32{routerCommunity, tag}, 200},
+		{"tag present, overwrite true", true, set(tag, routerCommunity),
+			nextHop, []uint32{tag, routerCommunity}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, fmt.Sprintf(`
+enrichment:
+  rules:
+    - {name: customers, network: "198.51.100.0/24", match_as: 0, set_as: 64501, overwrite: %v,
+       add_communities: ["64512:100"], set_local_pref: 200, set_next_hop: "192.0.2.254"}
+`, tt.overwrite))
+			// Not gatewayRecord: it would give an UNKNOWN next hop its default
+			gateway := sflow.NewFlowRecord(sflow.FlowRecordExtendedGateway, mustEncode(t, &tt.record))
+			out, ok := enrich(t, testDatagram(t, []sflow.FlowRecord{gateway, rawHeaderRecord(t, 1500, testSrc, testDst)}))
+			if !ok {
+				t.Fatal("not enriched")
+			}
+			eg := gateways(t, out)[0]
+			if !eg.NextHop.Equal(tt.nextHop) || !equalUint32s(eg.Communities, tt.communities) || eg.LocalPref != tt.localPref {
+				t.Errorf("next hop %v, communities %v, local_pref %d; want %v, %v, %d",
+					eg.NextHop, eg.Communities, eg.LocalPref, tt.nextHop, tt.communities, tt.localPref)
+			}
+			if eg.SrcAS != 64501 {
+				t.Errorf("SrcAS = %d, want 64501", eg.SrcAS)
+			}
+		})
+	}
+}
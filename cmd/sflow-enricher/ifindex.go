@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// IfIndexStats holds counters for per-agent ifIndex translation
+type IfIndexStats struct {
+	SamplesRemapped uint64 // flow and counter samples with at least one ifIndex rewritten
+}
+
+// agentInterface identifies an interface of an agent by its ifIndex
+type agentInterface struct {
+	agent   netip.Addr
+	ifIndex uint32
+}
+
+var (
+	ifIndexStats IfIndexStats
+
+	// ifName of agent interfaces, learned from port_name counter records of
+	// agents with an ifname_map. Keyed by the ifIndex the agent reports.
+	portNames   = make(map[agentInterface]string)
+	portNamesMu sync.RWMutex
+)
+
+// ifIndexMapper translates the ifIndexes of one agent
+type ifIndexMapper struct {
+	agent netip.Addr
+	cfg   *config.AgentConfig
+}
+
+// remap returns the new ifIndex from ifindex_map, or from ifname_map by the
+// learned ifName of the interface
+func (m *ifIndexMapper) remap(ifIndex uint32) (uint32, bool) {
+	if newIndex, ok := m.cfg.IfIndexMap[ifIndex]; ok {
+		return newIndex, true
+	}
+	if len(m.cfg.IfNameMap) == 0 {
+		return 0, false
+	}
+	portNamesMu.RLock()
+	name, ok := portNames[agentInterface{agent: m.agent, ifIndex: ifIndex}]
+	portNamesMu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	newIndex, ok := m.cfg.IfNameMap[name]
+	return newIndex, ok
+}
+
+// remapIfIndex translates input/output and source_id of the sample at
+// sampleOffset (flow or counter, in place) with the agent's tables
+func remapIfIndex(packet []byte, sampleOffset int, agentAddr netip.Addr, agent *config.AgentConfig) {
+	mapper := ifIndexMapper{agent: agentAddr, cfg: agent}
+	if sflow.RemapIfIndex(packet, sampleOffset, mapper.remap) {
+		atomic.AddUint64(&ifIndexStats.SamplesRemapped, 1)
+	}
+}
+
+// learnPortName records the ifName a counter sample reports for its data source.
+// It must run before the sample's source_id is translated.
+func learnPortName(agentAddr netip.Addr, data []byte, expanded bool) {
+	var cs sflow.CounterSampleReader
+	if err := cs.Reset(data, expanded); err != nil || cs.SourceIDType != 0 {
+		return
+	}
+	for cs.Next() {
+		record := cs.Record()
+		if record.Enterprise != 0 || record.Format != sflow.CounterRecordPortName {
+			continue
+		}
+		name, err := sflow.ParsePortName(record.Data)
+		if err != nil {
+			if debugMode {
+				logError("Port name parse error", err, nil)
+			}
+			return
+		}
+
+		key := agentInterface{agent: agentAddr, ifIndex: cs.SourceIDIndex}
+		portNamesMu.Lock()
+		old, known := portNames[key]
+		portNames[key] = name
+		portNamesMu.Unlock()
+		if debugMode && old != name {
+			logDebug("Learned port name", map[string]interface{}{
+				"agent":    agentAddr.String(),
+				"if_index": cs.SourceIDIndex,
+				"if_name":  name,
+				"previous": old,
+				"known":    known,
+			})
+		}
+		return
+	}
+}
+
+func ifIndexStatus() map[string]interface{} {
+	var agents []map[string]interface{}
+	for _, agent := range cfg.GetAgents() {
+		if !agent.RemapsIfIndex() {
+			continue
+		}
+		agents = append(agents, map[string]interface{}{
+			"address":     agent.Address,
+			"source":      agent.Source,
+			"ifindex_map": agent.IfIndexMap,
+			"ifname_map":  agent.IfNameMap,
+		})
+	}
+
+	portNamesMu.RLock()
+	learned := len(portNames)
+	portNamesMu.RUnlock()
+
+	return map[string]interface{}{
+		"agents":             agents,
+		"samples_remapped":   atomic.LoadUint64(&ifIndexStats.SamplesRemapped),
+		"port_names_learned": learned,
+	}
+}
+
+func writeIfIndexMetrics(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_ifindex_samples_remapped_total Samples with ifIndex values translated\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_ifindex_samples_remapped_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_ifindex_samples_remapped_total %d\n", atomic.LoadUint64(&ifIndexStats.SamplesRemapped))
+}
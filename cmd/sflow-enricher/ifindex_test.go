@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"sflow-enricher/internal/sflow"
+)
+
+// resetPortNames forgets the learned ifNames, now and after the test
+func resetPortNames(t *testing.T) {
+	clear(portNames)
+	t.Cleanup(func() { clear(portNames) })
+}
+
+// ifIndexDatagram returns a datagram from testAgent with a flow sample of
+// source, input and output, and a counter sample of counterSource with its
+// port name when not empty
+func ifIndexDatagram(t *testing.T, source, input, output, counterSource uint32, portName string) []byte {
+	t.Helper()
+	fs := &sflow.FlowSample{SequenceNum: 1, SourceIDIndex: source, SamplingRate: 1000, Input: input, Output: output,
+		Records: []sflow.FlowRecord{sampledIPv4Record(t, 1500, testSrc, testDst)}}
+	cs := &sflow.CounterSample{SequenceNum: 1, SourceIDIndex: counterSource, Records: []sflow.CounterRecord{
+		sflow.NewCounterRecord(sflow.CounterRecordGeneric, mustEncode(t, &sflow.IfCounters{IfIndex: counterSource})),
+	}}
+	if portName != "" {
+		cs.Records = append(cs.Records, sflow.NewCounterRecord(sflow.CounterRecordPortName, sflow.EncodePortName(portName)))
+	}
+	d := &sflow.Datagram{AgentAddrType: sflow.AddressTypeIPv4, AgentAddr: testAgent, SequenceNum: 1}
+	for _, sample := range []interface{ Sample() (sflow.Sample, error) }{fs, cs} {
+		s, err := sample.Sample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Samples = append(d.Samples, s)
+	}
+	return mustEncode(t, d)
+}
+
+// ifIndexes returns source_id, input and output of the flow sample, and
+// source_id and the if_counters ifIndex of the counter sample
+func ifIndexes(t *testing.T, data []byte) [5]uint32 {
+	t.Helper()
+	d, err := sflow.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := sflow.ParseFlowSample(d.Samples[0].Data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := sflow.ParseCounterSample(d.Samples[1].Data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := sflow.ParseIfCounters(cs.Records[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [5]uint32{fs.SourceIDIndex, fs.Input, fs.Output, cs.SourceIDIndex, c.IfIndex}
+}
+
+// ifname_map translates an interface once a counter sample reported its
+// name; the name is learned under the ifIndex the agent reports, although the
+// same counter sample is translated right after
+func TestRemapIfIndexByName(t *testing.T) {
+	loadTestConfig(t, `
+agents:
+  - address: "192.0.2.1"
+    ifindex_map: {4: 104, 5: 105}
+    ifname_map: {"ge-0/0/3": 503, "ge-0/0/5": 505}
+`)
+	resetPortNames(t)
+	steps := []struct {
+		name                                 string
+		source, input, output, counterSource uint32
+		portName                             string
+		want                                 [5]uint32
+	}{
+		// ge-0/0/3 not seen yet: only ifindex_map applies
+		{"before the name", 3, 3, 4, 4, "", [5]uint32{3, 3, 104, 104, 104}},
+		// Samples are processed last to first: the flow sample before the
+		// counter sample already uses the name
+		{"counter with the name", 3, 3, 4, 3, "ge-0/0/3", [5]uint32{503, 503, 104, 503, 503}},
+		{"after the name", 3, 3, 4, 9, "", [5]uint32{503, 503, 104, 9, 9}},
+		// ifindex_map takes precedence over a learned name
+		{"ifindex_map first", 5, 5, 3, 5, "ge-0/0/5", [5]uint32{105, 105, 503, 105, 105}},
+	}
+	for _, step := range steps {
+		out, _ := enrich(t, ifIndexDatagram(t, step.source, step.input, step.output, step.counterSource, step.portName))
+		if got := ifIndexes(t, out); got != step.want {
+			t.Errorf("%s: ifIndexes %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	agent := netip.MustParseAddr("192.0.2.1")
+	for ifIndex, name := range map[uint32]string{3: "ge-0/0/3", 5: "ge-0/0/5"} {
+		if got := portNames[agentInterface{agent: agent, ifIndex: ifIndex}]; got != name {
+			t.Errorf("ifIndex %d learned as %q, want %q", ifIndex, got, name)
+		}
+	}
+	if len(portNames) != 2 {
+		t.Errorf("learned %v", portNames)
+	}
+
+	// Names are learned for ifname_map agents only
+	loadTestConfig(t, `
+agents:
+  - {address: "192.0.2.1", ifindex_map: {4: 104}}
+`)
+	resetPortNames(t)
+	out, _ := enrich(t, ifIndexDatagram(t, 3, 3, 4, 3, "ge-0/0/3"))
+	if got, want := ifIndexes(t, out), [5]uint32{3, 3, 104, 3, 3}; got != want || len(portNames) != 0 {
+		t.Errorf("ifIndexes %v, want %v; learned %v", got, want, portNames)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"sflow-enricher/internal/sflow"
+)
+
+// InterfaceStats holds the latest if_counters snapshot for one agent interface,
+// plus rates derived from the previous snapshot
+type InterfaceStats struct {
+	Agent      string
+	IfIndex    uint32
+	IfSpeed    uint64 // bits per second
+	OperUp     bool
+	InOctets   uint64
+	OutOctets  uint64
+	InErrors   uint32
+	OutErrors  uint32
+	InBps      float64
+	OutBps     float64
+	InUtil     float64 // percent of IfSpeed
+	OutUtil    float64 // percent of IfSpeed
+	LastUpdate time.Time
+}
+
+var (
+	interfaceStats   = make(map[string]*InterfaceStats)
+	interfaceStatsMu sync.RWMutex
+)
+
+// recordCounterSample stores interface counters from a counter sample and
+// updates per-interface utilization. Non if_counters records are ignored.
+// Counter samples arrive once per polling interval per interface, so unlike
+// flow samples they are decoded into allocated structs.
+func recordCounterSample(agent net.IP, cs *sflow.CounterSampleReader) {
+	for cs.Next() {
+		record := cs.Record()
+		if record.Enterprise != 0 || record.Format != sflow.CounterRecordGeneric {
+			continue
+		}
+
+		ifc, err := sflow.ParseIfCounters(record.Data)
+		if err != nil {
+			if debugMode {
+				logError("Interface counters parse error", err, nil)
+			}
+			continue
+		}
+
+		updateInterfaceStats(agent.String(), ifc, time.Now())
+	}
+}
+
+func updateInterfaceStats(agent string, ifc *sflow.IfCounters, now time.Time) {
+	key := fmt.Sprintf("%s/%d", agent, ifc.IfIndex)
+
+	interfaceStatsMu.Lock()
+	defer interfaceStatsMu.Unlock()
+
+	st, ok := interfaceStats[key]
+	if !ok {
+		st = &InterfaceStats{Agent: agent, IfIndex: ifc.IfIndex}
+		interfaceStats[key] = st
+	}
+
+	// Rates need a previous snapshot; skip on counter reset (agent reboot)
+	if ok {
+		elapsed := now.Sub(st.LastUpdate).Seconds()
+		if elapsed > 0 && ifc.IfInOctets >= st.InOctets && ifc.IfOutOctets >= st.OutOctets {
+			st.InBps = float64(ifc.IfInOctets-st.InOctets) * 8 / elapsed
+			st.OutBps = float64(ifc.IfOutOctets-st.OutOctets) * 8 / elapsed
+			if ifc.IfSpeed > 0 {
+				st.InUtil = st.InBps / float64(ifc.IfSpeed) * 100
+				st.OutUtil = st.OutBps / float64(ifc.IfSpeed) * 100
+			}
+		}
+	}
+
+	st.IfSpeed = ifc.IfSpeed
+	st.OperUp = ifc.IfOperUp()
+	st.InOctets = ifc.IfInOctets
+	st.OutOctets = ifc.IfOutOctets
+	st.InErrors = ifc.IfInErrors
+	st.OutErrors = ifc.IfOutErrors
+	st.LastUpdate = now
+}
+
+// snapshotInterfaceStats returns a copy of all interface stats sorted by agent and ifIndex
+func snapshotInterfaceStats() []InterfaceStats {
+	interfaceStatsMu.RLock()
+	list := make([]InterfaceStats, 0, len(interfaceStats))
+	for _, st := range interfaceStats {
+		list = append(list, *st)
+	}
+	interfaceStatsMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Agent != list[j].Agent {
+			return list[i].Agent < list[j].Agent
+		}
+		return list[i].IfIndex < list[j].IfIndex
+	})
+	return list
+}
+
+func interfaceStatusList() []map[string]interface{} {
+	list := snapshotInterfaceStats()
+	result := make([]map[string]interface{}, len(list))
+	for i, st := range list {
+		result[i] = map[string]interface{}{
+			"agent":           st.Agent,
+			"if_index":        st.IfIndex,
+			"if_speed":        st.IfSpeed,
+			"oper_up":         st.OperUp,
+			"in_octets":       st.InOctets,
+			"out_octets":      st.OutOctets,
+			"in_errors":       st.InErrors,
+			"out_errors":      st.OutErrors,
+			"in_bps":          st.InBps,
+			"out_bps":         st.OutBps,
+			"in_utilization":  st.InUtil,
+			"out_utilization": st.OutUtil,
+			"last_update":     st.LastUpdate.Format(time.RFC3339),
+		}
+	}
+	return result
+}
+
+func writeInterfaceMetrics(w http.ResponseWriter) {
+	list := snapshotInterfaceStats()
+	if len(list) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_interface_octets_total Interface octets from sFlow if_counters\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_interface_octets_total counter\n")
+	for _, st := range list {
+		fmt.Fprintf(w, "sflow_asn_enricher_interface_octets_total{agent=\"%s\",ifindex=\"%d\",direction=\"in\"} %d\n", st.Agent, st.IfIndex, st.InOctets)
+		fmt.Fprintf(w, "sflow_asn_enricher_interface_octets_total{agent=\"%s\",ifindex=\"%d\",direction=\"out\"} %d\n", st.Agent, st.IfIndex, st.OutOctets)
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_interface_speed_bps Interface speed from sFlow if_counters\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_interface_speed_bps gauge\n")
+	for _, st := range list {
+		fmt.Fprintf(w, "sflow_asn_enricher_interface_speed_bps{agent=\"%s\",ifindex=\"%d\"} %d\n", st.Agent, st.IfIndex, st.IfSpeed)
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_interface_utilization_percent Interface utilization between the last two counter samples\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_interface_utilization_percent gauge\n")
+	for _, st := range list {
+		fmt.Fprintf(w, "sflow_asn_enricher_interface_utilization_percent{agent=\"%s\",ifindex=\"%d\",direction=\"in\"} %.2f\n", st.Agent, st.IfIndex, st.InUtil)
+		fmt.Fprintf(w, "sflow_asn_enricher_interface_utilization_percent{agent=\"%s\",ifindex=\"%d\",direction=\"out\"} %.2f\n", st.Agent, st.IfIndex, st.OutUtil)
+	}
+}
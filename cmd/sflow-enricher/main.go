@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strconv"
@@ -220,11 +221,31 @@ func main() {
 
 	logInfo("Listening", map[string]interface{}{"address": cfg.ListenAddr()})
 
+	// Start the BGP speaker and BMP collector
+	if cfg.BGP.Enabled {
+		if err := startBGPSpeaker(); err != nil {
+			log.Fatalf("Failed to start BGP speaker on %s: %v", cfg.BGPAddr(), err)
+		}
+	}
+	if cfg.BMP.Enabled {
+		if err := startBMPCollector(); err != nil {
+			log.Fatalf("Failed to start BMP collector on %s: %v", cfg.BMPAddr(), err)
+		}
+	}
+
 	// Start HTTP server for metrics and status
 	if cfg.HTTP.Enabled {
 		go startHTTPServer()
 	}
 
+	// Load the pfx2as table, then watch the file for changes
+	pfx2asTable.checkFile(pfx2asSettings())
+	go pfx2asTable.watch()
+
+	// Load the RPKI VRPs, then watch the file for changes
+	rpkiTable.checkFile(rpkiSettings())
+	go rpkiTable.watch()
+
 	// Start health checker
 	go healthChecker()
 
@@ -278,6 +299,10 @@ func main() {
 				logError("Failed to reload config", err, nil)
 			} else {
 				initTelegramClient()
+				pfx2asTable.requestCheck()
+				rpkiTable.requestCheck()
+				pruneSequenceShift()
+				pruneSamplerSequences()
 				logInfo("Configuration reloaded", map[string]interface{}{
 					"rules_count": len(cfg.Enrichment.Rules),
 				})
@@ -319,6 +344,12 @@ func main() {
 			sendTelegramAlertWithWait("shutdown", shutdownMsg, true)
 			close(stopChan)
 			listener.Close()
+			if bgpSpeaker != nil {
+				bgpSpeaker.Close()
+			}
+			if bmpCollector != nil {
+				bmpCollector.Close()
+			}
 			for _, dest := range destinations {
 				dest.Conn.Close()
 			}
@@ -337,7 +368,8 @@ func setupDestinations() error {
 			continue
 		}
 
-		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", destCfg.Address, destCfg.Port))
+		hostPort := net.JoinHostPort(destCfg.Address, strconv.Itoa(destCfg.Port))
+		addr, err := net.ResolveUDPAddr("udp", hostPort)
 		if err != nil {
 			return fmt.Errorf("failed to resolve destination %s: %w", destCfg.Name, err)
 		}
@@ -356,7 +388,7 @@ func setupDestinations() error {
 			Addr:   addr,
 			Stats: DestinationStats{
 				Name:    destCfg.Name,
-				Address: fmt.Sprintf("%s:%d", destCfg.Address, destCfg.Port),
+				Address: hostPort,
 				Healthy: true,
 			},
 		}
@@ -393,6 +425,9 @@ func setupDestinations() error {
 }
 
 func processPackets(listener *net.UDPConn, stopChan chan struct{}) {
+	// Decoding state reused across packets (this goroutine only)
+	scratch := &enrichScratch{}
+
 	for {
 		select {
 		case <-stopChan:
@@ -405,7 +440,7 @@ func processPackets(listener *net.UDPConn, stopChan chan struct{}) {
 		buffer := *bufPtr
 
 		listener.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, remoteAddr, err := listener.ReadFromUDP(buffer)
+		n, remoteAddr, err := listener.ReadFromUDPAddrPort(buffer)
 		if err != nil {
 			bufferPool.Put(bufPtr)
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
@@ -422,29 +457,37 @@ func processPackets(listener *net.UDPConn, stopChan chan struct{}) {
 		atomic.AddUint64(&stats.BytesReceived, uint64(n))
 
 		// Check whitelist
-		if !cfg.IsWhitelisted(remoteAddr.IP) {
+		remoteIP16 := remoteAddr.Addr().As16()
+		if !cfg.IsWhitelisted(net.IP(remoteIP16[:])) {
 			atomic.AddUint64(&stats.PacketsFiltered, 1)
 			bufferPool.Put(bufPtr)
 			if debugMode {
 				logDebug("Packet filtered (not whitelisted)", map[string]interface{}{
-					"source": remoteAddr.IP.String(),
+					"source": remoteAddr.Addr().Unmap().String(),
 				})
 			}
 			continue
 		}
 
-		// Make a copy of the packet for modification
-		packet := make([]byte, n)
-		copy(packet, buffer[:n])
-		bufferPool.Put(bufPtr)
+		// Check structure and apply the validation mode (forward/drop/repair)
+		packet, forward := validateDatagram(buffer[:n], remoteAddr)
+		if !forward {
+			bufferPool.Put(bufPtr)
+			continue
+		}
 
-		// Process and enrich the packet
-		packet, enriched := enrichPacket(packet, remoteAddr)
+		// Split datagrams are renumbered per stream as the agent sent it,
+		// before set_agent_address rewrites the header
+		stream := datagramStream(packet)
 
-		// Forward to all destinations (use potentially resized packet)
-		for _, dest := range destinations {
-			sendToDestination(dest, packet, len(packet))
-		}
+		// Enrich in the pool buffer: it has room to grow for DstAS insertion,
+		// so the packet is neither copied nor reallocated
+		packet, enriched := enrichPacket(packet, remoteAddr, scratch)
+
+		// Forward to all destinations (use potentially resized packet,
+		// split if it is larger than max_datagram_size)
+		forwardDatagram(packet, stream)
+		bufferPool.Put(bufPtr)
 
 		if enriched {
 			atomic.AddUint64(&stats.PacketsEnriched, 1)
@@ -487,9 +530,28 @@ func sendToDestination(dest *Destination, packet []byte, n int) {
 	}
 }
 
-func enrichPacket(packet []byte, remoteAddr *net.UDPAddr) ([]byte, bool) {
-	datagram, err := sflow.Parse(packet)
-	if err != nil {
+// enrichScratch holds decoding state reused across packets, so the enrichment
+// hot path does not allocate. It must not be shared between goroutines.
+type enrichScratch struct {
+	samples []sflow.Sample
+	drop    []bool // samples dropped by sub-sampling, by index
+	header  sflow.HeaderInfo
+}
+
+// sampleRecords holds the flow records of a sample the enricher looks at.
+// Data slices reference the packet buffer.
+type sampleRecords struct {
+	rawHeader   []byte
+	sampledIPv4 []byte
+	sampledIPv6 []byte
+	nat         []byte
+	gateway     sflow.FlowRecord
+	hasGateway  bool
+}
+
+func enrichPacket(packet []byte, remoteAddr netip.AddrPort, scratch *enrichScratch) ([]byte, bool) {
+	var reader sflow.DatagramReader
+	if err := reader.Reset(packet); err != nil {
 		if debugMode {
 			logError("Parse error", err, map[string]interface{}{
 				"source": remoteAddr.String(),
@@ -498,15 +560,43 @@ func enrichPacket(packet []byte, remoteAddr *net.UDPAddr) ([]byte, bool) {
 		return packet, false
 	}
 
+	scratch.samples = scratch.samples[:0]
+	for reader.Next() {
+		scratch.samples = append(scratch.samples, reader.Sample())
+	}
+
 	enriched := false
-	rules := cfg.GetEnrichmentRules()
+	rules := cfg.Rules()
+
+	// Per-agent settings, by the agent address in the datagram header or the
+	// UDP source address
+	agentAddr, _ := netip.AddrFromSlice(reader.AgentAddr)
+	agentAddr = agentAddr.Unmap()
+	agent := cfg.Agent(agentAddr, remoteAddr.Addr().Unmap())
+	stream := agentStream{agent: agentAddr, subAgentID: reader.SubAgentID}
+
+	// Sampling settings follow the datagram order (sequence numbers and
+	// sample_pool per data source); dropped samples are removed below
+	if cap(scratch.drop) < len(scratch.samples) {
+		scratch.drop = make([]bool, len(scratch.samples))
+	}
+	drop := scratch.drop[:len(scratch.samples)]
+	clear(drop)
+	if agent != nil && agent.RewritesSampling() {
+		applySampling(packet, scratch.samples, stream, remoteAddr.Addr().Unmap(), agent, drop)
+	}
+
+	// Inner headers are only dissected when a rule matches on them
+	// Samples without extended_gateway are only looked at by synthesize rules
+	decodeTunnels := rules.UsesMatchOn(config.MatchOnInner)
+	synthesize := rules.Synthesizes()
 
 	// CRITICAL: Process samples in REVERSE ORDER to handle packet resizing correctly.
 	// When ModifyDstAS inserts 12 bytes into a sample, it shifts all subsequent data.
 	// By processing from last to first, we ensure earlier sample offsets remain valid.
 	// This is the correct approach for XDR variable-length data modification.
-	for i := len(datagram.Samples) - 1; i >= 0; i-- {
-		sample := datagram.Samples[i]
+	for i := len(scratch.samples) - 1; i >= 0; i-- {
+		sample := scratch.samples[i]
 		if sample.Enterprise != 0 {
 			continue
 		}
@@ -517,136 +607,353 @@ func enrichPacket(packet []byte, remoteAddr *net.UDPAddr) ([]byte, bool) {
 			expanded = false
 		case sflow.SampleTypeExpandedFlowSample:
 			expanded = true
+		case sflow.SampleTypeCounterSample, sflow.SampleTypeExpandedCounterSample:
+			counterExpanded := sample.Format == sflow.SampleTypeExpandedCounterSample
+			if agent != nil && agent.RemapsIfIndex() {
+				// ifNames are learned under the ifIndex the agent reports
+				if len(agent.IfNameMap) > 0 {
+					learnPortName(agentAddr, sample.Data, counterExpanded)
+				}
+				remapIfIndex(packet, sample.Offset, agentAddr, agent)
+			}
+
+			var counterReader sflow.CounterSampleReader
+			if err := counterReader.Reset(sample.Data, counterExpanded); err != nil {
+				if debugMode {
+					logError("Counter sample parse error", err, nil)
+				}
+				continue
+			}
+			recordCounterSample(reader.AgentAddr, &counterReader)
+			continue
 		default:
 			continue
 		}
 
-		flowSample, err := sflow.ParseFlowSample(sample.Data, expanded)
-		if err != nil {
+		var flowReader sflow.FlowSampleReader
+		if err := flowReader.Reset(sample.Data, expanded); err != nil {
 			if debugMode {
 				logError("Flow sample parse error", err, nil)
 			}
 			continue
 		}
 
-		// Find source and destination IP from raw packet header
-		var srcIP, dstIP net.IP
-		for _, record := range flowSample.Records {
-			if record.Enterprise == 0 && record.Format == sflow.FlowRecordRawPacketHeader {
-				srcIP, dstIP = sflow.GetSrcDstIPFromRawPacket(record.Data)
-				break
-			}
+		// Software sub-sampling; later samples were already processed
+		if drop[i] {
+			packet = dropSample(packet, sample.Offset)
+			continue
+		}
+
+		// ifIndex translation of source_id and input/output
+		if agent != nil && agent.RemapsIfIndex() {
+			remapIfIndex(packet, sample.Offset, agentAddr, agent)
 		}
 
-		// Process extended gateway records
-		for _, record := range flowSample.Records {
-			if record.Enterprise != 0 || record.Format != sflow.FlowRecordExtendedGateway {
+		// Collect the records we need in a single pass
+		var records sampleRecords
+		for flowReader.Next() {
+			record := flowReader.Record()
+			if record.Enterprise != 0 {
 				continue
 			}
+			switch record.Format {
+			case sflow.FlowRecordRawPacketHeader:
+				if records.rawHeader == nil {
+					records.rawHeader = record.Data
+				}
+			case sflow.FlowRecordIPv4:
+				records.sampledIPv4 = record.Data
+			case sflow.FlowRecordIPv6:
+				records.sampledIPv6 = record.Data
+			case sflow.FlowRecordExtendedNAT:
+				records.nat = record.Data
+			case sflow.FlowRecordExtendedGateway:
+				// sFlow v5 allows one extended_gateway per sample
+				if !records.hasGateway {
+					records.gateway = record
+					records.hasGateway = true
+				}
+			}
+		}
+
+		if !records.hasGateway && !synthesize {
+			continue
+		}
 
-			eg, err := sflow.ParseExtendedGateway(record.Data)
-			if err != nil {
+		// Find source and destination IP from raw packet header,
+		// falling back to sampled_ipv4 / sampled_ipv6 records
+		addrs := sampleAddresses(&records, &scratch.header, decodeTunnels)
+
+		if !records.hasGateway {
+			// Append a new extended_gateway record built from the matching rules
+			var ok bool
+			packet, ok = synthesizeGateway(packet, sample.Offset, rules, &addrs)
+			if ok {
+				enriched = true
+			}
+			continue
+		}
+		record := records.gateway
+
+		var eg sflow.ExtendedGatewayHeader
+		if err := eg.Decode(record.Data); err != nil {
+			if debugMode {
+				logError("Extended gateway parse error", err, nil)
+			}
+			continue
+		}
+
+		// SrcAS (outbound traffic): the most specific rule containing the source
+		// IP, among those whose match_as equals SrcAS unless overwrite is set
+		srcMatch := matchRule(rules, &addrs, false, func(rule *config.EnrichmentRule) bool {
+			return rule.Overwrite || eg.SrcAS == rule.MatchAS
+		})
+		if srcMatch.rule != nil {
+			rule := srcMatch.rule
+			srcIP, _ := addrs.forMatchOn(rule.MatchOn)
+			if debugMode {
+				logDebug("Enriching SrcAS", map[string]interface{}{
+					"src_ip": srcIP.String(),
+					"old_as": eg.SrcAS,
+					"new_as": rule.SetAS,
+					"rule":   rule.Name,
+				})
+			}
+			sflow.ModifySrcAS(packet, sample.Offset, record.Offset, rule.SetAS)
+			enriched = true
+
+			// SrcPeerAS: for locally-originated traffic, the "source peer" is the router itself
+			if eg.SrcPeerAS == 0 {
 				if debugMode {
-					logError("Extended gateway parse error", err, nil)
+					logDebug("Enriching SrcPeerAS", map[string]interface{}{
+						"src_ip":          srcIP.String(),
+						"old_src_peer_as": eg.SrcPeerAS,
+						"new_src_peer_as": rule.SetAS,
+						"rule":            rule.Name,
+					})
 				}
-				continue
+				sflow.ModifySrcPeerAS(packet, sample.Offset, record.Offset, rule.SetAS)
 			}
 
-			// Check enrichment rules for SrcAS (outbound traffic)
-			for _, rule := range rules {
-				// Check if we should apply this rule for SrcAS
-				shouldApply := false
-				if rule.Overwrite {
-					// Always apply if IP matches
-					shouldApply = srcIP != nil && rule.IPNet.Contains(srcIP)
-				} else {
-					// Only apply if AS matches and IP matches
-					shouldApply = eg.SrcAS == rule.MatchAS && srcIP != nil && rule.IPNet.Contains(srcIP)
+			// RouterAS: only set if missing (0). Don't overwrite non-zero values
+			// as they may contain valid data from the router's BGP table.
+			if eg.AS == 0 {
+				if debugMode {
+					logDebug("Enriching RouterAS", map[string]interface{}{
+						"old_router_as": eg.AS,
+						"new_router_as": rule.SetAS,
+						"rule":          rule.Name,
+					})
 				}
+				sflow.ModifyRouterAS(packet, sample.Offset, record.Offset, rule.SetAS)
+			}
+		}
 
-				if shouldApply {
-					if debugMode {
-						logDebug("Enriching SrcAS", map[string]interface{}{
-							"src_ip": srcIP.String(),
-							"old_as": eg.SrcAS,
-							"new_as": rule.SetAS,
-							"rule":   rule.Name,
-						})
-					}
-					sflow.ModifySrcAS(packet, sample.Offset, record.Offset, rule.SetAS)
-					enriched = true
-
-					// SrcPeerAS: for locally-originated traffic, the "source peer" is the router itself
-					if eg.SrcPeerAS == 0 {
-						if debugMode {
-							logDebug("Enriching SrcPeerAS", map[string]interface{}{
-								"src_ip":          srcIP.String(),
-								"old_src_peer_as": eg.SrcPeerAS,
-								"new_src_peer_as": rule.SetAS,
-								"rule":            rule.Name,
-							})
-						}
-						sflow.ModifySrcPeerAS(packet, sample.Offset, record.Offset, rule.SetAS)
-					}
-
-					// RouterAS: only set if missing (0). Don't overwrite non-zero values
-					// as they may contain valid data from the router's BGP table.
-					if eg.AS == 0 {
-						if debugMode {
-							logDebug("Enriching RouterAS", map[string]interface{}{
-								"old_router_as": eg.AS,
-								"new_router_as": rule.SetAS,
-								"rule":          rule.Name,
-							})
-						}
-						sflow.ModifyRouterAS(packet, sample.Offset, record.Offset, rule.SetAS)
-					}
-					break // Only apply first matching rule for SrcAS
-				}
+		// DstAS (inbound traffic): the most specific rule containing the
+		// destination IP; rules in "insert" mode (default) only apply if
+		// DstASPath is empty (no segments)
+		dstMatch := matchRule(rules, &addrs, true, func(rule *config.EnrichmentRule) bool {
+			return rule.ASPathMode != config.ASPathInsert || eg.DstASPathSegments == 0
+		})
+		if dstMatch.rule != nil {
+			rule := dstMatch.rule
+			_, dstIP := addrs.forMatchOn(rule.MatchOn)
+			if debugMode {
+				logDebug("Enriching DstAS", map[string]interface{}{
+					"dst_ip":       dstIP.String(),
+					"as_path":      rule.SetASPath.String(),
+					"as_path_mode": rule.ASPathMode,
+					"rule":         rule.Name,
+				})
+			}
+			// Both return the (possibly resized) packet and success flag
+			var newPacket []byte
+			var ok bool
+			if rule.ASPathMode == config.ASPathPrepend {
+				newPacket, ok = sflow.PrependDstASPath(packet, sample.Offset, record.Offset, rule.SetASPath[0].ASNs)
+			} else {
+				newPacket, ok = sflow.ReplaceDstASPath(packet, sample.Offset, record.Offset, rule.SetASPath)
+			}
+			if ok {
+				packet = newPacket
+				enriched = true
 			}
 
-			// Check enrichment rules for DstAS (inbound traffic)
-			// Only enrich if DstASPath is empty (DstASPathLen == 0)
-			if eg.DstASPathLen == 0 {
-				for _, rule := range rules {
-					// Check if destination IP matches the rule's network
-					if dstIP != nil && rule.IPNet.Contains(dstIP) {
-						if debugMode {
-							logDebug("Enriching DstAS", map[string]interface{}{
-								"dst_ip": dstIP.String(),
-								"new_as": rule.SetAS,
-								"rule":   rule.Name,
-							})
-						}
-						// ModifyDstAS returns a new packet (resized) and success flag
-						newPacket, ok := sflow.ModifyDstAS(packet, sample.Offset, record.Offset, rule.SetAS)
-						if ok {
-							packet = newPacket
-							enriched = true
-						}
-
-						// RouterAS: set to router's own AS if missing (inbound has router_as=0)
-						if eg.AS == 0 {
-							if debugMode {
-								logDebug("Enriching RouterAS (inbound)", map[string]interface{}{
-									"old_router_as": eg.AS,
-									"new_router_as": rule.SetAS,
-									"rule":          rule.Name,
-								})
-							}
-							sflow.ModifyRouterAS(packet, sample.Offset, record.Offset, rule.SetAS)
-							enriched = true
-						}
-						break // Only apply first matching rule for DstAS
-					}
+			// RouterAS: set to router's own AS if missing (inbound has router_as=0)
+			if eg.AS == 0 {
+				if debugMode {
+					logDebug("Enriching RouterAS (inbound)", map[string]interface{}{
+						"old_router_as": eg.AS,
+						"new_router_as": rule.SetAS,
+						"rule":          rule.Name,
+					})
 				}
+				sflow.ModifyRouterAS(packet, sample.Offset, record.Offset, rule.SetAS)
+				enriched = true
+			}
+		}
+
+		// Addresses no rule covers: fill what the router left at 0 (or empty)
+		// from the agent's peer_as table (SrcPeerAS), learned BGP routes and
+		// the origin AS from the pfx2as table, then give a destination path
+		// without one its first hop from the peer_as table
+		fill := routeFill{
+			srcAS:     srcMatch.rule == nil && eg.SrcAS == 0,
+			srcPeerAS: srcMatch.rule == nil && eg.SrcPeerAS == 0,
+			dstASPath: dstMatch.rule == nil && eg.DstASPathSegments == 0,
+		}
+		var dstPeer uint32
+		if agent != nil && agent.HasPeerAS() {
+			if fill.srcPeerAS && fillSrcPeerAS(packet, sample.Offset, record.Offset, agent, &flowReader.FlowSample, &fill) {
+				enriched = true
+			}
+			if fill.dstASPath {
+				// Looked up while eg still describes the record as received
+				dstPeer, _ = dstPeerAS(agent, &eg, &flowReader.FlowSample)
+			}
+		}
+		if fill.srcAS || fill.srcPeerAS || fill.dstASPath {
+			var filled bool
+			packet, filled = fillFromRoutes(packet, sample.Offset, record.Offset, &addrs, &fill)
+			if filled {
+				enriched = true
 			}
 		}
+		if fill.srcAS || fill.dstASPath {
+			var filled bool
+			packet, filled = fillOriginAS(packet, sample.Offset, record.Offset, &addrs, &fill)
+			if filled {
+				enriched = true
+			}
+		}
+		if dstPeer != 0 && (fill.dstASPath || fill.dstOriginAS != 0) {
+			var filled bool
+			packet, filled = fillDstPeerAS(packet, sample.Offset, record.Offset, dstPeer, &fill)
+			if filled {
+				enriched = true
+			}
+		}
+
+		// BGP communities and local_pref
+		var attrsEnriched bool
+		packet, attrsEnriched = enrichGatewayAttributes(packet, sample.Offset, record.Offset, rules, &addrs, &eg)
+		if attrsEnriched {
+			enriched = true
+		}
+
+		// Route origin validation of the final SrcAS and destination origin
+		var validated bool
+		packet, validated = validateOrigins(packet, sample.Offset, record.Offset, &addrs, flowReader.FlowSample.SamplingRate)
+		if validated {
+			enriched = true
+		}
+	}
+
+	// Agent address rewrite moves all samples, so it comes last
+	if agent != nil {
+		packet = rewriteAgentAddress(packet, reader.AgentAddr, agent)
 	}
 
 	return packet, enriched
 }
 
+// flowAddresses holds the addresses of a flow sample. For tunnelled traffic
+// the Inner addresses are those of the encapsulated packet; the NAT addresses
+// come from an extended_nat record. Unknown addresses are the zero Addr.
+// Everything is copied out of the packet: resizing the gateway record moves
+// the records after it.
+type flowAddresses struct {
+	SrcIP      netip.Addr
+	DstIP      netip.Addr
+	InnerSrcIP netip.Addr
+	InnerDstIP netip.Addr
+	NATSrcIP   netip.Addr
+	NATDstIP   netip.Addr
+	// Length of the sampled frame, from the raw packet header or the
+	// sampled_ipv4 / sampled_ipv6 record; 0 if unknown
+	FrameLength uint32
+}
+
+// forMatchOn returns the addresses rules with a match_on mode see. Rules matching on the inner
+// header fall back to the outer header for traffic that is not tunnelled, and
+// rules matching on NAT addresses fall back to it when no extended_nat was sent.
+func (a *flowAddresses) forMatchOn(matchOn string) (srcIP, dstIP netip.Addr) {
+	switch {
+	case matchOn == config.MatchOnInner && a.InnerSrcIP.IsValid():
+		return a.InnerSrcIP, a.InnerDstIP
+	case matchOn == config.MatchOnNAT && (a.NATSrcIP.IsValid() || a.NATDstIP.IsValid()):
+		srcIP, dstIP = a.SrcIP, a.DstIP
+		if a.NATSrcIP.IsValid() {
+			srcIP = a.NATSrcIP
+		}
+		if a.NATDstIP.IsValid() {
+			dstIP = a.NATDstIP
+		}
+		return srcIP, dstIP
+	}
+	return a.SrcIP, a.DstIP
+}
+
+// sampleAddresses returns the source and destination IP of a flow sample.
+// The raw packet header is preferred; sampled_ipv4 / sampled_ipv6 records are
+// used when the agent sent no raw header or it could not be decoded.
+// hdr is reused for dissection. Must be called before the packet is modified:
+// records references it.
+func sampleAddresses(records *sampleRecords, hdr *sflow.HeaderInfo, decodeTunnels bool) flowAddresses {
+	var addrs flowAddresses
+
+	if records.nat != nil {
+		var nat sflow.ExtendedNAT
+		if err := nat.Decode(records.nat); err == nil {
+			// Agents may report an untranslated address as UNKNOWN or 0.0.0.0
+			if addr, ok := addrFromIP(nat.SrcAddr); ok && !addr.IsUnspecified() {
+				addrs.NATSrcIP = addr
+			}
+			if addr, ok := addrFromIP(nat.DstAddr); ok && !addr.IsUnspecified() {
+				addrs.NATDstIP = addr
+			}
+		}
+	}
+
+	var ip4 sflow.SampledIPv4
+	var ip6 sflow.SampledIPv6
+	hasIPv4 := records.sampledIPv4 != nil && ip4.Decode(records.sampledIPv4) == nil
+	hasIPv6 := records.sampledIPv6 != nil && ip6.Decode(records.sampledIPv6) == nil
+	switch {
+	case hasIPv4:
+		addrs.FrameLength = ip4.Length
+	case hasIPv6:
+		addrs.FrameLength = ip6.Length
+	}
+
+	if records.rawHeader != nil {
+		var rh sflow.RawPacketHeader
+		if err := rh.Decode(records.rawHeader); err == nil {
+			addrs.FrameLength = rh.FrameLength
+			err = hdr.Decode(rh.Protocol, rh.Header, sflow.DissectOptions{DecodeTunnels: decodeTunnels})
+			if err == nil && hdr.IPVersion != 0 {
+				addrs.SrcIP, _ = addrFromIP(hdr.SrcIP)
+				addrs.DstIP, _ = addrFromIP(hdr.DstIP)
+				if hdr.Inner != nil && hdr.Inner.IPVersion != 0 {
+					addrs.InnerSrcIP, _ = addrFromIP(hdr.Inner.SrcIP)
+					addrs.InnerDstIP, _ = addrFromIP(hdr.Inner.DstIP)
+				}
+				return addrs
+			}
+		}
+	}
+
+	switch {
+	case hasIPv4:
+		addrs.SrcIP, _ = addrFromIP(ip4.SrcIP)
+		addrs.DstIP, _ = addrFromIP(ip4.DstIP)
+	case hasIPv6:
+		addrs.SrcIP, _ = addrFromIP(ip6.SrcIP)
+		addrs.DstIP, _ = addrFromIP(ip6.DstIP)
+	}
+	return addrs
+}
+
 func healthChecker() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
@@ -660,7 +967,7 @@ func healthChecker() {
 
 func checkDestinationHealth(dest *Destination) {
 	// Simple health check: try to resolve the address
-	addr := fmt.Sprintf("%s:%d", dest.Config.Address, dest.Config.Port)
+	addr := net.JoinHostPort(dest.Config.Address, strconv.Itoa(dest.Config.Port))
 	conn, err := net.DialTimeout("udp", addr, 5*time.Second)
 
 	wasHealthy := dest.Healthy.Load()
@@ -713,6 +1020,7 @@ func startHTTPServer() {
 	http.HandleFunc("/metrics", prometheusMetricsHandler)
 	http.HandleFunc("/status", statusHandler)
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/bmp/peers", bmpPeersHandler)
 
 	logInfo("HTTP server starting", map[string]interface{}{"address": cfg.HTTPAddr()})
 
@@ -788,6 +1096,24 @@ func prometheusMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		fmt.Fprintf(w, "sflow_asn_enricher_destination_healthy{%s} %d\n", labels, healthy)
 	}
+
+	// Structural validation metrics
+	writeValidationMetrics(w)
+
+	// Datagram split metrics
+	writeSplitMetrics(w)
+	writeSamplingMetrics(w)
+	writeIfIndexMetrics(w)
+	writeAgentAddressMetrics(w)
+	writePeerASMetrics(w)
+	writePfx2ASMetrics(w)
+	writeRoutesMetrics(w)
+	writeBGPMetrics(w)
+	writeBMPMetrics(w)
+	writeRPKIMetrics(w)
+
+	// Per-interface metrics from counter samples
+	writeInterfaceMetrics(w)
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -798,11 +1124,13 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	rulesList := make([]map[string]interface{}, len(rules))
 	for i, r := range rules {
 		rulesList[i] = map[string]interface{}{
-			"name":      r.Name,
-			"network":   r.Network,
-			"match_as":  r.MatchAS,
-			"set_as":    r.SetAS,
-			"overwrite": r.Overwrite,
+			"name":         r.Name,
+			"network":      r.Network,
+			"match_as":     r.MatchAS,
+			"set_as":       r.SetAS,
+			"overwrite":    r.Overwrite,
+			"set_as_path":  r.SetASPath.String(),
+			"as_path_mode": r.ASPathMode,
 		}
 	}
 
@@ -821,7 +1149,19 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 			"bytes_received":    atomic.LoadUint64(&stats.BytesReceived),
 			"bytes_forwarded":   atomic.LoadUint64(&stats.BytesForwarded),
 		},
-		"destinations": []map[string]interface{}{},
+		"validation":    validationStatus(),
+		"split":         splitStatus(),
+		"sampling":      samplingStatus(),
+		"ifindex":       ifIndexStatus(),
+		"agent_address": agentAddressStatus(),
+		"peer_as":       peerASStatus(),
+		"pfx2as":        pfx2asStatus(),
+		"routes":        routesStatus(),
+		"bgp":           bgpStatus(),
+		"bmp":           bmpStatus(),
+		"rpki":          rpkiStatus(),
+		"destinations":  []map[string]interface{}{},
+		"interfaces":    interfaceStatusList(),
 	}
 
 	destList := status["destinations"].([]map[string]interface{})
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/pfx2as"
+	"sflow-enricher/internal/sflow"
+)
+
+const testConfigHeader = `
+listen: {address: "127.0.0.1", port: 6343}
+destinations:
+  - {name: collector, address: "127.0.0.1", port: 9995, enabled: true}
+`
+
+// loadTestConfig installs a configuration for the test from YAML following
+// the listen and destinations sections
+func loadTestConfig(t *testing.T, yaml string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfigHeader+yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cfg
+	cfg = c
+	t.Cleanup(func() { cfg = old })
+}
+
+// loadTestPfx2AS installs a pfx2as table from CAIDA lines
+func loadTestPfx2AS(t *testing.T, lines string) {
+	t.Helper()
+	table, err := pfx2as.ReadCAIDA(strings.NewReader(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx2asTable.Store(table)
+	t.Cleanup(func() { pfx2asTable.Store(nil) })
+}
+
+var (
+	testAgent = net.IP{192, 0, 2, 1}
+	testSrc   = net.IP{198, 51, 100, 7}
+	testDst   = net.IP{203, 0, 113, 9}
+)
+
+func mustEncode(t *testing.T, v interface{ Encode() ([]byte, error) }) []byte {
+	t.Helper()
+	b, err := v.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// ipv4Packet returns an IPv4 header from src to dst followed by payload
+func ipv4Packet(protocol byte, src, dst net.IP, payload []byte) []byte {
+	ip := make([]byte, 20, 20+len(payload))
+	ip[0], ip[9] = 0x45, protocol
+	copy(ip[12:], src.To4())
+	copy(ip[16:], dst.To4())
+	return append(ip, payload...)
+}
+
+// rawFrameRecord returns a sampled_header record of an Ethernet frame
+// carrying an IPv4 packet
+func rawFrameRecord(t *testing.T, frameLength uint32, packet []byte) sflow.FlowRecord {
+	t.Helper()
+	frame := append(make([]byte, 14, 14+len(packet)), packet...)
+	frame[12], frame[13] = 0x08, 0x00
+	rh := &sflow.RawPacketHeader{Protocol: sflow.HeaderProtocolEthernet, FrameLength: frameLength, Header: frame}
+	return sflow.NewFlowRecord(sflow.FlowRecordRawPacketHeader, mustEncode(t, rh))
+}
+
+func rawHeaderRecord(t *testing.T, frameLength uint32, src, dst net.IP) sflow.FlowRecord {
+	t.Helper()
+	return rawFrameRecord(t, frameLength, ipv4Packet(sflow.IPProtocolTCP, src, dst, nil))
+}
+
+func sampledIPv4Record(t *testing.T, length uint32, src, dst net.IP) sflow.FlowRecord {
+	t.Helper()
+	s4 := &sflow.SampledIPv4{Length: length, Protocol: 6, SrcIP: src.To4(), DstIP: dst.To4()}
+	return sflow.NewFlowRecord(sflow.FlowRecordIPv4, mustEncode(t, s4))
+}
+
+func sampledIPv6Record(t *testing.T, length uint32, src, dst net.IP) sflow.FlowRecord {
+	t.Helper()
+	s6 := &sflow.SampledIPv6{Length: length, Protocol: 6, SrcIP: src, DstIP: dst}
+	return sflow.NewFlowRecord(sflow.FlowRecordIPv6, mustEncode(t, s6))
+}
+
+func sampledEthernetRecord(t *testing.T, length uint32) sflow.FlowRecord {
+	t.Helper()
+	se := &sflow.SampledEthernet{Length: length, SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EtherType: 0x0800}
+	return sflow.NewFlowRecord(sflow.FlowRecordEthernetFrame, mustEncode(t, se))
+}
+
+func natRecord(t *testing.T, src, dst net.IP) sflow.FlowRecord {
+	t.Helper()
+	nat := &sflow.ExtendedNAT{SrcAddrType: sflow.AddressTypeIPv4, SrcAddr: src.To4(), DstAddrType: sflow.AddressTypeIPv4, DstAddr: dst.To4()}
+	return sflow.NewFlowRecord(sflow.FlowRecordExtendedNAT, mustEncode(t, nat))
+}
+
+func gatewayRecord(t *testing.T, eg *sflow.ExtendedGateway) sflow.FlowRecord {
+	t.Helper()
+	if eg.NextHopType == 0 {
+		eg.NextHopType, eg.NextHop = sflow.AddressTypeIPv4, net.IP{10, 0, 0, 1}
+	}
+	return sflow.NewFlowRecord(sflow.FlowRecordExtendedGateway, mustEncode(t, eg))
+}
+
+// testDatagram returns a datagram from testAgent with one flow sample per
+// record list
+func testDatagram(t *testing.T, samples ...[]sflow.FlowRecord) []byte {
+	t.Helper()
+	d := &sflow.Datagram{AgentAddrType: sflow.AddressTypeIPv4, AgentAddr: testAgent, SequenceNum: 1}
+	for i, records := range samples {
+		fs := &sflow.FlowSample{SequenceNum: uint32(i + 1), SourceIDIndex: 3, SamplingRate: 1000, SamplePool: 1000, Input: 3, Output: 4, Records: records}
+		s, err := fs.Sample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Samples = append(d.Samples, s)
+	}
+	return mustEncode(t, d)
+}
+
+// enrich runs enrichPacket on a copy of data in a buffer as large as the
+// receive buffers, so resizes happen in place
+func enrich(t *testing.T, data []byte) ([]byte, bool) {
+	t.Helper()
+	buf := make([]byte, maxPacketSize)
+	n := copy(buf, data)
+	return enrichPacket(buf[:n], netip.MustParseAddrPort("192.0.2.1:6343"), &enrichScratch{})
+}
+
+// gateways returns the extended_gateway record of each flow sample
+func gateways(t *testing.T, data []byte) []*sflow.ExtendedGateway {
+	t.Helper()
+	d, err := sflow.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var egs []*sflow.ExtendedGateway
+	for _, s := range d.Samples {
+		fs, err := sflow.ParseFlowSample(s.Data, s.Format == sflow.SampleTypeExpandedFlowSample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var eg *sflow.ExtendedGateway
+		for _, r := range fs.Records {
+			if r.Format == sflow.FlowRecordExtendedGateway {
+				if eg, err = sflow.ParseExtendedGateway(r.Data); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		egs = append(egs, eg)
+	}
+	return egs
+}
+
+// Records after extended_gateway move when the gateway record grows in place;
+// the addresses taken from them must not change with them
+func TestEnrichRecordsAfterGateway(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: dst, network: "203.0.113.0/24", match_as: 0, set_as: 64999}
+    - {name: nat, network: "192.0.2.0/24", match_on: nat, match_as: 0, set_as: 64777, add_communities: ["64512:1"]}
+`)
+	loadTestPfx2AS(t, "198.51.100.0\t24\t64501\n")
+	natSrc := net.IP{192, 0, 2, 10}
+
+	tests := []struct {
+		name        string
+		records     []sflow.FlowRecord
+		srcAS       uint32
+		communities []uint32
+	}{
+		{"raw header", []sflow.FlowRecord{
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+			rawHeaderRecord(t, 1500, testSrc, testDst),
+		}, 64501, nil},
+		{"sampled_ipv4", []sflow.FlowRecord{
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+			sampledIPv4Record(t, 1500, testSrc, testDst),
+		}, 64501, nil},
+		{"extended_nat", []sflow.FlowRecord{
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+			natRecord(t, natSrc, testDst),
+			rawHeaderRecord(t, 1500, testSrc, testDst),
+		}, 64777, []uint32{64512<<16 | 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, ok := enrich(t, testDatagram(t, tt.records))
+			if !ok {
+				t.Fatal("not enriched")
+			}
+			eg := gateways(t, out)[0]
+			if eg.DstAS() != 64999 {
+				t.Errorf("DstAS = %d, want 64999", eg.DstAS())
+			}
+			if eg.SrcAS != tt.srcAS {
+				t.Errorf("SrcAS = %d, want %d", eg.SrcAS, tt.srcAS)
+			}
+			if !equalUint32s(eg.Communities, tt.communities) {
+				t.Errorf("communities = %v, want %v", eg.Communities, tt.communities)
+			}
+		})
+	}
+}
+
+// Without a raw packet header the addresses come from sampled_ipv4 or
+// sampled_ipv6; sampled_ethernet carries none, so a sample with only that
+// is left alone
+func TestEnrichSampledRecordFallback(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: dst4, network: "203.0.113.0/24", match_as: 0, set_as: 64999}
+    - {name: dst6, network: "2001:db8:1::/48", match_as: 0, set_as: 64998}
+`)
+	loadTestPfx2AS(t, "198.51.100.0\t24\t64501\n2001:db8::\t32\t64502\n")
+	src6, dst6 := net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8:1::9")
+
+	tests := []struct {
+		name         string
+		records      []sflow.FlowRecord
+		enriched     bool
+		srcAS, dstAS uint32
+	}{
+		{"sampled_ipv6", []sflow.FlowRecord{
+			sampledIPv6Record(t, 1280, src6, dst6),
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+		}, true, 64502, 64998},
+		{"sampled_ethernet and sampled_ipv4", []sflow.FlowRecord{
+			sampledEthernetRecord(t, 1518),
+			sampledIPv4Record(t, 1500, testSrc, testDst),
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+		}, true, 64501, 64999},
+		{"sampled_ethernet and sampled_ipv6", []sflow.FlowRecord{
+			sampledEthernetRecord(t, 1518),
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+			sampledIPv6Record(t, 1280, src6, dst6),
+		}, true, 64502, 64998},
+		{"sampled_ethernet only", []sflow.FlowRecord{
+			sampledEthernetRecord(t, 1518),
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+		}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testDatagram(t, tt.records)
+			out, ok := enrich(t, data)
+			if ok != tt.enriched {
+				t.Fatalf("enriched = %v, want %v", ok, tt.enriched)
+			}
+			if !ok && string(out) != string(data) {
+				t.Error("datagram modified")
+			}
+			eg := gateways(t, out)[0]
+			if eg.SrcAS != tt.srcAS || eg.DstAS() != tt.dstAS {
+				t.Errorf("SrcAS/DstAS = %d/%d, want %d/%d", eg.SrcAS, eg.DstAS(), tt.srcAS, tt.dstAS)
+			}
+		})
+	}
+}
+
+// Rules with match_on: inner see the encapsulated addresses of tunnelled
+// traffic, outer rules the tunnel endpoints
+func TestEnrichMatchOnInner(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: outer, network: "10.1.0.0/16", match_as: 0, set_as: 64666}
+    - {name: inner, network: "10.1.0.0/16", match_on: inner, match_as: 0, set_as: 64777}
+    - {name: inner-src, network: "10.0.0.0/24", match_on: inner, match_as: 0, set_as: 64555}
+`)
+	innerSrc, innerDst := net.IP{10, 0, 0, 1}, net.IP{10, 1, 2, 3}
+	inner := ipv4Packet(sflow.IPProtocolTCP, innerSrc, innerDst, make([]byte, 20))
+	gre := append([]byte{0, 0, 0x08, 0x00}, inner...)
+
+	tests := []struct {
+		name         string
+		packet       []byte
+		srcAS, dstAS uint32
+	}{
+		{"GRE", ipv4Packet(sflow.IPProtocolGRE, testSrc, testDst, gre), 64555, 64777},
+		{"IP-in-IP", ipv4Packet(sflow.IPProtocolIPIP, testSrc, testDst, inner), 64555, 64777},
+		// Both rules see the only header; the same network goes in config order
+		{"not tunnelled", inner, 64555, 64666},
+		{"tunnel endpoint in the network", ipv4Packet(sflow.IPProtocolIPIP, testSrc, innerDst,
+			ipv4Packet(sflow.IPProtocolUDP, innerSrc, net.IP{192, 0, 2, 5}, nil)), 64555, 64666},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, ok := enrich(t, testDatagram(t, []sflow.FlowRecord{
+				rawFrameRecord(t, 1500, tt.packet),
+				gatewayRecord(t, &sflow.ExtendedGateway{}),
+			}))
+			if !ok {
+				t.Fatal("not enriched")
+			}
+			eg := gateways(t, out)[0]
+			if eg.SrcAS != tt.srcAS || eg.DstAS() != tt.dstAS {
+				t.Errorf("SrcAS/DstAS = %d/%d, want %d/%d", eg.SrcAS, eg.DstAS(), tt.srcAS, tt.dstAS)
+			}
+		})
+	}
+}
+
+// Rules with match_on: nat see the extended_nat addresses: a router sampling
+// on its outside interface reports the inside (pre-NAT) addresses there
+func TestEnrichMatchOnNAT(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: outer, network: "10.0.0.0/8", match_as: 0, set_as: 64666}
+    - {name: inside, network: "10.0.0.0/8", match_on: nat, match_as: 0, set_as: 64777}
+    - {name: dst, network: "203.0.113.0/24", match_as: 0, set_as: 64999}
+`)
+	inside := net.IP{10, 0, 0, 5}
+
+	tests := []struct {
+		name         string
+		records      []sflow.FlowRecord
+		srcAS, dstAS uint32
+	}{
+		{"source translated", []sflow.FlowRecord{
+			rawHeaderRecord(t, 1500, testSrc, testDst),
+			natRecord(t, inside, testDst),
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+		}, 64777, 64999},
+		// An untranslated destination reported as 0.0.0.0 falls back to the header
+		{"destination unspecified", []sflow.FlowRecord{
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+			natRecord(t, inside, net.IPv4zero),
+			rawHeaderRecord(t, 1500, testSrc, testDst),
+		}, 64777, 64999},
+		{"destination translated", []sflow.FlowRecord{
+			rawHeaderRecord(t, 1500, testDst, testSrc),
+			natRecord(t, net.IPv4zero, inside),
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+		}, 64999, 64777},
+		// Without extended_nat both rules see the header; same network, config order
+		{"no extended_nat", []sflow.FlowRecord{
+			rawHeaderRecord(t, 1500, inside, testDst),
+			gatewayRecord(t, &sflow.ExtendedGateway{}),
+		}, 64666, 64999},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, ok := enrich(t, testDatagram(t, tt.records))
+			if !ok {
+				t.Fatal("not enriched")
+			}
+			eg := gateways(t, out)[0]
+			if eg.SrcAS != tt.srcAS || eg.DstAS() != tt.dstAS {
+				t.Errorf("SrcAS/DstAS = %d/%d, want %d/%d", eg.SrcAS, eg.DstAS(), tt.srcAS, tt.dstAS)
+			}
+		})
+	}
+}
+
+func equalUint32s(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEnrichPacketAllocs(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: dst, network: "203.0.113.0/24", match_as: 0, set_as: 64999, add_communities: ["64512:1"]}
+`)
+	loadTestPfx2AS(t, "198.51.100.0\t24\t64501\n")
+	data := testDatagram(t,
+		[]sflow.FlowRecord{gatewayRecord(t, &sflow.ExtendedGateway{}), rawHeaderRecord(t, 1500, testSrc, testDst)},
+		[]sflow.FlowRecord{sampledIPv4Record(t, 1500, testSrc, testDst), gatewayRecord(t, &sflow.ExtendedGateway{})},
+	)
+	buf := make([]byte, maxPacketSize)
+	scratch := &enrichScratch{}
+	remote := netip.MustParseAddrPort("192.0.2.1:6343")
+	allocs := testing.AllocsPerRun(100, func() {
+		n := copy(buf, data)
+		enrichPacket(buf[:n], remote, scratch)
+	})
+	if allocs != 0 {
+		t.Errorf("enrichPacket allocates %.1f times per datagram, want 0", allocs)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// PeerASStats holds counters for neighbor AS lookups in the agents' peer_as tables
+type PeerASStats struct {
+	SrcPeerASFilled uint64 // gateway records whose SrcPeerAS was set from the input interface
+	DstPeerASFilled uint64 // gateway records whose DstASPath got its first hop from the next hop or output interface
+}
+
+var peerASStats PeerASStats
+
+// srcPeerAS returns the AS of the peer on the sample's input interface
+func srcPeerAS(agent *config.AgentConfig, fs *sflow.FlowSample) (uint32, bool) {
+	ifIndex, ok := fs.InputIfIndex()
+	if !ok {
+		return 0, false
+	}
+	asn, ok := agent.PeerAS.Interfaces[ifIndex]
+	return asn, ok
+}
+
+// dstPeerAS returns the AS of the peer the sampled packet was sent to: by the
+// gateway record's next hop, else by the output interface
+func dstPeerAS(agent *config.AgentConfig, eg *sflow.ExtendedGatewayHeader, fs *sflow.FlowSample) (uint32, bool) {
+	if addr, ok := addrFromIP(eg.NextHop); ok {
+		if asn, ok := agent.PeerAS.NextHopAddrs[addr]; ok {
+			return asn, true
+		}
+	}
+	ifIndex, ok := fs.OutputIfIndex()
+	if !ok {
+		return 0, false
+	}
+	asn, ok := agent.PeerAS.Interfaces[ifIndex]
+	return asn, ok
+}
+
+// fillSrcPeerAS sets SrcPeerAS of a gateway record to the AS of the peer on
+// the input interface
+func fillSrcPeerAS(packet []byte, sampleOffset, recordOffset int, agent *config.AgentConfig, fs *sflow.FlowSample, fill *routeFill) bool {
+	asn, ok := srcPeerAS(agent, fs)
+	if !ok {
+		return false
+	}
+	sflow.ModifySrcPeerAS(packet, sampleOffset, recordOffset, asn)
+	atomic.AddUint64(&peerASStats.SrcPeerASFilled, 1)
+	fill.srcPeerAS = false
+	return true
+}
+
+// fillDstPeerAS gives the destination AS path the peer AS as first hop: the
+// whole path if it is still empty, or before the origin AS from the pfx2as
+// table. Paths from the router, rules or learned routes already start with
+// the neighbor AS. Returns the (possibly resized) packet and whether it changed.
+func fillDstPeerAS(packet []byte, sampleOffset, recordOffset int, asn uint32, fill *routeFill) ([]byte, bool) {
+	var newPacket []byte
+	var ok bool
+	switch {
+	case fill.dstASPath:
+		newPacket, ok = sflow.ModifyDstAS(packet, sampleOffset, recordOffset, asn)
+	case fill.dstOriginAS != 0 && fill.dstOriginAS != asn:
+		newPacket, ok = sflow.PrependDstASPath(packet, sampleOffset, recordOffset, []uint32{asn})
+	}
+	if !ok {
+		return packet, false
+	}
+	atomic.AddUint64(&peerASStats.DstPeerASFilled, 1)
+	fill.dstASPath = false
+	return newPacket, true
+}
+
+func peerASStatus() map[string]interface{} {
+	var agents []map[string]interface{}
+	for _, agent := range cfg.GetAgents() {
+		if !agent.HasPeerAS() {
+			continue
+		}
+		agents = append(agents, map[string]interface{}{
+			"address":    agent.Address,
+			"source":     agent.Source,
+			"interfaces": agent.PeerAS.Interfaces,
+			"next_hops":  agent.PeerAS.NextHops,
+		})
+	}
+	return map[string]interface{}{
+		"agents":             agents,
+		"src_peer_as_filled": atomic.LoadUint64(&peerASStats.SrcPeerASFilled),
+		"dst_peer_as_filled": atomic.LoadUint64(&peerASStats.DstPeerASFilled),
+	}
+}
+
+func writePeerASMetrics(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_peer_as_src_filled_total Gateway records whose SrcPeerAS was set from the agent's peer_as table\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_peer_as_src_filled_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_peer_as_src_filled_total %d\n", atomic.LoadUint64(&peerASStats.SrcPeerASFilled))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_peer_as_dst_filled_total Gateway records whose DstASPath first hop was set from the agent's peer_as table\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_peer_as_dst_filled_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_peer_as_dst_filled_total %d\n", atomic.LoadUint64(&peerASStats.DstPeerASFilled))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"sflow-enricher/internal/sflow"
+)
+
+// peerASDatagram returns a datagram from testAgent with a flow sample of
+// input and output carrying eg and a raw header from testSrc to dst
+func peerASDatagram(t *testing.T, input, output uint32, eg *sflow.ExtendedGateway, dst net.IP) []byte {
+	t.Helper()
+	fs := &sflow.FlowSample{SequenceNum: 1, SourceIDIndex: input, SamplingRate: 1000, SamplePool: 1000, Input: input, Output: output,
+		Records: []sflow.FlowRecord{
+			sflow.NewFlowRecord(sflow.FlowRecordExtendedGateway, mustEncode(t, eg)),
+			rawHeaderRecord(t, 1500, testSrc, dst),
+		}}
+	s, err := fs.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &sflow.Datagram{AgentAddrType: sflow.AddressTypeIPv4, AgentAddr: testAgent, SequenceNum: 1, Samples: []sflow.Sample{s}}
+	return mustEncode(t, d)
+}
+
+func TestEnrichPeerAS(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: dst, network: "203.0.113.128/25", match_as: 0, set_as: 64999}
+agents:
+  - address: "192.0.2.1"
+    peer_as:
+      interfaces: {3: 64601, 4: 64602}
+      next_hops: {"10.0.0.9": 64609, "2001:db8::9": 64619, "10.0.0.7": 64700}
+`)
+	loadTestPfx2AS(t, "203.0.113.0\t24\t64700\n")
+	outside := net.IP{233, 252, 0, 1} // not in the pfx2as table
+
+	testPath := []sflow.ASPathSegment{
+		{Type: sflow.ASPathSegmentSequence, ASNs: []uint32{3356}},
+		{Type: sflow.ASPathSegmentSet, ASNs: []uint32{64700, 64701}},
+	}
+	sequence := func(asns ...uint32) []sflow.ASPathSegment {
+		return []sflow.ASPathSegment{{Type: sflow.ASPathSegmentSequence, ASNs: asns}}
+	}
+
+	tests := []struct {
+		name          string
+		input, output uint32
+		nextHop       net.IP // nil: UNKNOWN
+		srcPeerAS     uint32
+		path          []sflow.ASPathSegment
+		dst           net.IP
+		wantSrcPeerAS uint32
+		wantPath      []sflow.ASPathSegment
+	}{
+		// SrcPeerAS from the input interface when the router left it at 0
+		{"source peer", 3, 9, nil, 0, nil, outside, 64601, nil},
+		{"source peer from the router", 3, 9, nil, 64555, nil, outside, 64555, nil},
+		{"input without a peer", 9, 9, nil, 0, nil, outside, 0, nil},
+
+		// An empty path with no pfx2as origin becomes the peer AS alone
+		{"empty path, next hop", 9, 9, net.IP{10, 0, 0, 9}, 0, nil, outside, 0, sequence(64609)},
+		{"empty path, IPv6 next hop", 9, 9, net.ParseIP("2001:db8::9"), 0, nil, outside, 0, sequence(64619)},
+		{"empty path, output interface", 9, 4, net.IP{10, 0, 0, 1}, 0, nil, outside, 0, sequence(64602)},
+		{"empty path, UNKNOWN next hop", 9, 4, nil, 0, nil, outside, 0, sequence(64602)},
+		{"empty path, no peer", 9, 9, net.IP{10, 0, 0, 1}, 0, nil, outside, 0, nil},
+		// The next hop is looked up before the output interface
+		{"next hop before output", 9, 4, net.IP{10, 0, 0, 9}, 0, nil, outside, 0, sequence(64609)},
+
+		// A pfx2as origin gets the peer AS in front, unless it is the peer
+		{"before the pfx2as origin", 9, 4, net.IP{10, 0, 0, 9}, 0, nil, testDst, 0, sequence(64609, 64700)},
+		{"before the pfx2as origin, output interface", 9, 4, nil, 0, nil, testDst, 0, sequence(64602, 64700)},
+		{"pfx2as origin is the peer", 9, 4, net.IP{10, 0, 0, 7}, 0, nil, testDst, 0, sequence(64700)},
+		{"pfx2as origin, no peer", 9, 9, nil, 0, nil, testDst, 0, sequence(64700)},
+
+		// Paths from the router or a rule are left alone
+		{"path from the router", 3, 4, net.IP{10, 0, 0, 9}, 0, testPath, testDst, 64601, testPath},
+		{"destination rule", 9, 4, net.IP{10, 0, 0, 9}, 0, nil, net.IP{203, 0, 113, 200}, 0, sequence(64999)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eg := &sflow.ExtendedGateway{NextHopType: sflow.AddressTypeUnknown, NextHop: tt.nextHop, AS: 65000, SrcPeerAS: tt.srcPeerAS, DstASPath: tt.path}
+			switch {
+			case tt.nextHop.To4() != nil:
+				eg.NextHopType = sflow.AddressTypeIPv4
+			case tt.nextHop != nil:
+				eg.NextHopType = sflow.AddressTypeIPv6
+			}
+
+			out, _ := enrich(t, peerASDatagram(t, tt.input, tt.output, eg, tt.dst))
+			got := gateways(t, out)[0]
+			if got.SrcPeerAS != tt.wantSrcPeerAS {
+				t.Errorf("SrcPeerAS = %d, want %d", got.SrcPeerAS, tt.wantSrcPeerAS)
+			}
+			if fmt.Sprint(got.DstASPath) != fmt.Sprint(tt.wantPath) {
+				t.Errorf("DstASPath %v, want %v", got.DstASPath, tt.wantPath)
+			}
+			if !got.NextHop.Equal(eg.NextHop) || got.AS != 65000 {
+				t.Errorf("gateway %+v", *got)
+			}
+		})
+	}
+
+	// Agents without a peer_as table are left alone
+	loadTestConfig(t, `
+agents:
+  - {address: "192.0.2.1", sampling_rate: 1000, sampling_rate_mode: "fill"}
+`)
+	eg := &sflow.ExtendedGateway{AS: 65000, NextHopType: sflow.AddressTypeIPv4, NextHop: net.IP{10, 0, 0, 9}}
+	out, _ := enrich(t, peerASDatagram(t, 3, 4, eg, outside))
+	if got := gateways(t, out)[0]; got.SrcPeerAS != 0 || len(got.DstASPath) != 0 {
+		t.Errorf("without peer_as: %+v", *got)
+	}
+}
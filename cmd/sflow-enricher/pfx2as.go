@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"sflow-enricher/internal/pfx2as"
+	"sflow-enricher/internal/sflow"
+)
+
+// Pfx2ASStats holds counters for origin AS lookups in the pfx2as table
+type Pfx2ASStats struct {
+	SrcASFilled uint64 // gateway records whose SrcAS was set from the table
+	DstASFilled uint64 // gateway records whose empty DstASPath was set from the table
+}
+
+var (
+	pfx2asStats Pfx2ASStats
+
+	// Current table, reloaded when the configured file, format or the file
+	// changes
+	pfx2asTable = newTableFile("pfx2as table", "entries", pfx2asSettings,
+		func(s fileSettings) (*pfx2as.Table, error) { return pfx2as.Load(s.File, s.Format) })
+)
+
+func pfx2asSettings() fileSettings {
+	pc := cfg.Pfx2AS()
+	return fileSettings{File: pc.File, Format: pc.Format, CheckInterval: pc.CheckInterval}
+}
+
+// fillOriginAS sets SrcAS and the empty destination AS path of a gateway
+// record, as far as fill allows, to the origin AS of the sample's outer
+// addresses in the pfx2as table. Returns the (possibly resized) packet and
+// whether it changed.
+func fillOriginAS(packet []byte, sampleOffset, recordOffset int, addrs *flowAddresses, fill *routeFill) ([]byte, bool) {
+	table := pfx2asTable.Load()
+	if table == nil {
+		return packet, false
+	}
+	filled := false
+
+	if fill.srcAS {
+		if asn, ok := lookupOrigin(table, addrs.SrcIP); ok {
+			sflow.ModifySrcAS(packet, sampleOffset, recordOffset, asn)
+			atomic.AddUint64(&pfx2asStats.SrcASFilled, 1)
+			fill.srcAS, filled = false, true
+		}
+	}
+
+	if fill.dstASPath {
+		if asn, ok := lookupOrigin(table, addrs.DstIP); ok {
+			if newPacket, ok := sflow.ModifyDstAS(packet, sampleOffset, recordOffset, asn); ok {
+				packet = newPacket
+				atomic.AddUint64(&pfx2asStats.DstASFilled, 1)
+				fill.dstASPath, filled = false, true
+				fill.dstOriginAS = asn
+			}
+		}
+	}
+
+	return packet, filled
+}
+
+func lookupOrigin(table *pfx2as.Table, addr netip.Addr) (uint32, bool) {
+	if !addr.IsValid() {
+		return 0, false
+	}
+	return table.Lookup(addr)
+}
+
+func pfx2asStatus() map[string]interface{} {
+	pc := cfg.Pfx2AS()
+	status := map[string]interface{}{
+		"file":          pc.File,
+		"format":        pc.Format,
+		"src_as_filled": atomic.LoadUint64(&pfx2asStats.SrcASFilled),
+		"dst_as_filled": atomic.LoadUint64(&pfx2asStats.DstASFilled),
+	}
+	pfx2asTable.addStatus(status)
+	return status
+}
+
+func writePfx2ASMetrics(w http.ResponseWriter) {
+	state := pfx2asTable.currentState()
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_pfx2as_entries Prefixes in the loaded pfx2as table\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_pfx2as_entries gauge\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_pfx2as_entries %d\n", state.entries)
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_pfx2as_load_duration_seconds Time taken by the last pfx2as table load\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_pfx2as_load_duration_seconds gauge\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_pfx2as_load_duration_seconds %.3f\n", state.loadDuration.Seconds())
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_pfx2as_load_errors_total Failed pfx2as table loads\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_pfx2as_load_errors_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_pfx2as_load_errors_total %d\n", state.loadErrors)
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_pfx2as_src_as_filled_total Gateway records whose SrcAS was set from the pfx2as table\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_pfx2as_src_as_filled_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_pfx2as_src_as_filled_total %d\n", atomic.LoadUint64(&pfx2asStats.SrcASFilled))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_pfx2as_dst_as_filled_total Gateway records whose DstAS was set from the pfx2as table\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_pfx2as_dst_as_filled_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_pfx2as_dst_as_filled_total %d\n", atomic.LoadUint64(&pfx2asStats.DstASFilled))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"sflow-enricher/internal/bgp"
+	"sflow-enricher/internal/sflow"
+)
+
+// RouteStats holds counters for gateway fields filled from learned routes
+type RouteStats struct {
+	SrcASFilled     uint64
+	SrcPeerASFilled uint64
+	DstASPathFilled uint64
+}
+
+var (
+	routeStats RouteStats
+
+	// Routes learned from routers; empty unless a route source is enabled
+	routeRIB = bgp.NewRIB()
+)
+
+// routeFill says which gateway fields may still be filled: those the router
+// left at 0 and no rule set. Each source clears what it filled.
+type routeFill struct {
+	srcAS     bool
+	srcPeerAS bool
+	dstASPath bool
+	// Origin AS the empty destination path was set to from the pfx2as table,
+	// which has no first hop
+	dstOriginAS uint32
+}
+
+// fillFromRoutes sets SrcAS and SrcPeerAS from the best route to the source
+// address, and the empty destination AS path from the best route to the
+// destination address. Returns the (possibly resized) packet and whether it
+// changed.
+func fillFromRoutes(packet []byte, sampleOffset, recordOffset int, addrs *flowAddresses, fill *routeFill) ([]byte, bool) {
+	filled := false
+
+	if fill.srcAS || fill.srcPeerAS {
+		if route, ok := lookupRoute(addrs.SrcIP); ok {
+			if fill.srcAS && route.OriginAS != 0 {
+				sflow.ModifySrcAS(packet, sampleOffset, recordOffset, route.OriginAS)
+				atomic.AddUint64(&routeStats.SrcASFilled, 1)
+				fill.srcAS, filled = false, true
+			}
+			if fill.srcPeerAS && route.NeighborAS != 0 {
+				sflow.ModifySrcPeerAS(packet, sampleOffset, recordOffset, route.NeighborAS)
+				atomic.AddUint64(&routeStats.SrcPeerASFilled, 1)
+				fill.srcPeerAS, filled = false, true
+			}
+		}
+	}
+
+	if fill.dstASPath {
+		// A route with an empty path is internal: sFlow leaves the path empty too
+		if route, ok := lookupRoute(addrs.DstIP); ok && len(route.ASPath) > 0 {
+			if newPacket, ok := sflow.ReplaceDstASPath(packet, sampleOffset, recordOffset, route.ASPath); ok {
+				packet = newPacket
+				atomic.AddUint64(&routeStats.DstASPathFilled, 1)
+				fill.dstASPath, filled = false, true
+			}
+		}
+	}
+
+	return packet, filled
+}
+
+func lookupRoute(addr netip.Addr) (*bgp.Route, bool) {
+	if !addr.IsValid() {
+		return nil, false
+	}
+	return routeRIB.Lookup(addr)
+}
+
+func routesStatus() map[string]interface{} {
+	return map[string]interface{}{
+		"prefixes":           routeRIB.Len(),
+		"src_as_filled":      atomic.LoadUint64(&routeStats.SrcASFilled),
+		"src_peer_as_filled": atomic.LoadUint64(&routeStats.SrcPeerASFilled),
+		"dst_as_path_filled": atomic.LoadUint64(&routeStats.DstASPathFilled),
+	}
+}
+
+func writeRoutesMetrics(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_route_prefixes Prefixes with at least one learned route\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_route_prefixes gauge\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_route_prefixes %d\n", routeRIB.Len())
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_route_src_as_filled_total Gateway records whose SrcAS was set from learned routes\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_route_src_as_filled_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_route_src_as_filled_total %d\n", atomic.LoadUint64(&routeStats.SrcASFilled))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_route_src_peer_as_filled_total Gateway records whose SrcPeerAS was set from learned routes\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_route_src_peer_as_filled_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_route_src_peer_as_filled_total %d\n", atomic.LoadUint64(&routeStats.SrcPeerASFilled))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_route_dst_as_path_filled_total Gateway records whose DstASPath was set from learned routes\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_route_dst_as_path_filled_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_route_dst_as_path_filled_total %d\n", atomic.LoadUint64(&routeStats.DstASPathFilled))
+}
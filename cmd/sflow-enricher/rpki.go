@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"sflow-enricher/internal/rpki"
+	"sflow-enricher/internal/sflow"
+)
+
+// Traffic directions of origin validation: the source address with SrcAS,
+// the destination address with the origin of DstASPath
+const (
+	rpkiSrc = iota
+	rpkiDst
+)
+
+var rpkiDirections = [...]string{rpkiSrc: "src", rpkiDst: "dst"}
+
+// RPKIStats holds counters for route origin validation of sampled traffic.
+// Bytes and packets are estimates: sampled frames scaled by the sampling rate.
+type RPKIStats struct {
+	Bytes              [2][len(rpki.States)]uint64 // by direction and validation state
+	Packets            [2][len(rpki.States)]uint64
+	NoPrefix           [2]uint64 // samples by direction not validated: no route prefix known
+	InvalidCommunities uint64    // gateway records given the invalid_community
+}
+
+var (
+	rpkiStats RPKIStats
+
+	// Current VRPs, reloaded when the configured file or the file changes
+	rpkiTable = newTableFile("RPKI VRPs", "vrps", rpkiSettings,
+		func(s fileSettings) (*rpki.Table, error) { return rpki.Load(s.File) })
+)
+
+func rpkiSettings() fileSettings {
+	rc := cfg.RPKI()
+	return fileSettings{File: rc.File, CheckInterval: rc.CheckInterval}
+}
+
+// validateOrigins evaluates the origin validity of the source address with
+// SrcAS and of the destination address with the destination origin AS, as the
+// gateway record now has them, and counts the sampled traffic per state. A
+// record with an invalid origin gets the configured invalid_community.
+// Returns the (possibly resized) packet and whether it changed.
+func validateOrigins(packet []byte, sampleOffset, recordOffset int, addrs *flowAddresses, samplingRate uint32) ([]byte, bool) {
+	table := rpkiTable.Load()
+	if table == nil {
+		return packet, false
+	}
+	srcAS, dstAS, ok := sflow.GatewayOrigins(packet, sampleOffset, recordOffset)
+	if !ok {
+		return packet, false
+	}
+
+	// A rate of 0 means unknown: count the sample itself
+	packets := uint64(samplingRate)
+	if packets == 0 {
+		packets = 1
+	}
+	bytes := uint64(addrs.FrameLength) * packets
+
+	invalid := false
+	for direction, origin := range [...]struct {
+		addr netip.Addr
+		asn  uint32
+	}{rpkiSrc: {addrs.SrcIP, srcAS}, rpkiDst: {addrs.DstIP, dstAS}} {
+		if origin.asn == 0 || !origin.addr.IsValid() {
+			continue
+		}
+		state, ok := validateOrigin(table, origin.addr, origin.asn)
+		if !ok {
+			atomic.AddUint64(&rpkiStats.NoPrefix[direction], 1)
+			continue
+		}
+		atomic.AddUint64(&rpkiStats.Bytes[direction][state], bytes)
+		atomic.AddUint64(&rpkiStats.Packets[direction][state], packets)
+		if state == rpki.Invalid {
+			invalid = true
+		}
+	}
+
+	if !invalid {
+		return packet, false
+	}
+	communities := cfg.RPKI().InvalidCommunities
+	if len(communities) == 0 {
+		return packet, false
+	}
+	newPacket, ok := sflow.AddCommunities(packet, sampleOffset, recordOffset, communities)
+	if !ok {
+		return packet, false
+	}
+	atomic.AddUint64(&rpkiStats.InvalidCommunities, 1)
+	return newPacket, true
+}
+
+// validateOrigin validates the route to addr originated by asn. The route's
+// prefix, whose length is checked against VRP maxLength, is the longest
+// learned route or else pfx2as prefix containing addr; without either the
+// origin is not validated.
+func validateOrigin(table *rpki.Table, addr netip.Addr, asn uint32) (rpki.State, bool) {
+	prefixLen, ok := routeRIB.PrefixLen(addr)
+	if !ok {
+		pt := pfx2asTable.Load()
+		if pt == nil {
+			return rpki.NotFound, false
+		}
+		if prefixLen, ok = pt.PrefixLen(addr); !ok {
+			return rpki.NotFound, false
+		}
+	}
+	return table.Validate(addr, prefixLen, asn), true
+}
+
+func rpkiStatus() map[string]interface{} {
+	traffic := map[string]interface{}{}
+	noPrefix := map[string]uint64{}
+	for direction, name := range rpkiDirections {
+		noPrefix[name] = atomic.LoadUint64(&rpkiStats.NoPrefix[direction])
+		byState := map[string]interface{}{}
+		for _, s := range rpki.States {
+			byState[s.String()] = map[string]uint64{
+				"bytes":   atomic.LoadUint64(&rpkiStats.Bytes[direction][s]),
+				"packets": atomic.LoadUint64(&rpkiStats.Packets[direction][s]),
+			}
+		}
+		traffic[name] = byState
+	}
+
+	rc := cfg.RPKI()
+	status := map[string]interface{}{
+		"file":                rc.File,
+		"invalid_community":   rc.InvalidCommunity,
+		"traffic":             traffic,
+		"no_prefix":           noPrefix,
+		"invalid_communities": atomic.LoadUint64(&rpkiStats.InvalidCommunities),
+	}
+	rpkiTable.addStatus(status)
+	return status
+}
+
+func writeRPKIMetrics(w http.ResponseWriter) {
+	state := rpkiTable.currentState()
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_rpki_vrps VRPs in the loaded RPKI file\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_rpki_vrps gauge\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_rpki_vrps %d\n", state.entries)
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_rpki_load_errors_total Failed RPKI file loads\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_rpki_load_errors_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_rpki_load_errors_total %d\n", state.loadErrors)
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_rpki_bytes_total Estimated bytes by origin validation state (sampled frames scaled by the sampling rate)\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_rpki_bytes_total counter\n")
+	for direction, name := range rpkiDirections {
+		for _, s := range rpki.States {
+			fmt.Fprintf(w, "sflow_asn_enricher_rpki_bytes_total{direction=\"%s\",state=\"%s\"} %d\n",
+				name, s, atomic.LoadUint64(&rpkiStats.Bytes[direction][s]))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_rpki_packets_total Estimated packets by origin validation state (samples scaled by the sampling rate)\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_rpki_packets_total counter\n")
+	for direction, name := range rpkiDirections {
+		for _, s := range rpki.States {
+			fmt.Fprintf(w, "sflow_asn_enricher_rpki_packets_total{direction=\"%s\",state=\"%s\"} %d\n",
+				name, s, atomic.LoadUint64(&rpkiStats.Packets[direction][s]))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_rpki_no_prefix_total Samples whose origin was not validated for lack of a route prefix\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_rpki_no_prefix_total counter\n")
+	for direction, name := range rpkiDirections {
+		fmt.Fprintf(w, "sflow_asn_enricher_rpki_no_prefix_total{direction=\"%s\"} %d\n",
+			name, atomic.LoadUint64(&rpkiStats.NoPrefix[direction]))
+	}
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_rpki_invalid_communities_total Gateway records given the invalid_community\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_rpki_invalid_communities_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_rpki_invalid_communities_total %d\n", atomic.LoadUint64(&rpkiStats.InvalidCommunities))
+}
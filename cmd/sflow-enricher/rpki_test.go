@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"sflow-enricher/internal/rpki"
+	"sflow-enricher/internal/sflow"
+)
+
+// loadTestRPKI installs VRPs from a JSON export and clears the counters
+func loadTestRPKI(t *testing.T, export string) {
+	t.Helper()
+	table, err := rpki.Read(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpkiTable.Store(table)
+	rpkiStats = RPKIStats{}
+	t.Cleanup(func() {
+		rpkiTable.Store(nil)
+		rpkiStats = RPKIStats{}
+	})
+}
+
+// The gateway record comes before the header record, so the addresses and
+// frame length are only known after it
+func TestValidateOrigins(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rpki: {invalid_community: "64512:666"}
+`)
+	loadTestRPKI(t, `{"roas": [
+		{"prefix": "198.51.100.0/24", "maxLength": 24, "asn": 64501},
+		{"prefix": "203.0.113.0/24", "maxLength": 24, "asn": 64999}
+	]}`)
+	invalidCommunity := []uint32{64512<<16 | 666}
+	sample := func(srcAS, dstAS uint32) []sflow.FlowRecord {
+		return []sflow.FlowRecord{
+			gatewayRecord(t, &sflow.ExtendedGateway{SrcAS: srcAS, DstASPathSegments: 1, DstASPath: []sflow.ASPathSegment{
+				{Type: sflow.ASPathSegmentSequence, ASNs: []uint32{64600, dstAS}},
+			}}),
+			rawHeaderRecord(t, 1500, testSrc, testDst),
+		}
+	}
+	const bytes, packets = 1500 * 1000, 1000 // testDatagram samples at 1 in 1000
+
+	tests := []struct {
+		name         string
+		pfx2as       string
+		srcAS, dstAS uint32
+		src, dst     rpki.State
+		noPrefix     [2]uint64
+	}{
+		{"valid", "198.51.100.0\t24\t1\n203.0.113.0\t24\t1\n", 64501, 64999, rpki.Valid, rpki.Valid, [2]uint64{}},
+		{"invalid source", "198.51.100.0\t24\t1\n203.0.113.0\t24\t1\n", 64502, 64999, rpki.Invalid, rpki.Valid, [2]uint64{}},
+		{"route prefix lengths", "198.51.100.0\t25\t1\n203.0.113.0\t23\t1\n", 64501, 64999, rpki.Invalid, rpki.NotFound, [2]uint64{}},
+		{"no route prefix", "198.51.100.0\t24\t1\n", 64501, 64998, rpki.Valid, -1, [2]uint64{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestPfx2AS(t, tt.pfx2as)
+			rpkiStats = RPKIStats{}
+			out, _ := enrich(t, testDatagram(t, sample(tt.srcAS, tt.dstAS)))
+
+			var want RPKIStats
+			for direction, state := range [...]rpki.State{rpkiSrc: tt.src, rpkiDst: tt.dst} {
+				if state >= 0 {
+					want.Bytes[direction][state] = bytes
+					want.Packets[direction][state] = packets
+				}
+			}
+			want.NoPrefix = tt.noPrefix
+			var communities []uint32
+			if tt.src == rpki.Invalid || tt.dst == rpki.Invalid {
+				want.InvalidCommunities = 1
+				communities = invalidCommunity
+			}
+			if rpkiStats != want {
+				t.Errorf("counters %+v, want %+v", rpkiStats, want)
+			}
+			if eg := gateways(t, out)[0]; !equalUint32s(eg.Communities, communities) {
+				t.Errorf("communities = %v, want %v", eg.Communities, communities)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"sflow-enricher/internal/config"
+)
+
+// matchOnModes lists the address selections rules can match on
+var matchOnModes = [...]string{config.MatchOnOuter, config.MatchOnInner, config.MatchOnNAT}
+
+// ruleMatch is a rule found by matchRule, with what ranks it against others
+type ruleMatch struct {
+	rule      *config.EnrichmentRule
+	index     int // position in config order
+	prefixLen int
+}
+
+// better reports whether m ranks before o: more specific prefix, then config order
+func (m ruleMatch) better(o ruleMatch) bool {
+	switch {
+	case m.rule == nil:
+		return false
+	case o.rule == nil:
+		return true
+	case m.prefixLen != o.prefixLen:
+		return m.prefixLen > o.prefixLen
+	}
+	return m.index < o.index
+}
+
+// matchRule returns the most specific rule whose network contains the source
+// (dst=false) or destination address of a sample and that accept allows. Each
+// rule sees the addresses its match_on selects; rules with the same prefix
+// length are taken in config order. accept may be nil.
+func matchRule(table *config.RuleTable, addrs *flowAddresses, dst bool, accept func(*config.EnrichmentRule) bool) ruleMatch {
+	var best ruleMatch
+	for _, matchOn := range matchOnModes {
+		srcIP, dstIP := addrs.forMatchOn(matchOn)
+		addr := srcIP
+		if dst {
+			addr = dstIP
+		}
+		if !addr.IsValid() {
+			continue
+		}
+		table.Lookup(matchOn, addr, func(rule *config.EnrichmentRule, index, prefixLen int) bool {
+			m := ruleMatch{rule: rule, index: index, prefixLen: prefixLen}
+			if !m.better(best) {
+				return false // the rest ranks lower too
+			}
+			if accept != nil && !accept(rule) {
+				return true
+			}
+			best = m
+			return false
+		})
+	}
+	return best
+}
+
+// addrFromIP converts a 4- or 16-byte net.IP without allocating
+func addrFromIP(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"sflow-enricher/internal/config"
+)
+
+// oracleMatchRule is matchRule by linear scan of the rules in config order
+func oracleMatchRule(rules []config.EnrichmentRule, addrs *flowAddresses, dst bool, accept func(*config.EnrichmentRule) bool) (index, prefixLen int) {
+	index = -1
+	for i := range rules {
+		rule := &rules[i]
+		srcIP, dstIP := addrs.forMatchOn(rule.MatchOn)
+		addr := srcIP
+		if dst {
+			addr = dstIP
+		}
+		ones, _ := rule.IPNet.Mask.Size()
+		network, _ := netip.AddrFromSlice(rule.IPNet.IP)
+		if !addr.IsValid() || !netip.PrefixFrom(network.Unmap(), ones).Contains(addr) {
+			continue
+		}
+		if accept != nil && !accept(rule) {
+			continue
+		}
+		if index < 0 || ones > prefixLen {
+			index, prefixLen = i, ones
+		}
+	}
+	return index, prefixLen
+}
+
+func checkMatchRule(t *testing.T, addrs *flowAddresses, dst bool, accept func(*config.EnrichmentRule) bool) {
+	t.Helper()
+	table := cfg.Rules()
+	m := matchRule(table, addrs, dst, accept)
+	index, prefixLen := oracleMatchRule(table.Rules(), addrs, dst, accept)
+	got := -1
+	if m.rule != nil {
+		got = m.index
+		if m.rule != &table.Rules()[m.index] {
+			t.Fatalf("rule %q does not sit at index %d", m.rule.Name, m.index)
+		}
+	}
+	if got != index || (got >= 0 && m.prefixLen != prefixLen) {
+		t.Fatalf("matchRule(%+v, dst=%v) = rule %d /%d, want rule %d /%d", *addrs, dst, got, m.prefixLen, index, prefixLen)
+	}
+}
+
+func TestMatchRuleTieBreak(t *testing.T) {
+	loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: wide, network: "203.0.113.0/24", match_as: 0, set_as: 64501}
+    - {name: nat, network: "203.0.113.0/25", match_on: nat, match_as: 0, set_as: 64502}
+    - {name: outer, network: "203.0.113.0/25", match_as: 0, set_as: 64503}
+    - {name: inner, network: "203.0.113.200/32", match_on: inner, match_as: 0, set_as: 64504}
+    - {name: v6, network: "2001:db8::/32", match_as: 0, set_as: 64505}
+`)
+	dst := netip.MustParseAddr("203.0.113.9")
+	other := netip.MustParseAddr("203.0.113.200")
+	tests := []struct {
+		name   string
+		addrs  flowAddresses
+		accept func(*config.EnrichmentRule) bool
+		want   string
+	}{
+		{"same prefix in config order", flowAddresses{DstIP: dst}, nil, "nat"},
+		{"NAT address outside", flowAddresses{DstIP: dst, NATDstIP: other}, nil, "outer"},
+		{"longer prefix wins", flowAddresses{DstIP: dst, InnerSrcIP: dst, InnerDstIP: other}, nil, "inner"},
+		{"inner rule on untunnelled traffic", flowAddresses{DstIP: other}, nil, "inner"},
+		{"rejected host route falls back", flowAddresses{DstIP: other},
+			func(r *config.EnrichmentRule) bool { return r.Name != "inner" }, "wide"},
+		{"rejected rule falls back", flowAddresses{DstIP: dst},
+			func(r *config.EnrichmentRule) bool { return r.Name != "nat" }, "outer"},
+		{"all rejected", flowAddresses{DstIP: dst},
+			func(r *config.EnrichmentRule) bool { return false }, ""},
+		{"IPv6", flowAddresses{DstIP: netip.MustParseAddr("2001:db8::1")}, nil, "v6"},
+		{"no address", flowAddresses{}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := matchRule(cfg.Rules(), &tt.addrs, true, tt.accept)
+			got := ""
+			if m.rule != nil {
+				got = m.rule.Name
+			}
+			if got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+			checkMatchRule(t, &tt.addrs, true, tt.accept)
+		})
+	}
+}
+
+func TestMatchRuleMatchesOracle(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	networks := []string{"10.0.0.0", "10.1.0.0", "10.1.2.0", "2001:db8::", "2001:db8:1::"}
+	matchOns := []string{"", config.MatchOnOuter, config.MatchOnInner, config.MatchOnNAT}
+	randomAddr := func() netip.Addr {
+		if r.Intn(2) == 0 {
+			return netip.AddrFrom4([4]byte{10, byte(r.Intn(2)), byte(r.Intn(4)), byte(r.Intn(4))})
+		}
+		b := netip.MustParseAddr("2001:db8::").As16()
+		b[5], b[15] = byte(r.Intn(2)), byte(r.Intn(4))
+		return netip.AddrFrom16(b)
+	}
+
+	for round := 0; round < 20; round++ {
+		// Few distinct networks, so prefixes repeat across rules and match_on modes
+		var yaml strings.Builder
+		yaml.WriteString("enrichment:\n  rules:\n")
+		for i := 0; i < 30; i++ {
+			network := networks[r.Intn(len(networks))]
+			bits := []int{8, 16, 24, 30, 32}[r.Intn(5)]
+			if strings.Contains(network, ":") {
+				bits = []int{0, 32, 48, 64, 126, 128}[r.Intn(6)]
+			}
+			prefix := netip.PrefixFrom(netip.MustParseAddr(network), bits).Masked()
+			fmt.Fprintf(&yaml, "    - {name: r%d, network: %q, match_on: %q, match_as: 0, set_as: %d}\n",
+				i, prefix, matchOns[r.Intn(len(matchOns))], 64512+i)
+		}
+		loadTestConfig(t, yaml.String())
+
+		rejected := r.Intn(30)
+		accept := func(rule *config.EnrichmentRule) bool { return rule.SetAS != uint32(64512+rejected) }
+		for q := 0; q < 200; q++ {
+			addrs := flowAddresses{SrcIP: randomAddr(), DstIP: randomAddr()}
+			if r.Intn(2) == 0 {
+				addrs.InnerSrcIP, addrs.InnerDstIP = randomAddr(), randomAddr()
+			}
+			if r.Intn(2) == 0 {
+				addrs.NATDstIP = randomAddr()
+			}
+			for _, dst := range []bool{false, true} {
+				checkMatchRule(t, &addrs, dst, nil)
+				checkMatchRule(t, &addrs, dst, accept)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// SamplingStats holds counters for per-agent sampling rate handling
+type SamplingStats struct {
+	RatesRewritten uint64 // flow samples forwarded with a different sampling_rate
+	PoolsRewritten uint64 // flow samples forwarded with a rebuilt sample_pool
+	SamplesKept    uint64 // flow samples kept by software sub-sampling
+	SamplesDropped uint64 // flow samples dropped by software sub-sampling
+}
+
+// samplerStream identifies a flow sample sequence: one per data source of an agent
+type samplerStream struct {
+	agentStream
+	sourceIDType  uint32
+	sourceIDIndex uint32
+}
+
+// samplerSequence tracks the flow samples of a data source
+type samplerSequence struct {
+	last   uint32 // agent's sequence number of the latest sample
+	shift  uint32 // samples dropped by sub-sampling so far
+	number uint32 // forwarded sequence number of the latest kept sample
+	pool   uint32 // its rebuilt sample_pool
+
+	source netip.Addr // UDP source, to find the agent's settings after a reload
+}
+
+// A sequence number further back than this means the agent restarted; closer
+// ones are reordered samples
+const sampleReorderWindow = 1024
+
+// Data sources are not checked against any configuration, so the sequences
+// tracked are limited; samples of further sources are handled as the first
+// of their source every time
+const maxSamplerStreams = 65536
+
+var (
+	samplingStats SamplingStats
+
+	// Flow sample sequences per data source. Samples after dropped ones are
+	// renumbered by the drops so far, so collectors do not count them as loss.
+	samplerSequences   = make(map[samplerStream]samplerSequence)
+	samplerSequencesMu sync.Mutex
+
+	// keepSample decides whether sub-sampling from rate to target keeps a sample
+	keepSample = func(rate, target uint32) bool {
+		return rand.Int63n(int64(target)) < int64(rate)
+	}
+)
+
+// applySampling applies an agent's sampling settings to the flow samples of a
+// datagram, in datagram order:
+//   - sampling_rate is rewritten per sampling_rate_mode
+//   - with target_sampling_rate, samples taken at a lower rate are kept with
+//     probability rate/target and report the target rate; dropped ones are
+//     marked in drop, for the reverse pass to remove
+//   - kept samples are renumbered by the samples of their data source dropped
+//     so far
+//   - with sample_pool_mode rebuild, sample_pool advances by the forwarded rate
+//     for every forwarded sequence number, so pool/samples matches the
+//     reported rate and a sequence gap still accounts for its packets
+//
+// Sizes do not change, so the sample offsets stay valid. source is the UDP
+// source the datagram came from.
+func applySampling(packet []byte, samples []sflow.Sample, stream agentStream, source netip.Addr, agent *config.AgentConfig, drop []bool) {
+	samplerSequencesMu.Lock()
+	defer samplerSequencesMu.Unlock()
+
+	var reader sflow.FlowSampleReader
+	for i, sample := range samples {
+		if sample.Enterprise != 0 ||
+			(sample.Format != sflow.SampleTypeFlowSample && sample.Format != sflow.SampleTypeExpandedFlowSample) {
+			continue
+		}
+		if reader.Reset(sample.Data, sample.Format == sflow.SampleTypeExpandedFlowSample) != nil {
+			continue
+		}
+		fs := &reader.FlowSample
+
+		key := samplerStream{stream, fs.SourceIDType, fs.SourceIDIndex}
+		seq, known := samplerSequences[key]
+		back := int32(seq.last - fs.SequenceNum)
+		if known && back > sampleReorderWindow {
+			seq, known = samplerSequence{}, false
+		}
+		reordered := known && back >= 0
+		if !reordered {
+			seq.last = fs.SequenceNum
+		}
+		seq.source = source
+		tracked := known || len(samplerSequences) < maxSamplerStreams
+
+		rate := fs.SamplingRate
+		switch {
+		case agent.SamplingRateMode == config.SamplingRateOverride:
+			rate = agent.SamplingRate
+		case agent.SamplingRateMode == config.SamplingRateFill && rate == 0:
+			rate = agent.SamplingRate
+		}
+
+		if target := agent.TargetSamplingRate; target != 0 && rate != 0 && rate < target {
+			// Each kept sample then stands for target packets instead of rate
+			if !keepSample(rate, target) {
+				drop[i] = true
+				seq.shift++
+				if tracked {
+					samplerSequences[key] = seq
+				}
+				continue
+			}
+			atomic.AddUint64(&samplingStats.SamplesKept, 1)
+			rate = target
+		}
+
+		if rate != fs.SamplingRate && sflow.SetSamplingRate(packet, sample.Offset, rate) {
+			atomic.AddUint64(&samplingStats.RatesRewritten, 1)
+		}
+
+		number := fs.SequenceNum - seq.shift
+		if seq.shift != 0 {
+			sflow.SetFlowSampleSequence(packet, sample.Offset, number)
+		}
+
+		if agent.SamplePoolMode == config.SamplePoolRebuild && rate != 0 {
+			// A reordered sample reports the pool of the latest one; the first
+			// sample of a source counts as if all before had its rate
+			if !reordered {
+				seq.pool += (number - seq.number) * rate
+				seq.number = number
+			}
+			if sflow.SetSamplePool(packet, sample.Offset, seq.pool) {
+				atomic.AddUint64(&samplingStats.PoolsRewritten, 1)
+			}
+		}
+		if tracked {
+			samplerSequences[key] = seq
+		}
+	}
+}
+
+// pruneSamplerSequences drops the sequences of agents whose sampling settings
+// a configuration reload removed, so they start over if they get them again
+func pruneSamplerSequences() {
+	samplerSequencesMu.Lock()
+	defer samplerSequencesMu.Unlock()
+	for key, seq := range samplerSequences {
+		if agent := cfg.Agent(key.agent, seq.source); agent == nil || !agent.RewritesSampling() {
+			delete(samplerSequences, key)
+		}
+	}
+}
+
+// dropSample removes a flow sample that sub-sampling dropped
+func dropSample(packet []byte, sampleOffset int) []byte {
+	newPacket, ok := sflow.RemoveSample(packet, sampleOffset)
+	if !ok {
+		return packet
+	}
+	atomic.AddUint64(&samplingStats.SamplesDropped, 1)
+	return newPacket
+}
+
+func samplingStatus() map[string]interface{} {
+	var agents []map[string]interface{}
+	for _, agent := range cfg.GetAgents() {
+		if !agent.RewritesSampling() {
+			continue
+		}
+		agents = append(agents, map[string]interface{}{
+			"address":              agent.Address,
+			"source":               agent.Source,
+			"sampling_rate":        agent.SamplingRate,
+			"sampling_rate_mode":   agent.SamplingRateMode,
+			"target_sampling_rate": agent.TargetSamplingRate,
+			"sample_pool_mode":     agent.SamplePoolMode,
+		})
+	}
+	return map[string]interface{}{
+		"agents":          agents,
+		"rates_rewritten": atomic.LoadUint64(&samplingStats.RatesRewritten),
+		"pools_rewritten": atomic.LoadUint64(&samplingStats.PoolsRewritten),
+		"samples_kept":    atomic.LoadUint64(&samplingStats.SamplesKept),
+		"samples_dropped": atomic.LoadUint64(&samplingStats.SamplesDropped),
+	}
+}
+
+func writeSamplingMetrics(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_sampling_rates_rewritten_total Flow samples forwarded with a rewritten sampling_rate\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_sampling_rates_rewritten_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_sampling_rates_rewritten_total %d\n", atomic.LoadUint64(&samplingStats.RatesRewritten))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_sample_pools_rewritten_total Flow samples forwarded with a rebuilt sample_pool\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_sample_pools_rewritten_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_sample_pools_rewritten_total %d\n", atomic.LoadUint64(&samplingStats.PoolsRewritten))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_subsampling_kept_total Flow samples kept by software sub-sampling\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_subsampling_kept_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_subsampling_kept_total %d\n", atomic.LoadUint64(&samplingStats.SamplesKept))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_subsampling_dropped_total Flow samples dropped by software sub-sampling\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_subsampling_dropped_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_subsampling_dropped_total %d\n", atomic.LoadUint64(&samplingStats.SamplesDropped))
+}
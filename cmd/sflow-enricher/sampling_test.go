@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"sflow-enricher/internal/sflow"
+)
+
+// resetSampling clears the per-source sample state, now and after the test
+func resetSampling(t *testing.T) {
+	samplerSequences = make(map[samplerStream]samplerSequence)
+	t.Cleanup(func() { samplerSequences = make(map[samplerStream]samplerSequence) })
+}
+
+// scriptKeepSample makes sub-sampling keep or drop samples in the given order
+func scriptKeepSample(t *testing.T, decisions ...bool) {
+	old := keepSample
+	keepSample = func(rate, target uint32) bool {
+		if len(decisions) == 0 {
+			t.Fatal("more sub-sampling decisions than scripted")
+		}
+		keep := decisions[0]
+		decisions = decisions[1:]
+		return keep
+	}
+	t.Cleanup(func() {
+		keepSample = old
+		if len(decisions) != 0 {
+			t.Errorf("%d scripted sub-sampling decisions left", len(decisions))
+		}
+	})
+}
+
+// flowSampleDatagram returns a datagram from testAgent with the flow samples
+func flowSampleDatagram(t *testing.T, samples ...sflow.FlowSample) []byte {
+	t.Helper()
+	d := &sflow.Datagram{AgentAddrType: sflow.AddressTypeIPv4, AgentAddr: testAgent, SequenceNum: 1}
+	for i := range samples {
+		samples[i].Records = []sflow.FlowRecord{sampledIPv4Record(t, 1500, testSrc, testDst)}
+		s, err := samples[i].Sample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Samples = append(d.Samples, s)
+	}
+	return mustEncode(t, d)
+}
+
+// sampleHeader is what the sampling settings change in a flow sample
+type sampleHeader struct {
+	source, seq, rate, pool uint32
+}
+
+func sampleHeaders(t *testing.T, data []byte) []sampleHeader {
+	t.Helper()
+	d, err := sflow.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers []sampleHeader
+	for _, s := range d.Samples {
+		fs, err := sflow.ParseFlowSample(s.Data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, sampleHeader{fs.SourceIDIndex, fs.SequenceNum, fs.SamplingRate, fs.SamplePool})
+	}
+	return headers
+}
+
+func checkSampleHeaders(t *testing.T, data []byte, want ...sampleHeader) {
+	t.Helper()
+	got := sampleHeaders(t, data)
+	if len(got) != len(want) {
+		t.Fatalf("samples %+v, want %+v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("samples %+v, want %+v", got, want)
+		}
+	}
+}
+
+// Drops earlier in a datagram renumber the later samples of the same source,
+// however the samples of several sources interleave
+func TestSubsamplingSequence(t *testing.T) {
+	loadTestConfig(t, `
+agents:
+  - {address: "192.0.2.1", target_sampling_rate: 4000}
+`)
+	resetSampling(t)
+	sample := func(source, seq uint32) sflow.FlowSample {
+		return sflow.FlowSample{SequenceNum: seq, SourceIDIndex: source, SamplingRate: 1000, SamplePool: seq * 1000}
+	}
+
+	scriptKeepSample(t, true, false, false, false, true, true, true)
+	out, _ := enrich(t, flowSampleDatagram(t, sample(3, 10), sample(3, 11), sample(4, 20), sample(3, 12), sample(3, 13)))
+	checkSampleHeaders(t, out,
+		sampleHeader{3, 10, 4000, 40000},
+		sampleHeader{3, 11, 4000, 44000},
+	)
+
+	out, _ = enrich(t, flowSampleDatagram(t, sample(3, 14), sample(4, 21)))
+	checkSampleHeaders(t, out,
+		sampleHeader{3, 12, 4000, 48000},
+		sampleHeader{4, 20, 4000, 80000},
+	)
+}
+
+func TestSamplePool(t *testing.T) {
+	tests := []struct {
+		name    string
+		agent   string
+		in, out []sampleHeader // one datagram per sample
+	}{
+		{"fill and rebuild", `{address: "192.0.2.1", sampling_rate: 512, sampling_rate_mode: fill}`,
+			[]sampleHeader{{3, 5, 0, 0}, {3, 6, 0, 7}, {3, 9, 0, 0}},
+			[]sampleHeader{{3, 5, 512, 2560}, {3, 6, 512, 3072}, {3, 9, 512, 4608}}},
+		{"override and keep", `{address: "192.0.2.1", sampling_rate: 512, sample_pool_mode: keep}`,
+			[]sampleHeader{{3, 5, 100, 7}, {3, 6, 100, 9}},
+			[]sampleHeader{{3, 5, 512, 7}, {3, 6, 512, 9}}},
+		{"normalize only", `{address: "192.0.2.1", sample_pool_mode: rebuild}`,
+			[]sampleHeader{{3, 5, 100, 1}, {3, 6, 100, 2}, {4, 2, 200, 0}},
+			[]sampleHeader{{3, 5, 100, 500}, {3, 6, 100, 600}, {4, 2, 200, 400}}},
+		{"reordered", `{address: "192.0.2.1", sampling_rate: 10}`,
+			[]sampleHeader{{3, 5, 0, 0}, {3, 8, 0, 0}, {3, 7, 0, 0}, {3, 9, 0, 0}},
+			[]sampleHeader{{3, 5, 10, 50}, {3, 8, 10, 80}, {3, 7, 10, 80}, {3, 9, 10, 90}}},
+		{"agent restart", `{address: "192.0.2.1", sampling_rate: 10}`,
+			[]sampleHeader{{3, 5000, 0, 0}, {3, 2, 0, 0}, {3, 3, 0, 0}},
+			[]sampleHeader{{3, 5000, 10, 50000}, {3, 2, 10, 20}, {3, 3, 10, 30}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, "agents:\n  - "+tt.agent+"\n")
+			resetSampling(t)
+			for i, h := range tt.in {
+				fs := sflow.FlowSample{SourceIDIndex: h.source, SequenceNum: h.seq, SamplingRate: h.rate, SamplePool: h.pool}
+				out, _ := enrich(t, flowSampleDatagram(t, fs))
+				checkSampleHeaders(t, out, tt.out[i])
+			}
+		})
+	}
+}
+
+// Sequences are kept across reloads for agents that still have sampling
+// settings, whether they are found by agent address or UDP source
+func TestPruneSamplerSequences(t *testing.T) {
+	loadTestConfig(t, `
+agents:
+  - {address: "192.0.2.1", sampling_rate: 10}
+  - {source: "192.0.2.1", sampling_rate: 20}
+`)
+	resetSampling(t)
+	fs := sflow.FlowSample{SourceIDIndex: 3, SequenceNum: 5}
+	enrich(t, flowSampleDatagram(t, fs))
+	// Another agent address, known by the UDP source only
+	data := flowSampleDatagram(t, fs)
+	copy(data[8:12], []byte{10, 9, 9, 9})
+	enrich(t, data)
+	if len(samplerSequences) != 2 {
+		t.Fatalf("%d sequences, want 2", len(samplerSequences))
+	}
+
+	pruneSamplerSequences()
+	if len(samplerSequences) != 2 {
+		t.Errorf("%d sequences after a reload keeping the settings, want 2", len(samplerSequences))
+	}
+
+	loadTestConfig(t, `
+agents:
+  - {address: "192.0.2.1", sampling_rate: 10}
+  - {source: "192.0.2.1", set_agent_address: "10.255.0.1"}
+`)
+	pruneSamplerSequences()
+	want := samplerStream{agentStream{agent: netip.MustParseAddr("192.0.2.1")}, 0, 3}
+	if _, ok := samplerSequences[want]; len(samplerSequences) != 1 || !ok {
+		t.Errorf("sequences %v, want only %v", samplerSequences, want)
+	}
+
+	loadTestConfig(t, "")
+	pruneSamplerSequences()
+	if len(samplerSequences) != 0 {
+		t.Errorf("sequences %v without agents", samplerSequences)
+	}
+}
+
+// Past the limit, new data sources are not tracked: each sample is handled as
+// the first of its source
+func TestSamplerSequencesLimit(t *testing.T) {
+	loadTestConfig(t, `
+agents:
+  - {address: "192.0.2.1", sampling_rate: 10}
+`)
+	resetSampling(t)
+	for i := 0; i < maxSamplerStreams; i++ {
+		samplerSequences[samplerStream{agentStream{agent: netip.MustParseAddr("10.0.0.1")}, 0, uint32(i)}] = samplerSequence{}
+	}
+	for _, seq := range []uint32{7, 9} {
+		out, _ := enrich(t, flowSampleDatagram(t, sflow.FlowSample{SourceIDIndex: 5, SequenceNum: seq}))
+		checkSampleHeaders(t, out, sampleHeader{5, seq, 10, seq * 10})
+	}
+	if len(samplerSequences) != maxSamplerStreams {
+		t.Errorf("%d sequences, limit %d", len(samplerSequences), maxSamplerStreams)
+	}
+}
+
+func TestApplySamplingAllocs(t *testing.T) {
+	loadTestConfig(t, `
+agents:
+  - {address: "192.0.2.1", sampling_rate: 512, target_sampling_rate: 4096}
+`)
+	resetSampling(t)
+	data := flowSampleDatagram(t,
+		sflow.FlowSample{SequenceNum: 1, SourceIDIndex: 3},
+		sflow.FlowSample{SequenceNum: 1, SourceIDIndex: 4})
+	buf := make([]byte, maxPacketSize)
+	scratch := &enrichScratch{}
+	remote := netip.MustParseAddrPort("192.0.2.1:6343")
+	allocs := testing.AllocsPerRun(100, func() {
+		n := copy(buf, data)
+		enrichPacket(buf[:n], remote, scratch)
+	})
+	if allocs != 0 {
+		t.Errorf("enrichPacket with sampling settings allocates %.1f times per datagram, want 0", allocs)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// SplitStats holds counters for datagrams split by max_datagram_size
+type SplitStats struct {
+	DatagramsSplit    uint64 // datagrams that exceeded max_datagram_size
+	PartsCreated      uint64 // datagrams sent in their place
+	DatagramsOversize uint64 // parts still above the limit (single oversize sample)
+}
+
+// agentStream identifies an sFlow datagram sequence: one per agent and sub-agent
+type agentStream struct {
+	agent      netip.Addr
+	subAgentID uint32
+}
+
+var (
+	splitStats SplitStats
+
+	// Extra datagrams created by splitting, per stream. With the "shift" strategy
+	// every later datagram of the stream is renumbered by this amount, so the
+	// sequence stays contiguous and collectors keep detecting real loss as gaps.
+	// Streams are keyed as received, before set_agent_address rewrites them.
+	sequenceShift   = make(map[agentStream]uint32)
+	sequenceShiftMu sync.Mutex
+)
+
+// Agent addresses in datagram headers are not checked against the whitelist,
+// so the streams renumbered are limited; datagrams of further streams are
+// split as with "keep"
+const maxSplitStreams = 4096
+
+// datagramStream returns the stream of a datagram as the agent sent it, or the
+// zero stream if the header cannot be read
+func datagramStream(packet []byte) agentStream {
+	var reader sflow.DatagramReader
+	if reader.Reset(packet) != nil {
+		return agentStream{}
+	}
+	agent, _ := netip.AddrFromSlice(reader.AgentAddr)
+	return agentStream{agent: agent.Unmap(), subAgentID: reader.SubAgentID}
+}
+
+// forwardDatagram sends a datagram to all destinations. A datagram larger than
+// max_datagram_size, whether enrichment made it grow or the agent sent it that
+// large, is split into datagrams of at most that size. With splitting disabled
+// datagrams are sent as they are, without renumbering. stream is the
+// datagram's stream as received; the zero stream is never renumbered.
+func forwardDatagram(packet []byte, stream agentStream) {
+	maxSize, sequence := cfg.DatagramSplit()
+	if maxSize == 0 {
+		sendToAll(packet)
+		return
+	}
+	shift := sequence == config.SplitSequenceShift && stream.agent.IsValid()
+
+	// Renumbering only concerns agents whose datagrams were split before
+	var seq uint32
+	if shift {
+		var reader sflow.DatagramReader
+		if err := reader.Reset(packet); err == nil {
+			seq = reader.SequenceNum
+		} else {
+			shift = false
+		}
+	}
+
+	if len(packet) <= maxSize {
+		if shift {
+			sequenceShiftMu.Lock()
+			offset := sequenceShift[stream]
+			sequenceShiftMu.Unlock()
+			if offset != 0 {
+				sflow.SetSequenceNum(packet, seq+offset)
+			}
+		}
+		sendToAll(packet)
+		return
+	}
+
+	parts, err := sflow.SplitDatagram(packet, maxSize)
+	if err != nil {
+		if debugMode {
+			logError("Datagram split error", err, nil)
+		}
+		sendToAll(packet)
+		return
+	}
+
+	if len(parts) > 1 {
+		atomic.AddUint64(&splitStats.DatagramsSplit, 1)
+		atomic.AddUint64(&splitStats.PartsCreated, uint64(len(parts)))
+	}
+
+	if shift {
+		sequenceShiftMu.Lock()
+		offset, known := sequenceShift[stream]
+		if known || len(sequenceShift) < maxSplitStreams {
+			sequenceShift[stream] = offset + uint32(len(parts)-1)
+			for i, part := range parts {
+				sflow.SetSequenceNum(part, seq+offset+uint32(i))
+			}
+		}
+		sequenceShiftMu.Unlock()
+	}
+
+	for _, part := range parts {
+		if len(part) > maxSize {
+			atomic.AddUint64(&splitStats.DatagramsOversize, 1)
+		}
+		sendToAll(part)
+	}
+}
+
+// pruneSequenceShift drops the renumbering state after a configuration reload
+// that stopped it: if "shift" is enabled again, streams start over unshifted
+func pruneSequenceShift() {
+	maxSize, sequence := cfg.DatagramSplit()
+	if maxSize != 0 && sequence == config.SplitSequenceShift {
+		return
+	}
+	sequenceShiftMu.Lock()
+	clear(sequenceShift)
+	sequenceShiftMu.Unlock()
+}
+
+func sendToAll(packet []byte) {
+	for _, dest := range destinations {
+		sendToDestination(dest, packet, len(packet))
+	}
+}
+
+func splitStatus() map[string]interface{} {
+	maxSize, sequence := cfg.DatagramSplit()
+	return map[string]interface{}{
+		"max_datagram_size":  maxSize,
+		"split_sequence":     sequence,
+		"datagrams_split":    atomic.LoadUint64(&splitStats.DatagramsSplit),
+		"parts_created":      atomic.LoadUint64(&splitStats.PartsCreated),
+		"datagrams_oversize": atomic.LoadUint64(&splitStats.DatagramsOversize),
+	}
+}
+
+func writeSplitMetrics(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_datagrams_split_total Datagrams split because they exceeded max_datagram_size\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_datagrams_split_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_datagrams_split_total %d\n", atomic.LoadUint64(&splitStats.DatagramsSplit))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_split_parts_total Datagrams sent in place of split datagrams\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_split_parts_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_split_parts_total %d\n", atomic.LoadUint64(&splitStats.PartsCreated))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_datagrams_oversize_total Split parts still above max_datagram_size (single oversize sample)\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_datagrams_oversize_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_datagrams_oversize_total %d\n", atomic.LoadUint64(&splitStats.DatagramsOversize))
+}
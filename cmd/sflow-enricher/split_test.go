@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// captureDestinations replaces the destinations with one UDP socket and
+// returns a function reading the next n datagrams sent to it
+func captureDestinations(t *testing.T) func(n int) [][]byte {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	out, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { out.Close() })
+
+	dest := &Destination{Config: config.DestinationConfig{Name: "capture"}, Conn: out}
+	dest.Healthy.Store(true)
+	old := destinations
+	destinations = []*Destination{dest}
+	t.Cleanup(func() { destinations = old })
+
+	return func(n int) [][]byte {
+		t.Helper()
+		var got [][]byte
+		buf := make([]byte, maxPacketSize)
+		for len(got) < n {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			m, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("%d of %d datagrams received: %v", len(got), n, err)
+			}
+			got = append(got, append([]byte{}, buf[:m]...))
+		}
+		return got
+	}
+}
+
+// resetSequenceShift clears the renumbering state, now and after the test
+func resetSequenceShift(t *testing.T) {
+	clear(sequenceShift)
+	t.Cleanup(func() { clear(sequenceShift) })
+}
+
+// forward runs a datagram from agent through the receive loop's enrich and
+// forward steps
+func forward(t *testing.T, data []byte, agent net.IP, seq uint32) {
+	t.Helper()
+	buf := make([]byte, maxPacketSize)
+	n := copy(buf, data)
+	packet := buf[:n]
+	copy(packet[8:12], agent.To4())
+	sflow.SetSequenceNum(packet, seq)
+	remote := netip.AddrPortFrom(netip.AddrFrom4([4]byte(agent.To4())), 6343)
+
+	stream := datagramStream(packet)
+	packet, _ = enrichPacket(packet, remote, &enrichScratch{})
+	forwardDatagram(packet, stream)
+}
+
+// forwarded returns the agent address and sequence number of each datagram,
+// checking each parses
+func forwarded(t *testing.T, datagrams [][]byte) []string {
+	t.Helper()
+	var got []string
+	for _, data := range datagrams {
+		d, err := sflow.Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%v#%d/%d", d.AgentAddr, d.SequenceNum, len(d.Samples)))
+	}
+	return got
+}
+
+func TestForwardDatagramSequence(t *testing.T) {
+	sample := []sflow.FlowRecord{sampledIPv4Record(t, 1500, testSrc, testDst)}
+	small := testDatagram(t, sample)
+	large := testDatagram(t, sample, sample, sample)
+	other := net.IP{192, 0, 2, 2}
+
+	// Three datagrams of testAgent, the first and third split in three, with
+	// one of another agent between them
+	run := func(t *testing.T) []string {
+		read := captureDestinations(t)
+		forward(t, large, testAgent, 10)
+		forward(t, small, other, 500)
+		forward(t, small, testAgent, 11)
+		forward(t, large, testAgent, 12)
+		forward(t, small, testAgent, 13)
+		return forwarded(t, read(9))
+	}
+	maxSize := fmt.Sprint(len(small))
+
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"shift", "enrichment: {max_datagram_size: " + maxSize + ", split_sequence: shift}\n", []string{
+			"192.0.2.1#10/1", "192.0.2.1#11/1", "192.0.2.1#12/1",
+			"192.0.2.2#500/1",
+			"192.0.2.1#13/1",
+			"192.0.2.1#14/1", "192.0.2.1#15/1", "192.0.2.1#16/1",
+			"192.0.2.1#17/1",
+		}},
+		{"keep", "enrichment: {max_datagram_size: " + maxSize + ", split_sequence: keep}\n", []string{
+			"192.0.2.1#10/1", "192.0.2.1#10/1", "192.0.2.1#10/1",
+			"192.0.2.2#500/1",
+			"192.0.2.1#11/1",
+			"192.0.2.1#12/1", "192.0.2.1#12/1", "192.0.2.1#12/1",
+			"192.0.2.1#13/1",
+		}},
+		// Both agents are rewritten to one address; each keeps its own shift
+		{"shift with set_agent_address", "enrichment: {max_datagram_size: " + maxSize + ", split_sequence: shift}\n" + `
+agents:
+  - {address: "192.0.2.1", set_agent_address: "10.255.0.1"}
+  - {address: "192.0.2.2", set_agent_address: "10.255.0.1"}
+`, []string{
+			"10.255.0.1#10/1", "10.255.0.1#11/1", "10.255.0.1#12/1",
+			"10.255.0.1#500/1",
+			"10.255.0.1#13/1",
+			"10.255.0.1#14/1", "10.255.0.1#15/1", "10.255.0.1#16/1",
+			"10.255.0.1#17/1",
+		}},
+		{"disabled", "enrichment: {max_datagram_size: 0}\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, tt.config)
+			resetSequenceShift(t)
+			if tt.want == nil {
+				read := captureDestinations(t)
+				forward(t, large, testAgent, 10)
+				if got := forwarded(t, read(1)); got[0] != "192.0.2.1#10/3" {
+					t.Errorf("forwarded %v, want the datagram unsplit", got)
+				}
+				return
+			}
+			got := run(t)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("forwarded\n %v\nwant\n %v", got, tt.want)
+			}
+		})
+	}
+
+	// Shift state is keyed by the stream as received, dropped once a reload
+	// stops renumbering, and bounded in size
+	t.Run("state", func(t *testing.T) {
+		loadTestConfig(t, "enrichment: {max_datagram_size: "+maxSize+"}\n"+`
+agents:
+  - {address: "192.0.2.1", set_agent_address: "10.255.0.1"}
+`)
+		resetSequenceShift(t)
+		read := captureDestinations(t)
+		forward(t, large, testAgent, 10)
+		read(3)
+		want := agentStream{agent: netip.MustParseAddr("192.0.2.1")}
+		if len(sequenceShift) != 1 || sequenceShift[want] != 2 {
+			t.Errorf("sequence shift %v, want %v: 2", sequenceShift, want)
+		}
+
+		pruneSequenceShift()
+		if len(sequenceShift) != 1 {
+			t.Error("renumbering state dropped while still shifting")
+		}
+		loadTestConfig(t, "enrichment: {max_datagram_size: "+maxSize+", split_sequence: keep}\n")
+		pruneSequenceShift()
+		if len(sequenceShift) != 0 {
+			t.Errorf("sequence shift %v after reload to keep", sequenceShift)
+		}
+
+		loadTestConfig(t, "enrichment: {max_datagram_size: "+maxSize+"}\n")
+		for i := 0; i < maxSplitStreams; i++ {
+			sequenceShift[agentStream{agent: netip.MustParseAddr("10.0.0.1"), subAgentID: uint32(i)}] = 1
+		}
+		forward(t, large, testAgent, 10)
+		if got := forwarded(t, read(3)); fmt.Sprint(got) != "[192.0.2.1#10/1 192.0.2.1#10/1 192.0.2.1#10/1]" {
+			t.Errorf("untracked stream forwarded %v, want its parts unshifted", got)
+		}
+		if len(sequenceShift) != maxSplitStreams {
+			t.Errorf("%d streams tracked, limit %d", len(sequenceShift), maxSplitStreams)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fileSettings selects a table file and how it is read
+type fileSettings struct {
+	File          string
+	Format        string // empty for tables with a single file format
+	CheckInterval int    // seconds between file change checks, 0 = 60
+}
+
+// fileState describes the loaded table and the file it came from
+type fileState struct {
+	fileSettings
+	modTime      time.Time
+	size         int64
+	loadedAt     time.Time
+	loadDuration time.Duration
+	entries      int
+	skipped      int
+	lastError    string
+	loads        uint64
+	loadErrors   uint64
+}
+
+// loadedTable is what a table file tells about its contents
+type loadedTable interface {
+	Len() int
+	Skipped() int
+}
+
+// tableFile keeps a table loaded from a file, swapped as a whole when the file
+// settings or the file's modification time or size change. Lookups Load the
+// current table, nil if none; on a failed load the current table is kept.
+type tableFile[T any, P interface {
+	*T
+	loadedTable
+}] struct {
+	atomic.Pointer[T]
+
+	name        string // in log messages, e.g. "pfx2as table"
+	entriesName string // of the entry count in log messages and status
+	settings    func() fileSettings
+	load        func(fileSettings) (P, error)
+
+	mu    sync.Mutex
+	state fileState
+
+	// Wakes the watcher after a configuration reload
+	check chan struct{}
+}
+
+func newTableFile[T any, P interface {
+	*T
+	loadedTable
+}](name, entriesName string, settings func() fileSettings, load func(fileSettings) (P, error)) *tableFile[T, P] {
+	return &tableFile[T, P]{
+		name:        name,
+		entriesName: entriesName,
+		settings:    settings,
+		load:        load,
+		check:       make(chan struct{}, 1),
+	}
+}
+
+// watch checks the file at the configured interval or when requested
+func (f *tableFile[T, P]) watch() {
+	for {
+		s := f.settings()
+		f.checkFile(s)
+
+		interval := time.Duration(s.CheckInterval) * time.Second
+		if interval == 0 {
+			interval = time.Minute
+		}
+		select {
+		case <-time.After(interval):
+		case <-f.check:
+		}
+	}
+}
+
+// requestCheck makes the watcher check the file now
+func (f *tableFile[T, P]) requestCheck() {
+	select {
+	case f.check <- struct{}{}:
+	default:
+	}
+}
+
+// checkFile loads the table if the settings or the file changed
+func (f *tableFile[T, P]) checkFile(s fileSettings) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s.File == "" {
+		if f.Swap(nil) != nil {
+			logInfo(f.name+" unloaded", nil)
+		}
+		f.state = fileState{loads: f.state.loads, loadErrors: f.state.loadErrors}
+		return
+	}
+
+	info, err := os.Stat(s.File)
+	if err != nil {
+		f.loadFailed(s, err)
+		return
+	}
+	if f.Load() != nil && s.File == f.state.File && s.Format == f.state.Format &&
+		info.ModTime().Equal(f.state.modTime) && info.Size() == f.state.size {
+		return
+	}
+
+	start := time.Now()
+	table, err := f.load(s)
+	if err != nil {
+		f.loadFailed(s, err)
+		return
+	}
+	f.Store(table)
+
+	f.state = fileState{
+		fileSettings: s,
+		modTime:      info.ModTime(),
+		size:         info.Size(),
+		loadedAt:     time.Now(),
+		loadDuration: time.Since(start),
+		entries:      table.Len(),
+		skipped:      table.Skipped(),
+		loads:        f.state.loads + 1,
+		loadErrors:   f.state.loadErrors,
+	}
+	fields := map[string]interface{}{
+		"file":        s.File,
+		f.entriesName: table.Len(),
+		"skipped":     table.Skipped(),
+		"duration":    f.state.loadDuration.String(),
+	}
+	if s.Format != "" {
+		fields["format"] = s.Format
+	}
+	logInfo(f.name+" loaded", fields)
+}
+
+func (f *tableFile[T, P]) loadFailed(s fileSettings, err error) {
+	f.state.loadErrors++
+	f.state.lastError = err.Error()
+	fields := map[string]interface{}{"file": s.File}
+	if s.Format != "" {
+		fields["format"] = s.Format
+	}
+	logError("Failed to load "+f.name, err, fields)
+}
+
+// currentState returns a copy of the file state
+func (f *tableFile[T, P]) currentState() fileState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// addStatus adds the entry count and load state to status
+func (f *tableFile[T, P]) addStatus(status map[string]interface{}) {
+	state := f.currentState()
+	status[f.entriesName] = state.entries
+	status["skipped"] = state.skipped
+	status["loads"] = state.loads
+	status["load_errors"] = state.loadErrors
+	status["last_error"] = state.lastError
+	if !state.loadedAt.IsZero() {
+		status["loaded_at"] = state.loadedAt.Format(time.RFC3339)
+		status["load_duration"] = state.loadDuration.String()
+		status["file_modified"] = state.modTime.Format(time.RFC3339)
+	}
+}
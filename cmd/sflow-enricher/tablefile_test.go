@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sflow-enricher/internal/rpki"
+)
+
+func TestTableFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vrps.json")
+	write := func(data string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := fileSettings{File: path}
+	f := newTableFile("test VRPs", "vrps", func() fileSettings { return settings },
+		func(s fileSettings) (*rpki.Table, error) { return rpki.Load(s.File) })
+	check := func(what string, entries int, loads, loadErrors uint64, failed bool) {
+		t.Helper()
+		f.checkFile(settings)
+		state := f.currentState()
+		if state.entries != entries || state.loads != loads || state.loadErrors != loadErrors || (state.lastError != "") != failed {
+			t.Fatalf("%s: entries %d, loads %d, load errors %d, last error %q; want %d, %d, %d, failed %v",
+				what, state.entries, state.loads, state.loadErrors, state.lastError, entries, loads, loadErrors, failed)
+		}
+		if table := f.Load(); (table != nil) != (entries > 0) || (table != nil && table.Len() != entries) {
+			t.Fatalf("%s: table %v, want %d VRPs", what, table, entries)
+		}
+	}
+	one := `{"roas": [{"prefix": "192.0.2.0/24", "asn": 64496}]}`
+	two := `{"roas": [{"prefix": "192.0.2.0/24", "asn": 64496}, {"prefix": "198.51.100.0/24", "asn": 64497}]}`
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	check("missing file", 0, 0, 1, true)
+	write(one, modTime)
+	check("first load", 1, 1, 1, false)
+	check("unchanged", 1, 1, 1, false)
+
+	write(`{"roas": []}`, modTime.Add(time.Second))
+	check("load error keeps the table", 1, 1, 2, true)
+	write(two, modTime.Add(2*time.Second))
+	check("modified", 2, 2, 2, false)
+
+	// Same modification time, other size
+	write(one, modTime.Add(2*time.Second))
+	check("resized", 1, 3, 2, false)
+
+	settings.File = ""
+	check("unconfigured", 0, 3, 2, false)
+	settings.File = path
+	check("configured again", 1, 4, 2, false)
+}
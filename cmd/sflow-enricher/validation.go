@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// ValidationStats holds counters for structurally invalid datagrams
+type ValidationStats struct {
+	PacketsInvalid  uint64 // datagrams with at least one problem
+	PacketsRepaired uint64
+	PacketsRejected uint64 // dropped by "drop" mode or not repairable
+}
+
+var (
+	validationStats ValidationStats
+
+	// Per-problem counters, keyed by kind. The map is never written after init.
+	problemCounters = func() map[sflow.ProblemKind]*uint64 {
+		counters := make(map[sflow.ProblemKind]*uint64, len(sflow.ProblemKinds))
+		for _, kind := range sflow.ProblemKinds {
+			counters[kind] = new(uint64)
+		}
+		return counters
+	}()
+)
+
+// validateDatagram checks packet structure and applies the configured validation
+// mode. It returns the packet to enrich and forward (repaired in place if
+// needed) and whether it should be forwarded at all. In forward mode an invalid
+// datagram keeps its structure; the enricher only reads samples and records
+// whose lengths fit, so those are still enriched.
+func validateDatagram(packet []byte, remoteAddr netip.AddrPort) (out []byte, forward bool) {
+	problems := sflow.Validate(packet)
+	if problems == nil {
+		return packet, true
+	}
+
+	atomic.AddUint64(&validationStats.PacketsInvalid, 1)
+	for _, p := range problems {
+		atomic.AddUint64(problemCounters[p.Kind], 1)
+	}
+
+	mode := cfg.ValidationMode()
+	if debugMode {
+		logDebug("Invalid datagram", map[string]interface{}{
+			"source":   remoteAddr.String(),
+			"mode":     mode,
+			"problems": problemStrings(problems),
+		})
+	}
+
+	switch mode {
+	case config.ValidationDrop:
+		atomic.AddUint64(&validationStats.PacketsRejected, 1)
+		return packet, false
+	case config.ValidationRepair:
+		repaired, _, ok := sflow.Repair(packet)
+		if !ok {
+			atomic.AddUint64(&validationStats.PacketsRejected, 1)
+			return packet, false
+		}
+		atomic.AddUint64(&validationStats.PacketsRepaired, 1)
+		return repaired, true
+	default:
+		return packet, true
+	}
+}
+
+func problemStrings(problems []sflow.Problem) []string {
+	list := make([]string, len(problems))
+	for i, p := range problems {
+		list[i] = p.String()
+	}
+	return list
+}
+
+func validationStatus() map[string]interface{} {
+	problems := make(map[string]uint64, len(problemCounters))
+	for kind, counter := range problemCounters {
+		problems[string(kind)] = atomic.LoadUint64(counter)
+	}
+	return map[string]interface{}{
+		"mode":             cfg.ValidationMode(),
+		"packets_invalid":  atomic.LoadUint64(&validationStats.PacketsInvalid),
+		"packets_repaired": atomic.LoadUint64(&validationStats.PacketsRepaired),
+		"packets_rejected": atomic.LoadUint64(&validationStats.PacketsRejected),
+		"problems":         problems,
+	}
+}
+
+func writeValidationMetrics(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_packets_invalid_total Datagrams that failed structural validation\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_packets_invalid_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_packets_invalid_total %d\n", atomic.LoadUint64(&validationStats.PacketsInvalid))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_packets_repaired_total Invalid datagrams repaired and forwarded\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_packets_repaired_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_packets_repaired_total %d\n", atomic.LoadUint64(&validationStats.PacketsRepaired))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_packets_rejected_total Invalid datagrams dropped\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_packets_rejected_total counter\n")
+	fmt.Fprintf(w, "sflow_asn_enricher_packets_rejected_total %d\n", atomic.LoadUint64(&validationStats.PacketsRejected))
+
+	fmt.Fprintf(w, "# HELP sflow_asn_enricher_validation_problems_total Structural problems found, by kind\n")
+	fmt.Fprintf(w, "# TYPE sflow_asn_enricher_validation_problems_total counter\n")
+	for _, kind := range sflow.ProblemKinds {
+		fmt.Fprintf(w, "sflow_asn_enricher_validation_problems_total{kind=\"%s\"} %d\n", kind, atomic.LoadUint64(problemCounters[kind]))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"sflow-enricher/internal/config"
+	"sflow-enricher/internal/sflow"
+)
+
+// resetValidation clears the validation counters, now and after the test
+func resetValidation(t *testing.T) {
+	reset := func() {
+		validationStats = ValidationStats{}
+		for _, counter := range problemCounters {
+			atomic.StoreUint64(counter, 0)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// receive validates and enriches data as the receive loop does
+func receive(t *testing.T, data []byte) (out []byte, enriched, forwarded bool) {
+	t.Helper()
+	buf := make([]byte, maxPacketSize)
+	n := copy(buf, data)
+	remote := netip.MustParseAddrPort("192.0.2.1:6343")
+	packet, forward := validateDatagram(buf[:n], remote)
+	if !forward {
+		return nil, false, false
+	}
+	packet, enriched = enrichPacket(packet, remote, &enrichScratch{})
+	return packet, enriched, true
+}
+
+func problemCounts() map[sflow.ProblemKind]uint64 {
+	counts := map[sflow.ProblemKind]uint64{}
+	for kind, counter := range problemCounters {
+		if n := atomic.LoadUint64(counter); n != 0 {
+			counts[kind] = n
+		}
+	}
+	return counts
+}
+
+func TestValidationModes(t *testing.T) {
+	sample := []sflow.FlowRecord{gatewayRecord(t, &sflow.ExtendedGateway{}), rawHeaderRecord(t, 1500, testSrc, testDst)}
+	valid := testDatagram(t, sample, sample)
+	secondSample := func() int {
+		d, err := sflow.Parse(valid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Samples[1].Offset
+	}()
+	broken := func(change func([]byte) []byte) []byte {
+		return change(append([]byte{}, valid...))
+	}
+
+	datagrams := []struct {
+		name     string
+		data     []byte
+		problems map[sflow.ProblemKind]uint64
+		samples  int // samples left after repair
+	}{
+		{"trailing padding", broken(func(b []byte) []byte { return append(b, 0, 0, 0, 0) }),
+			map[sflow.ProblemKind]uint64{sflow.ProblemTrailingBytes: 1}, 2},
+		{"num_samples too high", broken(func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[24:], 3)
+			return b
+		}), map[sflow.ProblemKind]uint64{sflow.ProblemSampleCountMismatch: 1}, 2},
+		// The gateway record is the first record of the sample, after the 32-byte header
+		{"record length past the sample", broken(func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[secondSample+8+32+4:], 0xffff)
+			return b
+		}), map[sflow.ProblemKind]uint64{sflow.ProblemBadRecordLength: 1}, 1},
+		// The second sample is then trailing bytes
+		{"num_samples too low", broken(func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[24:], 1)
+			return b
+		}), map[sflow.ProblemKind]uint64{sflow.ProblemTrailingBytes: 1}, 1},
+		{"num_samples too high and padding", broken(func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[24:], 3)
+			return append(b, 0, 0)
+		}), map[sflow.ProblemKind]uint64{sflow.ProblemSampleCountMismatch: 1, sflow.ProblemTrailingBytes: 1}, 2},
+	}
+
+	for _, mode := range []string{config.ValidationForward, config.ValidationDrop, config.ValidationRepair} {
+		for _, dg := range datagrams {
+			t.Run(mode+"/"+dg.name, func(t *testing.T) {
+				loadTestConfig(t, `
+enrichment:
+  rules:
+    - {name: dst, network: "203.0.113.0/24", match_as: 0, set_as: 64999}
+validation:
+  mode: "`+mode+`"
+`)
+				resetValidation(t)
+				out, enriched, forwarded := receive(t, dg.data)
+
+				want := ValidationStats{PacketsInvalid: 1}
+				switch mode {
+				case config.ValidationDrop:
+					want.PacketsRejected = 1
+				case config.ValidationRepair:
+					want.PacketsRepaired = 1
+				}
+				if validationStats != want {
+					t.Errorf("counters %+v, want %+v", validationStats, want)
+				}
+				if counts := problemCounts(); len(counts) != len(dg.problems) {
+					t.Errorf("problems %v, want %v", counts, dg.problems)
+				} else {
+					for kind, n := range dg.problems {
+						if counts[kind] != n {
+							t.Errorf("problems %v, want %v", counts, dg.problems)
+						}
+					}
+				}
+
+				if mode == config.ValidationDrop {
+					if forwarded {
+						t.Error("invalid datagram forwarded")
+					}
+					return
+				}
+				if !forwarded || !enriched {
+					t.Fatalf("forwarded %v, enriched %v", forwarded, enriched)
+				}
+
+				// Forward keeps the problems; repairing the result then gives
+				// what repair mode forwards
+				problems := sflow.Validate(out)
+				if mode == config.ValidationRepair && problems != nil {
+					t.Errorf("repaired datagram has problems: %v", problems)
+				}
+				if mode == config.ValidationForward {
+					if len(problems) != len(sflow.Validate(dg.data)) {
+						t.Errorf("forwarded datagram problems %v, received %v", problems, sflow.Validate(dg.data))
+					}
+					var ok bool
+					if out, _, ok = sflow.Repair(out); !ok {
+						t.Fatal("forwarded datagram cannot be repaired")
+					}
+				}
+				egs := gateways(t, out)
+				if len(egs) != dg.samples {
+					t.Fatalf("%d valid samples, want %d", len(egs), dg.samples)
+				}
+				for i, eg := range egs {
+					if eg.DstAS() != 64999 {
+						t.Errorf("sample %d: DstAS = %d, want 64999", i, eg.DstAS())
+					}
+				}
+			})
+		}
+	}
+
+	// A valid datagram counts nothing in any mode
+	t.Run("valid", func(t *testing.T) {
+		loadTestConfig(t, "validation: {mode: drop}\n")
+		resetValidation(t)
+		if _, _, forwarded := receive(t, valid); !forwarded {
+			t.Error("valid datagram dropped")
+		}
+		if validationStats != (ValidationStats{}) || len(problemCounts()) != 0 {
+			t.Errorf("counters %+v, problems %v", validationStats, problemCounts())
+		}
+	})
+}
@@ -0,0 +1,16 @@
+// Package aspath defines BGP AS path segments (RFC 4271), as carried by the
+// BGP AS_PATH attribute and the sFlow extended_gateway record, so packages
+// that handle AS paths share them without depending on each other.
+package aspath
+
+// Segment types; sFlow v5 enum as_path_segment_type uses the BGP values
+const (
+	Set      = 1 // AS_SET: unordered set of ASs
+	Sequence = 2 // AS_SEQUENCE: ordered set of ASs
+)
+
+// Segment is one segment of an AS path
+type Segment struct {
+	Type uint32 // Set or Sequence
+	ASNs []uint32
+}
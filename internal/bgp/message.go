@@ -0,0 +1,285 @@
+// Package bgp implements the parts of BGP-4 (RFC 4271) the enricher needs to
+// learn routes: message encoding and decoding, a passive speaker that accepts
+// sessions from configured peers, and a RIB holding the routes of every peer.
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Message types
+const (
+	MsgOpen         = 1
+	MsgUpdate       = 2
+	MsgNotification = 3
+	MsgKeepalive    = 4
+	MsgRouteRefresh = 5
+)
+
+// Message sizes
+const (
+	HeaderLen     = 19
+	MaxMessageLen = 4096
+)
+
+// NOTIFICATION error codes and subcodes used by the speaker
+const (
+	ErrMessageHeader    = 1
+	ErrOpenMessage      = 2
+	ErrUpdateMessage    = 3
+	ErrHoldTimerExpired = 4
+	ErrFSM              = 5
+	ErrCease            = 6
+
+	ErrSubBadMessageLength   = 2
+	ErrSubBadMessageType     = 3
+	ErrSubUnsupportedVersion = 1
+	ErrSubBadPeerAS          = 2
+	ErrSubUnacceptableHold   = 6
+	ErrSubMalformedAttrList  = 1
+	ErrSubConnectionRejected = 5
+	ErrSubAdminShutdown      = 2
+)
+
+// Address families (AFI/SAFI)
+const (
+	AFIIPv4           = 1
+	AFIIPv6           = 2
+	SAFIUnicast       = 1
+	asTrans           = 23456 // RFC 6793: 2-byte placeholder for a 4-byte ASN
+	bgpVersion        = 4
+	paramCapabilities = 2
+)
+
+// Capability codes
+const (
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+	capAddPath       = 69
+)
+
+// ADD-PATH send/receive flags (RFC 7911)
+const (
+	AddPathReceive = 1
+	AddPathSend    = 2
+)
+
+var marker = [16]byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}
+
+// Family is an AFI/SAFI pair
+type Family struct {
+	AFI  uint16
+	SAFI uint8
+}
+
+// Unicast address families
+var (
+	IPv4Unicast = Family{AFIIPv4, SAFIUnicast}
+	IPv6Unicast = Family{AFIIPv6, SAFIUnicast}
+)
+
+func (f Family) String() string {
+	switch f {
+	case IPv4Unicast:
+		return "ipv4-unicast"
+	case IPv6Unicast:
+		return "ipv6-unicast"
+	}
+	return fmt.Sprintf("afi%d-safi%d", f.AFI, f.SAFI)
+}
+
+// Error is a protocol error, sent to the peer as a NOTIFICATION
+type Error struct {
+	Code    uint8
+	Subcode uint8
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (notification %d/%d)", e.Message, e.Code, e.Subcode)
+}
+
+func protoError(code, subcode uint8, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Subcode: subcode, Message: fmt.Sprintf(format, args...)}
+}
+
+// ReadMessage reads one message into buf (at least maxLen bytes) and returns
+// its type and body, which shares buf
+func ReadMessage(r io.Reader, buf []byte, maxLen int) (uint8, []byte, error) {
+	if _, err := io.ReadFull(r, buf[:HeaderLen]); err != nil {
+		return 0, nil, err
+	}
+	msgType, length, err := ParseHeader(buf[:HeaderLen], maxLen)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := buf[HeaderLen:length]
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return msgType, body, nil
+}
+
+// ParseHeader checks a message header and returns the message type and length
+func ParseHeader(data []byte, maxLen int) (uint8, int, error) {
+	if len(data) < HeaderLen {
+		return 0, 0, protoError(ErrMessageHeader, ErrSubBadMessageLength, "short message header")
+	}
+	if [16]byte(data[:16]) != marker {
+		return 0, 0, protoError(ErrMessageHeader, 1, "connection not synchronized")
+	}
+	length := int(binary.BigEndian.Uint16(data[16:18]))
+	if length < HeaderLen || length > maxLen {
+		return 0, 0, protoError(ErrMessageHeader, ErrSubBadMessageLength, "bad message length %d", length)
+	}
+	return data[18], length, nil
+}
+
+// AppendMessage appends a message with the given type and body
+func AppendMessage(b []byte, msgType uint8, body []byte) []byte {
+	b = append(b, marker[:]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(HeaderLen+len(body)))
+	b = append(b, msgType)
+	return append(b, body...)
+}
+
+// Open is an OPEN message
+type Open struct {
+	Version  uint8
+	AS       uint32 // 4-byte ASN from the capability if present, else My Autonomous System
+	HoldTime uint16
+	RouterID netip.Addr
+	// Capabilities
+	FourOctetAS bool
+	Families    []Family
+	AddPath     map[Family]uint8 // AddPathReceive | AddPathSend
+}
+
+// ParseOpen decodes the body of an OPEN message
+func ParseOpen(data []byte) (*Open, error) {
+	if len(data) < 10 {
+		return nil, protoError(ErrMessageHeader, ErrSubBadMessageLength, "short OPEN message")
+	}
+	o := &Open{
+		Version:  data[0],
+		AS:       uint32(binary.BigEndian.Uint16(data[1:3])),
+		HoldTime: binary.BigEndian.Uint16(data[3:5]),
+		RouterID: netip.AddrFrom4([4]byte(data[5:9])),
+	}
+	if o.Version != bgpVersion {
+		return nil, protoError(ErrOpenMessage, ErrSubUnsupportedVersion, "unsupported BGP version %d", o.Version)
+	}
+	if o.HoldTime == 1 || o.HoldTime == 2 {
+		return nil, protoError(ErrOpenMessage, ErrSubUnacceptableHold, "unacceptable hold time %d", o.HoldTime)
+	}
+
+	params := data[10:]
+	if len(params) != int(data[9]) {
+		return nil, protoError(ErrOpenMessage, 0, "bad optional parameters length")
+	}
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, protoError(ErrOpenMessage, 0, "truncated optional parameter")
+		}
+		if paramType == paramCapabilities {
+			if err := o.parseCapabilities(params[2 : 2+paramLen]); err != nil {
+				return nil, err
+			}
+		}
+		params = params[2+paramLen:]
+	}
+	return o, nil
+}
+
+func (o *Open) parseCapabilities(data []byte) error {
+	for len(data) >= 2 {
+		code, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			return protoError(ErrOpenMessage, 0, "truncated capability %d", code)
+		}
+		value := data[2 : 2+length]
+		switch code {
+		case capMultiprotocol:
+			if length == 4 {
+				o.Families = append(o.Families, Family{binary.BigEndian.Uint16(value), value[3]})
+			}
+		case capFourOctetAS:
+			if length == 4 {
+				o.FourOctetAS = true
+				o.AS = binary.BigEndian.Uint32(value)
+			}
+		case capAddPath:
+			for ; len(value) >= 4; value = value[4:] {
+				if o.AddPath == nil {
+					o.AddPath = make(map[Family]uint8)
+				}
+				o.AddPath[Family{binary.BigEndian.Uint16(value), value[2]}] = value[3]
+			}
+		}
+		data = data[2+length:]
+	}
+	return nil
+}
+
+// Append appends the OPEN message with its capabilities
+func (o *Open) Append(b []byte) []byte {
+	var caps []byte
+	for _, f := range o.Families {
+		caps = append(caps, capMultiprotocol, 4)
+		caps = binary.BigEndian.AppendUint16(caps, f.AFI)
+		caps = append(caps, 0, f.SAFI)
+	}
+	if o.FourOctetAS {
+		caps = append(caps, capFourOctetAS, 4)
+		caps = binary.BigEndian.AppendUint32(caps, o.AS)
+	}
+	if len(o.AddPath) > 0 {
+		caps = append(caps, capAddPath, byte(4*len(o.AddPath)))
+		for _, f := range o.Families {
+			if flags, ok := o.AddPath[f]; ok {
+				caps = binary.BigEndian.AppendUint16(caps, f.AFI)
+				caps = append(caps, f.SAFI, flags)
+			}
+		}
+	}
+
+	myAS := uint16(o.AS)
+	if o.AS > 0xffff {
+		myAS = asTrans
+	}
+	body := []byte{bgpVersion}
+	body = binary.BigEndian.AppendUint16(body, myAS)
+	body = binary.BigEndian.AppendUint16(body, o.HoldTime)
+	id := o.RouterID.As4()
+	body = append(body, id[:]...)
+	body = append(body, byte(2+len(caps)), paramCapabilities, byte(len(caps)))
+	body = append(body, caps...)
+	return AppendMessage(b, MsgOpen, body)
+}
+
+// AppendKeepalive appends a KEEPALIVE message
+func AppendKeepalive(b []byte) []byte {
+	return AppendMessage(b, MsgKeepalive, nil)
+}
+
+// AppendNotification appends a NOTIFICATION message
+func AppendNotification(b []byte, code, subcode uint8, data []byte) []byte {
+	body := append([]byte{code, subcode}, data...)
+	return AppendMessage(b, MsgNotification, body)
+}
+
+// ParseNotification decodes the body of a NOTIFICATION message
+func ParseNotification(data []byte) (*Error, error) {
+	if len(data) < 2 {
+		return nil, errors.New("short NOTIFICATION message")
+	}
+	return &Error{Code: data[0], Subcode: data[1], Message: "notification from peer"}, nil
+}
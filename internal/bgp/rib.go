@@ -0,0 +1,224 @@
+package bgp
+
+import (
+	"net/netip"
+	"sync"
+
+	"sflow-enricher/internal/lpm"
+)
+
+// PeerKey identifies the peer a route was received from
+type PeerKey struct {
+	Router        netip.Addr // BMP: monitored router the peer is a neighbor of; zero for a BGP session
+	Address       netip.Addr
+	Distinguisher uint64 // BMP peer distinguisher (VRF), 0 for the global instance
+}
+
+// Route is a path to a prefix received from a peer. Routes are not modified
+// once stored; a new announcement replaces the route.
+type Route struct {
+	Peer   PeerKey
+	PathID uint32
+	*Attributes
+}
+
+// defaultLocalPref applies to routes without LOCAL_PREF (eBGP)
+const defaultLocalPref = 100
+
+// better reports whether r is preferred over o: higher LOCAL_PREF, shorter
+// AS_PATH, lower ORIGIN, lower MED from the same neighbor AS, then lower peer
+// address, router, distinguisher and path identifier so the choice is stable
+func (r *Route) better(o *Route) bool {
+	if lp, olp := r.localPref(), o.localPref(); lp != olp {
+		return lp > olp
+	}
+	if l, ol := pathLen(r.ASPath), pathLen(o.ASPath); l != ol {
+		return l < ol
+	}
+	if r.Origin != o.Origin {
+		return r.Origin < o.Origin
+	}
+	if r.NeighborAS == o.NeighborAS && r.MED != o.MED {
+		return r.MED < o.MED
+	}
+	if c := r.Peer.Address.Compare(o.Peer.Address); c != 0 {
+		return c < 0
+	}
+	if c := r.Peer.Router.Compare(o.Peer.Router); c != 0 {
+		return c < 0
+	}
+	if r.Peer.Distinguisher != o.Peer.Distinguisher {
+		return r.Peer.Distinguisher < o.Peer.Distinguisher
+	}
+	return r.PathID < o.PathID
+}
+
+func (r *Route) localPref() uint32 {
+	if r.HasLocalPref {
+		return r.LocalPref
+	}
+	return defaultLocalPref
+}
+
+// ribEntry holds the routes to one prefix
+type ribEntry struct {
+	routes []*Route
+	best   *Route
+}
+
+func (e *ribEntry) selectBest() {
+	e.best = nil
+	for _, r := range e.routes {
+		if e.best == nil || r.better(e.best) {
+			e.best = r
+		}
+	}
+}
+
+// RIB holds the routes received from all peers, the Adj-RIB-In of each peer
+// merged per prefix, and selects the best route of every prefix. It is safe
+// for concurrent use.
+type RIB struct {
+	mu    sync.RWMutex
+	trie  lpm.Trie[*ribEntry]
+	peers map[PeerKey]int // routes per peer
+}
+
+// NewRIB returns an empty RIB
+func NewRIB() *RIB {
+	return &RIB{peers: make(map[PeerKey]int)}
+}
+
+// Apply withdraws and adds the routes of an UPDATE received from peer
+func (r *RIB) Apply(peer PeerKey, u *Update) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, n := range u.Withdrawn {
+		r.withdraw(peer, n)
+	}
+	for _, n := range u.Announced {
+		r.add(&Route{Peer: peer, PathID: n.PathID, Attributes: u.Attrs}, n.Prefix)
+	}
+}
+
+func (r *RIB) add(route *Route, prefix netip.Prefix) {
+	e, ok := r.trie.Get(prefix)
+	if !ok {
+		e = &ribEntry{}
+		r.trie.Insert(prefix, e)
+	}
+	for i, old := range e.routes {
+		if old.Peer == route.Peer && old.PathID == route.PathID {
+			e.routes[i] = route
+			e.selectBest()
+			return
+		}
+	}
+	e.routes = append(e.routes, route)
+	r.peers[route.Peer]++
+	e.selectBest()
+}
+
+func (r *RIB) withdraw(peer PeerKey, n NLRI) {
+	e, ok := r.trie.Get(n.Prefix)
+	if !ok {
+		return
+	}
+	for i, old := range e.routes {
+		if old.Peer == peer && old.PathID == n.PathID {
+			r.remove(n.Prefix, e, i)
+			return
+		}
+	}
+}
+
+// remove drops route i of the entry for prefix
+func (r *RIB) remove(prefix netip.Prefix, e *ribEntry, i int) {
+	peer := e.routes[i].Peer
+	if r.peers[peer]--; r.peers[peer] <= 0 {
+		delete(r.peers, peer)
+	}
+	last := len(e.routes) - 1
+	e.routes[i] = e.routes[last]
+	e.routes[last] = nil
+	e.routes = e.routes[:last]
+	if len(e.routes) == 0 {
+		r.trie.Delete(prefix)
+		return
+	}
+	e.selectBest()
+}
+
+// RemovePeer withdraws all routes of a peer and returns how many there were
+func (r *RIB) RemovePeer(peer PeerKey) int {
+	return r.RemovePeers(func(p PeerKey) bool { return p == peer })
+}
+
+// RemovePeers withdraws all routes of the peers match selects and returns how
+// many there were
+func (r *RIB) RemovePeers(match func(PeerKey) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for peer, n := range r.peers {
+		if match(peer) {
+			count += n
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+
+	var prefixes []netip.Prefix
+	r.trie.Walk(func(prefix netip.Prefix, e *ribEntry) bool {
+		for _, route := range e.routes {
+			if match(route.Peer) {
+				prefixes = append(prefixes, prefix)
+				break
+			}
+		}
+		return true
+	})
+	for _, prefix := range prefixes {
+		e, _ := r.trie.Get(prefix)
+		for i := len(e.routes) - 1; i >= 0; i-- {
+			if match(e.routes[i].Peer) {
+				r.remove(prefix, e, i)
+			}
+		}
+	}
+	return count
+}
+
+// Lookup returns the best route of the longest prefix containing addr
+func (r *RIB) Lookup(addr netip.Addr) (*Route, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, _, ok := r.trie.Lookup(addr)
+	if !ok {
+		return nil, false
+	}
+	return e.best, true
+}
+
+// PrefixLen returns the length of the longest prefix with a route to addr
+func (r *RIB) PrefixLen(addr netip.Addr) (int, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, bits, ok := r.trie.Lookup(addr)
+	return bits, ok
+}
+
+// Len returns the number of prefixes with at least one route
+func (r *RIB) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.trie.Len()
+}
+
+// PeerRoutes returns the number of routes received from a peer
+func (r *RIB) PeerRoutes(peer PeerKey) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.peers[peer]
+}
@@ -0,0 +1,412 @@
+package bgp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session states (RFC 4271 section 8.2.2); a passive speaker never dials, so
+// Connect and Active are not used
+const (
+	StateIdle        = "Idle"
+	StateOpenSent    = "OpenSent"
+	StateOpenConfirm = "OpenConfirm"
+	StateEstablished = "Established"
+)
+
+// openHoldTime bounds the wait for OPEN (RFC 4271 suggests 4 minutes)
+const openHoldTime = 4 * time.Minute
+
+// SpeakerConfig configures a passive BGP speaker
+type SpeakerConfig struct {
+	LocalAS  uint32
+	RouterID netip.Addr // IPv4
+	HoldTime uint16     // proposed hold time in seconds, 0 or at least 3
+	AddPath  bool       // offer to receive several paths per prefix (RFC 7911)
+	Peers    []PeerConfig
+}
+
+// PeerConfig is a peer allowed to connect
+type PeerConfig struct {
+	Address netip.Addr
+	AS      uint32 // expected peer AS, 0 = any
+}
+
+// SessionStatus describes the session with a configured peer
+type SessionStatus struct {
+	Peer        netip.Addr
+	PeerAS      uint32
+	RouterID    netip.Addr
+	State       string
+	Since       time.Time // time of the last state change
+	HoldTime    uint16
+	FourOctetAS bool
+	AddPath     []string // families with ADD-PATH receive negotiated
+	Updates     uint64   // UPDATE messages received in this session
+	Routes      int
+	LastError   string
+}
+
+// Speaker accepts BGP sessions from configured peers and keeps the routes they
+// send in a RIB. It never initiates connections and never announces routes.
+type Speaker struct {
+	// OnStateChange, if set, is called when a session is established or goes
+	// down (state Idle, with the error that ended it)
+	OnStateChange func(peer netip.Addr, state string, err error)
+
+	cfg SpeakerConfig
+	rib *RIB
+
+	mu       sync.Mutex
+	listener net.Listener
+	sessions map[netip.Addr]*session
+	status   map[netip.Addr]*SessionStatus // last known state of every configured peer
+	closed   bool
+}
+
+// NewSpeaker returns a speaker that stores routes in rib
+func NewSpeaker(cfg SpeakerConfig, rib *RIB) *Speaker {
+	s := &Speaker{
+		cfg:      cfg,
+		rib:      rib,
+		sessions: make(map[netip.Addr]*session),
+		status:   make(map[netip.Addr]*SessionStatus),
+	}
+	for _, p := range cfg.Peers {
+		s.status[p.Address] = &SessionStatus{Peer: p.Address, State: StateIdle}
+	}
+	return s
+}
+
+// Serve accepts sessions on l until Close is called
+func (s *Speaker) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting sessions and closes the established ones
+func (s *Speaker) Close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for _, sess := range s.sessions {
+		sess.conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// Sessions returns the status of every configured peer
+func (s *Speaker) Sessions() []SessionStatus {
+	s.mu.Lock()
+	list := make([]SessionStatus, 0, len(s.cfg.Peers))
+	for _, p := range s.cfg.Peers {
+		st := *s.status[p.Address]
+		if sess, ok := s.sessions[p.Address]; ok {
+			st.Updates = atomic.LoadUint64(&sess.updates)
+		}
+		list = append(list, st)
+	}
+	s.mu.Unlock()
+
+	for i := range list {
+		list[i].Routes = s.rib.PeerRoutes(PeerKey{Address: list[i].Peer})
+	}
+	return list
+}
+
+func (s *Speaker) peerConfig(addr netip.Addr) (PeerConfig, bool) {
+	for _, p := range s.cfg.Peers {
+		if p.Address == addr {
+			return p, true
+		}
+	}
+	return PeerConfig{}, false
+}
+
+func (s *Speaker) setState(addr netip.Addr, update func(st *SessionStatus)) {
+	s.mu.Lock()
+	if st, ok := s.status[addr]; ok {
+		update(st)
+		st.Since = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+func (s *Speaker) handle(conn net.Conn) {
+	remote, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	addr := remote.Addr().Unmap()
+	peer, ok := s.peerConfig(addr)
+	if !ok {
+		conn.Write(AppendNotification(nil, ErrCease, ErrSubConnectionRejected, nil))
+		conn.Close()
+		return
+	}
+
+	sess := &session{speaker: s, conn: conn, peer: peer, done: make(chan struct{})}
+
+	// A new connection from a peer replaces its old session, e.g. after the
+	// peer restarted before our hold timer expired. The old session's routes
+	// are removed before the new one starts.
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	old := s.sessions[addr]
+	s.sessions[addr] = sess
+	s.mu.Unlock()
+	if old != nil {
+		old.conn.Close()
+		<-old.done
+	}
+
+	err := sess.run()
+	conn.Close()
+	s.rib.RemovePeer(PeerKey{Address: addr})
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	s.mu.Lock()
+	if s.sessions[addr] == sess {
+		delete(s.sessions, addr)
+	}
+	s.mu.Unlock()
+	s.setState(addr, func(st *SessionStatus) {
+		st.State = StateIdle
+		if err != nil {
+			st.LastError = err.Error()
+		}
+	})
+	if s.OnStateChange != nil && sess.established {
+		s.OnStateChange(addr, StateIdle, err)
+	}
+	close(sess.done)
+}
+
+// session is one TCP connection with a peer
+type session struct {
+	speaker     *Speaker
+	conn        net.Conn
+	peer        PeerConfig
+	done        chan struct{}
+	established bool
+	updates     uint64
+
+	writeMu sync.Mutex
+}
+
+func (sess *session) write(msg []byte) error {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	sess.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := sess.conn.Write(msg)
+	return err
+}
+
+// notify sends a NOTIFICATION for protocol errors found locally
+func (sess *session) notify(err error) {
+	var pe *Error
+	switch {
+	case errors.As(err, &pe):
+		sess.write(AppendNotification(nil, pe.Code, pe.Subcode, nil))
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		sess.write(AppendNotification(nil, ErrHoldTimerExpired, 0, nil))
+	}
+}
+
+func (sess *session) run() error {
+	s := sess.speaker
+	addr := sess.peer.Address
+	buf := make([]byte, MaxMessageLen)
+
+	local := &Open{
+		AS:          s.cfg.LocalAS,
+		HoldTime:    s.cfg.HoldTime,
+		RouterID:    s.cfg.RouterID,
+		FourOctetAS: true,
+		Families:    []Family{IPv4Unicast, IPv6Unicast},
+	}
+	if s.cfg.AddPath {
+		local.AddPath = map[Family]uint8{IPv4Unicast: AddPathReceive, IPv6Unicast: AddPathReceive}
+	}
+	if err := sess.write(local.Append(nil)); err != nil {
+		return err
+	}
+	s.setState(addr, func(st *SessionStatus) { st.State = StateOpenSent })
+
+	// OpenSent: wait for the peer's OPEN
+	sess.conn.SetReadDeadline(time.Now().Add(openHoldTime))
+	msgType, body, err := ReadMessage(sess.conn, buf, MaxMessageLen)
+	if err != nil {
+		sess.notify(err)
+		return err
+	}
+	if msgType != MsgOpen {
+		err := sess.unexpected(msgType, body)
+		sess.notify(err)
+		return err
+	}
+	remote, err := ParseOpen(body)
+	if err != nil {
+		sess.notify(err)
+		return err
+	}
+	if sess.peer.AS != 0 && remote.AS != sess.peer.AS {
+		err := protoError(ErrOpenMessage, ErrSubBadPeerAS, "peer AS %d, expected %d", remote.AS, sess.peer.AS)
+		sess.notify(err)
+		return err
+	}
+
+	hold := min(s.cfg.HoldTime, remote.HoldTime)
+	opts := DecodeOptions{FourOctetAS: remote.FourOctetAS}
+	var addPath []string
+	if s.cfg.AddPath {
+		if remote.AddPath[IPv4Unicast]&AddPathSend != 0 {
+			opts.AddPathIPv4 = true
+			addPath = append(addPath, IPv4Unicast.String())
+		}
+		if remote.AddPath[IPv6Unicast]&AddPathSend != 0 {
+			opts.AddPathIPv6 = true
+			addPath = append(addPath, IPv6Unicast.String())
+		}
+	}
+	if err := sess.write(AppendKeepalive(nil)); err != nil {
+		return err
+	}
+	s.setState(addr, func(st *SessionStatus) {
+		st.State = StateOpenConfirm
+		st.PeerAS = remote.AS
+		st.RouterID = remote.RouterID
+		st.HoldTime = hold
+		st.FourOctetAS = remote.FourOctetAS
+		st.AddPath = addPath
+		st.LastError = ""
+	})
+
+	holdTimer := time.Duration(hold) * time.Second
+	readDeadline := func() {
+		if hold == 0 {
+			sess.conn.SetReadDeadline(time.Time{})
+		} else {
+			sess.conn.SetReadDeadline(time.Now().Add(holdTimer))
+		}
+	}
+
+	// OpenConfirm: wait for KEEPALIVE
+	readDeadline()
+	msgType, body, err = ReadMessage(sess.conn, buf, MaxMessageLen)
+	if err != nil {
+		sess.notify(err)
+		return err
+	}
+	if msgType != MsgKeepalive {
+		err := sess.unexpected(msgType, body)
+		sess.notify(err)
+		return err
+	}
+
+	sess.established = true
+	s.setState(addr, func(st *SessionStatus) { st.State = StateEstablished })
+	if s.OnStateChange != nil {
+		s.OnStateChange(addr, StateEstablished, nil)
+	}
+
+	if hold != 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go sess.keepalives(holdTimer/3, stop)
+	}
+
+	peerKey := PeerKey{Address: addr}
+	for {
+		readDeadline()
+		msgType, body, err := ReadMessage(sess.conn, buf, MaxMessageLen)
+		if err != nil {
+			sess.notify(err)
+			return err
+		}
+		switch msgType {
+		case MsgUpdate:
+			u, err := ParseUpdate(body, opts)
+			if err != nil {
+				sess.notify(err)
+				return err
+			}
+			if u.Attrs != nil {
+				u.Attrs.SetPeer(remote.AS, s.cfg.LocalAS)
+			}
+			s.rib.Apply(peerKey, u)
+			atomic.AddUint64(&sess.updates, 1)
+		case MsgKeepalive, MsgRouteRefresh:
+		default:
+			err := sess.unexpected(msgType, body)
+			sess.notify(err)
+			return err
+		}
+	}
+}
+
+// unexpected returns the error for a message not valid in the current state
+func (sess *session) unexpected(msgType uint8, body []byte) error {
+	switch msgType {
+	case MsgNotification:
+		if n, err := ParseNotification(body); err == nil {
+			return fmt.Errorf("peer sent notification %d/%d", n.Code, n.Subcode)
+		}
+		return errors.New("peer sent notification")
+	case MsgOpen, MsgUpdate, MsgKeepalive, MsgRouteRefresh:
+		return protoError(ErrFSM, 0, "unexpected message type %d", msgType)
+	}
+	return protoError(ErrMessageHeader, ErrSubBadMessageType, "bad message type %d", msgType)
+}
+
+func (sess *session) keepalives(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	msg := AppendKeepalive(nil)
+	for {
+		select {
+		case <-ticker.C:
+			if sess.write(msg) != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"sflow-enricher/internal/aspath"
+)
+
+const testLocalAS = 4200000000 // needs AS_TRANS in My Autonomous System
+
+var testRouterID = netip.MustParseAddr("192.0.2.1")
+
+// startSpeaker serves a speaker on a loopback port and returns its address
+func startSpeaker(t *testing.T, cfg SpeakerConfig) (*Speaker, *RIB, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.LocalAS, cfg.RouterID = testLocalAS, testRouterID
+	if cfg.Peers == nil {
+		cfg.Peers = []PeerConfig{{Address: netip.MustParseAddr("127.0.0.1")}}
+	}
+	rib := NewRIB()
+	s := NewSpeaker(cfg, rib)
+	go s.Serve(l)
+	t.Cleanup(s.Close)
+	return s, rib, l.Addr().String()
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func sessionState(s *Speaker) SessionStatus {
+	return s.Sessions()[0]
+}
+
+// testPeer is the router side of a session
+type testPeer struct {
+	t    *testing.T
+	conn net.Conn
+	buf  []byte
+}
+
+func dial(t *testing.T, addr string) *testPeer {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testPeer{t: t, conn: conn, buf: make([]byte, MaxMessageLen)}
+}
+
+// establish opens a session with open and returns the speaker's OPEN
+func establish(t *testing.T, s *Speaker, addr string, open *Open) (*testPeer, *Open, []byte) {
+	t.Helper()
+	p := dial(t, addr)
+	msgType, body := p.read()
+	if msgType != MsgOpen {
+		t.Fatalf("speaker sent message type %d, want OPEN", msgType)
+	}
+	raw := append([]byte(nil), body...)
+	local, err := ParseOpen(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.write(open.Append(nil))
+	if msgType, _ := p.read(); msgType != MsgKeepalive {
+		t.Fatalf("speaker sent message type %d, want KEEPALIVE", msgType)
+	}
+	p.write(AppendKeepalive(nil))
+	waitFor(t, "Established", func() bool { return sessionState(s).State == StateEstablished })
+	return p, local, raw
+}
+
+func (p *testPeer) read() (uint8, []byte) {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	msgType, body, err := ReadMessage(p.conn, p.buf, MaxMessageLen)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return msgType, body
+}
+
+func (p *testPeer) write(msg []byte) {
+	p.t.Helper()
+	if _, err := p.conn.Write(msg); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// readNotification skips KEEPALIVEs up to a NOTIFICATION
+func (p *testPeer) readNotification() *Error {
+	p.t.Helper()
+	for {
+		msgType, body := p.read()
+		switch msgType {
+		case MsgKeepalive:
+			continue
+		case MsgNotification:
+			n, err := ParseNotification(body)
+			if err != nil {
+				p.t.Fatal(err)
+			}
+			return n
+		}
+		p.t.Fatalf("speaker sent message type %d, want NOTIFICATION", msgType)
+	}
+}
+
+func (p *testPeer) update(body []byte) {
+	p.t.Helper()
+	p.write(AppendMessage(nil, MsgUpdate, body))
+}
+
+// UPDATE encoding
+
+func attr(flags, code byte, value []byte) []byte {
+	if len(value) > 255 {
+		b := []byte{flags | attrFlagExtendedLength, code}
+		return append(binary.BigEndian.AppendUint16(b, uint16(len(value))), value...)
+	}
+	return append([]byte{flags, code, byte(len(value))}, value...)
+}
+
+func originAttr() []byte { return attr(0x40, attrOrigin, []byte{0}) }
+
+func asPathAttr(code byte, asnLen int, segs ...aspath.Segment) []byte {
+	var v []byte
+	for _, seg := range segs {
+		v = append(v, byte(seg.Type), byte(len(seg.ASNs)))
+		for _, asn := range seg.ASNs {
+			if asnLen == 4 {
+				v = binary.BigEndian.AppendUint32(v, asn)
+			} else {
+				v = binary.BigEndian.AppendUint16(v, uint16(asn))
+			}
+		}
+	}
+	flags := byte(0x40)
+	if code == attrAS4Path {
+		flags = 0xc0
+	}
+	return attr(flags, code, v)
+}
+
+func nextHopAttr(nh string) []byte {
+	a := netip.MustParseAddr(nh).As4()
+	return attr(0x40, attrNextHop, a[:])
+}
+
+func localPrefAttr(lp uint32) []byte {
+	return attr(0x40, attrLocalPref, binary.BigEndian.AppendUint32(nil, lp))
+}
+
+// nlri encodes prefixes, each preceded by pathID if addPath
+func nlri(addPath bool, pathID uint32, prefixes ...string) []byte {
+	var b []byte
+	for _, s := range prefixes {
+		p := netip.MustParsePrefix(s)
+		if addPath {
+			b = binary.BigEndian.AppendUint32(b, pathID)
+		}
+		b = append(b, byte(p.Bits()))
+		b = append(b, p.Addr().AsSlice()[:(p.Bits()+7)/8]...)
+	}
+	return b
+}
+
+func mpReachAttr(afi uint16, nextHop []byte, nlri []byte) []byte {
+	v := binary.BigEndian.AppendUint16(nil, afi)
+	v = append(v, SAFIUnicast, byte(len(nextHop)))
+	v = append(v, nextHop...)
+	v = append(v, 0)
+	return attr(0x80, attrMPReach, append(v, nlri...))
+}
+
+func mpUnreachAttr(afi uint16, nlri []byte) []byte {
+	v := binary.BigEndian.AppendUint16(nil, afi)
+	return attr(0x80, attrMPUnreach, append(append(v, SAFIUnicast), nlri...))
+}
+
+func updateBody(withdrawn []byte, attrs [][]byte, announced []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(withdrawn)))
+	b = append(b, withdrawn...)
+	var a []byte
+	for _, at := range attrs {
+		a = append(a, at...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(a)))
+	return append(append(b, a...), announced...)
+}
+
+func seq(asns ...uint32) aspath.Segment {
+	return aspath.Segment{Type: aspath.Sequence, ASNs: asns}
+}
+
+func lookup(t *testing.T, rib *RIB, addr string) *Route {
+	t.Helper()
+	r, ok := rib.Lookup(netip.MustParseAddr(addr))
+	if !ok {
+		t.Fatalf("no route to %s", addr)
+	}
+	return r
+}
+
+func TestOpenFourOctetAS(t *testing.T) {
+	s, rib, addr := startSpeaker(t, SpeakerConfig{HoldTime: 90})
+	p, local, raw := establish(t, s, addr, &Open{
+		AS: 4200000001, HoldTime: 30, RouterID: netip.MustParseAddr("192.0.2.2"),
+		FourOctetAS: true, Families: []Family{IPv4Unicast},
+	})
+
+	if myAS := binary.BigEndian.Uint16(raw[1:3]); myAS != asTrans {
+		t.Errorf("My Autonomous System = %d, want AS_TRANS", myAS)
+	}
+	if !local.FourOctetAS || local.AS != testLocalAS || local.RouterID != testRouterID {
+		t.Errorf("speaker OPEN %+v", local)
+	}
+	st := sessionState(s)
+	if st.PeerAS != 4200000001 || !st.FourOctetAS || st.HoldTime != 30 || st.RouterID != netip.MustParseAddr("192.0.2.2") {
+		t.Errorf("session %+v", st)
+	}
+
+	// 4-byte AS_PATH; the peer's own AS is not part of the sFlow path
+	p.update(updateBody(nil, [][]byte{
+		originAttr(), asPathAttr(attrASPath, 4, seq(4200000001, 4200000002, 64500)), nextHopAttr("10.0.0.1"),
+	}, nlri(false, 0, "198.51.100.0/24")))
+	waitFor(t, "route", func() bool { return rib.Len() == 1 })
+	r := lookup(t, rib, "198.51.100.7")
+	if !reflect.DeepEqual(r.ASPath, []aspath.Segment{seq(4200000002, 64500)}) ||
+		r.OriginAS != 64500 || r.NeighborAS != 4200000002 || r.NextHop != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("route %+v", *r.Attributes)
+	}
+}
+
+func TestOpenTwoOctetPeer(t *testing.T) {
+	s, rib, addr := startSpeaker(t, SpeakerConfig{})
+	p, _, _ := establish(t, s, addr, &Open{
+		AS: 65001, HoldTime: 90, RouterID: netip.MustParseAddr("192.0.2.2"), Families: []Family{IPv4Unicast},
+	})
+	if st := sessionState(s); st.PeerAS != 65001 || st.FourOctetAS {
+		t.Errorf("session %+v", st)
+	}
+
+	// A 2-byte speaker puts AS_TRANS for 4-byte ASNs in AS_PATH and the
+	// real ones in AS4_PATH (RFC 6793)
+	p.update(updateBody(nil, [][]byte{
+		originAttr(),
+		asPathAttr(attrASPath, 2, seq(65001, asTrans, asTrans), aspath.Segment{Type: aspath.Set, ASNs: []uint32{asTrans, 64501}}),
+		asPathAttr(attrAS4Path, 4, seq(4200000002, 4200000003), aspath.Segment{Type: aspath.Set, ASNs: []uint32{4200000004, 64501}}),
+		nextHopAttr("10.0.0.1"),
+	}, nlri(false, 0, "198.51.100.0/24")))
+	waitFor(t, "route", func() bool { return rib.Len() == 1 })
+	r := lookup(t, rib, "198.51.100.7")
+	want := []aspath.Segment{seq(4200000002, 4200000003), {Type: aspath.Set, ASNs: []uint32{4200000004, 64501}}}
+	if !reflect.DeepEqual(r.ASPath, want) || r.OriginAS != 0 || r.NeighborAS != 4200000002 {
+		t.Errorf("route path %v origin %d neighbor %d, want %v, 0, 4200000002", r.ASPath, r.OriginAS, r.NeighborAS, want)
+	}
+}
+
+func TestOpenBadPeerAS(t *testing.T) {
+	s, _, addr := startSpeaker(t, SpeakerConfig{
+		Peers: []PeerConfig{{Address: netip.MustParseAddr("127.0.0.1"), AS: 65001}},
+	})
+	p := dial(t, addr)
+	p.read()
+	p.write((&Open{AS: 65002, HoldTime: 90, RouterID: netip.MustParseAddr("192.0.2.2")}).Append(nil))
+	if n := p.readNotification(); n.Code != ErrOpenMessage || n.Subcode != ErrSubBadPeerAS {
+		t.Errorf("notification %d/%d, want %d/%d", n.Code, n.Subcode, ErrOpenMessage, ErrSubBadPeerAS)
+	}
+	waitFor(t, "Idle", func() bool { return sessionState(s).State == StateIdle && sessionState(s).LastError != "" })
+}
+
+func TestUnknownPeerRejected(t *testing.T) {
+	_, _, addr := startSpeaker(t, SpeakerConfig{
+		Peers: []PeerConfig{{Address: netip.MustParseAddr("192.0.2.99")}},
+	})
+	p := dial(t, addr)
+	if n := p.readNotification(); n.Code != ErrCease || n.Subcode != ErrSubConnectionRejected {
+		t.Errorf("notification %d/%d, want %d/%d", n.Code, n.Subcode, ErrCease, ErrSubConnectionRejected)
+	}
+}
+
+func TestAddPath(t *testing.T) {
+	s, rib, addr := startSpeaker(t, SpeakerConfig{AddPath: true})
+	p, local, _ := establish(t, s, addr, &Open{
+		AS: 65001, HoldTime: 90, RouterID: netip.MustParseAddr("192.0.2.2"), FourOctetAS: true,
+		Families: []Family{IPv4Unicast, IPv6Unicast},
+		AddPath:  map[Family]uint8{IPv4Unicast: AddPathSend | AddPathReceive},
+	})
+	if local.AddPath[IPv4Unicast] != AddPathReceive || local.AddPath[IPv6Unicast] != AddPathReceive {
+		t.Errorf("speaker offers ADD-PATH %v, want receive for both families", local.AddPath)
+	}
+	if st := sessionState(s); !reflect.DeepEqual(st.AddPath, []string{"ipv4-unicast"}) {
+		t.Errorf("ADD-PATH negotiated for %v, want ipv4-unicast only", st.AddPath)
+	}
+
+	// Two paths to one prefix, told apart by path identifier
+	for _, path := range []struct {
+		id uint32
+		lp uint32
+	}{{1, 100}, {2, 200}} {
+		p.update(updateBody(nil, [][]byte{
+			originAttr(), asPathAttr(attrASPath, 4, seq(65001, 64500+path.id)), nextHopAttr("10.0.0.1"), localPrefAttr(path.lp),
+		}, nlri(true, path.id, "198.51.100.0/24")))
+	}
+	waitFor(t, "two paths", func() bool { return rib.PeerRoutes(PeerKey{Address: netip.MustParseAddr("127.0.0.1")}) == 2 })
+	if r := lookup(t, rib, "198.51.100.7"); r.PathID != 2 || r.OriginAS != 64502 {
+		t.Errorf("best path %d origin %d, want path 2", r.PathID, r.OriginAS)
+	}
+
+	p.update(updateBody(nlri(true, 2, "198.51.100.0/24"), nil, nil))
+	waitFor(t, "withdrawal", func() bool { return rib.PeerRoutes(PeerKey{Address: netip.MustParseAddr("127.0.0.1")}) == 1 })
+	if r := lookup(t, rib, "198.51.100.7"); r.PathID != 1 || r.OriginAS != 64501 {
+		t.Errorf("best path %d origin %d, want path 1", r.PathID, r.OriginAS)
+	}
+
+	// IPv6 was not negotiated: its NLRI carry no path identifier
+	nh := netip.MustParseAddr("2001:db8::1").As16()
+	p.update(updateBody(nil, [][]byte{
+		originAttr(), asPathAttr(attrASPath, 4, seq(65001, 64510)), mpReachAttr(AFIIPv6, nh[:], nlri(false, 0, "2001:db8:1::/48")),
+	}, nil))
+	waitFor(t, "IPv6 route", func() bool { return rib.Len() == 2 })
+	if r := lookup(t, rib, "2001:db8:1::7"); r.PathID != 0 || r.OriginAS != 64510 {
+		t.Errorf("IPv6 route path %d origin %d", r.PathID, r.OriginAS)
+	}
+}
+
+func TestMPReachIPv6(t *testing.T) {
+	s, rib, addr := startSpeaker(t, SpeakerConfig{})
+	p, _, _ := establish(t, s, addr, &Open{
+		AS: 65001, HoldTime: 90, RouterID: netip.MustParseAddr("192.0.2.2"), FourOctetAS: true,
+		Families: []Family{IPv4Unicast, IPv6Unicast},
+	})
+
+	// Global and link-local next hop
+	global, linkLocal := netip.MustParseAddr("2001:db8::1").As16(), netip.MustParseAddr("fe80::1").As16()
+	p.update(updateBody(nil, [][]byte{
+		originAttr(), asPathAttr(attrASPath, 4, seq(65001, 64500)),
+		mpReachAttr(AFIIPv6, append(global[:], linkLocal[:]...), nlri(false, 0, "2001:db8:1::/48", "2001:db8:2::/48", "::/0")),
+	}, nil))
+	waitFor(t, "routes", func() bool { return rib.Len() == 3 })
+	r := lookup(t, rib, "2001:db8:1::7")
+	if r.NextHop != netip.MustParseAddr("2001:db8::1") || r.OriginAS != 64500 {
+		t.Errorf("route next hop %s origin %d", r.NextHop, r.OriginAS)
+	}
+	if bits, _ := rib.PrefixLen(netip.MustParseAddr("2001:db8:3::1")); bits != 0 {
+		t.Errorf("default route prefix length %d", bits)
+	}
+
+	// MP_UNREACH_NLRI alone, without other attributes
+	p.update(updateBody(nil, [][]byte{mpUnreachAttr(AFIIPv6, nlri(false, 0, "2001:db8:1::/48", "::/0"))}, nil))
+	waitFor(t, "withdrawal", func() bool { return rib.Len() == 1 })
+	if _, ok := rib.Lookup(netip.MustParseAddr("2001:db8:1::7")); ok {
+		t.Error("withdrawn route still present")
+	}
+	lookup(t, rib, "2001:db8:2::7")
+
+	// IPv4 over MP_REACH_NLRI
+	nh4 := netip.MustParseAddr("10.0.0.9").As4()
+	p.update(updateBody(nil, [][]byte{
+		originAttr(), asPathAttr(attrASPath, 4, seq(65001)), mpReachAttr(AFIIPv4, nh4[:], nlri(false, 0, "203.0.113.0/24")),
+	}, nil))
+	waitFor(t, "IPv4 route", func() bool { return rib.Len() == 2 })
+	if r := lookup(t, rib, "203.0.113.1"); r.NextHop != netip.MustParseAddr("10.0.0.9") || r.OriginAS != 65001 {
+		t.Errorf("route next hop %s origin %d", r.NextHop, r.OriginAS)
+	}
+}
+
+func TestHoldTimerExpiry(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the 3 second hold timer")
+	}
+	down := make(chan error, 1)
+	s, rib, addr := startSpeaker(t, SpeakerConfig{HoldTime: 3})
+	s.OnStateChange = func(peer netip.Addr, state string, err error) {
+		if state == StateIdle {
+			down <- err
+		}
+	}
+	p, _, _ := establish(t, s, addr, &Open{
+		AS: 65001, HoldTime: 3, RouterID: netip.MustParseAddr("192.0.2.2"), FourOctetAS: true,
+	})
+	p.update(updateBody(nil, [][]byte{
+		originAttr(), asPathAttr(attrASPath, 4, seq(65001)), nextHopAttr("10.0.0.1"),
+	}, nlri(false, 0, "198.51.100.0/24")))
+	waitFor(t, "route", func() bool { return rib.Len() == 1 })
+
+	// The peer goes silent: the speaker keeps sending KEEPALIVEs, then gives up
+	start := time.Now()
+	if n := p.readNotification(); n.Code != ErrHoldTimerExpired {
+		t.Errorf("notification %d/%d, want hold timer expired", n.Code, n.Subcode)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("hold timer expired after %s", elapsed)
+	}
+	select {
+	case err := <-down:
+		if err == nil {
+			t.Error("session went down without error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state change to Idle")
+	}
+	if rib.Len() != 0 {
+		t.Errorf("%d routes left after the session went down", rib.Len())
+	}
+}
+
+func TestSessionReplacement(t *testing.T) {
+	s, rib, addr := startSpeaker(t, SpeakerConfig{})
+	open := &Open{AS: 65001, HoldTime: 90, RouterID: netip.MustParseAddr("192.0.2.2"), FourOctetAS: true}
+	old, _, _ := establish(t, s, addr, open)
+	old.update(updateBody(nil, [][]byte{
+		originAttr(), asPathAttr(attrASPath, 4, seq(65001)), nextHopAttr("10.0.0.1"),
+	}, nlri(false, 0, "198.51.100.0/24", "203.0.113.0/24")))
+	waitFor(t, "routes", func() bool { return rib.Len() == 2 })
+
+	// The peer restarted and connects again before the hold timer expired
+	p, _, _ := establish(t, s, addr, open)
+	if rib.Len() != 0 {
+		t.Errorf("%d routes of the replaced session left", rib.Len())
+	}
+	old.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ReadMessage(old.conn, old.buf, MaxMessageLen); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("replaced session still open: %v", err)
+	}
+
+	p.update(updateBody(nil, [][]byte{
+		originAttr(), asPathAttr(attrASPath, 4, seq(65001, 64500)), nextHopAttr("10.0.0.2"),
+	}, nlri(false, 0, "198.51.100.0/24")))
+	waitFor(t, "route", func() bool { return rib.Len() == 1 })
+	if r := lookup(t, rib, "198.51.100.7"); r.NextHop != netip.MustParseAddr("10.0.0.2") {
+		t.Errorf("route next hop %s", r.NextHop)
+	}
+
+	p.conn.Close()
+	waitFor(t, "routes removed", func() bool { return rib.Len() == 0 })
+	waitFor(t, "Idle", func() bool { return sessionState(s).State == StateIdle })
+}
@@ -0,0 +1,386 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"sflow-enricher/internal/aspath"
+)
+
+// Path attribute type codes
+const (
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrMED         = 4
+	attrLocalPref   = 5
+	attrCommunities = 8
+	attrMPReach     = 14
+	attrMPUnreach   = 15
+	attrAS4Path     = 17
+)
+
+const attrFlagExtendedLength = 0x10
+
+// Attributes are the path attributes of an UPDATE, shared by all its prefixes.
+// They are not modified once the UPDATE is decoded.
+type Attributes struct {
+	Origin       uint8 // 0 IGP, 1 EGP, 2 INCOMPLETE
+	ASPath       []aspath.Segment
+	NextHop      netip.Addr
+	MED          uint32
+	LocalPref    uint32
+	HasLocalPref bool
+	Communities  []uint32
+	// Set by the receiver of the route, see SetPeer and SetLearnedFrom
+	OriginAS   uint32 // last AS of the path
+	NeighborAS uint32 // AS the traffic leaves to: the eBGP peer or first AS of the path
+}
+
+// NLRI is an announced or withdrawn prefix, with its ADD-PATH identifier
+type NLRI struct {
+	Prefix netip.Prefix
+	PathID uint32
+}
+
+// Update is a decoded UPDATE message
+type Update struct {
+	Withdrawn []NLRI
+	Announced []NLRI
+	Attrs     *Attributes // nil if the UPDATE only withdraws
+}
+
+// EndOfRIB reports whether the UPDATE is an End-of-RIB marker (RFC 4724)
+func (u *Update) EndOfRIB() bool {
+	return len(u.Withdrawn) == 0 && len(u.Announced) == 0
+}
+
+// DecodeOptions are the session settings UPDATE decoding depends on
+type DecodeOptions struct {
+	FourOctetAS bool // AS_PATH carries 4-byte ASNs
+	AddPathIPv4 bool // IPv4 unicast NLRI carry path identifiers
+	AddPathIPv6 bool // IPv6 unicast NLRI carry path identifiers
+}
+
+func (o DecodeOptions) addPath(afi uint16) bool {
+	if afi == AFIIPv6 {
+		return o.AddPathIPv6
+	}
+	return o.AddPathIPv4
+}
+
+func malformed(format string, args ...interface{}) *Error {
+	return protoError(ErrUpdateMessage, ErrSubMalformedAttrList, format, args...)
+}
+
+// ParseUpdate decodes the body of an UPDATE message. Only IPv4 and IPv6
+// unicast routes are returned; other families in MP_REACH_NLRI and
+// MP_UNREACH_NLRI are ignored.
+func ParseUpdate(data []byte, opts DecodeOptions) (*Update, error) {
+	u := &Update{}
+	if len(data) < 2 {
+		return nil, malformed("short UPDATE message")
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+withdrawnLen+2 {
+		return nil, malformed("bad withdrawn routes length")
+	}
+	var err error
+	u.Withdrawn, err = appendPrefixes(nil, data[2:2+withdrawnLen], AFIIPv4, opts.AddPathIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := 2 + withdrawnLen
+	attrsLen := int(binary.BigEndian.Uint16(data[pos:]))
+	pos += 2
+	if len(data) < pos+attrsLen {
+		return nil, malformed("bad path attributes length")
+	}
+	attrData, nlriData := data[pos:pos+attrsLen], data[pos+attrsLen:]
+
+	if attrsLen > 0 {
+		if err := u.parseAttributes(attrData, opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(nlriData) > 0 {
+		if u.Attrs == nil {
+			return nil, malformed("NLRI without path attributes")
+		}
+		u.Announced, err = appendPrefixes(u.Announced, nlriData, AFIIPv4, opts.AddPathIPv4)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(u.Announced) == 0 {
+		u.Attrs = nil
+	}
+	return u, nil
+}
+
+func (u *Update) parseAttributes(data []byte, opts DecodeOptions) error {
+	attrs := &Attributes{}
+	var as4Path []aspath.Segment
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return malformed("truncated path attribute")
+		}
+		flags, code := data[0], data[1]
+		hdr, length := 3, int(data[2])
+		if flags&attrFlagExtendedLength != 0 {
+			if len(data) < 4 {
+				return malformed("truncated path attribute")
+			}
+			hdr, length = 4, int(binary.BigEndian.Uint16(data[2:4]))
+		}
+		if len(data) < hdr+length {
+			return malformed("path attribute %d overruns the UPDATE", code)
+		}
+		value := data[hdr : hdr+length]
+		data = data[hdr+length:]
+
+		var err error
+		switch code {
+		case attrOrigin:
+			if length != 1 {
+				return malformed("bad ORIGIN length")
+			}
+			attrs.Origin = value[0]
+		case attrASPath:
+			asnLen := 2
+			if opts.FourOctetAS {
+				asnLen = 4
+			}
+			attrs.ASPath, err = parseASPath(value, asnLen)
+		case attrAS4Path:
+			as4Path, err = parseASPath(value, 4)
+		case attrNextHop:
+			if length != 4 {
+				return malformed("bad NEXT_HOP length")
+			}
+			attrs.NextHop = netip.AddrFrom4([4]byte(value))
+		case attrMED:
+			if length != 4 {
+				return malformed("bad MULTI_EXIT_DISC length")
+			}
+			attrs.MED = binary.BigEndian.Uint32(value)
+		case attrLocalPref:
+			if length != 4 {
+				return malformed("bad LOCAL_PREF length")
+			}
+			attrs.LocalPref, attrs.HasLocalPref = binary.BigEndian.Uint32(value), true
+		case attrCommunities:
+			if length%4 != 0 {
+				return malformed("bad COMMUNITIES length")
+			}
+			for i := 0; i < length; i += 4 {
+				attrs.Communities = append(attrs.Communities, binary.BigEndian.Uint32(value[i:]))
+			}
+		case attrMPReach:
+			err = u.parseMPReach(value, attrs, opts)
+		case attrMPUnreach:
+			err = u.parseMPUnreach(value, opts)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !opts.FourOctetAS && as4Path != nil {
+		attrs.ASPath = mergeAS4Path(attrs.ASPath, as4Path)
+	}
+	u.Attrs = attrs
+	return nil
+}
+
+// parseMPReach decodes MP_REACH_NLRI (RFC 4760)
+func (u *Update) parseMPReach(data []byte, attrs *Attributes, opts DecodeOptions) error {
+	if len(data) < 5 {
+		return malformed("short MP_REACH_NLRI")
+	}
+	afi, safi := binary.BigEndian.Uint16(data), data[2]
+	nhLen := int(data[3])
+	if len(data) < 4+nhLen+1 {
+		return malformed("bad MP_REACH_NLRI next hop length")
+	}
+	if safi != SAFIUnicast || afi != AFIIPv4 && afi != AFIIPv6 {
+		return nil
+	}
+	nh := data[4 : 4+nhLen]
+	switch nhLen {
+	case 4:
+		attrs.NextHop = netip.AddrFrom4([4]byte(nh))
+	case 16, 32: // global, optionally followed by link-local
+		attrs.NextHop = netip.AddrFrom16([16]byte(nh[:16])).Unmap()
+	}
+	var err error
+	u.Announced, err = appendPrefixes(u.Announced, data[4+nhLen+1:], afi, opts.addPath(afi))
+	return err
+}
+
+// parseMPUnreach decodes MP_UNREACH_NLRI (RFC 4760)
+func (u *Update) parseMPUnreach(data []byte, opts DecodeOptions) error {
+	if len(data) < 3 {
+		return malformed("short MP_UNREACH_NLRI")
+	}
+	afi, safi := binary.BigEndian.Uint16(data), data[2]
+	if safi != SAFIUnicast || afi != AFIIPv4 && afi != AFIIPv6 {
+		return nil
+	}
+	var err error
+	u.Withdrawn, err = appendPrefixes(u.Withdrawn, data[3:], afi, opts.addPath(afi))
+	return err
+}
+
+// appendPrefixes decodes a list of prefixes in NLRI encoding
+func appendPrefixes(list []NLRI, data []byte, afi uint16, addPath bool) ([]NLRI, error) {
+	maxBits := 32
+	if afi == AFIIPv6 {
+		maxBits = 128
+	}
+	for len(data) > 0 {
+		var n NLRI
+		if addPath {
+			if len(data) < 4 {
+				return nil, malformed("truncated path identifier")
+			}
+			n.PathID = binary.BigEndian.Uint32(data)
+			data = data[4:]
+		}
+		if len(data) < 1 {
+			return nil, malformed("truncated prefix")
+		}
+		bits := int(data[0])
+		size := (bits + 7) / 8
+		if bits > maxBits || len(data) < 1+size {
+			return nil, malformed("bad prefix length %d", bits)
+		}
+		var addr [16]byte
+		copy(addr[:], data[1:1+size])
+		if afi == AFIIPv6 {
+			n.Prefix = netip.PrefixFrom(netip.AddrFrom16(addr), bits)
+		} else {
+			n.Prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte(addr[:4])), bits)
+		}
+		n.Prefix = n.Prefix.Masked()
+		list = append(list, n)
+		data = data[1+size:]
+	}
+	return list, nil
+}
+
+// parseASPath decodes AS_PATH or AS4_PATH segments with 2- or 4-byte ASNs
+func parseASPath(data []byte, asnLen int) ([]aspath.Segment, error) {
+	path := []aspath.Segment{}
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, malformed("truncated AS_PATH segment")
+		}
+		segType, count := uint32(data[0]), int(data[1])
+		if len(data) < 2+count*asnLen {
+			return nil, malformed("AS_PATH segment overruns the attribute")
+		}
+		asns := make([]uint32, count)
+		for i := range asns {
+			if asnLen == 4 {
+				asns[i] = binary.BigEndian.Uint32(data[2+4*i:])
+			} else {
+				asns[i] = uint32(binary.BigEndian.Uint16(data[2+2*i:]))
+			}
+		}
+		path = append(path, aspath.Segment{Type: segType, ASNs: asns})
+		data = data[2+count*asnLen:]
+	}
+	return path, nil
+}
+
+// pathLen counts an AS path the way route selection does: one per AS of a
+// sequence, one per AS_SET
+func pathLen(path []aspath.Segment) int {
+	n := 0
+	for _, seg := range path {
+		if seg.Type == aspath.Set {
+			n++
+		} else {
+			n += len(seg.ASNs)
+		}
+	}
+	return n
+}
+
+// mergeAS4Path rebuilds the 4-byte AS path from AS_PATH and AS4_PATH sent by
+// a 2-byte speaker (RFC 6793 section 4.2.3): the leading ASes of AS_PATH that
+// AS4_PATH lacks, then AS4_PATH
+func mergeAS4Path(asPath, as4Path []aspath.Segment) []aspath.Segment {
+	keep := pathLen(asPath) - pathLen(as4Path)
+	if keep < 0 {
+		return asPath
+	}
+	var merged []aspath.Segment
+	for _, seg := range asPath {
+		if keep == 0 {
+			break
+		}
+		if seg.Type == aspath.Set {
+			merged = append(merged, seg)
+			keep--
+			continue
+		}
+		n := min(keep, len(seg.ASNs))
+		merged = append(merged, aspath.Segment{Type: seg.Type, ASNs: seg.ASNs[:n]})
+		keep -= n
+	}
+	return append(merged, as4Path...)
+}
+
+// SetPeer derives OriginAS and NeighborAS for a route received from a peer in
+// peerAS, by a receiver in localAS. A peer in another AS prepends its own AS,
+// which sFlow paths, as seen by that peer, leave out: it is removed. An empty
+// path means the route originates in the peer's AS.
+func (a *Attributes) SetPeer(peerAS, localAS uint32) {
+	if peerAS != localAS && len(a.ASPath) > 0 {
+		first := a.ASPath[0]
+		if first.Type == aspath.Sequence && len(first.ASNs) > 0 && first.ASNs[0] == peerAS {
+			path := a.ASPath
+			if len(first.ASNs) == 1 {
+				path = path[1:]
+			} else {
+				path = append([]aspath.Segment{{Type: first.Type, ASNs: first.ASNs[1:]}}, path[1:]...)
+			}
+			a.ASPath = path
+		}
+	}
+	a.setPathEnds(peerAS)
+}
+
+// SetLearnedFrom derives OriginAS and NeighborAS for a route a router in
+// localAS learned from a peer in peerAS, with the path as that router sees it
+// (BMP Adj-RIB-In). For an eBGP peer the neighbor AS is the peer's.
+func (a *Attributes) SetLearnedFrom(peerAS, localAS uint32) {
+	a.setPathEnds(peerAS)
+	if peerAS != localAS {
+		a.NeighborAS = peerAS
+	}
+}
+
+// setPathEnds sets NeighborAS to the first AS of the path and OriginAS to the
+// last; both are fallbackAS if the path is empty
+func (a *Attributes) setPathEnds(fallbackAS uint32) {
+	a.OriginAS, a.NeighborAS = fallbackAS, fallbackAS
+	if len(a.ASPath) == 0 {
+		return
+	}
+	if first := a.ASPath[0]; first.Type == aspath.Sequence && len(first.ASNs) > 0 {
+		a.NeighborAS = first.ASNs[0]
+	}
+	last := a.ASPath[len(a.ASPath)-1]
+	switch {
+	case last.Type == aspath.Sequence && len(last.ASNs) > 0:
+		a.OriginAS = last.ASNs[len(last.ASNs)-1]
+	case last.Type == aspath.Set && len(last.ASNs) == 1:
+		a.OriginAS = last.ASNs[0]
+	default:
+		a.OriginAS = 0 // ambiguous origin
+	}
+}
@@ -0,0 +1,433 @@
+// Package bmp implements a BGP Monitoring Protocol (RFC 7854) collector:
+// message decoding and a listener that accepts connections from monitored
+// routers and keeps the Adj-RIB-In of each of their peers in a bgp.RIB.
+package bmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"sflow-enricher/internal/bgp"
+)
+
+// Version is the only BMP version supported
+const Version = 3
+
+// Message types
+const (
+	MsgRouteMonitoring = 0
+	MsgStatistics      = 1
+	MsgPeerDown        = 2
+	MsgPeerUp          = 3
+	MsgInitiation      = 4
+	MsgTermination     = 5
+	MsgRouteMirroring  = 6
+)
+
+// Message sizes
+const (
+	CommonHeaderLen = 6
+	PeerHeaderLen   = 42
+	// MaxMessageLen bounds a message; a Peer Up carrying two extended (RFC
+	// 8654) OPEN messages stays well below it
+	MaxMessageLen = 1 << 20
+	// maxBGPMessageLen allows extended BGP messages in Route Monitoring
+	maxBGPMessageLen = 65535
+)
+
+// Peer types
+const (
+	PeerTypeGlobal = 0
+	PeerTypeRD     = 1 // L3VPN instance, identified by the distinguisher
+	PeerTypeLocal  = 2
+	PeerTypeLocRIB = 3 // RFC 9069
+)
+
+// Per-peer header flags
+const (
+	FlagIPv6       = 0x80 // V: peer address is IPv6
+	FlagPostPolicy = 0x40 // L: routes are post-policy Adj-RIB-In
+	FlagTwoOctetAS = 0x20 // A: AS_PATH uses 2-byte ASNs
+	FlagAdjRIBOut  = 0x10 // O: routes are Adj-RIB-Out (RFC 8671)
+)
+
+// Information TLV types, Peer Down reasons and per-AFI/SAFI statistics types
+const (
+	tlvString       = 0
+	tlvSysDescr     = 1
+	tlvSysName      = 2
+	tlvTermReason   = 1
+	peerDownLocal   = 1
+	peerDownFSM     = 2
+	peerDownRemote  = 3
+	peerDownNoData  = 4
+	peerDownDeconf  = 5
+	peerDownLocRIB  = 6
+	statPerAFIFirst = 9
+	statPerAFILast  = 10
+)
+
+// Header is the per-peer header of Route Monitoring, Statistics, Peer Up and
+// Peer Down messages
+type Header struct {
+	PeerType      uint8
+	Flags         uint8
+	Distinguisher uint64
+	Address       netip.Addr
+	AS            uint32
+	BGPID         netip.Addr
+	Timestamp     time.Time // zero if the router did not set it
+}
+
+// PostPolicy reports whether the message carries post-policy routes
+func (h *Header) PostPolicy() bool { return h.Flags&FlagPostPolicy != 0 }
+
+// AdjRIBOut reports whether the message carries routes sent to the peer
+func (h *Header) AdjRIBOut() bool { return h.Flags&FlagAdjRIBOut != 0 }
+
+// FourOctetAS reports whether AS_PATH attributes carry 4-byte ASNs
+func (h *Header) FourOctetAS() bool { return h.Flags&FlagTwoOctetAS == 0 }
+
+// ParseHeader decodes the per-peer header at the start of data
+func ParseHeader(data []byte) (Header, error) {
+	if len(data) < PeerHeaderLen {
+		return Header{}, errors.New("short per-peer header")
+	}
+	h := Header{
+		PeerType:      data[0],
+		Flags:         data[1],
+		Distinguisher: binary.BigEndian.Uint64(data[2:10]),
+		AS:            binary.BigEndian.Uint32(data[26:30]),
+		BGPID:         netip.AddrFrom4([4]byte(data[30:34])),
+	}
+	h.Address = parseAddress(data[10:26], h.Flags&FlagIPv6 != 0)
+	if sec, usec := binary.BigEndian.Uint32(data[34:38]), binary.BigEndian.Uint32(data[38:42]); sec != 0 {
+		h.Timestamp = time.Unix(int64(sec), int64(usec)*1000)
+	}
+	return h, nil
+}
+
+// parseAddress decodes a 16-byte address field, IPv4 in the last 4 bytes
+func parseAddress(data []byte, ipv6 bool) netip.Addr {
+	if ipv6 {
+		return netip.AddrFrom16([16]byte(data))
+	}
+	return netip.AddrFrom4([4]byte(data[12:16]))
+}
+
+// FormatDistinguisher formats a route distinguisher (RFC 4364) as
+// "admin:assigned"
+func FormatDistinguisher(rd uint64) string {
+	value := rd & 0xffffffffffff
+	switch rd >> 48 {
+	case 0:
+		return fmt.Sprintf("%d:%d", value>>32, value&0xffffffff)
+	case 1:
+		ip := netip.AddrFrom4([4]byte{byte(value >> 40), byte(value >> 32), byte(value >> 24), byte(value >> 16)})
+		return fmt.Sprintf("%s:%d", ip, value&0xffff)
+	case 2:
+		return fmt.Sprintf("%d:%d", value>>16, value&0xffff)
+	}
+	return fmt.Sprintf("%d:%d", rd>>48, value)
+}
+
+// PeerTypeName returns the name of a peer type as shown in status output
+func PeerTypeName(t uint8) string {
+	switch t {
+	case PeerTypeGlobal:
+		return "global"
+	case PeerTypeRD:
+		return "rd"
+	case PeerTypeLocal:
+		return "local"
+	case PeerTypeLocRIB:
+		return "loc-rib"
+	}
+	return fmt.Sprintf("type%d", t)
+}
+
+// Reader reads BMP messages from a router connection
+type Reader struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewReader returns a reader of the messages in r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, buf: make([]byte, 4096)}
+}
+
+// Next returns the type and body (after the common header) of the next
+// message. The body is valid until the next call.
+func (r *Reader) Next() (uint8, []byte, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:CommonHeaderLen]); err != nil {
+		return 0, nil, err
+	}
+	if r.buf[0] != Version {
+		return 0, nil, fmt.Errorf("unsupported BMP version %d", r.buf[0])
+	}
+	length := int(binary.BigEndian.Uint32(r.buf[1:5]))
+	msgType := r.buf[5]
+	if length < CommonHeaderLen || length > MaxMessageLen {
+		return 0, nil, fmt.Errorf("bad BMP message length %d", length)
+	}
+	if length > len(r.buf) {
+		r.buf = append(r.buf[:CommonHeaderLen], make([]byte, length-CommonHeaderLen)...)
+	}
+	body := r.buf[CommonHeaderLen:length]
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return 0, nil, err
+	}
+	return msgType, body, nil
+}
+
+// ParseRouteMonitoring decodes the BGP UPDATE that follows the per-peer header
+// of a Route Monitoring message
+func ParseRouteMonitoring(data []byte, opts bgp.DecodeOptions) (*bgp.Update, error) {
+	msgType, length, err := bgp.ParseHeader(data, min(len(data), maxBGPMessageLen))
+	if err != nil {
+		return nil, err
+	}
+	if msgType != bgp.MsgUpdate {
+		return nil, fmt.Errorf("route monitoring carries BGP message type %d", msgType)
+	}
+	return bgp.ParseUpdate(data[bgp.HeaderLen:length], opts)
+}
+
+// PeerUp is the body of a Peer Up Notification
+type PeerUp struct {
+	LocalAddress netip.Addr
+	LocalPort    uint16
+	RemotePort   uint16
+	Sent         *bgp.Open // OPEN sent by the monitored router
+	Received     *bgp.Open // OPEN received from the peer
+}
+
+// ParsePeerUp decodes the body of a Peer Up Notification after the per-peer
+// header; ipv6 is the V flag of that header
+func ParsePeerUp(data []byte, ipv6 bool) (*PeerUp, error) {
+	if len(data) < 20 {
+		return nil, errors.New("short peer up notification")
+	}
+	p := &PeerUp{
+		LocalAddress: parseAddress(data[:16], ipv6),
+		LocalPort:    binary.BigEndian.Uint16(data[16:18]),
+		RemotePort:   binary.BigEndian.Uint16(data[18:20]),
+	}
+	data = data[20:]
+	var err error
+	if p.Sent, data, err = parseOpen(data); err != nil {
+		return nil, fmt.Errorf("sent OPEN: %w", err)
+	}
+	if p.Received, _, err = parseOpen(data); err != nil {
+		return nil, fmt.Errorf("received OPEN: %w", err)
+	}
+	return p, nil
+}
+
+// parseOpen decodes the OPEN message at the start of data and returns the rest
+func parseOpen(data []byte) (*bgp.Open, []byte, error) {
+	msgType, length, err := bgp.ParseHeader(data, min(len(data), maxBGPMessageLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgType != bgp.MsgOpen {
+		return nil, nil, fmt.Errorf("BGP message type %d", msgType)
+	}
+	open, err := bgp.ParseOpen(data[bgp.HeaderLen:length])
+	if err != nil {
+		return nil, nil, err
+	}
+	return open, data[length:], nil
+}
+
+// DecodeOptions returns how the peer's routes are encoded: 4-byte ASNs unless
+// the A flag is set, and ADD-PATH for families the peer sends several paths of
+// and the router accepts them
+func (p *PeerUp) DecodeOptions(h *Header) bgp.DecodeOptions {
+	addPath := func(f bgp.Family) bool {
+		return p.Received.AddPath[f]&bgp.AddPathSend != 0 && p.Sent.AddPath[f]&bgp.AddPathReceive != 0
+	}
+	return bgp.DecodeOptions{
+		FourOctetAS: h.FourOctetAS(),
+		AddPathIPv4: addPath(bgp.IPv4Unicast),
+		AddPathIPv6: addPath(bgp.IPv6Unicast),
+	}
+}
+
+// ParsePeerDown decodes the body of a Peer Down Notification after the
+// per-peer header and returns the reason as text
+func ParsePeerDown(data []byte) (string, error) {
+	if len(data) < 1 {
+		return "", errors.New("short peer down notification")
+	}
+	reason, data := data[0], data[1:]
+	switch reason {
+	case peerDownLocal, peerDownRemote:
+		side := "local"
+		if reason == peerDownRemote {
+			side = "remote"
+		}
+		if len(data) >= bgp.HeaderLen+2 && data[18] == bgp.MsgNotification {
+			return fmt.Sprintf("%s notification %d/%d", side, data[19], data[20]), nil
+		}
+		return side + " notification", nil
+	case peerDownFSM:
+		if len(data) >= 2 {
+			return fmt.Sprintf("local close, FSM event %d", binary.BigEndian.Uint16(data)), nil
+		}
+		return "local close", nil
+	case peerDownNoData:
+		return "remote close", nil
+	case peerDownDeconf:
+		return "peer de-configured", nil
+	case peerDownLocRIB:
+		return "local system closed", nil
+	}
+	return fmt.Sprintf("reason %d", reason), nil
+}
+
+// statNames are the names of the RFC 7854 statistics types, by type
+var statNames = []string{
+	"rejected_prefixes",
+	"duplicate_prefix_advertisements",
+	"duplicate_withdraws",
+	"cluster_list_loops",
+	"as_path_loops",
+	"originator_id_loops",
+	"as_confed_loops",
+	"adj_rib_in_routes",
+	"loc_rib_routes",
+	"adj_rib_in_routes",
+	"loc_rib_routes",
+	"updates_treated_as_withdraw",
+	"prefixes_treated_as_withdraw",
+	"duplicate_update_messages",
+}
+
+// Stat is one counter or gauge of a Statistics Report
+type Stat struct {
+	Type   uint16
+	Family bgp.Family // per-AFI/SAFI statistics (types 9 and 10) only
+	Value  uint64
+}
+
+// Name returns the statistic's name, with the address family for per-AFI/SAFI
+// statistics, e.g. "adj_rib_in_routes_ipv6_unicast"
+func (s Stat) Name() string {
+	name := fmt.Sprintf("type%d", s.Type)
+	if int(s.Type) < len(statNames) {
+		name = statNames[s.Type]
+	}
+	if s.Type < statPerAFIFirst || s.Type > statPerAFILast {
+		return name
+	}
+	switch s.Family {
+	case bgp.IPv4Unicast:
+		return name + "_ipv4_unicast"
+	case bgp.IPv6Unicast:
+		return name + "_ipv6_unicast"
+	}
+	return fmt.Sprintf("%s_afi%d_safi%d", name, s.Family.AFI, s.Family.SAFI)
+}
+
+// ParseStats decodes the body of a Statistics Report after the per-peer header
+func ParseStats(data []byte) ([]Stat, error) {
+	if len(data) < 4 {
+		return nil, errors.New("short statistics report")
+	}
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	stats := make([]Stat, 0, min(count, 32))
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("truncated statistics report")
+		}
+		stat := Stat{Type: binary.BigEndian.Uint16(data)}
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			return nil, errors.New("truncated statistic")
+		}
+		value := data[4 : 4+length]
+		data = data[4+length:]
+		if stat.Type >= statPerAFIFirst && stat.Type <= statPerAFILast {
+			if length < 3 {
+				continue
+			}
+			stat.Family = bgp.Family{AFI: binary.BigEndian.Uint16(value), SAFI: value[2]}
+			value = value[3:]
+		}
+		switch len(value) {
+		case 4:
+			stat.Value = uint64(binary.BigEndian.Uint32(value))
+		case 8:
+			stat.Value = binary.BigEndian.Uint64(value)
+		default:
+			continue
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// Information is the router description sent in an Initiation message
+type Information struct {
+	SysName  string
+	SysDescr string
+}
+
+// ParseInitiation decodes the information TLVs of an Initiation message
+func ParseInitiation(data []byte) Information {
+	var info Information
+	for len(data) >= 4 {
+		tlvType := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			break
+		}
+		switch tlvType {
+		case tlvSysName:
+			info.SysName = string(data[4 : 4+length])
+		case tlvSysDescr:
+			info.SysDescr = string(data[4 : 4+length])
+		}
+		data = data[4+length:]
+	}
+	return info
+}
+
+// ParseTermination returns the reason of a Termination message as text
+func ParseTermination(data []byte) string {
+	var reason string
+	for len(data) >= 4 {
+		tlvType := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			break
+		}
+		value := data[4 : 4+length]
+		switch {
+		case tlvType == tlvString:
+			reason = string(value)
+		case tlvType == tlvTermReason && length == 2 && reason == "":
+			switch binary.BigEndian.Uint16(value) {
+			case 0:
+				reason = "administratively closed"
+			case 1:
+				reason = "unspecified"
+			case 2:
+				reason = "out of resources"
+			case 3:
+				reason = "redundant connection"
+			case 4:
+				reason = "permanently administratively closed"
+			}
+		}
+		data = data[4+length:]
+	}
+	return reason
+}
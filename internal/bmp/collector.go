@@ -0,0 +1,434 @@
+package bmp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"sflow-enricher/internal/bgp"
+)
+
+// Peer states
+const (
+	PeerUpState   = "up"
+	PeerDownState = "down"
+)
+
+// Config configures a BMP collector
+type Config struct {
+	PostPolicy bool         // use post-policy instead of pre-policy Adj-RIB-In routes
+	Routers    []netip.Addr // routers allowed to connect, empty = any
+}
+
+// RouterStatus describes a connected monitored router
+type RouterStatus struct {
+	Address   netip.Addr
+	SysName   string
+	SysDescr  string
+	Since     time.Time
+	Messages  uint64
+	Errors    uint64 // messages that could not be decoded
+	LastError string
+	Peers     int
+}
+
+// PeerStatus describes a peer of a monitored router
+type PeerStatus struct {
+	Router          netip.Addr
+	RouterName      string
+	Peer            netip.Addr
+	PeerType        string
+	Distinguisher   uint64
+	PeerAS          uint32
+	LocalAS         uint32
+	BGPID           netip.Addr
+	State           string
+	Since           time.Time // time of the last Peer Up or Peer Down
+	DownReason      string
+	FourOctetAS     bool
+	AddPath         []string // families the peer sends several paths of
+	RouteMonitoring uint64   // Route Monitoring messages used
+	Skipped         uint64   // Route Monitoring messages of the other policy, Adj-RIB-Out or a non-global instance
+	Routes          int
+	Stats           map[string]uint64 // last Statistics Report values by name
+}
+
+// Collector accepts BMP connections from monitored routers and keeps the
+// routes of their peers in a RIB. Routes of a peer are removed when the router
+// reports it down or the router disconnects.
+type Collector struct {
+	// OnRouterChange, if set, is called when a router connects (up) or
+	// disconnects (down, with the error that ended the connection)
+	OnRouterChange func(router netip.Addr, up bool, err error)
+
+	cfg Config
+	rib *bgp.RIB
+
+	mu       sync.Mutex
+	listener net.Listener
+	routers  map[netip.Addr]*router
+	closed   bool
+}
+
+// router is the connection of a monitored router and the state of its peers
+type router struct {
+	addr     netip.Addr
+	conn     net.Conn
+	done     chan struct{}
+	since    time.Time
+	info     Information
+	messages uint64
+	errors   uint64
+	lastErr  string
+	peers    map[bgp.PeerKey]*peer
+}
+
+type peer struct {
+	header          Header
+	localAS         uint32
+	opts            bgp.DecodeOptions
+	up              bool
+	since           time.Time
+	downReason      string
+	routeMonitoring uint64
+	skipped         uint64
+	stats           map[string]uint64
+}
+
+// NewCollector returns a collector that stores routes in rib
+func NewCollector(cfg Config, rib *bgp.RIB) *Collector {
+	return &Collector{cfg: cfg, rib: rib, routers: make(map[netip.Addr]*router)}
+}
+
+// Serve accepts router connections on l until Close is called
+func (c *Collector) Serve(l net.Listener) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	c.listener = l
+	c.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go c.handle(conn)
+	}
+}
+
+// Close stops accepting connections and closes the connected routers
+func (c *Collector) Close() {
+	c.mu.Lock()
+	c.closed = true
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	for _, r := range c.routers {
+		r.conn.Close()
+	}
+	c.mu.Unlock()
+}
+
+func (c *Collector) allowed(addr netip.Addr) bool {
+	if len(c.cfg.Routers) == 0 {
+		return true
+	}
+	for _, r := range c.cfg.Routers {
+		if r == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Collector) handle(conn net.Conn) {
+	remote, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	addr := remote.Addr().Unmap()
+	if !c.allowed(addr) {
+		conn.Close()
+		return
+	}
+
+	r := &router{
+		addr:  addr,
+		conn:  conn,
+		done:  make(chan struct{}),
+		since: time.Now(),
+		peers: make(map[bgp.PeerKey]*peer),
+	}
+
+	// A new connection from a router replaces the old one, whose routes are
+	// removed first
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return
+	}
+	old := c.routers[addr]
+	c.routers[addr] = r
+	c.mu.Unlock()
+	if old != nil {
+		old.conn.Close()
+		<-old.done
+	}
+	if c.OnRouterChange != nil {
+		c.OnRouterChange(addr, true, nil)
+	}
+
+	err := c.run(r)
+	conn.Close()
+	c.rib.RemovePeers(func(p bgp.PeerKey) bool { return p.Router == addr })
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	c.mu.Lock()
+	if c.routers[addr] == r {
+		delete(c.routers, addr)
+	}
+	c.mu.Unlock()
+	if c.OnRouterChange != nil {
+		c.OnRouterChange(addr, false, err)
+	}
+	close(r.done)
+}
+
+// run reads messages until the router disconnects or sends Termination
+func (c *Collector) run(r *router) error {
+	reader := NewReader(r.conn)
+	for {
+		msgType, body, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		r.messages++
+		c.mu.Unlock()
+
+		switch msgType {
+		case MsgInitiation:
+			info := ParseInitiation(body)
+			c.mu.Lock()
+			r.info = info
+			c.mu.Unlock()
+			continue
+		case MsgTermination:
+			if reason := ParseTermination(body); reason != "" {
+				return fmt.Errorf("router terminated the session: %s", reason)
+			}
+			return nil
+		case MsgRouteMonitoring, MsgStatistics, MsgPeerDown, MsgPeerUp:
+		default:
+			// Route Mirroring and types from later specifications
+			continue
+		}
+
+		// A message that cannot be decoded is skipped; framing is by the
+		// common header, so the following messages are still usable
+		h, err := ParseHeader(body)
+		if err == nil {
+			if err = c.peerMessage(r, msgType, &h, body[PeerHeaderLen:]); err != nil {
+				err = fmt.Errorf("peer %s: %w", h.Address, err)
+			}
+		}
+		if err != nil {
+			c.mu.Lock()
+			r.errors++
+			r.lastErr = err.Error()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// peerMessage handles a message about one peer of the router
+func (c *Collector) peerMessage(r *router, msgType uint8, h *Header, data []byte) error {
+	key := bgp.PeerKey{Router: r.addr, Address: h.Address, Distinguisher: h.Distinguisher}
+
+	switch msgType {
+	case MsgPeerUp:
+		up, err := ParsePeerUp(data, h.Flags&FlagIPv6 != 0)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		p := r.peer(key, h)
+		p.header = *h
+		p.localAS = up.Sent.AS
+		p.opts = up.DecodeOptions(h)
+		p.up = true
+		p.since = time.Now()
+		p.downReason = ""
+		c.mu.Unlock()
+
+	case MsgPeerDown:
+		reason, err := ParsePeerDown(data)
+		if err != nil {
+			return err
+		}
+		c.rib.RemovePeer(key)
+		c.mu.Lock()
+		p := r.peer(key, h)
+		p.up = false
+		p.since = time.Now()
+		p.downReason = reason
+		c.mu.Unlock()
+
+	case MsgStatistics:
+		stats, err := ParseStats(data)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		p := r.peer(key, h)
+		for _, s := range stats {
+			p.stats[s.Name()] = s.Value
+		}
+		c.mu.Unlock()
+
+	case MsgRouteMonitoring:
+		c.mu.Lock()
+		p := r.peer(key, h)
+		// Only global instance peers: RD and local instance peers are VRFs,
+		// whose prefixes belong to another address space than the sFlow
+		// addresses looked up in the RIB
+		use := h.PeerType == PeerTypeGlobal && !h.AdjRIBOut() && h.PostPolicy() == c.cfg.PostPolicy
+		if !use {
+			p.skipped++
+		}
+		opts, peerAS, localAS := p.opts, p.header.AS, p.localAS
+		c.mu.Unlock()
+		if !use {
+			return nil
+		}
+
+		u, err := ParseRouteMonitoring(data, opts)
+		if err != nil {
+			return err
+		}
+		if u.Attrs != nil {
+			u.Attrs.SetLearnedFrom(peerAS, localAS)
+		}
+		c.rib.Apply(key, u)
+		c.mu.Lock()
+		p.routeMonitoring++
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// peer returns the state of a peer, created from the per-peer header if the
+// router sent no Peer Up for it. Called with the collector locked.
+func (r *router) peer(key bgp.PeerKey, h *Header) *peer {
+	p, ok := r.peers[key]
+	if !ok {
+		p = &peer{
+			header: *h,
+			opts:   bgp.DecodeOptions{FourOctetAS: h.FourOctetAS()},
+			up:     true,
+			since:  time.Now(),
+			stats:  make(map[string]uint64),
+		}
+		r.peers[key] = p
+	}
+	return p
+}
+
+// Routers returns the status of the connected routers, by address
+func (c *Collector) Routers() []RouterStatus {
+	c.mu.Lock()
+	list := make([]RouterStatus, 0, len(c.routers))
+	for _, r := range c.routers {
+		list = append(list, RouterStatus{
+			Address:   r.addr,
+			SysName:   r.info.SysName,
+			SysDescr:  r.info.SysDescr,
+			Since:     r.since,
+			Messages:  r.messages,
+			Errors:    r.errors,
+			LastError: r.lastErr,
+			Peers:     len(r.peers),
+		})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Address.Less(list[j].Address) })
+	return list
+}
+
+// Peers returns the status of the peers of the connected routers, by router,
+// peer address and distinguisher
+func (c *Collector) Peers() []PeerStatus {
+	var list []PeerStatus
+	c.mu.Lock()
+	for _, r := range c.routers {
+		for key, p := range r.peers {
+			st := PeerStatus{
+				Router:          r.addr,
+				RouterName:      r.info.SysName,
+				Peer:            key.Address,
+				PeerType:        PeerTypeName(p.header.PeerType),
+				Distinguisher:   key.Distinguisher,
+				PeerAS:          p.header.AS,
+				LocalAS:         p.localAS,
+				BGPID:           p.header.BGPID,
+				State:           PeerDownState,
+				Since:           p.since,
+				DownReason:      p.downReason,
+				FourOctetAS:     p.opts.FourOctetAS,
+				RouteMonitoring: p.routeMonitoring,
+				Skipped:         p.skipped,
+				Stats:           make(map[string]uint64, len(p.stats)),
+			}
+			if p.up {
+				st.State = PeerUpState
+			}
+			if p.opts.AddPathIPv4 {
+				st.AddPath = append(st.AddPath, bgp.IPv4Unicast.String())
+			}
+			if p.opts.AddPathIPv6 {
+				st.AddPath = append(st.AddPath, bgp.IPv6Unicast.String())
+			}
+			for name, value := range p.stats {
+				st.Stats[name] = value
+			}
+			list = append(list, st)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := &list[i], &list[j]
+		if c := a.Router.Compare(b.Router); c != 0 {
+			return c < 0
+		}
+		if c := a.Peer.Compare(b.Peer); c != 0 {
+			return c < 0
+		}
+		return a.Distinguisher < b.Distinguisher
+	})
+	for i := range list {
+		st := &list[i]
+		st.Routes = c.rib.PeerRoutes(bgp.PeerKey{Router: st.Router, Address: st.Peer, Distinguisher: st.Distinguisher})
+	}
+	return list
+}
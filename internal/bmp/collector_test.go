@@ -0,0 +1,423 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"sflow-enricher/internal/bgp"
+)
+
+// message returns a BMP message with the common header
+func message(msgType uint8, body []byte) []byte {
+	b := []byte{Version}
+	b = binary.BigEndian.AppendUint32(b, uint32(CommonHeaderLen+len(body)))
+	return append(append(b, msgType), body...)
+}
+
+// peerHeader returns a per-peer header of an IPv4 peer with 4-byte ASNs
+func peerHeader(peerType, flags uint8, rd uint64, peer string, as uint32) []byte {
+	b := []byte{peerType, flags}
+	b = binary.BigEndian.AppendUint64(b, rd)
+	addr := netip.MustParseAddr(peer).As16()
+	b = append(b, make([]byte, 12)...)
+	b = append(b, addr[12:]...)
+	b = binary.BigEndian.AppendUint32(b, as)
+	b = append(b, 192, 0, 2, 9)
+	return append(b, make([]byte, 8)...)
+}
+
+// routeMonitoring returns a Route Monitoring message announcing prefix with
+// the AS path as the only ASN
+func routeMonitoring(header []byte, prefix string, as uint32) []byte {
+	return message(MsgRouteMonitoring, append(header, update(prefix, as, bgp.DecodeOptions{FourOctetAS: true})...))
+}
+
+// update returns a BGP UPDATE announcing prefix with the AS path as the only
+// ASN, encoded with opts
+func update(prefix string, as uint32, opts bgp.DecodeOptions) []byte {
+	var attrs []byte
+	attrs = append(attrs, 0x40, 1, 1, 0) // ORIGIN IGP
+	if opts.FourOctetAS {
+		attrs = append(attrs, 0x40, 2, 6, 2, 1)          // AS_PATH, one AS_SEQUENCE
+		attrs = binary.BigEndian.AppendUint32(attrs, as) // of one 4-byte ASN
+	} else {
+		attrs = append(attrs, 0x40, 2, 4, 2, 1)                  // AS_PATH, one AS_SEQUENCE
+		attrs = binary.BigEndian.AppendUint16(attrs, uint16(as)) // of one 2-byte ASN
+	}
+	attrs = append(attrs, 0x40, 3, 4, 10, 0, 0, 1) // NEXT_HOP
+	body := binary.BigEndian.AppendUint16(nil, 0)  // no withdrawn routes
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	if opts.AddPathIPv4 {
+		body = binary.BigEndian.AppendUint32(body, 7) // path identifier
+	}
+	p := netip.MustParsePrefix(prefix)
+	body = append(body, byte(p.Bits()))
+	body = append(body, p.Addr().AsSlice()[:(p.Bits()+7)/8]...)
+	return bgp.AppendMessage(nil, bgp.MsgUpdate, body)
+}
+
+func TestRouteMonitoringPeerTypes(t *testing.T) {
+	rib := bgp.NewRIB()
+	c := NewCollector(Config{}, rib)
+	router, conn := net.Pipe()
+	defer router.Close()
+	go c.handle(conn)
+
+	// The same prefix from every kind of peer; only the global one is usable
+	messages := [][]byte{
+		routeMonitoring(peerHeader(PeerTypeGlobal, 0, 0, "10.0.0.2", 65002), "198.51.100.0/24", 65002),
+		routeMonitoring(peerHeader(PeerTypeRD, 0, 65000<<32|1, "10.0.0.3", 65003), "198.51.100.0/24", 65003),
+		routeMonitoring(peerHeader(PeerTypeRD, 0, 65000<<32|1, "10.0.0.3", 65003), "203.0.113.0/24", 65003),
+		routeMonitoring(peerHeader(PeerTypeLocal, 0, 7, "10.0.0.4", 65004), "198.51.100.0/25", 65004),
+		routeMonitoring(peerHeader(PeerTypeLocRIB, 0, 0, "0.0.0.0", 0), "198.51.100.0/26", 65005),
+		routeMonitoring(peerHeader(PeerTypeGlobal, FlagAdjRIBOut, 0, "10.0.0.2", 65002), "198.51.100.0/27", 65006),
+		routeMonitoring(peerHeader(PeerTypeGlobal, FlagPostPolicy, 0, "10.0.0.2", 65002), "198.51.100.0/28", 65007),
+	}
+	for _, m := range messages {
+		if _, err := router.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[netip.Addr][2]uint64{ // used, skipped
+		netip.MustParseAddr("10.0.0.2"): {1, 2},
+		netip.MustParseAddr("10.0.0.3"): {0, 2},
+		netip.MustParseAddr("10.0.0.4"): {0, 1},
+		netip.MustParseAddr("0.0.0.0"):  {0, 1},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var total uint64
+		for _, p := range c.Peers() {
+			total += p.RouteMonitoring + p.Skipped
+		}
+		if total == uint64(len(messages)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d messages handled", total, len(messages))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for _, p := range c.Peers() {
+		if got := [2]uint64{p.RouteMonitoring, p.Skipped}; got != want[p.Peer] {
+			t.Errorf("peer %s (%s): used, skipped = %v, want %v", p.Peer, p.PeerType, got, want[p.Peer])
+		}
+	}
+
+	if rib.Len() != 1 {
+		t.Errorf("RIB holds %d routes, want the global peer's only", rib.Len())
+	}
+	if r, ok := rib.Lookup(netip.MustParseAddr("198.51.100.1")); !ok || r.OriginAS != 65002 {
+		t.Errorf("route to 198.51.100.1 = %+v, %v; want origin 65002", r, ok)
+	}
+	if _, ok := rib.Lookup(netip.MustParseAddr("203.0.113.1")); ok {
+		t.Error("VRF route in the global RIB")
+	}
+}
+
+// peerUp returns the body of a Peer Up Notification with the OPEN messages
+func peerUp(sent, received *bgp.Open) []byte {
+	b := append(make([]byte, 12), 10, 0, 0, 1) // local address
+	b = binary.BigEndian.AppendUint16(b, 179)
+	b = binary.BigEndian.AppendUint16(b, 50000)
+	return received.Append(sent.Append(b))
+}
+
+// open returns an OPEN with 4-byte ASNs, both unicast families and the
+// ADD-PATH flags given
+func open(as uint32, addPath map[bgp.Family]uint8) *bgp.Open {
+	return &bgp.Open{
+		AS:          as,
+		HoldTime:    90,
+		RouterID:    netip.MustParseAddr("192.0.2.9"),
+		FourOctetAS: true,
+		Families:    []bgp.Family{bgp.IPv4Unicast, bgp.IPv6Unicast},
+		AddPath:     addPath,
+	}
+}
+
+// tlv returns an Information TLV
+func tlv(tlvType uint16, value []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, tlvType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// ADD-PATH is used for a family when the peer sends several paths and the
+// router receives them; the A flag, not the capabilities, gives the ASN size
+func TestPeerUpDecodeOptions(t *testing.T) {
+	const (
+		recv = bgp.AddPathReceive
+		send = bgp.AddPathSend
+	)
+	tests := []struct {
+		name           string
+		flags          uint8
+		sent, received map[bgp.Family]uint8
+		want           bgp.DecodeOptions
+	}{
+		{"no ADD-PATH", 0, nil, nil, bgp.DecodeOptions{FourOctetAS: true}},
+		{"IPv4", 0, map[bgp.Family]uint8{bgp.IPv4Unicast: recv}, map[bgp.Family]uint8{bgp.IPv4Unicast: send},
+			bgp.DecodeOptions{FourOctetAS: true, AddPathIPv4: true}},
+		{"IPv6 of both offered", 0, map[bgp.Family]uint8{bgp.IPv4Unicast: send, bgp.IPv6Unicast: recv | send},
+			map[bgp.Family]uint8{bgp.IPv4Unicast: recv | send, bgp.IPv6Unicast: send},
+			bgp.DecodeOptions{FourOctetAS: true, AddPathIPv6: true}},
+		{"peer sends, router does not receive", 0, map[bgp.Family]uint8{bgp.IPv4Unicast: send},
+			map[bgp.Family]uint8{bgp.IPv4Unicast: send}, bgp.DecodeOptions{FourOctetAS: true}},
+		{"router receives, peer does not send", 0, map[bgp.Family]uint8{bgp.IPv4Unicast: recv},
+			map[bgp.Family]uint8{bgp.IPv4Unicast: recv}, bgp.DecodeOptions{FourOctetAS: true}},
+		{"2-byte ASNs", FlagTwoOctetAS, map[bgp.Family]uint8{bgp.IPv4Unicast: recv}, map[bgp.Family]uint8{bgp.IPv4Unicast: send},
+			bgp.DecodeOptions{AddPathIPv4: true}},
+	}
+	for _, tt := range tests {
+		h, err := ParseHeader(peerHeader(PeerTypeGlobal, tt.flags, 0, "10.0.0.2", 65002))
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, err := ParsePeerUp(peerUp(open(65001, tt.sent), open(65002, tt.received)), false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := up.DecodeOptions(&h); got != tt.want {
+			t.Errorf("%s: options %+v, want %+v", tt.name, got, tt.want)
+		}
+		if up.LocalAddress != netip.MustParseAddr("10.0.0.1") || up.LocalPort != 179 || up.RemotePort != 50000 ||
+			up.Sent.AS != 65001 || up.Received.AS != 65002 {
+			t.Errorf("%s: peer up %+v", tt.name, *up)
+		}
+	}
+
+	body := peerUp(open(65001, nil), open(65002, nil))
+	sentLen := len(open(65001, nil).Append(nil))
+	for name, data := range map[string][]byte{
+		"short":             body[:19],
+		"sent OPEN cut":     body[:20+sentLen-1],
+		"no received OPEN":  body[:20+sentLen],
+		"received not OPEN": bgp.AppendKeepalive(body[:20+sentLen]),
+	} {
+		if _, err := ParsePeerUp(data, false); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestParsePeerDown(t *testing.T) {
+	notification := bgp.AppendNotification(nil, 6, 2, nil)
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{append([]byte{peerDownLocal}, notification...), "local notification 6/2"},
+		{[]byte{peerDownLocal}, "local notification"},
+		{append([]byte{peerDownRemote}, bgp.AppendNotification(nil, 6, 4, []byte{1})...), "remote notification 6/4"},
+		{append([]byte{peerDownRemote}, bgp.AppendKeepalive(nil)...), "remote notification"},
+		{[]byte{peerDownFSM, 0, 12}, "local close, FSM event 12"},
+		{[]byte{peerDownFSM}, "local close"},
+		{[]byte{peerDownNoData}, "remote close"},
+		{[]byte{peerDownDeconf}, "peer de-configured"},
+		{[]byte{peerDownLocRIB, 0, 0}, "local system closed"},
+		{[]byte{9}, "reason 9"},
+	}
+	for _, tt := range tests {
+		got, err := ParsePeerDown(tt.data)
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePeerDown(%x) = %q, %v; want %q", tt.data, got, err, tt.want)
+		}
+	}
+	if _, err := ParsePeerDown(nil); err == nil {
+		t.Error("empty peer down parsed")
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	stat := func(statType uint16, value []byte) []byte { return tlv(statType, value) }
+	u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+	u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+	family := func(afi uint16, safi uint8, value []byte) []byte {
+		return append(append(binary.BigEndian.AppendUint16(nil, afi), safi), value...)
+	}
+	records := [][]byte{
+		stat(0, u32(3)),
+		stat(7, u64(1<<40)),
+		stat(statPerAFIFirst, family(bgp.AFIIPv4, bgp.SAFIUnicast, u64(900000))),
+		stat(statPerAFILast, family(bgp.AFIIPv6, bgp.SAFIUnicast, u64(200000))),
+		stat(statPerAFIFirst, family(25, 70, u64(12))),
+		stat(statPerAFILast, []byte{0, 1}), // no room for the family: skipped
+		stat(11, []byte{0, 0, 1}),          // neither a counter nor a gauge: skipped
+		stat(99, u32(5)),
+	}
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(records)))
+	for _, r := range records {
+		data = append(data, r...)
+	}
+
+	stats, err := ParseStats(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]uint64{}
+	for _, s := range stats {
+		got[s.Name()] = s.Value
+	}
+	want := map[string]uint64{
+		"rejected_prefixes":              3,
+		"adj_rib_in_routes":              1 << 40,
+		"adj_rib_in_routes_ipv4_unicast": 900000,
+		"loc_rib_routes_ipv6_unicast":    200000,
+		"adj_rib_in_routes_afi25_safi70": 12,
+		"type99":                         5,
+	}
+	if len(stats) != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stats %v, want %v", got, want)
+	}
+
+	for name, data := range map[string][]byte{
+		"short":          data[:3],
+		"record header":  data[:6],
+		"record value":   data[:4+len(records[0])-1],
+		"count too high": append(binary.BigEndian.AppendUint32(nil, 2), records[0]...),
+	} {
+		if _, err := ParseStats(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestParseInitiation(t *testing.T) {
+	data := bytes.Join([][]byte{
+		tlv(tlvString, []byte("free text")),
+		tlv(tlvSysDescr, []byte("JunOS 23.4")),
+		tlv(tlvSysName, []byte("edge1")),
+	}, nil)
+	want := Information{SysName: "edge1", SysDescr: "JunOS 23.4"}
+	if got := ParseInitiation(data); got != want {
+		t.Errorf("ParseInitiation = %+v, want %+v", got, want)
+	}
+	// A TLV past the message ends the list
+	if got := ParseInitiation(append(tlv(tlvSysName, []byte("edge1")), tlv(tlvSysDescr, []byte("JunOS"))[:6]...)); got != (Information{SysName: "edge1"}) {
+		t.Errorf("truncated: %+v", got)
+	}
+}
+
+func TestParseTermination(t *testing.T) {
+	reason := func(code uint16) []byte { return tlv(tlvTermReason, binary.BigEndian.AppendUint16(nil, code)) }
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"administratively closed", reason(0), "administratively closed"},
+		{"unspecified", reason(1), "unspecified"},
+		{"out of resources", reason(2), "out of resources"},
+		{"redundant connection", reason(3), "redundant connection"},
+		{"permanently closed", reason(4), "permanently administratively closed"},
+		{"unknown code", reason(9), ""},
+		{"string after the code", append(reason(2), tlv(tlvString, []byte("maintenance"))...), "maintenance"},
+		{"string before the code", append(tlv(tlvString, []byte("maintenance")), reason(2)...), "maintenance"},
+		{"truncated", reason(2)[:5], ""},
+		{"none", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := ParseTermination(tt.data); got != tt.want {
+			t.Errorf("%s: reason %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A peer's decode options come from its Peer Up, its routes go at Peer Down
+// and the router's at Termination
+func TestCollectorPeerLifecycle(t *testing.T) {
+	rib := bgp.NewRIB()
+	c := NewCollector(Config{}, rib)
+	changes := make(chan error, 2)
+	c.OnRouterChange = func(_ netip.Addr, up bool, err error) {
+		if !up {
+			changes <- err
+		}
+	}
+	router, conn := net.Pipe()
+	defer router.Close()
+	go c.handle(conn)
+
+	var sent int
+	send := func(msgs ...[]byte) {
+		t.Helper()
+		for _, m := range msgs {
+			if _, err := router.Write(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sent += len(msgs)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if routers := c.Routers(); len(routers) == 1 && routers[0].Messages == uint64(sent) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d messages not handled", sent)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A 2-byte ASN peer sending several IPv4 paths
+	header := peerHeader(PeerTypeGlobal, FlagTwoOctetAS, 0, "10.0.0.2", 65002)
+	stats := binary.BigEndian.AppendUint32(nil, 2)
+	stats = append(stats, tlv(0, binary.BigEndian.AppendUint32(nil, 3))...)
+	stats = append(stats, tlv(statPerAFIFirst, append([]byte{0, bgp.AFIIPv4, bgp.SAFIUnicast}, binary.BigEndian.AppendUint64(nil, 1)...))...)
+	send(
+		message(MsgInitiation, append(tlv(tlvSysName, []byte("edge1")), tlv(tlvSysDescr, []byte("JunOS"))...)),
+		message(MsgPeerUp, append(header, peerUp(
+			open(65001, map[bgp.Family]uint8{bgp.IPv4Unicast: bgp.AddPathReceive}),
+			open(65002, map[bgp.Family]uint8{bgp.IPv4Unicast: bgp.AddPathSend}))...)),
+		message(MsgRouteMonitoring, append(header, update("198.51.100.0/24", 64500, bgp.DecodeOptions{AddPathIPv4: true})...)),
+		message(MsgStatistics, append(header, stats...)),
+	)
+	if r := c.Routers()[0]; r.SysName != "edge1" || r.SysDescr != "JunOS" || r.Errors != 0 {
+		t.Fatalf("router %+v", r)
+	}
+	peers := c.Peers()
+	if len(peers) != 1 {
+		t.Fatalf("peers %+v", peers)
+	}
+	p := peers[0]
+	if p.State != PeerUpState || p.FourOctetAS || fmt.Sprint(p.AddPath) != "[ipv4-unicast]" ||
+		p.PeerAS != 65002 || p.LocalAS != 65001 || p.RouterName != "edge1" || p.RouteMonitoring != 1 || p.Routes != 1 {
+		t.Errorf("peer after Peer Up %+v", p)
+	}
+	if fmt.Sprint(p.Stats) != "map[adj_rib_in_routes_ipv4_unicast:1 rejected_prefixes:3]" {
+		t.Errorf("stats %v", p.Stats)
+	}
+	if r, ok := rib.Lookup(netip.MustParseAddr("198.51.100.1")); !ok || r.OriginAS != 64500 {
+		t.Errorf("route to 198.51.100.1 = %+v, %v; want origin 64500", r, ok)
+	}
+
+	send(message(MsgPeerDown, append(header, append([]byte{peerDownRemote}, bgp.AppendNotification(nil, 6, 2, nil)...)...)))
+	p = c.Peers()[0]
+	if p.State != PeerDownState || p.DownReason != "remote notification 6/2" || p.Routes != 0 || rib.Len() != 0 {
+		t.Errorf("peer after Peer Down %+v, RIB %d routes", p, rib.Len())
+	}
+
+	if _, err := router.Write(message(MsgTermination, tlv(tlvTermReason, []byte{0, 3}))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-changes:
+		if err == nil || !strings.Contains(err.Error(), "redundant connection") {
+			t.Errorf("router down with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("router not disconnected")
+	}
+	if len(c.Routers()) != 0 || len(c.Peers()) != 0 {
+		t.Error("router kept after Termination")
+	}
+}
@@ -3,10 +3,67 @@ package config
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v3"
+
+	"sflow-enricher/internal/aspath"
+)
+
+// Rule address selection for tunnelled traffic (GRE, VXLAN, IP-in-IP, GTP-U)
+const (
+	MatchOnOuter = "outer"
+	MatchOnInner = "inner"
+	MatchOnNAT   = "nat"
+)
+
+// Destination AS path handling when a rule matches the destination IP
+const (
+	ASPathInsert  = "insert"  // set the path only if the record has none
+	ASPathReplace = "replace" // replace any existing path
+	ASPathPrepend = "prepend" // prepend to an existing path (insert if none)
+)
+
+// Sequence numbering of datagrams split by max_datagram_size
+const (
+	SplitSequenceShift = "shift" // renumber per agent so collectors see no gaps or duplicates
+	SplitSequenceKeep  = "keep"  // all parts keep the original sequence number
+)
+
+// Per-agent sampling_rate rewriting
+const (
+	SamplingRateOverride = "override" // replace the rate in every flow sample
+	SamplingRateFill     = "fill"     // only set it in flow samples that report 0
+)
+
+// Per-agent sample_pool handling
+const (
+	SamplePoolKeep    = "keep"    // forward the agent's sample_pool
+	SamplePoolRebuild = "rebuild" // recompute it from the forwarded rate and sequence
+)
+
+// Formats of the pfx2as file, as pfx2as.Load takes them
+const (
+	Pfx2ASFormatCAIDA = "caida" // CAIDA pfx2as text lines
+	Pfx2ASFormatMRT   = "mrt"   // MRT TABLE_DUMP_V2 RIB dump
+)
+
+// Adj-RIB-In view used by the BMP collector
+const (
+	BMPPolicyPre  = "pre"  // routes as received from the peer
+	BMPPolicyPost = "post" // routes after the router's inbound policy
+)
+
+// Handling of structurally invalid datagrams
+const (
+	ValidationForward = "forward" // forward as received, enriching the samples that can be read
+	ValidationDrop    = "drop"    // drop the datagram
+	ValidationRepair  = "repair"  // trim to the valid samples and fix counts, then enrich
 )
 
 type Config struct {
@@ -14,10 +71,21 @@ type Config struct {
 	HTTP        HTTPConfig         `yaml:"http"`
 	Destinations []DestinationConfig `yaml:"destinations"`
 	Enrichment  EnrichmentConfig   `yaml:"enrichment"`
+	Validation  ValidationConfig   `yaml:"validation"`
+	Agents      []AgentConfig      `yaml:"agents"`
+	BGP         BGPConfig          `yaml:"bgp"`
+	BMP         BMPConfig          `yaml:"bmp"`
 	Logging     LoggingConfig      `yaml:"logging"`
 	Security    SecurityConfig     `yaml:"security"`
 	Telegram    TelegramConfig     `yaml:"telegram"`
 
+	// Compiled enrichment rules, built by parse and swapped by Reload
+	ruleTable atomic.Pointer[RuleTable]
+
+	// Agents by agent and by UDP source address, built by parse
+	agents       map[netip.Addr]*AgentConfig
+	agentSources map[netip.Addr]*AgentConfig
+
 	mu sync.RWMutex
 }
 
@@ -42,7 +110,32 @@ type DestinationConfig struct {
 }
 
 type EnrichmentConfig struct {
-	Rules []EnrichmentRule `yaml:"rules"`
+	Rules           []EnrichmentRule `yaml:"rules"`
+	MaxDatagramSize int              `yaml:"max_datagram_size"` // split forwarded datagrams above this size, 0 = never
+	SplitSequence   string           `yaml:"split_sequence"`    // "shift" (default) or "keep"
+	// Prefix-to-origin-AS table for addresses the router left at AS 0
+	Pfx2AS Pfx2ASConfig `yaml:"pfx2as"`
+	// Validated ROA payloads for origin validation of enriched traffic
+	RPKI RPKIConfig `yaml:"rpki"`
+}
+
+// Pfx2ASConfig locates a prefix-to-origin-AS file, watched for changes
+type Pfx2ASConfig struct {
+	File          string `yaml:"file"`           // .gz and .bz2 files are decompressed
+	Format        string `yaml:"format"`         // "caida" (default) or "mrt"
+	CheckInterval int    `yaml:"check_interval"` // seconds between file change checks, default 60
+}
+
+// RPKIConfig locates a VRP file (rpki-client or Routinator JSON export),
+// watched for changes
+type RPKIConfig struct {
+	File          string `yaml:"file"`           // .gz files are decompressed
+	CheckInterval int    `yaml:"check_interval"` // seconds between file change checks, default 60
+	// Community added to gateway records of traffic with an invalid origin, "ASN:value"
+	InvalidCommunity string `yaml:"invalid_community"`
+
+	// Parsed invalid_community, empty if unset
+	InvalidCommunities []uint32 `yaml:"-"`
 }
 
 type EnrichmentRule struct {
@@ -51,10 +144,264 @@ type EnrichmentRule struct {
 	MatchAS   uint32 `yaml:"match_as"`
 	SetAS     uint32 `yaml:"set_as"`
 	Overwrite bool   `yaml:"overwrite"` // Force overwrite even if AS != match_as
+	MatchOn   string `yaml:"match_on"`  // "outer" (default), "inner" header of tunnelled traffic, or "nat" (extended_nat addresses)
+	// Append an extended_gateway record to matching samples that have none
+	SynthesizeGateway bool `yaml:"synthesize_gateway"`
+	// Destination AS path to set; defaults to [set_as]
+	SetASPath  ASPath `yaml:"set_as_path"`
+	ASPathMode string `yaml:"as_path_mode"` // "insert" (default), "replace" or "prepend"
+	// BGP attributes written to the extended_gateway record
+	AddCommunities []string `yaml:"add_communities"` // "ASN:value"
+	SetLocalPref   *uint32  `yaml:"set_local_pref"`
+	SetNextHop     string   `yaml:"set_next_hop"` // IPv4 or IPv6 address
+	// Parsed communities and next hop
+	Communities []uint32 `yaml:"-"`
+	NextHop     net.IP   `yaml:"-"`
 	// Parsed network
 	IPNet *net.IPNet `yaml:"-"`
 }
 
+// AgentConfig holds per-agent settings, keyed by the agent address in the
+// datagram header or by the UDP source address of the datagrams
+type AgentConfig struct {
+	Address string `yaml:"address"` // agent address in the datagram header
+	Source  string `yaml:"source"`  // or UDP source address
+	// Agent address to put in the datagram header
+	SetAgentAddress string `yaml:"set_agent_address"`
+	// Flow sample sampling_rate to report instead of the agent's
+	SamplingRate     uint32 `yaml:"sampling_rate"`
+	SamplingRateMode string `yaml:"sampling_rate_mode"` // "override" (default) or "fill"
+	// Sub-sample in software down to 1-in-N, 0 = off
+	TargetSamplingRate uint32 `yaml:"target_sampling_rate"`
+	// "rebuild" (default with a sampling_rate or target_sampling_rate) or "keep"
+	SamplePoolMode string `yaml:"sample_pool_mode"`
+	// ifIndex translation of input/output and source_id: old ifIndex -> new,
+	// or ifName (learned from port_name counters) -> new
+	IfIndexMap map[uint32]uint32 `yaml:"ifindex_map"`
+	IfNameMap  map[string]uint32 `yaml:"ifname_map"`
+	// Neighbor AS of transit traffic by interface and next hop
+	PeerAS PeerASConfig `yaml:"peer_as"`
+	// Parsed addresses
+	Addr         netip.Addr `yaml:"-"`
+	SourceAddr   netip.Addr `yaml:"-"`
+	AgentAddress net.IP     `yaml:"-"`
+}
+
+// name identifies the entry in error messages
+func (a *AgentConfig) name() string {
+	if a.Address != "" {
+		return a.Address
+	}
+	return "source " + a.Source
+}
+
+// RemapsIfIndex reports whether the agent has an ifIndex translation table
+func (a *AgentConfig) RemapsIfIndex() bool {
+	return len(a.IfIndexMap) > 0 || len(a.IfNameMap) > 0
+}
+
+// RewritesSampling reports whether the agent has sampling_rate,
+// target_sampling_rate or sample_pool settings
+func (a *AgentConfig) RewritesSampling() bool {
+	return a.SamplingRate != 0 || a.TargetSamplingRate != 0 || a.SamplePoolMode == SamplePoolRebuild
+}
+
+// PeerASConfig maps the agent's peering interfaces and the next hops of its
+// peers to the peer AS
+type PeerASConfig struct {
+	Interfaces map[uint32]uint32 `yaml:"interfaces"` // ifIndex the agent reports -> peer AS
+	NextHops   map[string]uint32 `yaml:"next_hops"`  // peer address -> peer AS
+	// Parsed next hops
+	NextHopAddrs map[netip.Addr]uint32 `yaml:"-"`
+}
+
+// HasPeerAS reports whether the agent has a peer AS table
+func (a *AgentConfig) HasPeerAS() bool {
+	return len(a.PeerAS.Interfaces) > 0 || len(a.PeerAS.NextHops) > 0
+}
+
+// BGPConfig configures the passive BGP speaker that learns routes from routers
+type BGPConfig struct {
+	Enabled  bool            `yaml:"enabled"`
+	Address  string          `yaml:"address"` // listen address, default all
+	Port     int             `yaml:"port"`    // default 179
+	LocalAS  uint32          `yaml:"local_as"`
+	RouterID string          `yaml:"router_id"` // IPv4 address
+	HoldTime int             `yaml:"hold_time"` // seconds, default 90
+	AddPath  bool            `yaml:"add_path"`  // accept several paths per prefix (RFC 7911)
+	Peers    []BGPPeerConfig `yaml:"peers"`
+	// Parsed router ID
+	RouterIDAddr netip.Addr `yaml:"-"`
+}
+
+// BGPPeerConfig is a router allowed to open a session
+type BGPPeerConfig struct {
+	Address string `yaml:"address"`
+	AS      uint32 `yaml:"as"` // expected peer AS, 0 = any
+	// Parsed address
+	Addr netip.Addr `yaml:"-"`
+}
+
+// BMPConfig configures the BMP (RFC 7854) collector that learns routes from
+// the peers of monitored routers
+type BMPConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Address string   `yaml:"address"` // listen address, default all
+	Port    int      `yaml:"port"`    // default 11019
+	Policy  string   `yaml:"policy"`  // "pre" (default) or "post"
+	Routers []string `yaml:"routers"` // routers allowed to connect, empty = any
+	// Parsed router addresses
+	RouterAddrs []netip.Addr `yaml:"-"`
+}
+
+func (b *BMPConfig) parse() error {
+	if b.Port == 0 {
+		b.Port = 11019
+	}
+	switch b.Policy {
+	case "":
+		b.Policy = BMPPolicyPre
+	case BMPPolicyPre, BMPPolicyPost:
+	default:
+		return fmt.Errorf("invalid policy %q (use %q or %q)", b.Policy, BMPPolicyPre, BMPPolicyPost)
+	}
+	b.RouterAddrs = nil
+	for _, router := range b.Routers {
+		addr, err := netip.ParseAddr(router)
+		if err != nil {
+			return fmt.Errorf("invalid router address %q: %w", router, err)
+		}
+		b.RouterAddrs = append(b.RouterAddrs, addr.Unmap())
+	}
+	return nil
+}
+
+type ValidationConfig struct {
+	Mode string `yaml:"mode"` // "forward" (default), "drop" or "repair"
+}
+
+func (b *BGPConfig) parse() error {
+	if b.LocalAS == 0 {
+		return fmt.Errorf("local_as is required")
+	}
+	addr, err := netip.ParseAddr(b.RouterID)
+	if err != nil || !addr.Is4() {
+		return fmt.Errorf("router_id %q must be an IPv4 address", b.RouterID)
+	}
+	b.RouterIDAddr = addr
+	if b.Port == 0 {
+		b.Port = 179
+	}
+	switch {
+	case b.HoldTime == 0:
+		b.HoldTime = 90
+	case b.HoldTime < 3 || b.HoldTime > 65535:
+		return fmt.Errorf("invalid hold_time %d (3-65535 seconds)", b.HoldTime)
+	}
+	if len(b.Peers) == 0 {
+		return fmt.Errorf("no peers configured")
+	}
+	seen := make(map[netip.Addr]bool)
+	for i := range b.Peers {
+		peer := &b.Peers[i]
+		addr, err := netip.ParseAddr(peer.Address)
+		if err != nil {
+			return fmt.Errorf("invalid peer address %q: %w", peer.Address, err)
+		}
+		peer.Addr = addr.Unmap()
+		if seen[peer.Addr] {
+			return fmt.Errorf("duplicate peer %s", peer.Address)
+		}
+		seen[peer.Addr] = true
+	}
+	return nil
+}
+
+// ASPath is a destination AS path in rule configuration. ASNs form AS_SEQUENCE
+// segments and nested lists AS_SET segments, e.g. [64512, 65001, [65010, 65011]]
+type ASPath []aspath.Segment
+
+// parseCommunity parses a standard BGP community (RFC 1997) in "ASN:value" notation
+func parseCommunity(s string) (uint32, error) {
+	asn, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid community %q (use ASN:value)", s)
+	}
+	high, err := strconv.ParseUint(asn, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q: ASN must be 0-65535", s)
+	}
+	low, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q: value must be 0-65535", s)
+	}
+	return uint32(high)<<16 | uint32(low), nil
+}
+
+// String formats the path in BGP notation, AS_SETs in braces: "64512 65001 {65010,65011}"
+func (p ASPath) String() string {
+	var b strings.Builder
+	for i, seg := range p {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		sep := " "
+		if seg.Type == aspath.Set {
+			b.WriteByte('{')
+			sep = ","
+		}
+		for j, asn := range seg.ASNs {
+			if j > 0 {
+				b.WriteString(sep)
+			}
+			b.WriteString(strconv.FormatUint(uint64(asn), 10))
+		}
+		if seg.Type == aspath.Set {
+			b.WriteByte('}')
+		}
+	}
+	return b.String()
+}
+
+// UnmarshalYAML decodes an AS path list, merging consecutive ASNs into one AS_SEQUENCE
+func (p *ASPath) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: AS path must be a list", value.Line)
+	}
+
+	var path ASPath
+	for _, item := range value.Content {
+		switch item.Kind {
+		case yaml.ScalarNode:
+			var asn uint32
+			if err := item.Decode(&asn); err != nil || asn == 0 {
+				return fmt.Errorf("line %d: invalid ASN %q", item.Line, item.Value)
+			}
+			if n := len(path); n > 0 && path[n-1].Type == aspath.Sequence {
+				path[n-1].ASNs = append(path[n-1].ASNs, asn)
+			} else {
+				path = append(path, aspath.Segment{Type: aspath.Sequence, ASNs: []uint32{asn}})
+			}
+		case yaml.SequenceNode:
+			var asns []uint32
+			if err := item.Decode(&asns); err != nil || len(asns) == 0 {
+				return fmt.Errorf("line %d: AS_SET must be a non-empty list of ASNs", item.Line)
+			}
+			for _, asn := range asns {
+				if asn == 0 {
+					return fmt.Errorf("line %d: invalid ASN 0 in AS_SET", item.Line)
+				}
+			}
+			path = append(path, aspath.Segment{Type: aspath.Set, ASNs: asns})
+		default:
+			return fmt.Errorf("line %d: AS path entries must be ASNs or lists of ASNs", item.Line)
+		}
+	}
+
+	*p = path
+	return nil
+}
+
 type LoggingConfig struct {
 	Level         string `yaml:"level"`
 	Format        string `yaml:"format"` // "text" or "json"
@@ -105,6 +452,215 @@ func (c *Config) parse() error {
 			return fmt.Errorf("invalid network %s: %w", c.Enrichment.Rules[i].Network, err)
 		}
 		c.Enrichment.Rules[i].IPNet = ipnet
+
+		switch c.Enrichment.Rules[i].MatchOn {
+		case "":
+			c.Enrichment.Rules[i].MatchOn = MatchOnOuter
+		case MatchOnOuter, MatchOnInner, MatchOnNAT:
+		default:
+			return fmt.Errorf("invalid match_on %q in rule %s (use %q, %q or %q)",
+				c.Enrichment.Rules[i].MatchOn, c.Enrichment.Rules[i].Name, MatchOnOuter, MatchOnInner, MatchOnNAT)
+		}
+
+		rule := &c.Enrichment.Rules[i]
+		if len(rule.SetASPath) == 0 {
+			rule.SetASPath = ASPath{{Type: aspath.Sequence, ASNs: []uint32{rule.SetAS}}}
+		}
+		rule.Communities = nil
+		for _, community := range rule.AddCommunities {
+			value, err := parseCommunity(community)
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.Communities = append(rule.Communities, value)
+		}
+
+		rule.NextHop = nil
+		if rule.SetNextHop != "" {
+			rule.NextHop = net.ParseIP(rule.SetNextHop)
+			if rule.NextHop == nil {
+				return fmt.Errorf("rule %s: invalid set_next_hop %q", rule.Name, rule.SetNextHop)
+			}
+			if ip4 := rule.NextHop.To4(); ip4 != nil {
+				rule.NextHop = ip4
+			}
+		}
+
+		switch rule.ASPathMode {
+		case "":
+			rule.ASPathMode = ASPathInsert
+		case ASPathInsert, ASPathReplace:
+		case ASPathPrepend:
+			// Prepending only makes sense for a plain AS_SEQUENCE
+			if len(rule.SetASPath) != 1 || rule.SetASPath[0].Type != aspath.Sequence {
+				return fmt.Errorf("rule %s: as_path_mode %q needs set_as_path without AS_SET", rule.Name, ASPathPrepend)
+			}
+		default:
+			return fmt.Errorf("invalid as_path_mode %q in rule %s (use %q, %q or %q)",
+				rule.ASPathMode, rule.Name, ASPathInsert, ASPathReplace, ASPathPrepend)
+		}
+	}
+
+	c.ruleTable.Store(newRuleTable(c.Enrichment.Rules))
+
+	if c.Enrichment.MaxDatagramSize < 0 {
+		return fmt.Errorf("invalid max_datagram_size %d", c.Enrichment.MaxDatagramSize)
+	}
+	switch c.Enrichment.SplitSequence {
+	case "":
+		c.Enrichment.SplitSequence = SplitSequenceShift
+	case SplitSequenceShift, SplitSequenceKeep:
+	default:
+		return fmt.Errorf("invalid split_sequence %q (use %q or %q)",
+			c.Enrichment.SplitSequence, SplitSequenceShift, SplitSequenceKeep)
+	}
+
+	if c.Enrichment.Pfx2AS.File != "" {
+		switch c.Enrichment.Pfx2AS.Format {
+		case "":
+			c.Enrichment.Pfx2AS.Format = Pfx2ASFormatCAIDA
+		case Pfx2ASFormatCAIDA, Pfx2ASFormatMRT:
+		default:
+			return fmt.Errorf("invalid pfx2as format %q (use %q or %q)",
+				c.Enrichment.Pfx2AS.Format, Pfx2ASFormatCAIDA, Pfx2ASFormatMRT)
+		}
+		if c.Enrichment.Pfx2AS.CheckInterval < 0 {
+			return fmt.Errorf("invalid pfx2as check_interval %d", c.Enrichment.Pfx2AS.CheckInterval)
+		}
+		if c.Enrichment.Pfx2AS.CheckInterval == 0 {
+			c.Enrichment.Pfx2AS.CheckInterval = 60
+		}
+	}
+
+	if c.Enrichment.RPKI.CheckInterval < 0 {
+		return fmt.Errorf("invalid rpki check_interval %d", c.Enrichment.RPKI.CheckInterval)
+	}
+	if c.Enrichment.RPKI.CheckInterval == 0 {
+		c.Enrichment.RPKI.CheckInterval = 60
+	}
+	c.Enrichment.RPKI.InvalidCommunities = nil
+	if c.Enrichment.RPKI.InvalidCommunity != "" {
+		value, err := parseCommunity(c.Enrichment.RPKI.InvalidCommunity)
+		if err != nil {
+			return fmt.Errorf("rpki: %w", err)
+		}
+		c.Enrichment.RPKI.InvalidCommunities = []uint32{value}
+	}
+
+	switch c.Validation.Mode {
+	case "":
+		c.Validation.Mode = ValidationForward
+	case ValidationForward, ValidationDrop, ValidationRepair:
+	default:
+		return fmt.Errorf("invalid validation mode %q (use %q, %q or %q)",
+			c.Validation.Mode, ValidationForward, ValidationDrop, ValidationRepair)
+	}
+
+	// Parse per-agent settings
+	c.agents = make(map[netip.Addr]*AgentConfig)
+	c.agentSources = make(map[netip.Addr]*AgentConfig)
+	for i := range c.Agents {
+		agent := &c.Agents[i]
+		switch {
+		case agent.Address != "" && agent.Source != "":
+			return fmt.Errorf("agent %s: use either address or source, not both", agent.Address)
+		case agent.Address != "":
+			addr, err := netip.ParseAddr(agent.Address)
+			if err != nil {
+				return fmt.Errorf("invalid agent address %q: %w", agent.Address, err)
+			}
+			agent.Addr = addr.Unmap()
+			if _, dup := c.agents[agent.Addr]; dup {
+				return fmt.Errorf("duplicate agent %s", agent.Address)
+			}
+			c.agents[agent.Addr] = agent
+		case agent.Source != "":
+			addr, err := netip.ParseAddr(agent.Source)
+			if err != nil {
+				return fmt.Errorf("invalid agent source %q: %w", agent.Source, err)
+			}
+			agent.SourceAddr = addr.Unmap()
+			if _, dup := c.agentSources[agent.SourceAddr]; dup {
+				return fmt.Errorf("duplicate agent source %s", agent.Source)
+			}
+			c.agentSources[agent.SourceAddr] = agent
+		default:
+			return fmt.Errorf("agent entry %d: address or source is required", i+1)
+		}
+
+		agent.AgentAddress = nil
+		if agent.SetAgentAddress != "" {
+			agent.AgentAddress = net.ParseIP(agent.SetAgentAddress)
+			if agent.AgentAddress == nil {
+				return fmt.Errorf("agent %s: invalid set_agent_address %q", agent.name(), agent.SetAgentAddress)
+			}
+			if ip4 := agent.AgentAddress.To4(); ip4 != nil {
+				agent.AgentAddress = ip4
+			}
+		}
+
+		switch agent.SamplingRateMode {
+		case "":
+			if agent.SamplingRate != 0 {
+				agent.SamplingRateMode = SamplingRateOverride
+			}
+		case SamplingRateOverride, SamplingRateFill:
+			if agent.SamplingRate == 0 {
+				return fmt.Errorf("agent %s: sampling_rate_mode %q needs sampling_rate", agent.name(), agent.SamplingRateMode)
+			}
+		default:
+			return fmt.Errorf("invalid sampling_rate_mode %q for agent %s (use %q or %q)",
+				agent.SamplingRateMode, agent.name(), SamplingRateOverride, SamplingRateFill)
+		}
+
+		switch agent.SamplePoolMode {
+		case "":
+			agent.SamplePoolMode = SamplePoolKeep
+			if agent.SamplingRate != 0 || agent.TargetSamplingRate != 0 {
+				agent.SamplePoolMode = SamplePoolRebuild
+			}
+		case SamplePoolKeep, SamplePoolRebuild:
+		default:
+			return fmt.Errorf("invalid sample_pool_mode %q for agent %s (use %q or %q)",
+				agent.SamplePoolMode, agent.name(), SamplePoolRebuild, SamplePoolKeep)
+		}
+
+		for old, ifIndex := range agent.IfIndexMap {
+			if old == 0 || ifIndex == 0 {
+				return fmt.Errorf("agent %s: invalid ifindex_map entry %d: %d", agent.name(), old, ifIndex)
+			}
+		}
+		for name, ifIndex := range agent.IfNameMap {
+			if name == "" || ifIndex == 0 {
+				return fmt.Errorf("agent %s: invalid ifname_map entry %q: %d", agent.name(), name, ifIndex)
+			}
+		}
+
+		for ifIndex, asn := range agent.PeerAS.Interfaces {
+			if ifIndex == 0 || asn == 0 {
+				return fmt.Errorf("agent %s: invalid peer_as interfaces entry %d: %d", agent.name(), ifIndex, asn)
+			}
+		}
+		agent.PeerAS.NextHopAddrs = make(map[netip.Addr]uint32, len(agent.PeerAS.NextHops))
+		for nextHop, asn := range agent.PeerAS.NextHops {
+			addr, err := netip.ParseAddr(nextHop)
+			if err != nil || asn == 0 {
+				return fmt.Errorf("agent %s: invalid peer_as next_hops entry %q: %d", agent.name(), nextHop, asn)
+			}
+			agent.PeerAS.NextHopAddrs[addr.Unmap()] = asn
+		}
+	}
+
+	if c.BGP.Enabled {
+		if err := c.BGP.parse(); err != nil {
+			return fmt.Errorf("bgp: %w", err)
+		}
+	}
+
+	if c.BMP.Enabled {
+		if err := c.BMP.parse(); err != nil {
+			return fmt.Errorf("bmp: %w", err)
+		}
 	}
 
 	// Parse whitelist networks
@@ -171,6 +727,11 @@ func (c *Config) Reload(path string) error {
 
 	// Update reloadable fields
 	c.Enrichment = newCfg.Enrichment
+	c.ruleTable.Store(newCfg.ruleTable.Load())
+	c.Validation = newCfg.Validation
+	c.Agents = newCfg.Agents
+	c.agents = newCfg.agents
+	c.agentSources = newCfg.agentSources
 	c.Security = newCfg.Security
 	c.Telegram = newCfg.Telegram
 	c.Logging.Level = newCfg.Logging.Level
@@ -186,6 +747,63 @@ func (c *Config) GetEnrichmentRules() []EnrichmentRule {
 	return rules
 }
 
+// Rules returns the compiled enrichment rules, for the packet path. It does not
+// lock: Reload swaps in a new table atomically.
+func (c *Config) Rules() *RuleTable {
+	return c.ruleTable.Load()
+}
+
+// DatagramSplit returns the maximum forwarded datagram size (0 = unlimited)
+// and the sequence numbering strategy for split datagrams
+func (c *Config) DatagramSplit() (maxSize int, sequence string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Enrichment.MaxDatagramSize, c.Enrichment.SplitSequence
+}
+
+// Pfx2AS returns the prefix-to-origin-AS file settings; File is empty if unset
+func (c *Config) Pfx2AS() Pfx2ASConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Enrichment.Pfx2AS
+}
+
+// RPKI returns the VRP file settings; File is empty if unset
+func (c *Config) RPKI() RPKIConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Enrichment.RPKI
+}
+
+// Agent returns the settings for datagrams of an agent received from source:
+// the entry for the agent address, else the entry for the UDP source address,
+// else nil. The result is shared and must not be modified; Reload replaces it
+// as a whole.
+func (c *Config) Agent(agentAddr, source netip.Addr) *AgentConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if agent, ok := c.agents[agentAddr]; ok {
+		return agent
+	}
+	return c.agentSources[source]
+}
+
+// GetAgents returns a copy of the per-agent settings
+func (c *Config) GetAgents() []AgentConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	agents := make([]AgentConfig, len(c.Agents))
+	copy(agents, c.Agents)
+	return agents
+}
+
+// ValidationMode returns how structurally invalid datagrams are handled
+func (c *Config) ValidationMode() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Validation.Mode
+}
+
 func (c *Config) IsWhitelisted(ip net.IP) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -209,3 +827,13 @@ func (c *Config) ListenAddr() string {
 func (c *Config) HTTPAddr() string {
 	return fmt.Sprintf("%s:%d", c.HTTP.Address, c.HTTP.Port)
 }
+
+// BGPAddr returns the BGP speaker's listen address
+func (c *Config) BGPAddr() string {
+	return net.JoinHostPort(c.BGP.Address, strconv.Itoa(c.BGP.Port))
+}
+
+// BMPAddr returns the BMP collector's listen address
+func (c *Config) BMPAddr() string {
+	return net.JoinHostPort(c.BMP.Address, strconv.Itoa(c.BMP.Port))
+}
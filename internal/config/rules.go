@@ -0,0 +1,88 @@
+package config
+
+import (
+	"net/netip"
+
+	"sflow-enricher/internal/lpm"
+)
+
+// RuleTable holds the enrichment rules compiled into one longest-prefix-match
+// trie per match_on mode in use. It is built by Load and Reload and never
+// modified afterwards, so the packet path reads it without locking.
+type RuleTable struct {
+	rules      []EnrichmentRule
+	tries      []ruleTrie
+	synthesize bool
+}
+
+type ruleTrie struct {
+	matchOn string
+	trie    *lpm.Table[[]int] // indexes of the rules with the prefix, in config order
+}
+
+func newRuleTable(rules []EnrichmentRule) *RuleTable {
+	t := &RuleTable{rules: rules}
+	builders := make(map[string]*lpm.Builder[[]int])
+	for i := range rules {
+		rule := &rules[i]
+		if rule.SynthesizeGateway {
+			t.synthesize = true
+		}
+		b, ok := builders[rule.MatchOn]
+		if !ok {
+			b = &lpm.Builder[[]int]{}
+			builders[rule.MatchOn] = b
+			t.tries = append(t.tries, ruleTrie{matchOn: rule.MatchOn})
+		}
+		ones, _ := rule.IPNet.Mask.Size()
+		addr, _ := netip.AddrFromSlice(rule.IPNet.IP)
+		index := i
+		b.Update(netip.PrefixFrom(addr.Unmap(), ones), func(old []int, _ bool) []int {
+			return append(old, index)
+		})
+	}
+	for i := range t.tries {
+		t.tries[i].trie = builders[t.tries[i].matchOn].Build()
+	}
+	return t
+}
+
+// Rules returns the rules in config order. The slice is shared and must not be modified.
+func (t *RuleTable) Rules() []EnrichmentRule {
+	return t.rules
+}
+
+// UsesMatchOn reports whether any rule has the given match_on mode
+func (t *RuleTable) UsesMatchOn(matchOn string) bool {
+	for _, rt := range t.tries {
+		if rt.matchOn == matchOn {
+			return true
+		}
+	}
+	return false
+}
+
+// Synthesizes reports whether any rule has synthesize_gateway
+func (t *RuleTable) Synthesizes() bool {
+	return t.synthesize
+}
+
+// Lookup calls fn for the rules with the given match_on mode whose network
+// contains addr: most specific prefix first, rules with the same prefix in
+// config order, until fn returns false. index is the rule's position in Rules.
+func (t *RuleTable) Lookup(matchOn string, addr netip.Addr, fn func(rule *EnrichmentRule, index, prefixLen int) bool) {
+	for _, rt := range t.tries {
+		if rt.matchOn != matchOn {
+			continue
+		}
+		rt.trie.LookupAll(addr, func(indexes []int, prefixLen int) bool {
+			for _, i := range indexes {
+				if !fn(&t.rules[i], i, prefixLen) {
+					return false
+				}
+			}
+			return true
+		})
+		return
+	}
+}
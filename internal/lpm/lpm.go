@@ -0,0 +1,360 @@
+// Package lpm implements longest-prefix-match tables for IPv4 and IPv6
+// prefixes: a path-compressed binary (radix) trie per address family, either
+// mutable (Trie) or built once and shared (Table).
+// A lookup visits at most one node per prefix bit, whatever the table size.
+package lpm
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// key holds prefix bits left-aligned: IPv4 uses the top 32 bits of key[0]
+type key [2]uint64
+
+type node[V any] struct {
+	key   key
+	bits  int // prefix length
+	child [2]*node[V]
+	value V
+	set   bool // node holds a prefix (not just a branch point)
+}
+
+// Trie is a mutable longest-prefix-match table. It is not safe for concurrent
+// use: callers that update it while others look up must lock.
+type Trie[V any] struct {
+	v4, v6 *node[V]
+	len    int
+}
+
+// Builder collects prefixes for a Table. It is not safe for concurrent use.
+type Builder[V any] struct {
+	trie Trie[V]
+}
+
+// Table is an immutable longest-prefix-match table built by a Builder.
+// It is safe for concurrent lookups.
+type Table[V any] struct {
+	trie Trie[V]
+}
+
+func addrKey(addr netip.Addr) key {
+	b := addr.As16()
+	if addr.Is4() {
+		return key{uint64(b[12])<<56 | uint64(b[13])<<48 | uint64(b[14])<<40 | uint64(b[15])<<32, 0}
+	}
+	var k key
+	for i := 0; i < 8; i++ {
+		k[0] = k[0]<<8 | uint64(b[i])
+		k[1] = k[1]<<8 | uint64(b[8+i])
+	}
+	return k
+}
+
+// bit returns bit i of k (0 = most significant)
+func (k key) bit(i int) int {
+	return int(k[i/64]>>(63-uint(i%64))) & 1
+}
+
+// masked returns k with all bits from n on cleared
+func (k key) masked(n int) key {
+	switch {
+	case n <= 0:
+		return key{}
+	case n < 64:
+		return key{k[0] &^ (^uint64(0) >> uint(n)), 0}
+	case n < 128:
+		return key{k[0], k[1] &^ (^uint64(0) >> uint(n-64))}
+	}
+	return k
+}
+
+// commonLen returns the number of leading bits a and b share, at most max
+func commonLen(a, b key, max int) int {
+	n := bits.LeadingZeros64(a[0] ^ b[0])
+	if n == 64 {
+		n += bits.LeadingZeros64(a[1] ^ b[1])
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// Insert adds a prefix, replacing the value of an identical prefix.
+// The prefix is masked to its length; an invalid prefix is ignored.
+func (t *Trie[V]) Insert(prefix netip.Prefix, value V) {
+	if !prefix.IsValid() {
+		return
+	}
+	prefix = prefix.Masked()
+	if insert(t.rootPtr(prefix.Addr()), addrKey(prefix.Addr()), prefix.Bits(), value) {
+		t.len++
+	}
+}
+
+// Update sets the value of a prefix from its current value, if any.
+// It avoids a separate lookup when values are accumulated (e.g. lists).
+func (t *Trie[V]) Update(prefix netip.Prefix, update func(old V, found bool) V) {
+	if !prefix.IsValid() {
+		return
+	}
+	prefix = prefix.Masked()
+	old, found := exact(*t.rootPtr(prefix.Addr()), addrKey(prefix.Addr()), prefix.Bits())
+	t.Insert(prefix, update(old, found))
+}
+
+// Get returns the value of an exact prefix
+func (t *Trie[V]) Get(prefix netip.Prefix) (V, bool) {
+	if !prefix.IsValid() {
+		var zero V
+		return zero, false
+	}
+	prefix = prefix.Masked()
+	return exact(*t.rootPtr(prefix.Addr()), addrKey(prefix.Addr()), prefix.Bits())
+}
+
+// Delete removes a prefix and reports whether it was present
+func (t *Trie[V]) Delete(prefix netip.Prefix) bool {
+	if !prefix.IsValid() {
+		return false
+	}
+	prefix = prefix.Masked()
+	k, length := addrKey(prefix.Addr()), prefix.Bits()
+
+	var parent **node[V]
+	n := t.rootPtr(prefix.Addr())
+	for *n != nil && (*n).bits <= length && commonLen((*n).key, k, (*n).bits) == (*n).bits {
+		cur := *n
+		if cur.bits != length {
+			parent = n
+			n = &cur.child[k.bit(cur.bits)]
+			continue
+		}
+		if !cur.set {
+			return false
+		}
+		var zero V
+		cur.value, cur.set = zero, false
+		t.len--
+		// Drop the node if it no longer branches, then its parent if that
+		// was a branch point for it only
+		compact(n)
+		if parent != nil {
+			compact(parent)
+		}
+		return true
+	}
+	return false
+}
+
+// compact replaces a node that holds no prefix and has at most one child by that child
+func compact[V any](n **node[V]) {
+	cur := *n
+	switch {
+	case cur.set:
+	case cur.child[0] == nil:
+		*n = cur.child[1]
+	case cur.child[1] == nil:
+		*n = cur.child[0]
+	}
+}
+
+// Len returns the number of prefixes in the trie
+func (t *Trie[V]) Len() int {
+	return t.len
+}
+
+func (t *Trie[V]) rootPtr(addr netip.Addr) **node[V] {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// Walk calls fn for every prefix, IPv4 first, each family in address order
+// with shorter prefixes before the longer ones they contain, until fn returns
+// false. The trie must not be modified during the walk.
+func (t *Trie[V]) Walk(fn func(prefix netip.Prefix, value V) bool) {
+	if walk(t.v4, true, fn) {
+		walk(t.v6, false, fn)
+	}
+}
+
+func walk[V any](n *node[V], is4 bool, fn func(netip.Prefix, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.set && !fn(netip.PrefixFrom(keyAddr(n.key, is4), n.bits), n.value) {
+		return false
+	}
+	return walk(n.child[0], is4, fn) && walk(n.child[1], is4, fn)
+}
+
+// keyAddr is the inverse of addrKey
+func keyAddr(k key, is4 bool) netip.Addr {
+	if is4 {
+		v := uint32(k[0] >> 32)
+		return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	}
+	var b [16]byte
+	for i := 0; i < 8; i++ {
+		b[i] = byte(k[0] >> (56 - 8*uint(i)))
+		b[8+i] = byte(k[1] >> (56 - 8*uint(i)))
+	}
+	return netip.AddrFrom16(b)
+}
+
+// Insert adds a prefix, replacing the value of an identical prefix.
+// The prefix is masked to its length; an invalid prefix is ignored.
+func (b *Builder[V]) Insert(prefix netip.Prefix, value V) {
+	b.trie.Insert(prefix, value)
+}
+
+// Update sets the value of a prefix from its current value, if any.
+// It avoids a separate lookup when values are accumulated (e.g. lists).
+func (b *Builder[V]) Update(prefix netip.Prefix, update func(old V, found bool) V) {
+	b.trie.Update(prefix, update)
+}
+
+// Len returns the number of prefixes inserted so far
+func (b *Builder[V]) Len() int {
+	return b.trie.len
+}
+
+// Build returns the table. The builder is reset and can be reused.
+func (b *Builder[V]) Build() *Table[V] {
+	t := &Table[V]{trie: b.trie}
+	*b = Builder[V]{}
+	return t
+}
+
+// insert adds key/length below *n and reports whether the prefix is new
+func insert[V any](n **node[V], k key, length int, value V) bool {
+	for {
+		cur := *n
+		if cur == nil {
+			*n = &node[V]{key: k, bits: length, value: value, set: true}
+			return true
+		}
+
+		common := commonLen(cur.key, k, min(cur.bits, length))
+		if common == cur.bits {
+			if length == cur.bits {
+				isNew := !cur.set
+				cur.value, cur.set = value, true
+				return isNew
+			}
+			n = &cur.child[k.bit(cur.bits)]
+			continue
+		}
+
+		// The new prefix diverges from cur, or contains it
+		leaf := &node[V]{key: k, bits: length, value: value, set: true}
+		if common == length {
+			leaf.child[cur.key.bit(length)] = cur
+			*n = leaf
+			return true
+		}
+		branch := &node[V]{key: k.masked(common), bits: common}
+		branch.child[k.bit(common)] = leaf
+		branch.child[cur.key.bit(common)] = cur
+		*n = branch
+		return true
+	}
+}
+
+// exact returns the value of an exact prefix
+func exact[V any](n *node[V], k key, length int) (V, bool) {
+	for n != nil && n.bits <= length && commonLen(n.key, k, n.bits) == n.bits {
+		if n.bits == length {
+			return n.value, n.set
+		}
+		n = n.child[k.bit(n.bits)]
+	}
+	var zero V
+	return zero, false
+}
+
+// Len returns the number of prefixes in the table
+func (t *Table[V]) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.trie.len
+}
+
+// Lookup returns the value of the longest prefix containing addr.
+// IPv4-mapped IPv6 addresses are looked up as IPv4.
+func (t *Table[V]) Lookup(addr netip.Addr) (value V, prefixLen int, ok bool) {
+	if t == nil {
+		return value, 0, false
+	}
+	return t.trie.Lookup(addr)
+}
+
+// LookupAll calls fn for every prefix containing addr, longest first, until fn
+// returns false. IPv4-mapped IPv6 addresses are looked up as IPv4.
+func (t *Table[V]) LookupAll(addr netip.Addr, fn func(value V, prefixLen int) bool) {
+	if t == nil {
+		return
+	}
+	t.trie.LookupAll(addr, fn)
+}
+
+func (t *Trie[V]) root(addr netip.Addr) (*node[V], int) {
+	if addr.Is4() {
+		return t.v4, 32
+	}
+	return t.v6, 128
+}
+
+// Lookup returns the value of the longest prefix containing addr.
+// IPv4-mapped IPv6 addresses are looked up as IPv4.
+func (t *Trie[V]) Lookup(addr netip.Addr) (value V, prefixLen int, ok bool) {
+	if !addr.IsValid() {
+		return value, 0, false
+	}
+	addr = addr.Unmap()
+	n, addrLen := t.root(addr)
+	k := addrKey(addr)
+	for n != nil && n.bits <= addrLen && commonLen(n.key, k, n.bits) == n.bits {
+		if n.set {
+			value, prefixLen, ok = n.value, n.bits, true
+		}
+		if n.bits == addrLen {
+			break
+		}
+		n = n.child[k.bit(n.bits)]
+	}
+	return value, prefixLen, ok
+}
+
+// LookupAll calls fn for every prefix containing addr, longest first, until fn
+// returns false. IPv4-mapped IPv6 addresses are looked up as IPv4.
+func (t *Trie[V]) LookupAll(addr netip.Addr, fn func(value V, prefixLen int) bool) {
+	if !addr.IsValid() {
+		return
+	}
+	addr = addr.Unmap()
+	n, addrLen := t.root(addr)
+	k := addrKey(addr)
+
+	var path [129]*node[V]
+	depth := 0
+	for n != nil && n.bits <= addrLen && commonLen(n.key, k, n.bits) == n.bits {
+		if n.set {
+			path[depth] = n
+			depth++
+		}
+		if n.bits == addrLen {
+			break
+		}
+		n = n.child[k.bit(n.bits)]
+	}
+	for i := depth - 1; i >= 0; i-- {
+		if !fn(path[i].value, path[i].bits) {
+			return
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package lpm
+
+import (
+	"math/rand"
+	"net/netip"
+	"sort"
+	"testing"
+)
+
+// oracle is a linear-scan longest-prefix-match table
+type oracle map[netip.Prefix]int
+
+func (o oracle) lookupAll(addr netip.Addr) []netip.Prefix {
+	addr = addr.Unmap()
+	var matches []netip.Prefix
+	for p := range o {
+		if p.Contains(addr) {
+			matches = append(matches, p)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Bits() > matches[j].Bits() })
+	return matches
+}
+
+func (o oracle) lookup(addr netip.Addr) (int, int, bool) {
+	matches := o.lookupAll(addr)
+	if len(matches) == 0 {
+		return 0, 0, false
+	}
+	return o[matches[0]], matches[0].Bits(), true
+}
+
+// randomAddr returns an address near base: base with its last bits randomized
+func randomAddr(r *rand.Rand, base netip.Addr) netip.Addr {
+	b := base.As16()
+	keep := r.Intn(base.BitLen() + 1)
+	start := 16 - base.BitLen()/8
+	for i := start; i < 16; i++ {
+		bit := (i - start) * 8
+		for j := 0; j < 8; j++ {
+			if bit+j >= keep && r.Intn(2) == 1 {
+				b[i] ^= 0x80 >> uint(j)
+			}
+		}
+	}
+	if base.Is4() {
+		return netip.AddrFrom4([4]byte(b[12:]))
+	}
+	return netip.AddrFrom16(b)
+}
+
+// randomPrefixes returns prefixes clustered around a few bases, so they nest
+// and share branch points, plus the edge lengths
+func randomPrefixes(r *rand.Rand, n int) []netip.Prefix {
+	bases := []netip.Addr{
+		netip.MustParseAddr("10.1.2.3"),
+		netip.MustParseAddr("192.0.2.200"),
+		netip.MustParseAddr("2001:db8:1:2::3"),
+		netip.MustParseAddr("2001:db8:ffff::1"),
+		netip.MustParseAddr("fe80::1"),
+	}
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("10.1.2.3/32"),
+		netip.MustParsePrefix("2001:db8:1:2::3/128"),
+	}
+	for len(prefixes) < n {
+		addr := randomAddr(r, bases[r.Intn(len(bases))])
+		prefixes = append(prefixes, netip.PrefixFrom(addr, r.Intn(addr.BitLen()+1)).Masked())
+	}
+	return prefixes
+}
+
+// randomQueries returns addresses inside and around the prefixes, and the
+// IPv4-mapped form of the IPv4 ones
+func randomQueries(r *rand.Rand, prefixes []netip.Prefix) []netip.Addr {
+	var queries []netip.Addr
+	for _, p := range prefixes {
+		queries = append(queries, p.Addr(), randomAddr(r, p.Addr()))
+	}
+	for _, q := range queries {
+		if q.Is4() {
+			queries = append(queries, netip.AddrFrom16(q.As16()))
+		}
+	}
+	return queries
+}
+
+func checkTrie(t *testing.T, trie *Trie[int], o oracle, queries []netip.Addr) {
+	t.Helper()
+	if trie.Len() != len(o) {
+		t.Fatalf("Len = %d, want %d", trie.Len(), len(o))
+	}
+	for _, q := range queries {
+		value, bits, ok := trie.Lookup(q)
+		wantValue, wantBits, wantOK := o.lookup(q)
+		if value != wantValue || bits != wantBits || ok != wantOK {
+			t.Fatalf("Lookup(%s) = %d, /%d, %v; want %d, /%d, %v", q, value, bits, ok, wantValue, wantBits, wantOK)
+		}
+
+		var all []netip.Prefix
+		trie.LookupAll(q, func(value, prefixLen int) bool {
+			all = append(all, netip.PrefixFrom(q.Unmap(), prefixLen).Masked())
+			return true
+		})
+		want := o.lookupAll(q)
+		if len(all) != len(want) {
+			t.Fatalf("LookupAll(%s) = %v, want %v", q, all, want)
+		}
+		for i := range all {
+			if all[i] != want[i] {
+				t.Fatalf("LookupAll(%s) = %v, want %v", q, all, want)
+			}
+		}
+	}
+	for p, want := range o {
+		if value, ok := trie.Get(p); !ok || value != want {
+			t.Fatalf("Get(%s) = %d, %v; want %d", p, value, ok, want)
+		}
+	}
+	checkCompact(t, trie.v4)
+	checkCompact(t, trie.v6)
+}
+
+// checkCompact checks that every node either holds a prefix or branches
+func checkCompact(t *testing.T, n *node[int]) {
+	t.Helper()
+	if n == nil {
+		return
+	}
+	if !n.set && (n.child[0] == nil || n.child[1] == nil) {
+		t.Fatalf("branch node /%d with fewer than two children", n.bits)
+	}
+	checkCompact(t, n.child[0])
+	checkCompact(t, n.child[1])
+}
+
+func TestTrieMatchesOracle(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		prefixes := randomPrefixes(r, 200)
+		queries := randomQueries(r, prefixes)
+
+		var trie Trie[int]
+		o := oracle{}
+		for i, p := range prefixes {
+			trie.Insert(p, i)
+			o[p] = i
+		}
+		checkTrie(t, &trie, o, queries)
+
+		// Delete half, with repeats and prefixes never inserted
+		for _, p := range prefixes[:len(prefixes)/2] {
+			_, present := o[p]
+			if trie.Delete(p) != present {
+				t.Fatalf("Delete(%s) = %v, want %v", p, !present, present)
+			}
+			delete(o, p)
+		}
+		for _, p := range randomPrefixes(r, 20) {
+			_, present := o[p]
+			if trie.Delete(p) != present {
+				t.Fatalf("Delete(%s) = %v, want %v", p, !present, present)
+			}
+			delete(o, p)
+		}
+		checkTrie(t, &trie, o, queries)
+
+		// Reinsert over the compacted trie
+		for i, p := range prefixes[:len(prefixes)/4] {
+			trie.Insert(p, -i)
+			o[p] = -i
+		}
+		checkTrie(t, &trie, o, queries)
+
+		for p := range o {
+			trie.Delete(p)
+		}
+		if trie.Len() != 0 || trie.v4 != nil || trie.v6 != nil {
+			t.Fatalf("trie not empty after deleting everything: len %d", trie.Len())
+		}
+	}
+}
+
+func TestTableMatchesOracle(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	prefixes := randomPrefixes(r, 500)
+	var b Builder[int]
+	o := oracle{}
+	for i, p := range prefixes {
+		b.Insert(p, i)
+		o[p] = i
+	}
+	table := b.Build()
+	if b.Len() != 0 {
+		t.Errorf("builder not reset: Len %d", b.Len())
+	}
+	checkTrie(t, &table.trie, o, randomQueries(r, prefixes))
+}
+
+func TestWalkOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	var trie Trie[int]
+	o := oracle{}
+	for i, p := range randomPrefixes(r, 300) {
+		trie.Insert(p, i)
+		o[p] = i
+	}
+
+	var walked []netip.Prefix
+	trie.Walk(func(p netip.Prefix, value int) bool {
+		if o[p] != value {
+			t.Fatalf("Walk gave %s = %d, want %d", p, value, o[p])
+		}
+		walked = append(walked, p)
+		return true
+	})
+	if len(walked) != len(o) {
+		t.Fatalf("Walk gave %d prefixes, want %d", len(walked), len(o))
+	}
+	for i := 1; i < len(walked); i++ {
+		a, b := walked[i-1], walked[i]
+		switch {
+		case a.Addr().Is4() != b.Addr().Is4():
+			if !a.Addr().Is4() {
+				t.Fatalf("IPv6 %s before IPv4 %s", a, b)
+			}
+		case a.Addr().Compare(b.Addr()) > 0:
+			t.Fatalf("%s before %s", a, b)
+		case a.Addr() == b.Addr() && a.Bits() > b.Bits():
+			t.Fatalf("%s before the shorter %s", a, b)
+		}
+	}
+
+	n := 0
+	trie.Walk(func(netip.Prefix, int) bool { n++; return n < 5 })
+	if n != 5 {
+		t.Errorf("Walk went on after fn returned false: %d calls", n)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	var trie Trie[[]int]
+	p := netip.MustParsePrefix("192.0.2.77/24") // masked on insert
+	for i := 0; i < 3; i++ {
+		trie.Update(p, func(old []int, found bool) []int {
+			if found != (i > 0) {
+				t.Fatalf("update %d: found = %v", i, found)
+			}
+			return append(old, i)
+		})
+	}
+	values, ok := trie.Get(netip.MustParsePrefix("192.0.2.0/24"))
+	if !ok || len(values) != 3 || trie.Len() != 1 {
+		t.Errorf("Get = %v, %v with Len %d", values, ok, trie.Len())
+	}
+}
+
+func TestInvalidInput(t *testing.T) {
+	var trie Trie[int]
+	trie.Insert(netip.Prefix{}, 1)
+	if trie.Len() != 0 || trie.Delete(netip.Prefix{}) {
+		t.Error("invalid prefix was inserted")
+	}
+	if _, _, ok := trie.Lookup(netip.Addr{}); ok {
+		t.Error("Lookup of the zero address matched")
+	}
+	var table *Table[int]
+	if _, _, ok := table.Lookup(netip.MustParseAddr("192.0.2.1")); ok || table.Len() != 0 {
+		t.Error("nil table matched")
+	}
+}
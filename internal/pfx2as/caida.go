@@ -0,0 +1,70 @@
+package pfx2as
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"sflow-enricher/internal/lpm"
+)
+
+// ReadCAIDA reads a CAIDA Routeviews pfx2as file: one "prefix length ASN" line
+// per prefix, separated by tabs or spaces. "prefix/length ASN" and
+// "prefix/length,ASN" lines are accepted too. For multi-origin prefixes
+// ("64500_64501") and AS sets ("64500,64501") the first ASN is used. Empty
+// lines and lines starting with '#' are ignored; malformed lines are skipped.
+func ReadCAIDA(r io.Reader) (*Table, error) {
+	var b lpm.Builder[uint32]
+	skipped := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		prefix, asn, ok := parseCAIDALine(line)
+		if !ok {
+			skipped++
+			continue
+		}
+		b.Insert(prefix, asn)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &Table{trie: b.Build(), skipped: skipped}, nil
+}
+
+func parseCAIDALine(line string) (netip.Prefix, uint32, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		fields = strings.SplitN(line, ",", 2)
+	}
+
+	var prefix netip.Prefix
+	var err error
+	switch {
+	case len(fields) == 2 && strings.Contains(fields[0], "/"):
+		prefix, err = netip.ParsePrefix(fields[0])
+	case len(fields) == 3:
+		prefix, err = netip.ParsePrefix(fields[0] + "/" + fields[1])
+	default:
+		return prefix, 0, false
+	}
+	if err != nil {
+		return prefix, 0, false
+	}
+
+	origin := fields[len(fields)-1]
+	if i := strings.IndexAny(origin, "_,"); i >= 0 {
+		origin = origin[:i]
+	}
+	asn, err := strconv.ParseUint(origin, 10, 32)
+	if err != nil || asn == 0 {
+		return prefix, 0, false
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()), uint32(asn), true
+}
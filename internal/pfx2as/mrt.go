@@ -0,0 +1,191 @@
+package pfx2as
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"sflow-enricher/internal/lpm"
+)
+
+// MRT record types and TABLE_DUMP_V2 subtypes (RFC 6396, RFC 8050)
+const (
+	mrtTypeTableDumpV2 = 13
+
+	mrtRIBIPv4Unicast        = 2
+	mrtRIBIPv6Unicast        = 4
+	mrtRIBIPv4UnicastAddPath = 8
+	mrtRIBIPv6UnicastAddPath = 10
+)
+
+// BGP path attribute constants
+const (
+	bgpAttrFlagExtendedLength = 0x10
+	bgpAttrASPath             = 2
+
+	bgpASSet      = 1
+	bgpASSequence = 2
+)
+
+const mrtHeaderLen = 12
+
+// ReadMRT reads an MRT TABLE_DUMP_V2 RIB dump (e.g. RouteViews or RIPE RIS
+// bview files). The origin of a prefix is the last ASN of the AS_PATH of its
+// first RIB entry that has one; a path ending in an AS_SET is used only if the
+// set has a single member. Records other than IPv4/IPv6 unicast RIB entries
+// are skipped.
+func ReadMRT(r io.Reader) (*Table, error) {
+	var b lpm.Builder[uint32]
+	skipped := 0
+
+	var header [mrtHeaderLen]byte
+	var body []byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("MRT header: %w", err)
+		}
+		recordType := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := int(binary.BigEndian.Uint32(header[8:12]))
+
+		if cap(body) < length {
+			body = make([]byte, length)
+		}
+		body = body[:length]
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("MRT record: %w", err)
+		}
+		if recordType != mrtTypeTableDumpV2 {
+			continue
+		}
+
+		var v6, addPath bool
+		switch subtype {
+		case mrtRIBIPv4Unicast:
+		case mrtRIBIPv6Unicast:
+			v6 = true
+		case mrtRIBIPv4UnicastAddPath:
+			addPath = true
+		case mrtRIBIPv6UnicastAddPath:
+			v6, addPath = true, true
+		default:
+			continue
+		}
+
+		prefix, asn, err := parseRIBEntry(body, v6, addPath)
+		if err != nil {
+			return nil, err
+		}
+		if asn == 0 {
+			skipped++
+			continue
+		}
+		b.Insert(prefix, asn)
+	}
+	return &Table{trie: b.Build(), skipped: skipped}, nil
+}
+
+var errMRTTruncated = errors.New("truncated MRT RIB record")
+
+// parseRIBEntry returns the prefix and origin AS of a RIB_IPV4/IPV6_UNICAST
+// record, or origin 0 if no entry has a usable AS_PATH
+func parseRIBEntry(data []byte, v6, addPath bool) (netip.Prefix, uint32, error) {
+	// sequence number (4), prefix length (1), prefix, entry count (2)
+	if len(data) < 5 {
+		return netip.Prefix{}, 0, errMRTTruncated
+	}
+	bits := int(data[4])
+	maxBits := 32
+	if v6 {
+		maxBits = 128
+	}
+	if bits > maxBits {
+		return netip.Prefix{}, 0, fmt.Errorf("invalid MRT prefix length %d", bits)
+	}
+	n := (bits + 7) / 8
+	pos := 5 + n
+	if len(data) < pos+2 {
+		return netip.Prefix{}, 0, errMRTTruncated
+	}
+	var addr [16]byte
+	copy(addr[:], data[5:pos])
+	var prefix netip.Prefix
+	if v6 {
+		prefix = netip.PrefixFrom(netip.AddrFrom16(addr), bits)
+	} else {
+		prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte(addr[:4])), bits)
+	}
+
+	count := int(binary.BigEndian.Uint16(data[pos:]))
+	pos += 2
+	for i := 0; i < count; i++ {
+		// peer index (2), originated time (4), [path identifier (4)], attribute length (2)
+		pos += 6
+		if addPath {
+			pos += 4
+		}
+		if len(data) < pos+2 {
+			return prefix, 0, errMRTTruncated
+		}
+		attrLen := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+		if len(data) < pos+attrLen {
+			return prefix, 0, errMRTTruncated
+		}
+		if asn := originFromAttributes(data[pos : pos+attrLen]); asn != 0 {
+			return prefix, asn, nil
+		}
+		pos += attrLen
+	}
+	return prefix, 0, nil
+}
+
+// originFromAttributes returns the origin AS from the AS_PATH attribute in a
+// list of BGP path attributes. TABLE_DUMP_V2 always encodes 4-byte ASNs.
+func originFromAttributes(attrs []byte) uint32 {
+	for len(attrs) >= 3 {
+		flags, attrType := attrs[0], attrs[1]
+		var length, hdr int
+		if flags&bgpAttrFlagExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return 0
+			}
+			length, hdr = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		} else {
+			length, hdr = int(attrs[2]), 3
+		}
+		if len(attrs) < hdr+length {
+			return 0
+		}
+		if attrType == bgpAttrASPath {
+			return originFromASPath(attrs[hdr : hdr+length])
+		}
+		attrs = attrs[hdr+length:]
+	}
+	return 0
+}
+
+func originFromASPath(path []byte) uint32 {
+	var origin uint32
+	for len(path) >= 2 {
+		segType, count := path[0], int(path[1])
+		if len(path) < 2+4*count {
+			return 0
+		}
+		origin = 0
+		switch {
+		case count == 0:
+		case segType == bgpASSequence:
+			origin = binary.BigEndian.Uint32(path[2+4*(count-1):])
+		case segType == bgpASSet && count == 1:
+			origin = binary.BigEndian.Uint32(path[2:])
+		}
+		path = path[2+4*count:]
+	}
+	return origin
+}
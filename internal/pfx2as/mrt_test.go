@@ -0,0 +1,220 @@
+package pfx2as
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mrtRecord returns an MRT record: timestamp, type, subtype, length, body
+func mrtRecord(recordType, subtype uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 1700000000)
+	b = binary.BigEndian.AppendUint16(b, recordType)
+	b = binary.BigEndian.AppendUint16(b, subtype)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// ribRecord returns a TABLE_DUMP_V2 RIB record of prefix with the entries,
+// in the ADD-PATH subtype if addPath is set
+func ribRecord(prefix string, addPath bool, entries ...[]byte) []byte {
+	p := netip.MustParsePrefix(prefix)
+	subtype := uint16(mrtRIBIPv4Unicast)
+	if p.Addr().Is6() {
+		subtype = mrtRIBIPv6Unicast
+	}
+	if addPath {
+		subtype += 6 // 2 -> 8, 4 -> 10
+	}
+	body := binary.BigEndian.AppendUint32(nil, 42)
+	body = append(body, byte(p.Bits()))
+	body = append(body, p.Addr().AsSlice()[:(p.Bits()+7)/8]...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(entries)))
+	for _, e := range entries {
+		body = append(body, e...)
+	}
+	return mrtRecord(mrtTypeTableDumpV2, subtype, body)
+}
+
+// ribEntry returns a RIB entry with the path attributes
+func ribEntry(addPath bool, attrs ...[]byte) []byte {
+	e := binary.BigEndian.AppendUint16(nil, 0)
+	e = binary.BigEndian.AppendUint32(e, 1700000000)
+	if addPath {
+		e = binary.BigEndian.AppendUint32(e, 7)
+	}
+	all := bytes.Join(attrs, nil)
+	e = binary.BigEndian.AppendUint16(e, uint16(len(all)))
+	return append(e, all...)
+}
+
+// attribute returns a BGP path attribute, with a 2-byte length if extended
+func attribute(attrType byte, extended bool, value []byte) []byte {
+	if extended {
+		return append(binary.BigEndian.AppendUint16([]byte{0x40 | bgpAttrFlagExtendedLength, attrType}, uint16(len(value))), value...)
+	}
+	return append([]byte{0x40, attrType, byte(len(value))}, value...)
+}
+
+// segment returns an AS_PATH segment with 4-byte ASNs
+func segment(segType byte, asns ...uint32) []byte {
+	s := []byte{segType, byte(len(asns))}
+	for _, asn := range asns {
+		s = binary.BigEndian.AppendUint32(s, asn)
+	}
+	return s
+}
+
+func asPath(segments ...[]byte) []byte {
+	return attribute(bgpAttrASPath, false, bytes.Join(segments, nil))
+}
+
+var originIGP = attribute(1, false, []byte{0})
+
+// testRIB returns a RIB dump with a record of each kind ReadMRT handles
+func testRIB() []byte {
+	return bytes.Join([][]byte{
+		mrtRecord(mrtTypeTableDumpV2, 1, []byte("peer index table")),
+		ribRecord("192.0.2.0/24", false, ribEntry(false, originIGP, asPath(segment(bgpASSequence, 3356, 64500)))),
+		ribRecord("2001:db8::/32", false, ribEntry(false, asPath(segment(bgpASSequence, 174, 64501)))),
+		ribRecord("198.51.100.0/24", true, ribEntry(true, asPath(segment(bgpASSequence, 64502)))),
+		ribRecord("2001:db8:1::/48", true, ribEntry(true, originIGP, asPath(segment(bgpASSequence, 6939, 64503)))),
+		// A path ending in a single-member AS_SET
+		ribRecord("203.0.113.0/25", false, ribEntry(false, asPath(segment(bgpASSequence, 3356), segment(bgpASSet, 64504)))),
+		// The first entry ends in a multi-member AS_SET, the second is used
+		ribRecord("203.0.113.128/25", false,
+			ribEntry(false, asPath(segment(bgpASSequence, 3356), segment(bgpASSet, 64505, 64506))),
+			ribEntry(false, asPath(segment(bgpASSequence, 174, 64507)))),
+		// No entry with a usable origin: skipped
+		ribRecord("10.0.0.0/8", false,
+			ribEntry(false, asPath(segment(bgpASSequence, 3356), segment(bgpASSet, 64505, 64506))),
+			ribEntry(false, originIGP)),
+		ribRecord("100.64.0.0/10", false, ribEntry(false, originIGP,
+			attribute(bgpAttrASPath, true, segment(bgpASSequence, 3356, 64508)))),
+		// BGP4MP records are not RIB entries
+		mrtRecord(16, 4, []byte{1, 2, 3, 4}),
+	}, nil)
+}
+
+func TestReadMRT(t *testing.T) {
+	table, err := ReadMRT(bytes.NewReader(testRIB()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Len() != 7 || table.Skipped() != 1 {
+		t.Errorf("Len %d, Skipped %d; want 7, 1", table.Len(), table.Skipped())
+	}
+	for addr, want := range map[string]uint32{
+		"192.0.2.1":     64500,
+		"2001:db8::1":   64501,
+		"198.51.100.1":  64502,
+		"2001:db8:1::1": 64503,
+		"203.0.113.1":   64504,
+		"203.0.113.129": 64507,
+		"100.64.0.1":    64508,
+		"10.0.0.1":      0,
+	} {
+		asn, ok := table.Lookup(netip.MustParseAddr(addr))
+		if asn != want || ok != (want != 0) {
+			t.Errorf("Lookup(%s) = %d, %v; want %d", addr, asn, ok, want)
+		}
+	}
+	if bits, _ := table.PrefixLen(netip.MustParseAddr("2001:db8:1::1")); bits != 48 {
+		t.Errorf("PrefixLen = %d, want 48", bits)
+	}
+}
+
+func TestReadMRTTruncated(t *testing.T) {
+	record := ribRecord("192.0.2.0/24", false, ribEntry(false, asPath(segment(bgpASSequence, 64500))))
+	body := record[mrtHeaderLen:]
+	rib := func(body []byte) []byte { return mrtRecord(mrtTypeTableDumpV2, mrtRIBIPv4Unicast, body) }
+
+	tests := map[string][]byte{
+		"header":             record[:7],
+		"body":               record[:len(record)-1],
+		"prefix":             rib(body[:7]),
+		"entry count":        rib(body[:9]),
+		"entry header":       rib(body[:15]),
+		"attributes":         rib(body[:len(body)-1]),
+		"prefix length":      rib(append(append([]byte{}, body[:4]...), append([]byte{33}, body[5:]...)...)),
+		"after a good entry": append(testRIB(), record[:len(record)-3]...),
+	}
+	for name, data := range tests {
+		if _, err := ReadMRT(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestOriginFromAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs []byte
+		want  uint32
+	}{
+		{"AS_SEQUENCE", asPath(segment(bgpASSequence, 3356, 64500)), 64500},
+		{"after other attributes", bytes.Join([][]byte{originIGP, attribute(3, false, []byte{10, 0, 0, 1}), asPath(segment(bgpASSequence, 64500))}, nil), 64500},
+		{"extended length", attribute(bgpAttrASPath, true, segment(bgpASSequence, 3356, 64500)), 64500},
+		{"single-member AS_SET last", asPath(segment(bgpASSequence, 3356), segment(bgpASSet, 64500)), 64500},
+		{"multi-member AS_SET last", asPath(segment(bgpASSequence, 3356), segment(bgpASSet, 64500, 64501)), 0},
+		{"AS_SET then AS_SEQUENCE", asPath(segment(bgpASSet, 64500, 64501), segment(bgpASSequence, 64502)), 64502},
+		{"empty segment last", asPath(segment(bgpASSequence, 3356), segment(bgpASSequence)), 0},
+		{"empty AS_PATH", asPath(), 0},
+		{"no AS_PATH", originIGP, 0},
+		{"segment past the attribute", attribute(bgpAttrASPath, false, []byte{bgpASSequence, 2, 0, 0, 0xfd, 0xf4}), 0},
+		{"attribute past the list", []byte{0x40, bgpAttrASPath, 6, bgpASSequence, 1, 0, 0}, 0},
+		{"extended length cut", []byte{0x50, bgpAttrASPath, 0}, 0},
+	}
+	for _, tt := range tests {
+		if got := originFromAttributes(tt.attrs); got != tt.want {
+			t.Errorf("%s: origin %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "rib.mrt")
+	if err := os.WriteFile(plain, testRIB(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	compressed := filepath.Join(dir, "rib.mrt.gz")
+	f, err := os.Create(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write(testRIB())
+	gz.Close()
+	f.Close()
+
+	for _, path := range []string{plain, compressed} {
+		table, err := Load(path, FormatMRT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asn, _ := table.Lookup(netip.MustParseAddr("100.64.0.1")); table.Len() != 7 || asn != 64508 {
+			t.Errorf("%s: Len %d, origin %d", filepath.Base(path), table.Len(), asn)
+		}
+	}
+
+	// A .gz name that is not gzip, a format mismatch and a table without prefixes
+	if _, err := Load(plain, "bgpdump"); err == nil {
+		t.Error("unknown format loaded")
+	}
+	notGzip := filepath.Join(dir, "rib.gz")
+	os.WriteFile(notGzip, testRIB(), 0o644)
+	if _, err := Load(notGzip, FormatMRT); err == nil {
+		t.Error("uncompressed .gz file loaded")
+	}
+	empty := filepath.Join(dir, "empty.mrt")
+	os.WriteFile(empty, ribRecord("10.0.0.0/8", false, ribEntry(false, originIGP)), 0o644)
+	if _, err := Load(empty, FormatMRT); err == nil || !strings.Contains(err.Error(), "no prefixes") {
+		t.Errorf("Load of a dump without origins: %v", err)
+	}
+}
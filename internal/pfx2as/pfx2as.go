@@ -0,0 +1,91 @@
+// Package pfx2as loads prefix-to-origin-AS tables: CAIDA-style pfx2as text
+// files and MRT TABLE_DUMP_V2 RIB dumps (RFC 6396), optionally gzip or bzip2
+// compressed. Tables are immutable and safe for concurrent lookups.
+package pfx2as
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"sflow-enricher/internal/lpm"
+)
+
+// File formats
+const (
+	FormatCAIDA = "caida" // "prefix<TAB>length<TAB>ASN" or "prefix/length,ASN" lines
+	FormatMRT   = "mrt"   // MRT TABLE_DUMP_V2 RIB dump; origin is the last ASN of the AS path
+)
+
+// Table maps prefixes to their origin AS by longest prefix match
+type Table struct {
+	trie    *lpm.Table[uint32]
+	skipped int
+}
+
+// Lookup returns the origin AS of the longest prefix containing addr
+func (t *Table) Lookup(addr netip.Addr) (uint32, bool) {
+	asn, _, ok := t.trie.Lookup(addr)
+	return asn, ok
+}
+
+// PrefixLen returns the length of the longest prefix in the table containing addr
+func (t *Table) PrefixLen(addr netip.Addr) (int, bool) {
+	_, bits, ok := t.trie.Lookup(addr)
+	return bits, ok
+}
+
+// Len returns the number of prefixes in the table
+func (t *Table) Len() int {
+	return t.trie.Len()
+}
+
+// Skipped returns the number of entries that could not be used: malformed
+// lines, or RIB entries without a usable origin AS
+func (t *Table) Skipped() int {
+	return t.skipped
+}
+
+// Load reads a table from a file. Files ending in .gz or .bz2 are decompressed.
+func Load(path, format string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReaderSize(f, 1<<20)
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = bufio.NewReaderSize(gz, 1<<20)
+	case strings.HasSuffix(path, ".bz2"):
+		r = bufio.NewReaderSize(bzip2.NewReader(r), 1<<20)
+	}
+
+	var t *Table
+	switch format {
+	case FormatCAIDA:
+		t, err = ReadCAIDA(r)
+	case FormatMRT:
+		t, err = ReadMRT(r)
+	default:
+		return nil, fmt.Errorf("unknown pfx2as format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if t.Len() == 0 {
+		return nil, fmt.Errorf("%s: no prefixes found (%d entries skipped)", path, t.skipped)
+	}
+	return t, nil
+}
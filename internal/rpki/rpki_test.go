@@ -0,0 +1,125 @@
+package rpki
+
+import (
+	"compress/gzip"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testExport = `{"metadata": {"generated": 1700000000}, "roas": [
+	{"prefix": "192.0.2.0/24", "maxLength": 24, "asn": 64496, "ta": "ripe"},
+	{"prefix": "198.51.100.0/22", "maxLength": 24, "asn": "AS64500"},
+	{"prefix": "198.51.100.0/24", "maxLength": 24, "asn": 0},
+	{"prefix": "198.51.100.0/24", "asn": 64501},
+	{"prefix": "203.0.113.77/24", "maxLength": 25, "asn": 64502},
+	{"prefix": "2001:db8::/32", "maxLength": 48, "asn": 64503},
+	{"prefix": "2001:db8::/32", "maxLength": 48, "asn": 64504},
+	{"prefix": "10.0.0.0/8", "maxLength": 7, "asn": 64505},
+	{"prefix": "10.0.0.0/8", "maxLength": 33, "asn": 64505},
+	{"prefix": "2001:db8::/129", "asn": 64505},
+	{"prefix": "not a prefix", "asn": 64505}
+]}`
+
+func readTestTable(t *testing.T) *Table {
+	t.Helper()
+	table, err := Read(strings.NewReader(testExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestRead(t *testing.T) {
+	table := readTestTable(t)
+	if table.Len() != 7 || table.Skipped() != 4 {
+		t.Errorf("Len %d, Skipped %d; want 7, 4", table.Len(), table.Skipped())
+	}
+
+	for _, data := range []string{`{"roas": [{"prefix": "192.0.2.0/24", "asn": "ASx"}]}`, `[`} {
+		if _, err := Read(strings.NewReader(data)); err == nil {
+			t.Errorf("Read(%s) succeeded", data)
+		}
+	}
+}
+
+// Route origin validation as in RFC 6811 section 2: a VRP covers a route if
+// its prefix contains the route's; a covering VRP matches if it has the
+// route's origin AS and its maxLength is at least the route's prefix length
+func TestValidate(t *testing.T) {
+	table := readTestTable(t)
+	tests := []struct {
+		name  string
+		route string
+		asn   uint32
+		want  State
+	}{
+		{"exact match", "192.0.2.0/24", 64496, Valid},
+		{"other origin", "192.0.2.0/24", 64497, Invalid},
+		{"longer than maxLength", "192.0.2.128/25", 64496, Invalid},
+		{"less specific than the VRP", "192.0.2.0/23", 64496, NotFound},
+		{"AS 0 never matches", "192.0.2.0/24", 0, Invalid},
+		{"no VRP", "100.64.0.0/10", 64496, NotFound},
+		{"within maxLength", "198.51.101.0/24", 64500, Valid},
+		{"covering VRP with maxLength", "198.51.100.0/23", 64500, Valid},
+		{"beyond maxLength", "198.51.101.0/25", 64500, Invalid},
+		{"one of several matching", "198.51.100.0/24", 64500, Valid},
+		{"less specific VRP authorizes", "198.51.100.0/24", 64501, Valid},
+		{"AS 0 VRP covers", "198.51.100.0/24", 64502, Invalid},
+		{"maxLength of the more specific VRP", "198.51.100.0/25", 64501, Invalid},
+		{"masked on read", "203.0.113.0/25", 64502, Valid},
+		{"IPv6 second ASN", "2001:db8:1::/48", 64504, Valid},
+		{"IPv6 beyond maxLength", "2001:db8:1::/64", 64503, Invalid},
+		{"IPv6 default route", "::/0", 64503, NotFound},
+		{"skipped VRPs", "10.0.0.0/8", 64505, NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := netip.MustParsePrefix(tt.route)
+			// Any address of the route gives the same state
+			for _, addr := range []netip.Addr{route.Addr(), lastAddr(route)} {
+				if got := table.Validate(addr, route.Bits(), tt.asn); got != tt.want {
+					t.Errorf("Validate(%s, %d, %d) = %s, want %s", addr, route.Bits(), tt.asn, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vrps.json.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(testExport))
+	gz.Close()
+	f.Close()
+
+	table, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Len() != 7 {
+		t.Errorf("Len %d, want 7", table.Len())
+	}
+
+	empty := filepath.Join(dir, "empty.json")
+	os.WriteFile(empty, []byte(`{"roas": [{"prefix": "bad", "asn": 1}]}`), 0o644)
+	if _, err := Load(empty); err == nil || !strings.Contains(err.Error(), "no VRPs") {
+		t.Errorf("Load of a file without VRPs: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// gatewayRecord locates the fields of an extended gateway record inside a packet.
+// All offsets are absolute.
+type gatewayRecord struct {
+	sampleOffset   int
+	sampleLen      uint32
+	recordOffset   int
+	recordLen      uint32
+	dataStart      int
+	segmentsOffset int // dst_as_path segment count
+	pathEnd        int // end of the last dst_as_path segment (communities count)
+	segments       uint32
+	recordEnd      int
+}
+
+// findGatewayRecord validates the sample and extended gateway record at the given
+// offsets and locates its dst_as_path
+func findGatewayRecord(packet []byte, sampleOffset int, recordOffset int) (gatewayRecord, bool) {
+	var g gatewayRecord
+	if sampleOffset+8 > len(packet) {
+		return g, false
+	}
+
+	g.sampleOffset = sampleOffset
+	g.sampleLen = binary.BigEndian.Uint32(packet[sampleOffset+4:])
+	sampleDataStart := sampleOffset + 8
+	sampleDataEnd := sampleDataStart + int(g.sampleLen)
+	if sampleDataEnd > len(packet) {
+		return g, false
+	}
+
+	g.recordOffset = sampleDataStart + recordOffset
+	if g.recordOffset+8 > sampleDataEnd {
+		return g, false
+	}
+	g.recordLen = binary.BigEndian.Uint32(packet[g.recordOffset+4:])
+	g.dataStart = g.recordOffset + 8
+	recordEnd := g.dataStart + int(g.recordLen)
+	g.recordEnd = recordEnd
+	if recordEnd > sampleDataEnd {
+		return g, false
+	}
+
+	if g.dataStart+4 > recordEnd {
+		return g, false
+	}
+	addrSize := nextHopAddrSize(binary.BigEndian.Uint32(packet[g.dataStart:]))
+	if addrSize < 0 {
+		return g, false
+	}
+
+	// type(4) + addr(addrSize) + AS(4) + SrcAS(4) + SrcPeerAS(4)
+	g.segmentsOffset = g.dataStart + 4 + addrSize + 12
+	if g.segmentsOffset+4 > recordEnd {
+		return g, false
+	}
+	g.segments = binary.BigEndian.Uint32(packet[g.segmentsOffset:])
+
+	offset := g.segmentsOffset + 4
+	for i := uint32(0); i < g.segments; i++ {
+		if offset+8 > recordEnd {
+			return g, false
+		}
+		segLen := binary.BigEndian.Uint32(packet[offset+4:])
+		if uint64(offset)+8+uint64(segLen)*4 > uint64(recordEnd) {
+			return g, false
+		}
+		offset += 8 + int(segLen)*4
+	}
+	g.pathEnd = offset
+
+	return g, true
+}
+
+// resize replaces packet[start:end] (inside the record) with n bytes and
+// updates the record and sample lengths
+func (g gatewayRecord) resize(packet []byte, start, end, n int) []byte {
+	delta := n - (end - start)
+	newPacket := splice(packet, start, end, n)
+	binary.BigEndian.PutUint32(newPacket[g.recordOffset+4:], uint32(int(g.recordLen)+delta))
+	binary.BigEndian.PutUint32(newPacket[g.sampleOffset+4:], uint32(int(g.sampleLen)+delta))
+	return newPacket
+}
+
+// asPathSize returns the encoded size of AS path segments
+func asPathSize(path []ASPathSegment) int {
+	size := 0
+	for _, seg := range path {
+		size += 8 + 4*len(seg.ASNs)
+	}
+	return size
+}
+
+// GatewayOrigins returns SrcAS and the destination origin AS of the extended
+// gateway record at the given offsets, as ExtendedGateway.DstAS does: the last
+// ASN of the last AS_SEQUENCE segment of dst_as_path, 0 if none
+func GatewayOrigins(packet []byte, sampleOffset int, recordOffset int) (srcAS, dstAS uint32, ok bool) {
+	g, ok := findGatewayRecord(packet, sampleOffset, recordOffset)
+	if !ok {
+		return 0, 0, false
+	}
+	// SrcAS and SrcPeerAS precede the segment count
+	srcAS = binary.BigEndian.Uint32(packet[g.segmentsOffset-8:])
+	offset := g.segmentsOffset + 4
+	for i := uint32(0); i < g.segments; i++ {
+		segType := binary.BigEndian.Uint32(packet[offset:])
+		segLen := int(binary.BigEndian.Uint32(packet[offset+4:]))
+		offset += 8 + segLen*4
+		if segType == ASPathSegmentSequence && segLen > 0 {
+			dstAS = binary.BigEndian.Uint32(packet[offset-4:])
+		}
+	}
+	return srcAS, dstAS, true
+}
+
+// putASPath writes AS path segments at packet[offset:]
+func putASPath(packet []byte, offset int, path []ASPathSegment) {
+	for _, seg := range path {
+		binary.BigEndian.PutUint32(packet[offset:], seg.Type)
+		binary.BigEndian.PutUint32(packet[offset+4:], uint32(len(seg.ASNs)))
+		offset += 8
+		for _, asn := range seg.ASNs {
+			binary.BigEndian.PutUint32(packet[offset:], asn)
+			offset += 4
+		}
+	}
+}
+
+// ReplaceDstASPath replaces the destination AS path of an extended gateway record
+// with path (any number of AS_SEQUENCE / AS_SET segments), whether or not the
+// record already has one. Record and sample lengths are updated.
+// Returns the modified packet (may be resized) and success flag.
+// If packet has spare capacity it is resized in place and the returned slice
+// shares its backing array; otherwise a new packet is allocated.
+func ReplaceDstASPath(packet []byte, sampleOffset int, recordOffset int, path []ASPathSegment) ([]byte, bool) {
+	g, ok := findGatewayRecord(packet, sampleOffset, recordOffset)
+	if !ok {
+		return packet, false
+	}
+
+	pathStart := g.segmentsOffset + 4
+	newPacket := g.resize(packet, pathStart, g.pathEnd, asPathSize(path))
+	putASPath(newPacket, pathStart, path)
+	binary.BigEndian.PutUint32(newPacket[g.segmentsOffset:], uint32(len(path)))
+
+	return newPacket, true
+}
+
+// PrependDstASPath prepends ASNs to the destination AS path of an extended gateway
+// record, as a BGP speaker prepending its own AS would: they are added to the
+// front of a leading AS_SEQUENCE segment, or as a new AS_SEQUENCE segment when the
+// path is empty or starts with an AS_SET. Record and sample lengths are updated.
+// Returns the modified packet (may be resized) and success flag.
+func PrependDstASPath(packet []byte, sampleOffset int, recordOffset int, asns []uint32) ([]byte, bool) {
+	if len(asns) == 0 {
+		return packet, false
+	}
+	g, ok := findGatewayRecord(packet, sampleOffset, recordOffset)
+	if !ok {
+		return packet, false
+	}
+
+	firstSegment := g.segmentsOffset + 4
+	if g.segments > 0 && binary.BigEndian.Uint32(packet[firstSegment:]) == ASPathSegmentSequence {
+		// Extend the leading AS_SEQUENCE: ASNs go right after its header
+		segLen := binary.BigEndian.Uint32(packet[firstSegment+4:])
+		insertPoint := firstSegment + 8
+		newPacket := g.resize(packet, insertPoint, insertPoint, 4*len(asns))
+		for i, asn := range asns {
+			binary.BigEndian.PutUint32(newPacket[insertPoint+4*i:], asn)
+		}
+		binary.BigEndian.PutUint32(newPacket[firstSegment+4:], segLen+uint32(len(asns)))
+		return newPacket, true
+	}
+
+	// New leading AS_SEQUENCE segment
+	seg := [1]ASPathSegment{{Type: ASPathSegmentSequence, ASNs: asns}}
+	newPacket := g.resize(packet, firstSegment, firstSegment, asPathSize(seg[:]))
+	putASPath(newPacket, firstSegment, seg[:])
+	binary.BigEndian.PutUint32(newPacket[g.segmentsOffset:], g.segments+1)
+
+	return newPacket, true
+}
+
+// findCommunities locates the communities list and local_pref after dst_as_path.
+// Returns the offset of the communities count and the count.
+func (g gatewayRecord) findCommunities(packet []byte) (int, uint32, bool) {
+	if g.pathEnd+4 > g.recordEnd {
+		return 0, 0, false
+	}
+	count := binary.BigEndian.Uint32(packet[g.pathEnd:])
+	// communities + localpref
+	if uint64(g.pathEnd)+4+uint64(count)*4+4 > uint64(g.recordEnd) {
+		return 0, 0, false
+	}
+	return g.pathEnd, count, true
+}
+
+// AddCommunities adds BGP communities to an extended gateway record. Communities
+// the record already has are skipped. Record and sample lengths are updated.
+// Returns the modified packet (may be resized) and whether communities were added.
+// If packet has spare capacity it is grown in place and the returned slice shares
+// its backing array; otherwise a new packet is allocated.
+func AddCommunities(packet []byte, sampleOffset int, recordOffset int, communities []uint32) ([]byte, bool) {
+	g, ok := findGatewayRecord(packet, sampleOffset, recordOffset)
+	if !ok {
+		return packet, false
+	}
+	countOffset, count, ok := g.findCommunities(packet)
+	if !ok {
+		return packet, false
+	}
+
+	// Count the new communities: not in the record and not repeated
+	listStart := countOffset + 4
+	listEnd := listStart + int(count)*4
+	added := 0
+	for i, c := range communities {
+		if !hasCommunity(packet, listStart, listEnd, c) && !inCommunities(communities[:i], c) {
+			added++
+		}
+	}
+	if added == 0 {
+		return packet, false
+	}
+
+	// Append them to the list; the list so far includes those already written
+	newPacket := g.resize(packet, listEnd, listEnd, added*4)
+	offset := listEnd
+	for _, c := range communities {
+		if !hasCommunity(newPacket, listStart, offset, c) {
+			binary.BigEndian.PutUint32(newPacket[offset:], c)
+			offset += 4
+		}
+	}
+	binary.BigEndian.PutUint32(newPacket[countOffset:], count+uint32(added))
+
+	return newPacket, true
+}
+
+// hasCommunity reports whether the encoded list packet[start:end] contains c
+func hasCommunity(packet []byte, start, end int, c uint32) bool {
+	for off := start; off < end; off += 4 {
+		if binary.BigEndian.Uint32(packet[off:]) == c {
+			return true
+		}
+	}
+	return false
+}
+
+func inCommunities(list []uint32, c uint32) bool {
+	for _, v := range list {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLocalPref sets the local_pref of an extended gateway record (in-place)
+func SetLocalPref(packet []byte, sampleOffset int, recordOffset int, localPref uint32) bool {
+	g, ok := findGatewayRecord(packet, sampleOffset, recordOffset)
+	if !ok {
+		return false
+	}
+	countOffset, count, ok := g.findCommunities(packet)
+	if !ok {
+		return false
+	}
+	binary.BigEndian.PutUint32(packet[countOffset+4+int(count)*4:], localPref)
+	return true
+}
+
+// SetNextHop sets the next hop of an extended gateway record to an IPv4 or IPv6
+// address. When the address type changes (e.g. from UNKNOWN) the record is
+// resized and record and sample lengths are updated. A next hop that is neither
+// (nil or malformed) is not set: false is returned and the record keeps its next hop.
+// Returns the modified packet (may be resized) and success flag.
+// If packet has spare capacity it is resized in place and the returned slice
+// shares its backing array; otherwise a new packet is allocated.
+func SetNextHop(packet []byte, sampleOffset int, recordOffset int, nextHop net.IP) ([]byte, bool) {
+	addrType := AddressType(nextHop)
+	if addrType == AddressTypeUnknown {
+		return packet, false
+	}
+	addr := nextHop.To4()
+	if addrType == AddressTypeIPv6 {
+		addr = nextHop.To16()
+	}
+	if addr == nil {
+		return packet, false // neither IPv4 nor IPv6
+	}
+
+	g, ok := findGatewayRecord(packet, sampleOffset, recordOffset)
+	if !ok {
+		return packet, false
+	}
+
+	// Replace type(4) + old address with type(4) + new address
+	oldEnd := g.dataStart + 4 + nextHopAddrSize(binary.BigEndian.Uint32(packet[g.dataStart:]))
+	newPacket := g.resize(packet, g.dataStart, oldEnd, 4+len(addr))
+	binary.BigEndian.PutUint32(newPacket[g.dataStart:], addrType)
+	copy(newPacket[g.dataStart+4:], addr)
+
+	return newPacket, true
+}
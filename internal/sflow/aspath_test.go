@@ -0,0 +1,246 @@
+package sflow
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// gatewayOf returns the extended_gateway record of sample i, parsed
+func gatewayOf(t *testing.T, data []byte, i int) *ExtendedGateway {
+	t.Helper()
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.Samples[i]
+	fs, err := ParseFlowSample(s.Data, s.Format == SampleTypeExpandedFlowSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fs.Records {
+		if r.Format == FlowRecordExtendedGateway {
+			eg, err := ParseExtendedGateway(r.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return eg
+		}
+	}
+	t.Fatalf("sample %d has no extended_gateway", i)
+	return nil
+}
+
+// segmentLengths returns the ASN count of each segment of a path
+func segmentLengths(path []ASPathSegment) []int {
+	lengths := []int{}
+	for _, seg := range path {
+		lengths = append(lengths, len(seg.ASNs))
+	}
+	return lengths
+}
+
+func TestPrependDstASPath(t *testing.T) {
+	prepend := []uint32{64512, 64512}
+	tests := []struct {
+		name    string
+		path    []ASPathSegment
+		want    []ASPathSegment
+		lengths []int
+	}{
+		{"AS_SEQUENCE first", testPath, []ASPathSegment{
+			{Type: ASPathSegmentSequence, ASNs: []uint32{64512, 64512, 3356, 174}},
+			{Type: ASPathSegmentSet, ASNs: []uint32{64500, 64501}},
+		}, []int{4, 2}},
+		// An AS_SET cannot take the ASNs: a new AS_SEQUENCE goes in front
+		{"AS_SET first", []ASPathSegment{
+			{Type: ASPathSegmentSet, ASNs: []uint32{64500, 64501}},
+			{Type: ASPathSegmentSequence, ASNs: []uint32{3356}},
+		}, []ASPathSegment{
+			{Type: ASPathSegmentSequence, ASNs: []uint32{64512, 64512}},
+			{Type: ASPathSegmentSet, ASNs: []uint32{64500, 64501}},
+			{Type: ASPathSegmentSequence, ASNs: []uint32{3356}},
+		}, []int{2, 2, 1}},
+		{"empty", nil, []ASPathSegment{
+			{Type: ASPathSegmentSequence, ASNs: []uint32{64512, 64512}},
+		}, []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := resizeDatagram(
+				gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, tt.path, testCommunities, 100),
+				gatewayFlowRecord(net.ParseIP("2001:db8::2"), 64512, 0, 0, testPath, nil, 0),
+			)
+			s0, r0 := gatewayOffsets(t, data, 0)
+			checkResize(t, data, func(p []byte) ([]byte, bool) { return PrependDstASPath(p, s0, r0, prepend) },
+				func(_ []*FlowSample, eg []*ExtendedGateway) { eg[0].DstASPath = tt.want }, nil)
+
+			out, ok := PrependDstASPath(append([]byte{}, data...), s0, r0, prepend)
+			if !ok {
+				t.Fatal("not prepended")
+			}
+			eg := gatewayOf(t, out, 0)
+			if got := segmentLengths(eg.DstASPath); fmt.Sprint(got) != fmt.Sprint(tt.lengths) {
+				t.Errorf("segment lengths %v, want %v", got, tt.lengths)
+			}
+			if fmt.Sprint(eg.DstASPath) != fmt.Sprint(tt.want) {
+				t.Errorf("path %v, want %v", eg.DstASPath, tt.want)
+			}
+			// Fields after the path are read from their moved offsets
+			if fmt.Sprint(eg.Communities) != fmt.Sprint(testCommunities) || eg.LocalPref != 100 {
+				t.Errorf("communities %v, local_pref %d after the path", eg.Communities, eg.LocalPref)
+			}
+			wantGrowth := 4 * len(prepend)
+			if tt.path == nil || tt.path[0].Type == ASPathSegmentSet {
+				wantGrowth += 8
+			}
+			if len(out) != len(data)+wantGrowth {
+				t.Errorf("datagram grew by %d bytes, want %d", len(out)-len(data), wantGrowth)
+			}
+			if other := gatewayOf(t, out, 1); fmt.Sprint(other.DstASPath) != fmt.Sprint(testPath) {
+				t.Errorf("next sample's path %v", other.DstASPath)
+			}
+		})
+	}
+
+	data := resizeDatagram(gatewayFlowRecord(net.IP{10, 0, 0, 1}, 0, 0, 0, testPath, nil, 0),
+		gatewayFlowRecord(net.IP{10, 0, 0, 1}, 0, 0, 0, nil, nil, 0))
+	s0, r0 := gatewayOffsets(t, data, 0)
+	if _, ok := PrependDstASPath(data, s0, r0, nil); ok {
+		t.Error("nothing to prepend reported a change")
+	}
+}
+
+// local_pref follows the communities, so its offset depends on their count
+func TestSetLocalPref(t *testing.T) {
+	for _, communities := range [][]uint32{nil, testCommunities} {
+		t.Run(fmt.Sprintf("%d communities", len(communities)), func(t *testing.T) {
+			data := resizeDatagram(
+				gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, communities, 100),
+				gatewayFlowRecord(net.ParseIP("2001:db8::2"), 64512, 0, 0, nil, nil, 0),
+			)
+			s0, r0 := gatewayOffsets(t, data, 0)
+			checkResize(t, data, func(p []byte) ([]byte, bool) { return p, SetLocalPref(p, s0, r0, 250) },
+				func(_ []*FlowSample, eg []*ExtendedGateway) { eg[0].LocalPref = 250 }, nil)
+
+			out := append([]byte{}, data...)
+			if !SetLocalPref(out, s0, r0, 250) {
+				t.Fatal("local_pref not set")
+			}
+			eg := gatewayOf(t, out, 0)
+			if eg.LocalPref != 250 || fmt.Sprint(eg.Communities) != fmt.Sprint(communities) ||
+				fmt.Sprint(eg.DstASPath) != fmt.Sprint(testPath) {
+				t.Errorf("gateway %+v", *eg)
+			}
+			if other := gatewayOf(t, out, 1); other.LocalPref != 0 {
+				t.Errorf("next sample's local_pref %d", other.LocalPref)
+			}
+		})
+	}
+
+	// A communities count past the record, and a record that is no gateway
+	bad := xdr{}.u32(AddressTypeIPv4).raw(net.IP{10, 0, 0, 1}).u32(0, 0, 0, 0).u32(3, 1, 2).u32(100)
+	data := resizeDatagram(xdr{}.dataFormat(0, FlowRecordExtendedGateway, bad),
+		gatewayFlowRecord(net.IP{10, 0, 0, 1}, 0, 0, 0, nil, nil, 0))
+	s0, r0 := gatewayOffsets(t, data, 0)
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := ParseFlowSample(d.Samples[0].Data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := append([]byte{}, data...)
+	if SetLocalPref(data, s0, r0, 250) {
+		t.Error("local_pref set with communities past the record")
+	}
+	if SetLocalPref(data, s0, fs.Records[0].Offset, 250) {
+		t.Error("local_pref set in a raw packet header record")
+	}
+	if string(data) != string(before) {
+		t.Error("failed SetLocalPref changed the datagram")
+	}
+}
+
+// The next hop is the first field: changing its address type moves the rest
+// of the record and every later sample
+func TestSetNextHop(t *testing.T) {
+	type nextHop struct {
+		name     string
+		ip       net.IP
+		addrType uint32
+		size     int // address bytes on the wire
+	}
+	nextHops := []nextHop{
+		{"IPv4", net.IP{10, 0, 0, 1}, AddressTypeIPv4, 4},
+		{"IPv6", net.ParseIP("2001:db8::1"), AddressTypeIPv6, 16},
+		{"UNKNOWN", nil, AddressTypeUnknown, 0},
+	}
+	targets := []nextHop{
+		{"IPv4", net.IP{192, 0, 2, 254}, AddressTypeIPv4, 4},
+		{"IPv6", net.ParseIP("2001:db8::fe"), AddressTypeIPv6, 16},
+		{"UNKNOWN", nil, AddressTypeUnknown, 0},
+		{"malformed", net.IP{192, 0, 2}, AddressTypeUnknown, 0},
+	}
+	for _, from := range nextHops {
+		for _, to := range targets {
+			t.Run(from.name+" to "+to.name, func(t *testing.T) {
+				data := resizeDatagram(
+					gatewayFlowRecord(from.ip, 64512, 3356, 3356, testPath, testCommunities, 100),
+					gatewayFlowRecord(net.ParseIP("2001:db8::2"), 64512, 0, 0, nil, nil, 0),
+				)
+				s0, r0 := gatewayOffsets(t, data, 0)
+
+				// An UNKNOWN next hop cannot be set: there is no address to write
+				if to.addrType == AddressTypeUnknown {
+					out, ok := SetNextHop(append([]byte{}, data...), s0, r0, to.ip)
+					if ok || string(out) != string(data) {
+						t.Errorf("SetNextHop(nil) = %v, changed %v", ok, string(out) != string(data))
+					}
+					return
+				}
+
+				checkResize(t, data, func(p []byte) ([]byte, bool) { return SetNextHop(p, s0, r0, to.ip) },
+					func(_ []*FlowSample, eg []*ExtendedGateway) { eg[0].NextHopType, eg[0].NextHop = to.addrType, to.ip }, nil)
+
+				out, ok := SetNextHop(append([]byte{}, data...), s0, r0, to.ip)
+				if !ok {
+					t.Fatal("next hop not set")
+				}
+				growth := to.size - from.size
+				before, err := Parse(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				after, err := Parse(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(out) != len(data)+growth || after.Samples[0].Length != before.Samples[0].Length+uint32(growth) ||
+					after.Samples[1].Length != before.Samples[1].Length {
+					t.Errorf("datagram %d -> %d bytes, sample %d -> %d; want a change of %d",
+						len(data), len(out), before.Samples[0].Length, after.Samples[0].Length, growth)
+				}
+				fs, err := ParseFlowSample(after.Samples[0].Data, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range fs.Records {
+					if r.Format == FlowRecordExtendedGateway && int(r.Length) != len(gatewayRecordBody(from.ip, 0, 0, 0, testPath, testCommunities, 0))+growth {
+						t.Errorf("record length %d, want a change of %d", r.Length, growth)
+					}
+				}
+
+				eg := gatewayOf(t, out, 0)
+				if eg.NextHopType != to.addrType || !eg.NextHop.Equal(to.ip) {
+					t.Errorf("next hop %d %v, want %d %v", eg.NextHopType, eg.NextHop, to.addrType, to.ip)
+				}
+				if eg.AS != 64512 || eg.SrcAS != 3356 || eg.SrcPeerAS != 3356 || fmt.Sprint(eg.DstASPath) != fmt.Sprint(testPath) ||
+					fmt.Sprint(eg.Communities) != fmt.Sprint(testCommunities) || eg.LocalPref != 100 {
+					t.Errorf("fields after the next hop: %+v", *eg)
+				}
+			})
+		}
+	}
+}
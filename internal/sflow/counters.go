@@ -0,0 +1,243 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Counter record types (enterprise 0)
+	CounterRecordGeneric   = 1    // if_counters
+	CounterRecordEthernet  = 2    // ethernet_counters
+	CounterRecordVLAN      = 5    // vlan_counters
+	CounterRecordProcessor = 1001 // processor
+	CounterRecordPortName  = 1005 // port_name (ifName)
+)
+
+// CounterSample represents parsed counter sample data
+type CounterSample struct {
+	SequenceNum   uint32
+	SourceIDType  uint32
+	SourceIDIndex uint32
+	NumRecords    uint32
+	Records       []CounterRecord
+	Expanded      bool // Parsed from an expanded counter sample (format 4)
+}
+
+// CounterRecord represents a counter record within a sample.
+// Data always holds the raw record body, so unknown record types are preserved.
+type CounterRecord struct {
+	Enterprise uint32
+	Format     uint32
+	Length     uint32
+	Data       []byte
+	Offset     int // Offset within the sample data
+}
+
+// IfCounters represents generic interface counters (if_counters, RFC 2233)
+type IfCounters struct {
+	IfIndex            uint32
+	IfType             uint32
+	IfSpeed            uint64
+	IfDirection        uint32 // 0=unknown, 1=full-duplex, 2=half-duplex, 3=in, 4=out
+	IfStatus           uint32 // bit 0 = admin up, bit 1 = oper up
+	IfInOctets         uint64
+	IfInUcastPkts      uint32
+	IfInMulticastPkts  uint32
+	IfInBroadcastPkts  uint32
+	IfInDiscards       uint32
+	IfInErrors         uint32
+	IfInUnknownProtos  uint32
+	IfOutOctets        uint64
+	IfOutUcastPkts     uint32
+	IfOutMulticastPkts uint32
+	IfOutBroadcastPkts uint32
+	IfOutDiscards      uint32
+	IfOutErrors        uint32
+	IfPromiscuousMode  uint32
+}
+
+// EthernetCounters represents Ethernet interface counters (ethernet_counters, RFC 2358)
+type EthernetCounters struct {
+	AlignmentErrors           uint32
+	FCSErrors                 uint32
+	SingleCollisionFrames     uint32
+	MultipleCollisionFrames   uint32
+	SQETestErrors             uint32
+	DeferredTransmissions     uint32
+	LateCollisions            uint32
+	ExcessiveCollisions       uint32
+	InternalMacTransmitErrors uint32
+	CarrierSenseErrors        uint32
+	FrameTooLongs             uint32
+	InternalMacReceiveErrors  uint32
+	SymbolErrors              uint32
+}
+
+// VLANCounters represents per-VLAN counters (vlan_counters)
+type VLANCounters struct {
+	VLANID        uint32
+	Octets        uint64
+	UcastPkts     uint32
+	MulticastPkts uint32
+	BroadcastPkts uint32
+	Discards      uint32
+}
+
+// ProcessorCounters represents device CPU and memory counters (processor)
+type ProcessorCounters struct {
+	CPU5s       uint32 // 5 second average CPU utilization, percent * 100
+	CPU1m       uint32 // 1 minute average CPU utilization, percent * 100
+	CPU5m       uint32 // 5 minute average CPU utilization, percent * 100
+	TotalMemory uint64 // bytes
+	FreeMemory  uint64 // bytes
+}
+
+// IfAdminUp reports whether ifAdminStatus is up
+func (c *IfCounters) IfAdminUp() bool {
+	return c.IfStatus&0x1 != 0
+}
+
+// IfOperUp reports whether ifOperStatus is up
+func (c *IfCounters) IfOperUp() bool {
+	return c.IfStatus&0x2 != 0
+}
+
+// ParseCounterSample parses counter sample data.
+// Compact (format 2) and expanded (format 4) samples produce the same model;
+// only the source_id encoding differs.
+// It is a convenience wrapper around CounterSampleReader; truncated trailing records are dropped silently.
+func ParseCounterSample(data []byte, expanded bool) (*CounterSample, error) {
+	var r CounterSampleReader
+	if err := r.Reset(data, expanded); err != nil {
+		return nil, err
+	}
+
+	cs := r.CounterSample
+	for r.Next() {
+		cs.Records = append(cs.Records, r.Record())
+	}
+
+	return &cs, nil
+}
+
+// ParseIfCounters parses a generic interface counters record (88 bytes)
+func ParseIfCounters(data []byte) (*IfCounters, error) {
+	if len(data) < 88 {
+		return nil, fmt.Errorf("if_counters data too short: %d bytes (need 88)", len(data))
+	}
+
+	c := &IfCounters{}
+	offset := 0
+
+	c.IfIndex = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfType = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfSpeed = binary.BigEndian.Uint64(data[offset:])
+	offset += 8
+	c.IfDirection = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfStatus = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	c.IfInOctets = binary.BigEndian.Uint64(data[offset:])
+	offset += 8
+	c.IfInUcastPkts = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfInMulticastPkts = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfInBroadcastPkts = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfInDiscards = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfInErrors = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfInUnknownProtos = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	c.IfOutOctets = binary.BigEndian.Uint64(data[offset:])
+	offset += 8
+	c.IfOutUcastPkts = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfOutMulticastPkts = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfOutBroadcastPkts = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfOutDiscards = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	c.IfOutErrors = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	c.IfPromiscuousMode = binary.BigEndian.Uint32(data[offset:])
+
+	return c, nil
+}
+
+// ParseEthernetCounters parses an Ethernet interface counters record (52 bytes)
+func ParseEthernetCounters(data []byte) (*EthernetCounters, error) {
+	if len(data) < 52 {
+		return nil, fmt.Errorf("ethernet_counters data too short: %d bytes (need 52)", len(data))
+	}
+
+	fields := [13]uint32{}
+	for i := range fields {
+		fields[i] = binary.BigEndian.Uint32(data[i*4:])
+	}
+
+	return &EthernetCounters{
+		AlignmentErrors:           fields[0],
+		FCSErrors:                 fields[1],
+		SingleCollisionFrames:     fields[2],
+		MultipleCollisionFrames:   fields[3],
+		SQETestErrors:             fields[4],
+		DeferredTransmissions:     fields[5],
+		LateCollisions:            fields[6],
+		ExcessiveCollisions:       fields[7],
+		InternalMacTransmitErrors: fields[8],
+		CarrierSenseErrors:        fields[9],
+		FrameTooLongs:             fields[10],
+		InternalMacReceiveErrors:  fields[11],
+		SymbolErrors:              fields[12],
+	}, nil
+}
+
+// ParseVLANCounters parses a VLAN counters record (28 bytes)
+func ParseVLANCounters(data []byte) (*VLANCounters, error) {
+	if len(data) < 28 {
+		return nil, fmt.Errorf("vlan_counters data too short: %d bytes (need 28)", len(data))
+	}
+
+	return &VLANCounters{
+		VLANID:        binary.BigEndian.Uint32(data[0:]),
+		Octets:        binary.BigEndian.Uint64(data[4:]),
+		UcastPkts:     binary.BigEndian.Uint32(data[12:]),
+		MulticastPkts: binary.BigEndian.Uint32(data[16:]),
+		BroadcastPkts: binary.BigEndian.Uint32(data[20:]),
+		Discards:      binary.BigEndian.Uint32(data[24:]),
+	}, nil
+}
+
+// ParseProcessorCounters parses a processor counters record (28 bytes)
+func ParseProcessorCounters(data []byte) (*ProcessorCounters, error) {
+	if len(data) < 28 {
+		return nil, fmt.Errorf("processor data too short: %d bytes (need 28)", len(data))
+	}
+
+	return &ProcessorCounters{
+		CPU5s:       binary.BigEndian.Uint32(data[0:]),
+		CPU1m:       binary.BigEndian.Uint32(data[4:]),
+		CPU5m:       binary.BigEndian.Uint32(data[8:]),
+		TotalMemory: binary.BigEndian.Uint64(data[12:]),
+		FreeMemory:  binary.BigEndian.Uint64(data[20:]),
+	}, nil
+}
+
+// ParsePortName parses a port name record (string name<255>, the ifName)
+func ParsePortName(data []byte) (string, error) {
+	name, _, err := readOpaque(data, 0)
+	if err != nil {
+		return "", fmt.Errorf("port_name: %w", err)
+	}
+	return string(name), nil
+}
@@ -0,0 +1,133 @@
+package sflow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseCounterRecords(t *testing.T) {
+	ifc := xdr{}.u32(7, 6).u64(25_000_000_000).u32(1, 3).u64(1e12).
+		u32(10, 11, 12, 13, 14, 15).u64(2e12).u32(20, 21, 22, 23, 24, 1)
+	eth := xdr{}.u32(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13)
+	vlan := xdr{}.u32(100).u64(1<<40).u32(5, 6, 7, 8)
+	cpu := xdr{}.u32(1500, 2500, 3500).u64(16 << 30).u64(4 << 30)
+
+	c, err := ParseIfCounters(ifc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IfCounters{
+		IfIndex: 7, IfType: 6, IfSpeed: 25_000_000_000, IfDirection: 1, IfStatus: 3,
+		IfInOctets: 1e12, IfInUcastPkts: 10, IfInMulticastPkts: 11, IfInBroadcastPkts: 12,
+		IfInDiscards: 13, IfInErrors: 14, IfInUnknownProtos: 15,
+		IfOutOctets: 2e12, IfOutUcastPkts: 20, IfOutMulticastPkts: 21, IfOutBroadcastPkts: 22,
+		IfOutDiscards: 23, IfOutErrors: 24, IfPromiscuousMode: 1,
+	}
+	if *c != want {
+		t.Errorf("if_counters %+v, want %+v", *c, want)
+	}
+
+	e, err := ParseEthernetCounters(eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (EthernetCounters{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}); *e != want {
+		t.Errorf("ethernet_counters %+v, want %+v", *e, want)
+	}
+
+	v, err := ParseVLANCounters(vlan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (VLANCounters{VLANID: 100, Octets: 1 << 40, UcastPkts: 5, MulticastPkts: 6, BroadcastPkts: 7, Discards: 8}); *v != want {
+		t.Errorf("vlan_counters %+v, want %+v", *v, want)
+	}
+
+	p, err := ParseProcessorCounters(cpu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ProcessorCounters{CPU5s: 1500, CPU1m: 2500, CPU5m: 3500, TotalMemory: 16 << 30, FreeMemory: 4 << 30}); *p != want {
+		t.Errorf("processor %+v, want %+v", *p, want)
+	}
+
+	// Records one byte short of their fixed size
+	for name, parse := range map[string]func() error{
+		"if_counters":       func() error { _, err := ParseIfCounters(ifc[:87]); return err },
+		"ethernet_counters": func() error { _, err := ParseEthernetCounters(eth[:51]); return err },
+		"vlan_counters":     func() error { _, err := ParseVLANCounters(vlan[:27]); return err },
+		"processor":         func() error { _, err := ParseProcessorCounters(cpu[:27]); return err },
+	} {
+		if parse() == nil {
+			t.Errorf("short %s parsed", name)
+		}
+	}
+}
+
+func TestIfStatus(t *testing.T) {
+	for status, want := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		c := IfCounters{IfStatus: uint32(status)}
+		if c.IfAdminUp() != want[0] || c.IfOperUp() != want[1] {
+			t.Errorf("ifStatus %d: admin %v oper %v, want %v", status, c.IfAdminUp(), c.IfOperUp(), want)
+		}
+	}
+}
+
+func TestParsePortName(t *testing.T) {
+	for _, name := range []string{"", "eth0", "GE0/0/1", "100GE1/0/1.4094"} {
+		got, err := ParsePortName(xdr{}.opaque([]byte(name)))
+		if err != nil || got != name {
+			t.Errorf("ParsePortName(%q) = %q, %v", name, got, err)
+		}
+	}
+	for _, data := range []xdr{{}, xdr{}.u32(5).raw([]byte("eth0")), xdr{}.u32(300).raw(make([]byte, 8))} {
+		if _, err := ParsePortName(data); err == nil {
+			t.Errorf("ParsePortName(%x) succeeded", []byte(data))
+		}
+	}
+}
+
+// Unknown and enterprise counter records come back as raw bytes, between
+// and after known ones
+func TestCounterSampleUnknownRecords(t *testing.T) {
+	unknown := xdr{}.u32(1, 2, 3)
+	enterprise := xdr{}.u32(0xdeadbeef)
+	data := datagramV4(net.IP{192, 0, 2, 1}, 1, counterSample(false, 9, 3,
+		xdr{}.dataFormat(0, 999, unknown),
+		ifCountersRecord(3, 100, 200),
+		xdr{}.dataFormat(2011, 4, enterprise),
+		xdr{}.dataFormat(0, CounterRecordPortName, xdr{}.opaque([]byte("GE0/0/3"))),
+	))
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := ParseCounterSample(d.Samples[0].Data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.SequenceNum != 9 || cs.SourceIDIndex != 3 || cs.NumRecords != 4 || len(cs.Records) != 4 {
+		t.Fatalf("counter sample %+v", *cs)
+	}
+	for i, want := range []struct {
+		enterprise, format uint32
+		data               []byte
+	}{
+		{0, 999, unknown},
+		{0, CounterRecordGeneric, nil},
+		{2011, 4, enterprise},
+		{0, CounterRecordPortName, xdr{}.opaque([]byte("GE0/0/3"))},
+	} {
+		r := cs.Records[i]
+		if r.Enterprise != want.enterprise || r.Format != want.format || int(r.Length) != len(r.Data) {
+			t.Errorf("record %d: %d:%d length %d", i, r.Enterprise, r.Format, r.Length)
+		}
+		if want.data != nil && !bytes.Equal(r.Data, want.data) {
+			t.Errorf("record %d data %x, want %x", i, r.Data, want.data)
+		}
+	}
+	if c, err := ParseIfCounters(cs.Records[1].Data); err != nil || c.IfIndex != 3 || c.IfOutOctets != 200 {
+		t.Errorf("if_counters between unknown records: %+v, %v", c, err)
+	}
+}
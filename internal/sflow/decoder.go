@@ -0,0 +1,409 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// DatagramReader iterates over the samples of an sFlow v5 datagram without
+// copying or allocating. The buffer is borrowed: samples and addresses reference
+// it directly, so it must outlive (and not be modified during) the iteration.
+//
+//	var r sflow.DatagramReader
+//	if err := r.Reset(buf); err != nil { ... }
+//	for r.Next() {
+//		s := r.Sample()
+//		...
+//	}
+//	if err := r.Err(); err != nil { ... } // truncated datagram
+type DatagramReader struct {
+	Version       uint32
+	AgentAddrType uint32
+	AgentAddr     net.IP
+	SubAgentID    uint32
+	SequenceNum   uint32
+	Uptime        uint32
+	NumSamples    uint32
+
+	data   []byte
+	offset int
+	index  uint32
+	sample Sample
+	err    error
+}
+
+// Reset decodes the datagram header of data and positions the reader before the first sample
+func (r *DatagramReader) Reset(data []byte) error {
+	*r = DatagramReader{data: data}
+
+	if len(data) < 28 {
+		return fmt.Errorf("packet too short: %d bytes", len(data))
+	}
+
+	offset := 0
+
+	// Version
+	r.Version = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	if r.Version != SFlowVersion5 {
+		return fmt.Errorf("unsupported sFlow version: %d", r.Version)
+	}
+
+	// Agent address type
+	r.AgentAddrType = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	// Agent address
+	switch r.AgentAddrType {
+	case AddressTypeIPv4:
+		if len(data) < 28 { // 4+4+4+4+4+4+4 = 28 bytes minimum for IPv4 header
+			return fmt.Errorf("packet too short for IPv4 agent: %d bytes", len(data))
+		}
+		r.AgentAddr = net.IP(data[offset : offset+4])
+		offset += 4
+	case AddressTypeIPv6:
+		if len(data) < 40 { // 4+4+16+4+4+4+4 = 40 bytes minimum for IPv6 header
+			return fmt.Errorf("packet too short for IPv6 agent: %d bytes", len(data))
+		}
+		r.AgentAddr = net.IP(data[offset : offset+16])
+		offset += 16
+	default:
+		return fmt.Errorf("unsupported agent address type: %d", r.AgentAddrType)
+	}
+
+	r.SubAgentID = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	r.SequenceNum = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	r.Uptime = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	r.NumSamples = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	r.offset = offset
+	return nil
+}
+
+// Next advances to the next sample. It returns false when all NumSamples were
+// read or the datagram is truncated (see Err).
+func (r *DatagramReader) Next() bool {
+	if r.err != nil || r.index >= r.NumSamples || r.offset >= len(r.data) {
+		return false
+	}
+
+	sample, next, err := readDataFormat(r.data, r.offset)
+	if err != nil {
+		r.err = fmt.Errorf("sample %d: %w", r.index, err)
+		return false
+	}
+
+	r.sample = Sample(sample)
+	r.offset = next
+	r.index++
+	return true
+}
+
+// Sample returns the current sample. Data references the borrowed buffer.
+func (r *DatagramReader) Sample() Sample {
+	return r.sample
+}
+
+// Err returns the error that stopped the iteration, nil if the datagram was read completely
+func (r *DatagramReader) Err() error {
+	return r.err
+}
+
+// Offset returns the offset just past the last sample read
+func (r *DatagramReader) Offset() int {
+	return r.offset
+}
+
+// FlowSampleReader iterates over the records of a flow sample without allocating.
+// The embedded FlowSample holds the sample header; its Records field stays empty.
+type FlowSampleReader struct {
+	FlowSample
+
+	data   []byte
+	offset int
+	index  uint32
+	record FlowRecord
+	err    error
+}
+
+// Reset decodes the flow sample header of data (compact or expanded form)
+func (r *FlowSampleReader) Reset(data []byte, expanded bool) error {
+	*r = FlowSampleReader{data: data}
+	r.Expanded = expanded
+
+	minLen := 32 // standard flow_sample: 8 fields * 4 bytes
+	if expanded {
+		minLen = 44 // expanded: 11 fields * 4 bytes (source_id split + input/output expanded)
+	}
+	if len(data) < minLen {
+		return fmt.Errorf("flow sample too short: %d bytes (need %d)", len(data), minLen)
+	}
+
+	offset := 0
+
+	r.SequenceNum = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	if expanded {
+		r.SourceIDType = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+		r.SourceIDIndex = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	} else {
+		sourceID := binary.BigEndian.Uint32(data[offset:])
+		r.SourceIDType = sourceID >> 24
+		r.SourceIDIndex = sourceID & 0x00FFFFFF
+		offset += 4
+	}
+
+	r.SamplingRate = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	r.SamplePool = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	r.Drops = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	if expanded {
+		// Expanded: interface_expanded = {format(4), value(4)}
+		r.InputFormat = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+		r.Input = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+		r.OutputFormat = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+		r.Output = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	} else {
+		r.Input = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+		r.Output = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	}
+
+	r.NumRecords = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	r.offset = offset
+	return nil
+}
+
+// Next advances to the next flow record. It returns false when all NumRecords
+// were read or the sample is truncated (see Err).
+func (r *FlowSampleReader) Next() bool {
+	if r.err != nil || r.index >= r.NumRecords || r.offset >= len(r.data) {
+		return false
+	}
+
+	record, next, err := readDataFormat(r.data, r.offset)
+	if err != nil {
+		r.err = fmt.Errorf("flow record %d: %w", r.index, err)
+		return false
+	}
+
+	r.record = FlowRecord(record)
+	r.offset = next
+	r.index++
+	return true
+}
+
+// Record returns the current flow record. Data references the borrowed buffer.
+func (r *FlowSampleReader) Record() FlowRecord {
+	return r.record
+}
+
+// Err returns the error that stopped the iteration, nil if all records were read
+func (r *FlowSampleReader) Err() error {
+	return r.err
+}
+
+// Offset returns the offset just past the last record read
+func (r *FlowSampleReader) Offset() int {
+	return r.offset
+}
+
+// CounterSampleReader iterates over the records of a counter sample without allocating.
+// The embedded CounterSample holds the sample header; its Records field stays empty.
+type CounterSampleReader struct {
+	CounterSample
+
+	data   []byte
+	offset int
+	index  uint32
+	record CounterRecord
+	err    error
+}
+
+// Reset decodes the counter sample header of data (compact or expanded form)
+func (r *CounterSampleReader) Reset(data []byte, expanded bool) error {
+	*r = CounterSampleReader{data: data}
+	r.Expanded = expanded
+
+	minLen := 12 // compact: sequence_number + source_id + num_records
+	if expanded {
+		minLen = 16 // expanded: source_id split into type + index
+	}
+	if len(data) < minLen {
+		return fmt.Errorf("counter sample too short: %d bytes (need %d)", len(data), minLen)
+	}
+
+	offset := 0
+
+	r.SequenceNum = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	if expanded {
+		r.SourceIDType = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+		r.SourceIDIndex = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	} else {
+		sourceID := binary.BigEndian.Uint32(data[offset:])
+		r.SourceIDType = sourceID >> 24
+		r.SourceIDIndex = sourceID & 0x00FFFFFF
+		offset += 4
+	}
+
+	r.NumRecords = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	r.offset = offset
+	return nil
+}
+
+// Next advances to the next counter record. It returns false when all NumRecords
+// were read or the sample is truncated (see Err).
+func (r *CounterSampleReader) Next() bool {
+	if r.err != nil || r.index >= r.NumRecords || r.offset >= len(r.data) {
+		return false
+	}
+
+	record, next, err := readDataFormat(r.data, r.offset)
+	if err != nil {
+		r.err = fmt.Errorf("counter record %d: %w", r.index, err)
+		return false
+	}
+
+	r.record = CounterRecord(record)
+	r.offset = next
+	r.index++
+	return true
+}
+
+// Record returns the current counter record. Data references the borrowed buffer.
+func (r *CounterSampleReader) Record() CounterRecord {
+	return r.record
+}
+
+// Err returns the error that stopped the iteration, nil if all records were read
+func (r *CounterSampleReader) Err() error {
+	return r.err
+}
+
+// dataFormatView is the common layout of samples and records:
+// enterprise(20 bits)/format(12 bits) + length + opaque data
+type dataFormatView struct {
+	Enterprise uint32
+	Format     uint32
+	Length     uint32
+	Data       []byte
+	Offset     int
+}
+
+// readDataFormat reads one sample or record at offset and returns the offset past it
+func readDataFormat(data []byte, offset int) (dataFormatView, int, error) {
+	if offset+8 > len(data) {
+		return dataFormatView{}, offset, fmt.Errorf("header truncated at offset %d", offset)
+	}
+
+	header := binary.BigEndian.Uint32(data[offset:])
+	length := binary.BigEndian.Uint32(data[offset+4:])
+
+	v := dataFormatView{
+		Enterprise: header >> 12,
+		Format:     header & 0xFFF,
+		Length:     length,
+		Offset:     offset,
+	}
+
+	start := offset + 8
+	if uint64(start)+uint64(length) > uint64(len(data)) {
+		return v, offset, fmt.Errorf("length %d exceeds remaining %d bytes at offset %d", length, len(data)-start, offset)
+	}
+
+	v.Data = data[start : start+int(length)]
+	return v, start + int(length), nil
+}
+
+// ExtendedGatewayHeader holds the fixed-size fields of an extended gateway
+// record and the counts of its variable-length lists. Decoding it does not
+// allocate, unlike ParseExtendedGateway.
+type ExtendedGatewayHeader struct {
+	NextHopType       uint32
+	NextHop           net.IP
+	AS                uint32
+	SrcAS             uint32
+	SrcPeerAS         uint32
+	DstASPathSegments uint32 // 0 if the record ends before dst_as_path
+	CommunitiesLen    uint32 // 0 if the record ends before communities
+	LocalPref         uint32 // 0 if the record ends before localpref
+}
+
+// Decode decodes the extended gateway fields from a record body
+func (gh *ExtendedGatewayHeader) Decode(data []byte) error {
+	*gh = ExtendedGatewayHeader{}
+
+	nextHopType, nextHop, offset, err := readAddress(data, 0)
+	if err != nil {
+		return fmt.Errorf("extended gateway next hop: %w", err)
+	}
+	gh.NextHopType = nextHopType
+	gh.NextHop = nextHop
+
+	if offset+12 > len(data) {
+		return fmt.Errorf("extended gateway data too short for AS fields")
+	}
+	gh.AS = binary.BigEndian.Uint32(data[offset:])
+	gh.SrcAS = binary.BigEndian.Uint32(data[offset+4:])
+	gh.SrcPeerAS = binary.BigEndian.Uint32(data[offset+8:])
+	offset += 12
+
+	if offset+4 > len(data) {
+		return nil
+	}
+	gh.DstASPathSegments = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	// Skip the segments: type(4) + length(4) + ASNs
+	for i := uint32(0); i < gh.DstASPathSegments; i++ {
+		if offset+8 > len(data) {
+			return fmt.Errorf("extended gateway data too short for path segment %d", i)
+		}
+		segLen := binary.BigEndian.Uint32(data[offset+4:])
+		if uint64(offset)+8+uint64(segLen)*4 > uint64(len(data)) {
+			return fmt.Errorf("extended gateway path segment %d truncated", i)
+		}
+		offset += 8 + int(segLen)*4
+	}
+
+	if offset+4 > len(data) {
+		return nil
+	}
+	gh.CommunitiesLen = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	if uint64(offset)+uint64(gh.CommunitiesLen)*4 > uint64(len(data)) {
+		return fmt.Errorf("extended gateway communities truncated")
+	}
+	offset += int(gh.CommunitiesLen) * 4
+
+	if offset+4 <= len(data) {
+		gh.LocalPref = binary.BigEndian.Uint32(data[offset:])
+	}
+	return nil
+}
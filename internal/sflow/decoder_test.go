@@ -0,0 +1,350 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// The reference parsers below are the allocating parsers the readers
+// replaced, kept to check that the wrappers still return the same results.
+
+func referenceParse(data []byte) (*Datagram, error) {
+	if len(data) < 28 {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(data))
+	}
+
+	d := &Datagram{Raw: make([]byte, len(data))}
+	copy(d.Raw, data)
+
+	offset := 0
+	d.Version = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	if d.Version != SFlowVersion5 {
+		return nil, fmt.Errorf("unsupported sFlow version: %d", d.Version)
+	}
+	d.AgentAddrType = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	switch d.AgentAddrType {
+	case AddressTypeIPv4:
+		d.AgentAddr = net.IP(data[offset : offset+4])
+		offset += 4
+	case AddressTypeIPv6:
+		if len(data) < 40 {
+			return nil, fmt.Errorf("packet too short for IPv6 agent: %d bytes", len(data))
+		}
+		d.AgentAddr = net.IP(data[offset : offset+16])
+		offset += 16
+	default:
+		return nil, fmt.Errorf("unsupported agent address type: %d", d.AgentAddrType)
+	}
+	d.SubAgentID = binary.BigEndian.Uint32(data[offset:])
+	d.SequenceNum = binary.BigEndian.Uint32(data[offset+4:])
+	d.Uptime = binary.BigEndian.Uint32(data[offset+8:])
+	d.NumSamples = binary.BigEndian.Uint32(data[offset+12:])
+	offset += 16
+
+	for i := uint32(0); i < d.NumSamples && offset < len(data); i++ {
+		if offset+8 > len(data) {
+			break
+		}
+		header := binary.BigEndian.Uint32(data[offset:])
+		length := binary.BigEndian.Uint32(data[offset+4:])
+		sample := Sample{Enterprise: header >> 12, Format: header & 0xFFF, Length: length, Offset: offset}
+		offset += 8
+		if offset+int(length) > len(data) {
+			break
+		}
+		sample.Data = data[offset : offset+int(length)]
+		offset += int(length)
+		d.Samples = append(d.Samples, sample)
+	}
+	return d, nil
+}
+
+func referenceParseFlowSample(data []byte, expanded bool) (*FlowSample, error) {
+	minLen := 32
+	if expanded {
+		minLen = 44
+	}
+	if len(data) < minLen {
+		return nil, fmt.Errorf("flow sample too short: %d bytes (need %d)", len(data), minLen)
+	}
+
+	fs := &FlowSample{}
+	offset := 0
+	fs.SequenceNum = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	if expanded {
+		fs.SourceIDType = binary.BigEndian.Uint32(data[offset:])
+		fs.SourceIDIndex = binary.BigEndian.Uint32(data[offset+4:])
+		offset += 8
+	} else {
+		sourceID := binary.BigEndian.Uint32(data[offset:])
+		fs.SourceIDType = sourceID >> 24
+		fs.SourceIDIndex = sourceID & 0x00FFFFFF
+		offset += 4
+	}
+	fs.SamplingRate = binary.BigEndian.Uint32(data[offset:])
+	fs.SamplePool = binary.BigEndian.Uint32(data[offset+4:])
+	fs.Drops = binary.BigEndian.Uint32(data[offset+8:])
+	offset += 12
+	if expanded {
+		fs.Input = binary.BigEndian.Uint32(data[offset+4:])
+		fs.Output = binary.BigEndian.Uint32(data[offset+12:])
+		offset += 16
+	} else {
+		fs.Input = binary.BigEndian.Uint32(data[offset:])
+		fs.Output = binary.BigEndian.Uint32(data[offset+4:])
+		offset += 8
+	}
+	fs.NumRecords = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	for i := uint32(0); i < fs.NumRecords && offset < len(data); i++ {
+		if offset+8 > len(data) {
+			break
+		}
+		header := binary.BigEndian.Uint32(data[offset:])
+		length := binary.BigEndian.Uint32(data[offset+4:])
+		record := FlowRecord{Enterprise: header >> 12, Format: header & 0xFFF, Length: length, Offset: offset}
+		offset += 8
+		if offset+int(length) > len(data) {
+			break
+		}
+		record.Data = data[offset : offset+int(length)]
+		offset += int(length)
+		fs.Records = append(fs.Records, record)
+	}
+	return fs, nil
+}
+
+func referenceParseCounterSample(data []byte, expanded bool) (*CounterSample, error) {
+	minLen := 12
+	if expanded {
+		minLen = 16
+	}
+	if len(data) < minLen {
+		return nil, fmt.Errorf("counter sample too short: %d bytes (need %d)", len(data), minLen)
+	}
+
+	cs := &CounterSample{}
+	offset := 0
+	cs.SequenceNum = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+	if expanded {
+		cs.SourceIDType = binary.BigEndian.Uint32(data[offset:])
+		cs.SourceIDIndex = binary.BigEndian.Uint32(data[offset+4:])
+		offset += 8
+	} else {
+		sourceID := binary.BigEndian.Uint32(data[offset:])
+		cs.SourceIDType = sourceID >> 24
+		cs.SourceIDIndex = sourceID & 0x00FFFFFF
+		offset += 4
+	}
+	cs.NumRecords = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	for i := uint32(0); i < cs.NumRecords && offset < len(data); i++ {
+		if offset+8 > len(data) {
+			break
+		}
+		header := binary.BigEndian.Uint32(data[offset:])
+		length := binary.BigEndian.Uint32(data[offset+4:])
+		record := CounterRecord{Enterprise: header >> 12, Format: header & 0xFFF, Length: length, Offset: offset}
+		offset += 8
+		if offset+int(length) > len(data) {
+			break
+		}
+		record.Data = data[offset : offset+int(length)]
+		offset += int(length)
+		cs.Records = append(cs.Records, record)
+	}
+	return cs, nil
+}
+
+// decoderCorpus returns well-formed datagrams of every sample type
+func decoderCorpus() []xdr {
+	agent := net.IP{192, 0, 2, 1}
+	src, dst := net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9}
+	return []xdr{
+		datagramV4(agent, 1,
+			flowSample(10, 3, 1000, 3, 4,
+				rawHeaderRecord(1500, ipv4Header(src, dst)),
+				gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, testCommunities, 100)),
+			counterSample(false, 1, 3, ifCountersRecord(3, 1e9, 2e9)),
+			xdr{}.dataFormat(8800, 1, xdr{}.u32(9, 8, 7))),
+		datagramV6(net.ParseIP("2001:db8::1"), 2,
+			expandedFlowSample(11, 0x01000003, 512, 70000, 80000,
+				sampledIPv4Record(1500, src, dst), natRecord(src, dst)),
+			counterSample(true, 2, 70000, ifCountersRecord(70000, 5, 6), ifCountersRecord(70001, 7, 8))),
+	}
+}
+
+// decoderInputs returns the corpus with every truncation of it, and copies
+// with a sample or record length overrunning the datagram
+func decoderInputs() [][]byte {
+	var inputs [][]byte
+	for _, d := range decoderCorpus() {
+		for n := 0; n <= len(d); n++ {
+			inputs = append(inputs, d[:n])
+		}
+		for _, offset := range []int{32, 40, 72, 84} {
+			if offset+4 <= len(d) {
+				bad := append([]byte(nil), d...)
+				binary.BigEndian.PutUint32(bad[offset:], 0xFFFFFFF0)
+				inputs = append(inputs, bad)
+			}
+		}
+	}
+	return inputs
+}
+
+func TestParseMatchesReference(t *testing.T) {
+	for i, data := range decoderInputs() {
+		got, err := Parse(data)
+		want, wantErr := referenceParse(data)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("input %d (%d bytes): error %v, reference %v", i, len(data), err, wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("input %d (%d bytes):\n got %+v\nwant %+v", i, len(data), got, want)
+		}
+
+		for j, s := range got.Samples {
+			if s.Enterprise != 0 {
+				continue
+			}
+			switch s.Format {
+			case SampleTypeFlowSample, SampleTypeExpandedFlowSample:
+				expanded := s.Format == SampleTypeExpandedFlowSample
+				checkFlowSample(t, fmt.Sprintf("input %d sample %d", i, j), s.Data, expanded)
+			case SampleTypeCounterSample, SampleTypeExpandedCounterSample:
+				expanded := s.Format == SampleTypeExpandedCounterSample
+				checkCounterSample(t, fmt.Sprintf("input %d sample %d", i, j), s.Data, expanded)
+			}
+		}
+	}
+}
+
+// checkFlowSample compares ParseFlowSample with the reference on data and
+// every truncation of it
+func checkFlowSample(t *testing.T, name string, data []byte, expanded bool) {
+	t.Helper()
+	for n := 0; n <= len(data); n++ {
+		got, err := ParseFlowSample(data[:n], expanded)
+		want, wantErr := referenceParseFlowSample(data[:n], expanded)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("%s[:%d]: error %v, reference %v", name, n, err, wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if got.Expanded != expanded {
+			t.Fatalf("%s[:%d]: Expanded = %v", name, n, got.Expanded)
+		}
+		// Fields the reference did not decode
+		got.InputFormat, got.OutputFormat, got.Expanded = 0, 0, false
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s[:%d]:\n got %+v\nwant %+v", name, n, got, want)
+		}
+	}
+}
+
+// checkCounterSample compares ParseCounterSample with the reference on data
+// and every truncation of it
+func checkCounterSample(t *testing.T, name string, data []byte, expanded bool) {
+	t.Helper()
+	for n := 0; n <= len(data); n++ {
+		got, err := ParseCounterSample(data[:n], expanded)
+		want, wantErr := referenceParseCounterSample(data[:n], expanded)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("%s[:%d]: error %v, reference %v", name, n, err, wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if got.Expanded != expanded {
+			t.Fatalf("%s[:%d]: Expanded = %v", name, n, got.Expanded)
+		}
+		got.Expanded = false
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s[:%d]:\n got %+v\nwant %+v", name, n, got, want)
+		}
+	}
+}
+
+func TestReadersDoNotAllocate(t *testing.T) {
+	data := []byte(decoderCorpus()[0])
+	var (
+		dr DatagramReader
+		fr FlowSampleReader
+		cr CounterSampleReader
+		eg ExtendedGatewayHeader
+	)
+	records := 0
+	allocs := testing.AllocsPerRun(100, func() {
+		records = 0
+		if err := dr.Reset(data); err != nil {
+			t.Fatal(err)
+		}
+		for dr.Next() {
+			s := dr.Sample()
+			if s.Enterprise != 0 {
+				continue
+			}
+			switch s.Format {
+			case SampleTypeFlowSample:
+				if err := fr.Reset(s.Data, false); err != nil {
+					t.Fatal(err)
+				}
+				for fr.Next() {
+					r := fr.Record()
+					records++
+					if r.Format == FlowRecordExtendedGateway {
+						if err := eg.Decode(r.Data); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+			case SampleTypeCounterSample:
+				if err := cr.Reset(s.Data, false); err != nil {
+					t.Fatal(err)
+				}
+				for cr.Next() {
+					records++
+				}
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("readers allocate %.1f times per datagram, want 0", allocs)
+	}
+	if records != 3 || eg.DstASPathSegments != 2 || eg.CommunitiesLen != 2 || eg.LocalPref != 100 {
+		t.Errorf("read %d records, gateway %+v", records, eg)
+	}
+}
+
+func BenchmarkDatagramReader(b *testing.B) {
+	data := []byte(decoderCorpus()[0])
+	var (
+		dr DatagramReader
+		fr FlowSampleReader
+	)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		dr.Reset(data)
+		for dr.Next() {
+			if s := dr.Sample(); s.Enterprise == 0 && s.Format == SampleTypeFlowSample && fr.Reset(s.Data, false) == nil {
+				for fr.Next() {
+				}
+			}
+		}
+	}
+}
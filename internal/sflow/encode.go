@@ -0,0 +1,492 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// xdrWriter appends XDR (RFC 4506) encoded values to a byte slice
+type xdrWriter struct {
+	buf []byte
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+// opaque writes variable-length opaque data: length + bytes + zero padding to 4 bytes
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.fixedOpaque(b)
+}
+
+// fixedOpaque writes fixed-length opaque data (no length prefix), zero padded to 4 bytes
+func (w *xdrWriter) fixedOpaque(b []byte) {
+	w.buf = append(w.buf, b...)
+	for pad := (4 - len(b)%4) % 4; pad > 0; pad-- {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// address writes an sFlow address union. The address must match addrType:
+// UNKNOWN(0)=void, IP_V4(1)=4 bytes, IP_V6(2)=16 bytes.
+func (w *xdrWriter) address(addrType uint32, ip net.IP) error {
+	w.uint32(addrType)
+	switch addrType {
+	case AddressTypeUnknown:
+		return nil
+	case AddressTypeIPv4:
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return fmt.Errorf("address %v is not IPv4", ip)
+		}
+		w.buf = append(w.buf, ip4...)
+	case AddressTypeIPv6:
+		if len(ip) != net.IPv6len {
+			return fmt.Errorf("address %v is not IPv6", ip)
+		}
+		w.buf = append(w.buf, ip...)
+	default:
+		return fmt.Errorf("unsupported address type: %d", addrType)
+	}
+	return nil
+}
+
+// dataFormat writes an enterprise/format pair followed by the opaque length and data
+func (w *xdrWriter) dataFormat(enterprise, format uint32, data []byte) error {
+	if enterprise > 0xFFFFF || format > 0xFFF {
+		return fmt.Errorf("invalid data format %d:%d", enterprise, format)
+	}
+	if len(data)%4 != 0 {
+		return fmt.Errorf("data format %d:%d length %d is not 4-byte aligned", enterprise, format, len(data))
+	}
+	w.uint32(enterprise<<12 | format)
+	w.uint32(uint32(len(data)))
+	w.buf = append(w.buf, data...)
+	return nil
+}
+
+// AddressType returns the sFlow address type for ip: IPv4, IPv6 or UNKNOWN for nil
+func AddressType(ip net.IP) uint32 {
+	switch {
+	case ip == nil:
+		return AddressTypeUnknown
+	case ip.To4() != nil:
+		return AddressTypeIPv4
+	default:
+		return AddressTypeIPv6
+	}
+}
+
+// Encode serializes the datagram to sFlow v5. NumSamples and sample lengths are
+// recomputed from Samples; Raw is ignored.
+// Parse followed by Encode reproduces a well-formed datagram byte-for-byte.
+func (d *Datagram) Encode() ([]byte, error) {
+	size := 28
+	if d.AgentAddrType == AddressTypeIPv6 {
+		size = 40
+	}
+	for i := range d.Samples {
+		size += 8 + len(d.Samples[i].Data)
+	}
+
+	if d.AgentAddrType == AddressTypeUnknown {
+		return nil, fmt.Errorf("agent address type must be IPv4 or IPv6")
+	}
+
+	w := &xdrWriter{buf: make([]byte, 0, size)}
+	w.uint32(SFlowVersion5)
+	if err := w.address(d.AgentAddrType, d.AgentAddr); err != nil {
+		return nil, fmt.Errorf("agent address: %w", err)
+	}
+	w.uint32(d.SubAgentID)
+	w.uint32(d.SequenceNum)
+	w.uint32(d.Uptime)
+	w.uint32(uint32(len(d.Samples)))
+
+	for i := range d.Samples {
+		s := &d.Samples[i]
+		if err := w.dataFormat(s.Enterprise, s.Format, s.Data); err != nil {
+			return nil, fmt.Errorf("sample %d: %w", i, err)
+		}
+	}
+
+	return w.buf, nil
+}
+
+// Encode serializes the flow sample body (without the sample header).
+// The compact or expanded form is chosen by fs.Expanded; NumRecords and record
+// lengths are recomputed from Records.
+func (fs *FlowSample) Encode() ([]byte, error) {
+	size := 32
+	if fs.Expanded {
+		size = 44
+	}
+	for i := range fs.Records {
+		size += 8 + len(fs.Records[i].Data)
+	}
+
+	w := &xdrWriter{buf: make([]byte, 0, size)}
+	w.uint32(fs.SequenceNum)
+
+	if fs.Expanded {
+		w.uint32(fs.SourceIDType)
+		w.uint32(fs.SourceIDIndex)
+	} else {
+		if fs.SourceIDType > 0xFF || fs.SourceIDIndex > 0x00FFFFFF {
+			return nil, fmt.Errorf("source_id %d:%d does not fit compact encoding", fs.SourceIDType, fs.SourceIDIndex)
+		}
+		w.uint32(fs.SourceIDType<<24 | fs.SourceIDIndex)
+	}
+
+	w.uint32(fs.SamplingRate)
+	w.uint32(fs.SamplePool)
+	w.uint32(fs.Drops)
+
+	if fs.Expanded {
+		w.uint32(fs.InputFormat)
+		w.uint32(fs.Input)
+		w.uint32(fs.OutputFormat)
+		w.uint32(fs.Output)
+	} else {
+		w.uint32(fs.Input)
+		w.uint32(fs.Output)
+	}
+
+	w.uint32(uint32(len(fs.Records)))
+	for i := range fs.Records {
+		r := &fs.Records[i]
+		if err := w.dataFormat(r.Enterprise, r.Format, r.Data); err != nil {
+			return nil, fmt.Errorf("flow record %d: %w", i, err)
+		}
+	}
+
+	return w.buf, nil
+}
+
+// Sample encodes the flow sample and wraps it as a datagram sample
+func (fs *FlowSample) Sample() (Sample, error) {
+	data, err := fs.Encode()
+	if err != nil {
+		return Sample{}, err
+	}
+	format := uint32(SampleTypeFlowSample)
+	if fs.Expanded {
+		format = SampleTypeExpandedFlowSample
+	}
+	return Sample{Format: format, Length: uint32(len(data)), Data: data}, nil
+}
+
+// Encode serializes the counter sample body (without the sample header).
+// The compact or expanded form is chosen by cs.Expanded; NumRecords and record
+// lengths are recomputed from Records.
+func (cs *CounterSample) Encode() ([]byte, error) {
+	size := 12
+	if cs.Expanded {
+		size = 16
+	}
+	for i := range cs.Records {
+		size += 8 + len(cs.Records[i].Data)
+	}
+
+	w := &xdrWriter{buf: make([]byte, 0, size)}
+	w.uint32(cs.SequenceNum)
+
+	if cs.Expanded {
+		w.uint32(cs.SourceIDType)
+		w.uint32(cs.SourceIDIndex)
+	} else {
+		if cs.SourceIDType > 0xFF || cs.SourceIDIndex > 0x00FFFFFF {
+			return nil, fmt.Errorf("source_id %d:%d does not fit compact encoding", cs.SourceIDType, cs.SourceIDIndex)
+		}
+		w.uint32(cs.SourceIDType<<24 | cs.SourceIDIndex)
+	}
+
+	w.uint32(uint32(len(cs.Records)))
+	for i := range cs.Records {
+		r := &cs.Records[i]
+		if err := w.dataFormat(r.Enterprise, r.Format, r.Data); err != nil {
+			return nil, fmt.Errorf("counter record %d: %w", i, err)
+		}
+	}
+
+	return w.buf, nil
+}
+
+// Sample encodes the counter sample and wraps it as a datagram sample
+func (cs *CounterSample) Sample() (Sample, error) {
+	data, err := cs.Encode()
+	if err != nil {
+		return Sample{}, err
+	}
+	format := uint32(SampleTypeCounterSample)
+	if cs.Expanded {
+		format = SampleTypeExpandedCounterSample
+	}
+	return Sample{Format: format, Length: uint32(len(data)), Data: data}, nil
+}
+
+// NewFlowRecord wraps an encoded record body as an enterprise 0 flow record
+func NewFlowRecord(format uint32, data []byte) FlowRecord {
+	return FlowRecord{Format: format, Length: uint32(len(data)), Data: data}
+}
+
+// NewCounterRecord wraps an encoded record body as an enterprise 0 counter record
+func NewCounterRecord(format uint32, data []byte) CounterRecord {
+	return CounterRecord{Format: format, Length: uint32(len(data)), Data: data}
+}
+
+// Encode serializes the extended gateway record body.
+// Segment and community counts are recomputed from DstASPath and Communities.
+func (eg *ExtendedGateway) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	if err := w.address(eg.NextHopType, eg.NextHop); err != nil {
+		return nil, fmt.Errorf("extended gateway next hop: %w", err)
+	}
+	w.uint32(eg.AS)
+	w.uint32(eg.SrcAS)
+	w.uint32(eg.SrcPeerAS)
+
+	w.uint32(uint32(len(eg.DstASPath)))
+	for _, seg := range eg.DstASPath {
+		w.uint32(seg.Type)
+		w.uint32(uint32(len(seg.ASNs)))
+		for _, asn := range seg.ASNs {
+			w.uint32(asn)
+		}
+	}
+
+	w.uint32(uint32(len(eg.Communities)))
+	for _, comm := range eg.Communities {
+		w.uint32(comm)
+	}
+	w.uint32(eg.LocalPref)
+
+	return w.buf, nil
+}
+
+// Encode serializes the extended switch record body
+func (es *ExtendedSwitch) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	w.uint32(es.SrcVLAN)
+	w.uint32(es.SrcPriority)
+	w.uint32(es.DstVLAN)
+	w.uint32(es.DstPriority)
+	return w.buf, nil
+}
+
+// Encode serializes the extended router record body
+func (er *ExtendedRouter) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	if err := w.address(er.NextHopType, er.NextHop); err != nil {
+		return nil, fmt.Errorf("extended router next hop: %w", err)
+	}
+	w.uint32(er.SrcMaskLen)
+	w.uint32(er.DstMaskLen)
+	return w.buf, nil
+}
+
+// Encode serializes the extended user record body
+func (eu *ExtendedUser) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	w.uint32(eu.SrcCharset)
+	w.opaque([]byte(eu.SrcUser))
+	w.uint32(eu.DstCharset)
+	w.opaque([]byte(eu.DstUser))
+	return w.buf, nil
+}
+
+// Encode serializes the extended URL record body
+func (eu *ExtendedURL) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	w.uint32(eu.Direction)
+	w.opaque([]byte(eu.URL))
+	w.opaque([]byte(eu.Host))
+	return w.buf, nil
+}
+
+// Encode serializes the extended MPLS record body
+func (em *ExtendedMPLS) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	if err := w.address(em.NextHopType, em.NextHop); err != nil {
+		return nil, fmt.Errorf("extended mpls next hop: %w", err)
+	}
+	for _, stack := range [][]uint32{em.InStack, em.OutStack} {
+		w.uint32(uint32(len(stack)))
+		for _, entry := range stack {
+			w.uint32(entry)
+		}
+	}
+	return w.buf, nil
+}
+
+// Encode serializes the extended NAT record body
+func (en *ExtendedNAT) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	if err := w.address(en.SrcAddrType, en.SrcAddr); err != nil {
+		return nil, fmt.Errorf("extended nat src address: %w", err)
+	}
+	if err := w.address(en.DstAddrType, en.DstAddr); err != nil {
+		return nil, fmt.Errorf("extended nat dst address: %w", err)
+	}
+	return w.buf, nil
+}
+
+// Encode serializes the extended MPLS tunnel record body
+func (et *ExtendedMPLSTunnel) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	w.opaque([]byte(et.LSPName))
+	w.uint32(et.TunnelID)
+	w.uint32(et.TunnelCOS)
+	return w.buf, nil
+}
+
+// Encode serializes the extended MPLS virtual circuit record body
+func (ev *ExtendedMPLSVC) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	w.opaque([]byte(ev.InstanceName))
+	w.uint32(ev.VCID)
+	w.uint32(ev.VCLabelCOS)
+	return w.buf, nil
+}
+
+// Encode serializes the extended MPLS FTN record body
+func (ef *ExtendedMPLSFTN) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	w.opaque([]byte(ef.Description))
+	w.uint32(ef.Mask)
+	return w.buf, nil
+}
+
+// Encode serializes the sampled Ethernet record body
+func (se *SampledEthernet) Encode() ([]byte, error) {
+	if len(se.SrcMAC) != 6 || len(se.DstMAC) != 6 {
+		return nil, fmt.Errorf("sampled ethernet MAC addresses must be 6 bytes")
+	}
+	w := &xdrWriter{}
+	w.uint32(se.Length)
+	w.fixedOpaque(se.SrcMAC)
+	w.fixedOpaque(se.DstMAC)
+	w.uint32(se.EtherType)
+	return w.buf, nil
+}
+
+// Encode serializes the sampled IPv4 record body
+func (s4 *SampledIPv4) Encode() ([]byte, error) {
+	src, dst := s4.SrcIP.To4(), s4.DstIP.To4()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("sampled IPv4 addresses must be IPv4")
+	}
+	w := &xdrWriter{}
+	w.uint32(s4.Length)
+	w.uint32(s4.Protocol)
+	w.buf = append(w.buf, src...)
+	w.buf = append(w.buf, dst...)
+	w.uint32(s4.SrcPort)
+	w.uint32(s4.DstPort)
+	w.uint32(s4.TCPFlags)
+	w.uint32(s4.ToS)
+	return w.buf, nil
+}
+
+// Encode serializes the sampled IPv6 record body
+func (s6 *SampledIPv6) Encode() ([]byte, error) {
+	if len(s6.SrcIP) != net.IPv6len || len(s6.DstIP) != net.IPv6len {
+		return nil, fmt.Errorf("sampled IPv6 addresses must be 16 bytes")
+	}
+	w := &xdrWriter{}
+	w.uint32(s6.Length)
+	w.uint32(s6.Protocol)
+	w.buf = append(w.buf, s6.SrcIP...)
+	w.buf = append(w.buf, s6.DstIP...)
+	w.uint32(s6.SrcPort)
+	w.uint32(s6.DstPort)
+	w.uint32(s6.TCPFlags)
+	w.uint32(s6.Priority)
+	return w.buf, nil
+}
+
+// Encode serializes the raw packet header record body.
+// HeaderLength is recomputed from Header; the header is zero padded to 4 bytes.
+func (rh *RawPacketHeader) Encode() ([]byte, error) {
+	w := &xdrWriter{}
+	w.uint32(rh.Protocol)
+	w.uint32(rh.FrameLength)
+	w.uint32(rh.Stripped)
+	w.opaque(rh.Header)
+	return w.buf, nil
+}
+
+// Encode serializes the generic interface counters record body
+func (c *IfCounters) Encode() ([]byte, error) {
+	w := &xdrWriter{buf: make([]byte, 0, 88)}
+	w.uint32(c.IfIndex)
+	w.uint32(c.IfType)
+	w.uint64(c.IfSpeed)
+	w.uint32(c.IfDirection)
+	w.uint32(c.IfStatus)
+	w.uint64(c.IfInOctets)
+	w.uint32(c.IfInUcastPkts)
+	w.uint32(c.IfInMulticastPkts)
+	w.uint32(c.IfInBroadcastPkts)
+	w.uint32(c.IfInDiscards)
+	w.uint32(c.IfInErrors)
+	w.uint32(c.IfInUnknownProtos)
+	w.uint64(c.IfOutOctets)
+	w.uint32(c.IfOutUcastPkts)
+	w.uint32(c.IfOutMulticastPkts)
+	w.uint32(c.IfOutBroadcastPkts)
+	w.uint32(c.IfOutDiscards)
+	w.uint32(c.IfOutErrors)
+	w.uint32(c.IfPromiscuousMode)
+	return w.buf, nil
+}
+
+// Encode serializes the Ethernet interface counters record body
+func (c *EthernetCounters) Encode() ([]byte, error) {
+	w := &xdrWriter{buf: make([]byte, 0, 52)}
+	for _, v := range []uint32{
+		c.AlignmentErrors, c.FCSErrors, c.SingleCollisionFrames, c.MultipleCollisionFrames,
+		c.SQETestErrors, c.DeferredTransmissions, c.LateCollisions, c.ExcessiveCollisions,
+		c.InternalMacTransmitErrors, c.CarrierSenseErrors, c.FrameTooLongs,
+		c.InternalMacReceiveErrors, c.SymbolErrors,
+	} {
+		w.uint32(v)
+	}
+	return w.buf, nil
+}
+
+// Encode serializes the VLAN counters record body
+func (c *VLANCounters) Encode() ([]byte, error) {
+	w := &xdrWriter{buf: make([]byte, 0, 28)}
+	w.uint32(c.VLANID)
+	w.uint64(c.Octets)
+	w.uint32(c.UcastPkts)
+	w.uint32(c.MulticastPkts)
+	w.uint32(c.BroadcastPkts)
+	w.uint32(c.Discards)
+	return w.buf, nil
+}
+
+// Encode serializes the processor counters record body
+func (c *ProcessorCounters) Encode() ([]byte, error) {
+	w := &xdrWriter{buf: make([]byte, 0, 28)}
+	w.uint32(c.CPU5s)
+	w.uint32(c.CPU1m)
+	w.uint32(c.CPU5m)
+	w.uint64(c.TotalMemory)
+	w.uint64(c.FreeMemory)
+	return w.buf, nil
+}
+
+// EncodePortName serializes a port name record body
+func EncodePortName(name string) []byte {
+	w := &xdrWriter{}
+	w.opaque([]byte(name))
+	return w.buf
+}
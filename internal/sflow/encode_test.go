@@ -0,0 +1,383 @@
+package sflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// xdr builds test datagrams by hand, independently of the encoder
+type xdr []byte
+
+func (b xdr) u32(values ...uint32) xdr {
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func (b xdr) u64(v uint64) xdr {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+func (b xdr) raw(p []byte) xdr {
+	return append(b, p...)
+}
+
+// opaque appends a variable-length opaque: length, data, zero padding
+func (b xdr) opaque(p []byte) xdr {
+	b = b.u32(uint32(len(p))).raw(p)
+	for n := len(p); n%4 != 0; n++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// dataFormat appends a sample or record: enterprise/format, length, body
+func (b xdr) dataFormat(enterprise, format uint32, body xdr) xdr {
+	return b.u32(enterprise<<12|format, uint32(len(body))).raw(body)
+}
+
+func datagramV4(agent net.IP, seq uint32, samples ...xdr) xdr {
+	b := xdr{}.u32(SFlowVersion5, AddressTypeIPv4).raw(agent.To4()).u32(0, seq, 123456, uint32(len(samples)))
+	for _, s := range samples {
+		b = b.raw(s)
+	}
+	return b
+}
+
+func datagramV6(agent net.IP, seq uint32, samples ...xdr) xdr {
+	b := xdr{}.u32(SFlowVersion5, AddressTypeIPv6).raw(agent.To16()).u32(7, seq, 123456, uint32(len(samples)))
+	for _, s := range samples {
+		b = b.raw(s)
+	}
+	return b
+}
+
+// flowSample returns a compact flow sample (format 1) with the records
+func flowSample(seq, sourceIndex, rate, input, output uint32, records ...xdr) xdr {
+	body := xdr{}.u32(seq, sourceIndex, rate, rate*10, 0, input, output, uint32(len(records)))
+	for _, r := range records {
+		body = body.raw(r)
+	}
+	return xdr{}.dataFormat(0, SampleTypeFlowSample, body)
+}
+
+// expandedFlowSample returns an expanded flow sample (format 3) with the records
+func expandedFlowSample(seq, sourceIndex, rate, input, output uint32, records ...xdr) xdr {
+	body := xdr{}.u32(seq, 0, sourceIndex, rate, rate*10, 2, 0, input, 0, output, uint32(len(records)))
+	for _, r := range records {
+		body = body.raw(r)
+	}
+	return xdr{}.dataFormat(0, SampleTypeExpandedFlowSample, body)
+}
+
+func counterSample(expanded bool, seq, sourceIndex uint32, records ...xdr) xdr {
+	format := uint32(SampleTypeCounterSample)
+	body := xdr{}.u32(seq, sourceIndex)
+	if expanded {
+		format = SampleTypeExpandedCounterSample
+		body = xdr{}.u32(seq, 0, sourceIndex)
+	}
+	body = body.u32(uint32(len(records)))
+	for _, r := range records {
+		body = body.raw(r)
+	}
+	return xdr{}.dataFormat(0, format, body)
+}
+
+// ipv4Header returns an IPv4/TCP header from src to dst
+func ipv4Header(src, dst net.IP) []byte {
+	h := make([]byte, 40)
+	h[0] = 0x45
+	binary.BigEndian.PutUint16(h[2:], 40)
+	h[8] = 64
+	h[9] = 6
+	copy(h[12:], src.To4())
+	copy(h[16:], dst.To4())
+	return h
+}
+
+// rawHeaderRecord returns a sampled_header record of an Ethernet frame
+// carrying ipHeader
+func rawHeaderRecord(frameLength uint32, ipHeader []byte) xdr {
+	frame := append([]byte{
+		0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 2, 0x08, 0x00,
+	}, ipHeader...)
+	if ipHeader[0]>>4 == 6 {
+		frame[12], frame[13] = 0x86, 0xdd
+	}
+	body := xdr{}.u32(1, frameLength, 4).opaque(frame)
+	return xdr{}.dataFormat(0, FlowRecordRawPacketHeader, body)
+}
+
+func sampledIPv4Record(length uint32, src, dst net.IP) xdr {
+	body := xdr{}.u32(length, 6).raw(src.To4()).raw(dst.To4()).u32(1234, 443, 0x10, 0)
+	return xdr{}.dataFormat(0, FlowRecordIPv4, body)
+}
+
+func natRecord(src, dst net.IP) xdr {
+	body := xdr{}.u32(AddressTypeIPv4).raw(src.To4()).u32(AddressTypeIPv4).raw(dst.To4())
+	return xdr{}.dataFormat(0, FlowRecordExtendedNAT, body)
+}
+
+// gatewayRecordBody returns the body of an extended_gateway record; a nil
+// nextHop is UNKNOWN
+func gatewayRecordBody(nextHop net.IP, as, srcAS, srcPeerAS uint32, path []ASPathSegment, communities []uint32, localPref uint32) xdr {
+	b := xdr{}
+	if nextHop == nil {
+		b = b.u32(AddressTypeUnknown)
+	} else if ip4 := nextHop.To4(); ip4 != nil {
+		b = b.u32(AddressTypeIPv4).raw(ip4)
+	} else {
+		b = b.u32(AddressTypeIPv6).raw(nextHop.To16())
+	}
+	b = b.u32(as, srcAS, srcPeerAS, uint32(len(path)))
+	for _, seg := range path {
+		b = b.u32(seg.Type, uint32(len(seg.ASNs))).u32(seg.ASNs...)
+	}
+	b = b.u32(uint32(len(communities))).u32(communities...)
+	return b.u32(localPref)
+}
+
+// gatewayFlowRecord returns an extended_gateway record
+func gatewayFlowRecord(nextHop net.IP, as, srcAS, srcPeerAS uint32, path []ASPathSegment, communities []uint32, localPref uint32) xdr {
+	return xdr{}.dataFormat(0, FlowRecordExtendedGateway, gatewayRecordBody(nextHop, as, srcAS, srcPeerAS, path, communities, localPref))
+}
+
+func ifCountersRecord(ifIndex uint32, inOctets, outOctets uint64) xdr {
+	body := xdr{}.u32(ifIndex, 6).u64(10_000_000_000).u32(1, 3).u64(inOctets).
+		u32(100, 2, 1, 0, 0, 0).u64(outOctets).u32(200, 4, 3, 0, 0, 0)
+	return xdr{}.dataFormat(0, CounterRecordGeneric, body)
+}
+
+var (
+	testPath = []ASPathSegment{
+		{Type: ASPathSegmentSequence, ASNs: []uint32{3356, 174}},
+		{Type: ASPathSegmentSet, ASNs: []uint32{64500, 64501}},
+	}
+	testCommunities = []uint32{64512<<16 | 100, 64512<<16 | 200}
+)
+
+// reencode re-encodes a record body through its parsed model
+func reencode[T interface{ Encode() ([]byte, error) }](parse func([]byte) (T, error)) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		v, err := parse(data)
+		if err != nil {
+			return nil, err
+		}
+		return v.Encode()
+	}
+}
+
+var (
+	flowRecordCodecs = map[uint32]func([]byte) ([]byte, error){
+		FlowRecordRawPacketHeader: reencode(ParseRawPacketHeader),
+		FlowRecordEthernetFrame:   reencode(ParseSampledEthernet),
+		FlowRecordIPv4:            reencode(ParseSampledIPv4),
+		FlowRecordIPv6:            reencode(ParseSampledIPv6),
+		FlowRecordExtendedSwitch:  reencode(ParseExtendedSwitch),
+		FlowRecordExtendedRouter:  reencode(ParseExtendedRouter),
+		FlowRecordExtendedGateway: reencode(ParseExtendedGateway),
+		FlowRecordExtendedUser:    reencode(ParseExtendedUser),
+		FlowRecordExtendedURL:     reencode(ParseExtendedURL),
+		FlowRecordExtendedMPLS:    reencode(ParseExtendedMPLS),
+		FlowRecordExtendedNAT:     reencode(ParseExtendedNAT),
+		FlowRecordMPLSTunnel:      reencode(ParseExtendedMPLSTunnel),
+		FlowRecordMPLSVC:          reencode(ParseExtendedMPLSVC),
+		FlowRecordMPLSFTN:         reencode(ParseExtendedMPLSFTN),
+	}
+	counterRecordCodecs = map[uint32]func([]byte) ([]byte, error){
+		CounterRecordGeneric:   reencode(ParseIfCounters),
+		CounterRecordEthernet:  reencode(ParseEthernetCounters),
+		CounterRecordVLAN:      reencode(ParseVLANCounters),
+		CounterRecordProcessor: reencode(ParseProcessorCounters),
+		CounterRecordPortName: func(data []byte) ([]byte, error) {
+			name, err := ParsePortName(data)
+			return EncodePortName(name), err
+		},
+	}
+)
+
+// roundTrip parses a datagram down to its records, re-encodes every record
+// with a model, then every sample, then the datagram
+func roundTrip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for i := range d.Samples {
+		s := &d.Samples[i]
+		if s.Enterprise != 0 {
+			continue // opaque
+		}
+		switch s.Format {
+		case SampleTypeFlowSample, SampleTypeExpandedFlowSample:
+			fs, err := ParseFlowSample(s.Data, s.Format == SampleTypeExpandedFlowSample)
+			if err != nil {
+				t.Fatalf("sample %d: %v", i, err)
+			}
+			for j := range fs.Records {
+				r := &fs.Records[j]
+				if codec, ok := flowRecordCodecs[r.Format]; ok && r.Enterprise == 0 {
+					if r.Data, err = codec(r.Data); err != nil {
+						t.Fatalf("sample %d record %d (format %d): %v", i, j, r.Format, err)
+					}
+				}
+			}
+			if *s, err = fs.Sample(); err != nil {
+				t.Fatalf("sample %d: %v", i, err)
+			}
+		case SampleTypeCounterSample, SampleTypeExpandedCounterSample:
+			cs, err := ParseCounterSample(s.Data, s.Format == SampleTypeExpandedCounterSample)
+			if err != nil {
+				t.Fatalf("sample %d: %v", i, err)
+			}
+			for j := range cs.Records {
+				r := &cs.Records[j]
+				if codec, ok := counterRecordCodecs[r.Format]; ok && r.Enterprise == 0 {
+					if r.Data, err = codec(r.Data); err != nil {
+						t.Fatalf("sample %d record %d (format %d): %v", i, j, r.Format, err)
+					}
+				}
+			}
+			if *s, err = cs.Sample(); err != nil {
+				t.Fatalf("sample %d: %v", i, err)
+			}
+		}
+	}
+	out, err := d.Encode()
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return out
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	agent := net.IP{192, 0, 2, 1}
+	src, dst := net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9}
+	opaqueRecord := xdr{}.dataFormat(4413, 5, xdr{}.u32(1, 2, 3))
+
+	tests := []struct {
+		name string
+		data xdr
+	}{
+		{"empty", datagramV4(agent, 1)},
+		{"compact flow v4 gateway with AS_SET", datagramV4(agent, 2,
+			flowSample(10, 3, 1000, 3, 4,
+				rawHeaderRecord(1500, ipv4Header(src, dst)),
+				gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, testCommunities, 100)))},
+		{"expanded flow v6 gateway", datagramV6(net.ParseIP("2001:db8::1"), 3,
+			expandedFlowSample(11, 0x01000003, 512, 70000, 80000,
+				sampledIPv4Record(1500, src, dst),
+				gatewayFlowRecord(net.ParseIP("2001:db8::2"), 64512, 0, 0,
+					[]ASPathSegment{{Type: ASPathSegmentSet, ASNs: []uint32{1, 2, 3}}}, nil, 0)))},
+		{"gateway without path and communities", datagramV4(agent, 4,
+			flowSample(12, 3, 1, 3, 4, gatewayFlowRecord(net.IP{10, 0, 0, 1}, 0, 0, 0, nil, nil, 0)))},
+		{"enterprise records kept opaque", datagramV4(agent, 5,
+			flowSample(13, 3, 1, 3, 4, opaqueRecord, natRecord(src, dst), opaqueRecord))},
+		{"compact and expanded counters", datagramV4(agent, 6,
+			counterSample(false, 1, 3, ifCountersRecord(3, 1e9, 2e9), opaqueRecord),
+			counterSample(true, 2, 70000, ifCountersRecord(70000, 5, 6)))},
+		{"enterprise sample kept opaque", datagramV4(agent, 7,
+			xdr{}.dataFormat(8800, 1, xdr{}.u32(9, 8, 7)),
+			flowSample(14, 3, 1, 3, 4, rawHeaderRecord(64, ipv4Header(src, dst))))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := roundTrip(t, tt.data); !bytes.Equal(out, tt.data) {
+				t.Errorf("round trip changed the datagram\n got %x\nwant %x", out, []byte(tt.data))
+			}
+		})
+	}
+}
+
+// Every record type the package parses comes back unchanged from its model,
+// with odd-length strings, empty and non-empty label stacks and each address type
+func TestEncodeRoundTripAllRecords(t *testing.T) {
+	v4, v6 := net.IP{10, 0, 0, 1}, net.ParseIP("2001:db8::1")
+	src6, dst6 := net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8:1::9")
+	mac := func(last byte) []byte { return []byte{0x02, 0, 0, 0, 0, last, 0, 0} } // padded to 8
+	record := func(format uint32, body xdr) xdr { return xdr{}.dataFormat(0, format, body) }
+
+	data := datagramV4(net.IP{192, 0, 2, 1}, 1,
+		flowSample(1, 3, 1000, 3, 4,
+			rawHeaderRecord(1500, ipv4Header(net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9})),
+			record(FlowRecordEthernetFrame, xdr{}.u32(1518).raw(mac(1)).raw(mac(2)).u32(0x0800)),
+			sampledIPv4Record(1500, net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9}),
+			record(FlowRecordIPv6, xdr{}.u32(1280, 6).raw(src6).raw(dst6).u32(443, 51000, 0x12, 5)),
+			record(FlowRecordExtendedSwitch, xdr{}.u32(100, 3, 200, 5)),
+			record(FlowRecordExtendedRouter, xdr{}.u32(AddressTypeIPv4).raw(v4).u32(24, 16)),
+			gatewayFlowRecord(v4, 64512, 3356, 3356, testPath, testCommunities, 100),
+			record(FlowRecordExtendedUser, xdr{}.u32(106).opaque([]byte("alice")).u32(3).opaque([]byte("bob@example"))),
+			record(FlowRecordExtendedURL, xdr{}.u32(URLDirectionDst).opaque([]byte("/index.html")).opaque([]byte("www.example.com"))),
+			record(FlowRecordExtendedMPLS, xdr{}.u32(AddressTypeIPv4).raw(v4).u32(2, 16<<12|64, 17<<12|0x100|64).u32(1, 18<<12|0x100|64)),
+			natRecord(net.IP{192, 0, 2, 10}, net.IP{203, 0, 113, 9}),
+			record(FlowRecordMPLSTunnel, xdr{}.opaque([]byte("lsp-to-pe2")).u32(7, 3)),
+			record(FlowRecordMPLSVC, xdr{}.opaque([]byte("vc1")).u32(100, 5)),
+			record(FlowRecordMPLSFTN, xdr{}.opaque([]byte("ftn to 192.0.2.0/24")).u32(0xffffff00)),
+		),
+		expandedFlowSample(2, 0x01000003, 512, 70000, 80000,
+			record(FlowRecordExtendedRouter, xdr{}.u32(AddressTypeIPv6).raw(v6).u32(64, 48)),
+			record(FlowRecordExtendedMPLS, xdr{}.u32(AddressTypeIPv6).raw(v6).u32(0).u32(0)),
+			record(FlowRecordExtendedNAT, xdr{}.u32(AddressTypeUnknown).u32(AddressTypeIPv6).raw(dst6)),
+			record(FlowRecordExtendedUser, xdr{}.u32(0).opaque(nil).u32(0).opaque(nil)),
+			gatewayFlowRecord(v6, 64512, 0, 0, nil, nil, 0),
+		),
+		flowSample(3, 3, 1, 3, 4,
+			record(FlowRecordExtendedRouter, xdr{}.u32(AddressTypeUnknown).u32(0, 0)),
+			record(FlowRecordExtendedMPLS, xdr{}.u32(AddressTypeUnknown).u32(1, 3<<12|0x100).u32(0)),
+		),
+		counterSample(false, 1, 3,
+			ifCountersRecord(3, 1e9, 2e9),
+			record(CounterRecordEthernet, xdr{}.u32(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13)),
+			record(CounterRecordVLAN, xdr{}.u32(100).u64(1<<40).u32(5, 6, 7, 8)),
+			record(CounterRecordProcessor, xdr{}.u32(1500, 2500, 3500).u64(16<<30).u64(4<<30)),
+			record(CounterRecordPortName, xdr{}.opaque([]byte("GE0/0/3"))),
+		),
+		counterSample(true, 2, 70000, record(CounterRecordPortName, xdr{}.opaque(nil))),
+	)
+
+	if out := roundTrip(t, data); !bytes.Equal(out, data) {
+		t.Errorf("round trip changed the datagram\n got %x\nwant %x", out, []byte(data))
+	}
+
+	// The datagram has a record of every format with a codec
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[[2]uint32]bool{}
+	for _, s := range d.Samples {
+		switch s.Format {
+		case SampleTypeFlowSample, SampleTypeExpandedFlowSample:
+			fs, err := ParseFlowSample(s.Data, s.Format == SampleTypeExpandedFlowSample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range fs.Records {
+				seen[[2]uint32{s.Format, r.Format}] = true
+			}
+		default:
+			cs, err := ParseCounterSample(s.Data, s.Format == SampleTypeExpandedCounterSample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range cs.Records {
+				seen[[2]uint32{SampleTypeCounterSample, r.Format}] = true
+			}
+		}
+	}
+	for format := range flowRecordCodecs {
+		if !seen[[2]uint32{SampleTypeFlowSample, format}] && !seen[[2]uint32{SampleTypeExpandedFlowSample, format}] {
+			t.Errorf("no flow record of format %d", format)
+		}
+	}
+	for format := range counterRecordCodecs {
+		if !seen[[2]uint32{SampleTypeCounterSample, format}] {
+			t.Errorf("no counter record of format %d", format)
+		}
+	}
+}
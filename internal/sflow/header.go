@@ -0,0 +1,500 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	// Header protocols for raw packet header records (sFlow v5: enum header_protocol)
+	HeaderProtocolEthernet = 1
+	HeaderProtocolPPP      = 7
+	HeaderProtocolIPv4     = 11
+	HeaderProtocolIPv6     = 12
+	HeaderProtocolMPLS     = 13
+
+	// EtherTypes walked by the dissector
+	EtherTypeIPv4      = 0x0800
+	EtherTypeIPv6      = 0x86DD
+	EtherTypeVLAN      = 0x8100 // 802.1Q
+	EtherTypeQinQ      = 0x88A8 // 802.1ad
+	EtherTypeQinQOld   = 0x9100 // pre-standard QinQ
+	EtherTypeMPLS      = 0x8847
+	EtherTypeMPLSMulti = 0x8848
+
+	EtherTypeTransparentEthernet = 0x6558 // GRE payload: bridged Ethernet (NVGRE)
+
+	// IP protocol numbers with L4 ports
+	IPProtocolTCP  = 6
+	IPProtocolUDP  = 17
+	IPProtocolSCTP = 132
+
+	// IP protocol numbers for tunnels
+	IPProtocolIPIP = 4  // IPv4 in IP
+	IPProtocolIPv6 = 41 // IPv6 in IP
+	IPProtocolGRE  = 47
+
+	// Well-known UDP ports for tunnels
+	UDPPortVXLAN = 4789
+	UDPPortGTPU  = 2152
+)
+
+// TunnelType identifies the encapsulation found by the dissector
+type TunnelType uint8
+
+const (
+	TunnelNone TunnelType = iota
+	TunnelGRE
+	TunnelVXLAN
+	TunnelIPIP
+	TunnelGTPU
+)
+
+// String returns the tunnel name
+func (t TunnelType) String() string {
+	switch t {
+	case TunnelGRE:
+		return "gre"
+	case TunnelVXLAN:
+		return "vxlan"
+	case TunnelIPIP:
+		return "ipip"
+	case TunnelGTPU:
+		return "gtpu"
+	default:
+		return "none"
+	}
+}
+
+// DissectOptions controls optional dissector behaviour
+type DissectOptions struct {
+	// DecodeTunnels decodes the inner header of GRE, VXLAN, IP-in-IP and GTP-U
+	// tunnels into HeaderInfo.Inner. Only one level of encapsulation is decoded.
+	DecodeTunnels bool
+}
+
+// RawPacketHeader represents a raw packet header record (sampled_header)
+type RawPacketHeader struct {
+	Protocol     uint32 // header_protocol
+	FrameLength  uint32 // Original length of the packet before sampling
+	Stripped     uint32 // Bytes removed from the packet before header extraction
+	HeaderLength uint32
+	Header       []byte
+}
+
+// HeaderInfo is the result of dissecting a sampled packet header.
+// Addresses reference the header bytes; they are not copied.
+type HeaderInfo struct {
+	SrcMAC     net.HardwareAddr
+	DstMAC     net.HardwareAddr
+	VLANs      []uint16 // VLAN IDs, outermost first
+	MPLSLabels []uint32 // MPLS label values, outermost first
+	EtherType  uint16   // EtherType of the L3 payload (0 if not Ethernet)
+	IPVersion  uint8    // 4 or 6, 0 if no IP header was found
+	SrcIP      net.IP
+	DstIP      net.IP
+	Protocol   uint8 // IPv4 protocol / IPv6 final next header
+	TOS        uint8 // IPv4 ToS / IPv6 traffic class
+	Fragment   bool  // Non-first fragment: no L4 header present
+	SrcPort    uint16
+	DstPort    uint16
+	TCPFlags   uint8
+
+	// Tunnel encapsulation, set only with DissectOptions.DecodeTunnels
+	Tunnel   TunnelType
+	TunnelID uint32      // GRE key, VXLAN VNI or GTP-U TEID (0 if absent)
+	Inner    *HeaderInfo // Inner header, nil if not tunnelled or inner decode failed
+
+	opts     DissectOptions
+	innerBuf *HeaderInfo // Recycled by Decode
+}
+
+// Innermost returns the inner header for tunnelled traffic, h otherwise
+func (h *HeaderInfo) Innermost() *HeaderInfo {
+	if h.Inner != nil && h.Inner.IPVersion != 0 {
+		return h.Inner
+	}
+	return h
+}
+
+// ParseRawPacketHeader parses raw packet header record
+func ParseRawPacketHeader(data []byte) (*RawPacketHeader, error) {
+	rh := &RawPacketHeader{}
+	if err := rh.Decode(data); err != nil {
+		return nil, err
+	}
+	return rh, nil
+}
+
+// Decode decodes a raw packet header record body into rh without allocating.
+// Header references data.
+func (rh *RawPacketHeader) Decode(data []byte) error {
+	// protocol (4) + frame_length (4) + stripped (4) + header_length (4) + header...
+	if len(data) < 16 {
+		return fmt.Errorf("raw packet header data too short: %d bytes", len(data))
+	}
+
+	rh.Protocol = binary.BigEndian.Uint32(data[0:])
+	rh.FrameLength = binary.BigEndian.Uint32(data[4:])
+	rh.Stripped = binary.BigEndian.Uint32(data[8:])
+	rh.HeaderLength = binary.BigEndian.Uint32(data[12:])
+
+	if 16+uint64(rh.HeaderLength) > uint64(len(data)) {
+		return fmt.Errorf("raw packet header length %d exceeds record", rh.HeaderLength)
+	}
+	rh.Header = data[16 : 16+int(rh.HeaderLength)]
+
+	return nil
+}
+
+// DissectHeader walks the sampled header from the link layer down to L4.
+// Supported header protocols: Ethernet (with 802.1Q, QinQ and MPLS), IPv4, IPv6 and MPLS.
+func DissectHeader(protocol uint32, header []byte, opts DissectOptions) (*HeaderInfo, error) {
+	h := &HeaderInfo{}
+	if err := h.Decode(protocol, header, opts); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Decode dissects header into h, reusing its slices so a HeaderInfo can be
+// recycled across packets.
+func (h *HeaderInfo) Decode(protocol uint32, header []byte, opts DissectOptions) error {
+	h.reset()
+	h.opts = opts
+
+	switch protocol {
+	case HeaderProtocolEthernet:
+		return h.decodeEthernet(header)
+	case HeaderProtocolIPv4, HeaderProtocolIPv6:
+		return h.decodeIP(header)
+	case HeaderProtocolMPLS:
+		return h.decodeMPLS(header)
+	default:
+		return fmt.Errorf("unsupported header protocol: %d", protocol)
+	}
+}
+
+func (h *HeaderInfo) reset() {
+	vlans, labels, inner := h.VLANs[:0], h.MPLSLabels[:0], h.innerBuf
+	*h = HeaderInfo{VLANs: vlans, MPLSLabels: labels, innerBuf: inner}
+}
+
+// decodeEthernet decodes an Ethernet II header and any stacked VLAN tags
+func (h *HeaderInfo) decodeEthernet(b []byte) error {
+	if len(b) < 14 {
+		return fmt.Errorf("ethernet header truncated: %d bytes", len(b))
+	}
+
+	h.DstMAC = net.HardwareAddr(b[0:6])
+	h.SrcMAC = net.HardwareAddr(b[6:12])
+	etherType := binary.BigEndian.Uint16(b[12:14])
+	offset := 14
+
+	// 802.1Q / 802.1ad tags: TCI(2) + inner EtherType(2)
+	for etherType == EtherTypeVLAN || etherType == EtherTypeQinQ || etherType == EtherTypeQinQOld {
+		if offset+4 > len(b) {
+			return fmt.Errorf("VLAN tag truncated")
+		}
+		h.VLANs = append(h.VLANs, binary.BigEndian.Uint16(b[offset:])&0x0FFF)
+		etherType = binary.BigEndian.Uint16(b[offset+2:])
+		offset += 4
+	}
+
+	h.EtherType = etherType
+
+	switch etherType {
+	case EtherTypeIPv4, EtherTypeIPv6:
+		return h.decodeIP(b[offset:])
+	case EtherTypeMPLS, EtherTypeMPLSMulti:
+		return h.decodeMPLS(b[offset:])
+	default:
+		// Non-IP payload (ARP, LLDP, ...): nothing more to extract
+		return nil
+	}
+}
+
+// decodeMPLS walks an MPLS label stack and decodes the payload after bottom of stack.
+// MPLS has no payload type field, so the payload is guessed from the first nibble:
+// 4 = IPv4, 6 = IPv6, 0 = pseudowire control word followed by Ethernet.
+func (h *HeaderInfo) decodeMPLS(b []byte) error {
+	offset := 0
+	for {
+		if offset+4 > len(b) {
+			return fmt.Errorf("MPLS label stack truncated")
+		}
+		entry := binary.BigEndian.Uint32(b[offset:])
+		offset += 4
+		h.MPLSLabels = append(h.MPLSLabels, entry>>12)
+		if entry&0x100 != 0 { // bottom of stack
+			break
+		}
+	}
+
+	if offset >= len(b) {
+		return nil // Payload stripped by the agent
+	}
+
+	switch b[offset] >> 4 {
+	case 4, 6:
+		return h.decodeIP(b[offset:])
+	case 0:
+		// RFC 4385 control word (4 bytes) + Ethernet pseudowire payload
+		if offset+4 > len(b) {
+			return nil
+		}
+		return h.decodeEthernet(b[offset+4:])
+	default:
+		return nil
+	}
+}
+
+// decodeIP decodes an IPv4 or IPv6 header, using the version nibble
+func (h *HeaderInfo) decodeIP(b []byte) error {
+	if len(b) < 1 {
+		return fmt.Errorf("IP header truncated")
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		return h.decodeIPv4(b)
+	case 6:
+		return h.decodeIPv6(b)
+	default:
+		return fmt.Errorf("unknown IP version: %d", b[0]>>4)
+	}
+}
+
+func (h *HeaderInfo) decodeIPv4(b []byte) error {
+	if len(b) < 20 {
+		return fmt.Errorf("IPv4 header truncated: %d bytes", len(b))
+	}
+
+	ihl := int(b[0]&0x0F) * 4
+	if ihl < 20 {
+		return fmt.Errorf("invalid IPv4 header length: %d", ihl)
+	}
+
+	h.IPVersion = 4
+	h.TOS = b[1]
+	h.Protocol = b[9]
+	h.SrcIP = net.IP(b[12:16])
+	h.DstIP = net.IP(b[16:20])
+
+	// Fragment offset != 0: L4 header is in the first fragment only
+	if binary.BigEndian.Uint16(b[6:8])&0x1FFF != 0 {
+		h.Fragment = true
+		return nil
+	}
+
+	if ihl > len(b) {
+		return nil // Options truncated, no L4
+	}
+	h.decodeL4(b[ihl:])
+	h.decodeTunnel(b[ihl:])
+	return nil
+}
+
+func (h *HeaderInfo) decodeIPv6(b []byte) error {
+	if len(b) < 40 {
+		return fmt.Errorf("IPv6 header truncated: %d bytes", len(b))
+	}
+
+	h.IPVersion = 6
+	h.TOS = uint8(binary.BigEndian.Uint16(b[0:2]) >> 4)
+	h.SrcIP = net.IP(b[8:24])
+	h.DstIP = net.IP(b[24:40])
+
+	nextHeader := b[6]
+	offset := 40
+
+	// Walk extension headers to find the upper-layer protocol
+	for {
+		switch nextHeader {
+		case 0, 43, 60: // Hop-by-Hop, Routing, Destination Options
+			if offset+2 > len(b) {
+				h.Protocol = nextHeader
+				return nil
+			}
+			nextHeader, offset = b[offset], offset+(int(b[offset+1])+1)*8
+			continue
+		case 44: // Fragment
+			if offset+8 > len(b) {
+				h.Protocol = nextHeader
+				return nil
+			}
+			if binary.BigEndian.Uint16(b[offset+2:])&0xFFF8 != 0 {
+				h.Fragment = true
+			}
+			nextHeader, offset = b[offset], offset+8
+			continue
+		case 51: // Authentication Header
+			if offset+2 > len(b) {
+				h.Protocol = nextHeader
+				return nil
+			}
+			nextHeader, offset = b[offset], offset+(int(b[offset+1])+2)*4
+			continue
+		}
+		break
+	}
+
+	h.Protocol = nextHeader
+	if h.Fragment || offset > len(b) {
+		return nil
+	}
+	h.decodeL4(b[offset:])
+	h.decodeTunnel(b[offset:])
+	return nil
+}
+
+// decodeL4 extracts ports (TCP/UDP/SCTP) and TCP flags when present in the header
+func (h *HeaderInfo) decodeL4(b []byte) {
+	switch h.Protocol {
+	case IPProtocolTCP, IPProtocolUDP, IPProtocolSCTP:
+		if len(b) < 4 {
+			return
+		}
+		h.SrcPort = binary.BigEndian.Uint16(b[0:2])
+		h.DstPort = binary.BigEndian.Uint16(b[2:4])
+		if h.Protocol == IPProtocolTCP && len(b) >= 14 {
+			h.TCPFlags = b[13]
+		}
+	}
+}
+
+// decodeTunnel decodes the inner header when payload is a supported tunnel.
+// Inner decode errors are not fatal: the outer header stays valid.
+func (h *HeaderInfo) decodeTunnel(payload []byte) {
+	if !h.opts.DecodeTunnels {
+		return
+	}
+
+	switch {
+	case h.Protocol == IPProtocolIPIP || h.Protocol == IPProtocolIPv6:
+		h.decodeInner(TunnelIPIP, 0, payload, (*HeaderInfo).decodeIP)
+	case h.Protocol == IPProtocolGRE:
+		h.decodeGRE(payload)
+	case h.Protocol == IPProtocolUDP && h.DstPort == UDPPortVXLAN:
+		h.decodeVXLAN(payload)
+	case h.Protocol == IPProtocolUDP && (h.DstPort == UDPPortGTPU || h.SrcPort == UDPPortGTPU):
+		h.decodeGTPU(payload)
+	}
+}
+
+// decodeInner decodes b into h.Inner using decode, without further tunnel decoding
+func (h *HeaderInfo) decodeInner(tunnel TunnelType, id uint32, b []byte, decode func(*HeaderInfo, []byte) error) {
+	h.Tunnel = tunnel
+	h.TunnelID = id
+
+	if h.innerBuf == nil {
+		h.innerBuf = &HeaderInfo{}
+	}
+	inner := h.innerBuf
+	inner.reset()
+
+	if err := decode(inner, b); err != nil {
+		return
+	}
+	h.Inner = inner
+}
+
+// decodeGRE decodes a GRE header (RFC 2784 / RFC 2890) and its payload
+func (h *HeaderInfo) decodeGRE(b []byte) {
+	if len(b) < 4 {
+		return
+	}
+
+	flags := binary.BigEndian.Uint16(b[0:2])
+	if flags&0x0007 != 0 {
+		return // Version 1 (PPTP enhanced GRE) is not supported
+	}
+	protocol := binary.BigEndian.Uint16(b[2:4])
+	offset := 4
+
+	if flags&0x8000 != 0 { // Checksum present: checksum(2) + reserved(2)
+		offset += 4
+	}
+	var key uint32
+	if flags&0x2000 != 0 { // Key present
+		if offset+4 > len(b) {
+			return
+		}
+		key = binary.BigEndian.Uint32(b[offset:])
+		offset += 4
+	}
+	if flags&0x1000 != 0 { // Sequence number present
+		offset += 4
+	}
+	if offset > len(b) {
+		return
+	}
+
+	switch protocol {
+	case EtherTypeIPv4, EtherTypeIPv6:
+		h.decodeInner(TunnelGRE, key, b[offset:], (*HeaderInfo).decodeIP)
+	case EtherTypeTransparentEthernet:
+		h.decodeInner(TunnelGRE, key, b[offset:], (*HeaderInfo).decodeEthernet)
+	case EtherTypeMPLS, EtherTypeMPLSMulti:
+		h.decodeInner(TunnelGRE, key, b[offset:], (*HeaderInfo).decodeMPLS)
+	}
+}
+
+// decodeVXLAN decodes a VXLAN header (RFC 7348) carrying an inner Ethernet frame
+func (h *HeaderInfo) decodeVXLAN(udp []byte) {
+	// UDP header(8) + VXLAN header(8)
+	if len(udp) < 16 {
+		return
+	}
+	vxlan := udp[8:]
+	if vxlan[0]&0x08 == 0 {
+		return // VNI flag not set
+	}
+	vni := binary.BigEndian.Uint32(vxlan[4:8]) >> 8
+
+	h.decodeInner(TunnelVXLAN, vni, vxlan[8:], (*HeaderInfo).decodeEthernet)
+}
+
+// decodeGTPU decodes a GTPv1-U G-PDU header (3GPP TS 29.281) carrying an inner IP packet
+func (h *HeaderInfo) decodeGTPU(udp []byte) {
+	// UDP header(8) + mandatory GTP header(8)
+	if len(udp) < 16 {
+		return
+	}
+	gtp := udp[8:]
+
+	flags := gtp[0]
+	if flags>>5 != 1 || flags&0x10 == 0 {
+		return // Not GTPv1 / not GTP (GTP' uses PT=0)
+	}
+	if gtp[1] != 0xFF {
+		return // Only G-PDU carries user traffic
+	}
+	teid := binary.BigEndian.Uint32(gtp[4:8])
+	offset := 8
+
+	// E, S or PN set: sequence(2) + N-PDU(1) + next extension type(1)
+	if flags&0x07 != 0 {
+		if offset+4 > len(gtp) {
+			return
+		}
+		nextExt := gtp[offset+3]
+		offset += 4
+
+		// Extension headers: length(1) in 4-byte units, ..., next type(1)
+		for nextExt != 0 {
+			if offset >= len(gtp) {
+				return
+			}
+			extLen := int(gtp[offset]) * 4
+			if extLen == 0 || offset+extLen > len(gtp) {
+				return
+			}
+			nextExt = gtp[offset+extLen-1]
+			offset += extLen
+		}
+	}
+
+	h.decodeInner(TunnelGTPU, teid, gtp[offset:], (*HeaderInfo).decodeIP)
+}
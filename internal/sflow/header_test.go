@@ -0,0 +1,582 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// Packet builders for the dissector tests
+
+func cat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+var testMACs = []byte{0x02, 0, 0, 0, 0, 2, 0x02, 0, 0, 0, 0, 1}
+
+// ethernet returns an Ethernet header; tags are 802.1Q/802.1ad TPID and TCI
+// pairs, outermost first
+func ethernet(etherType uint16, tags ...uint16) []byte {
+	b := append([]byte{}, testMACs...)
+	for _, tag := range tags {
+		b = append(b, be16(tag)...)
+	}
+	return append(b, be16(etherType)...)
+}
+
+// mplsEntry returns an MPLS label stack entry with TTL 64
+func mplsEntry(label uint32, bottom bool) []byte {
+	entry := label<<12 | 64
+	if bottom {
+		entry |= 0x100
+	}
+	return be32(entry)
+}
+
+// ipv4 returns an IPv4 header with options followed by payload
+func ipv4(protocol, tos uint8, src, dst string, options, payload []byte) []byte {
+	h := make([]byte, 20, 20+len(options)+len(payload))
+	h[0] = 0x40 | uint8(5+len(options)/4)
+	h[1] = tos
+	binary.BigEndian.PutUint16(h[2:], uint16(20+len(options)+len(payload)))
+	h[8], h[9] = 64, protocol
+	copy(h[12:], net.ParseIP(src).To4())
+	copy(h[16:], net.ParseIP(dst).To4())
+	return cat(h, options, payload)
+}
+
+// ipv6 returns an IPv6 header followed by payload
+func ipv6(nextHeader, trafficClass uint8, src, dst string, payload []byte) []byte {
+	h := make([]byte, 40, 40+len(payload))
+	binary.BigEndian.PutUint32(h, 6<<28|uint32(trafficClass)<<20)
+	binary.BigEndian.PutUint16(h[4:], uint16(len(payload)))
+	h[6], h[7] = nextHeader, 64
+	copy(h[8:], net.ParseIP(src))
+	copy(h[24:], net.ParseIP(dst))
+	return cat(h, payload)
+}
+
+// ipv6Ext returns an extension header of length 8*(units+1) bytes
+func ipv6Ext(nextHeader, units uint8) []byte {
+	h := make([]byte, 8*(int(units)+1))
+	h[0], h[1] = nextHeader, units
+	return h
+}
+
+func tcp(srcPort, dstPort uint16, flags uint8) []byte {
+	h := make([]byte, 20)
+	binary.BigEndian.PutUint16(h[0:], srcPort)
+	binary.BigEndian.PutUint16(h[2:], dstPort)
+	h[12], h[13] = 5<<4, flags
+	return h
+}
+
+func udp(srcPort, dstPort uint16, payload []byte) []byte {
+	return cat(be16(srcPort), be16(dstPort), be16(uint16(8+len(payload))), be16(0), payload)
+}
+
+// dissected is the part of a HeaderInfo the tests compare
+type dissected struct {
+	VLANs, Labels    string
+	EtherType        uint16
+	IPVersion        uint8
+	Src, Dst         string
+	Protocol, TOS    uint8
+	Fragment         bool
+	SrcPort, DstPort uint16
+	TCPFlags         uint8
+	Tunnel           TunnelType
+	TunnelID         uint32
+	HasInner         bool
+}
+
+func dissectedOf(h *HeaderInfo) dissected {
+	d := dissected{
+		VLANs: fmt.Sprint(h.VLANs), Labels: fmt.Sprint(h.MPLSLabels),
+		EtherType: h.EtherType, IPVersion: h.IPVersion,
+		Protocol: h.Protocol, TOS: h.TOS, Fragment: h.Fragment,
+		SrcPort: h.SrcPort, DstPort: h.DstPort, TCPFlags: h.TCPFlags,
+		Tunnel: h.Tunnel, TunnelID: h.TunnelID, HasInner: h.Inner != nil,
+	}
+	if h.SrcIP != nil {
+		d.Src, d.Dst = h.SrcIP.String(), h.DstIP.String()
+	}
+	return d
+}
+
+const (
+	tcpSYN = 0x02
+	tcpACK = 0x10
+	tcpPSH = 0x08
+)
+
+func TestDissectHeader(t *testing.T) {
+	tcp4 := ipv4(IPProtocolTCP, 0x28, "198.51.100.7", "203.0.113.9", nil, tcp(51000, 443, tcpSYN|tcpACK))
+	udp6 := ipv6(IPProtocolUDP, 0xb8, "2001:db8::7", "2001:db8:1::9", udp(5353, 53, nil))
+	tcp4Want := dissected{VLANs: "[]", Labels: "[]", EtherType: EtherTypeIPv4, IPVersion: 4,
+		Src: "198.51.100.7", Dst: "203.0.113.9", Protocol: IPProtocolTCP, TOS: 0x28,
+		SrcPort: 51000, DstPort: 443, TCPFlags: tcpSYN | tcpACK}
+	udp6Want := dissected{VLANs: "[]", Labels: "[]", EtherType: EtherTypeIPv6, IPVersion: 6,
+		Src: "2001:db8::7", Dst: "2001:db8:1::9", Protocol: IPProtocolUDP, TOS: 0xb8,
+		SrcPort: 5353, DstPort: 53}
+	with := func(d dissected, change func(*dissected)) dissected {
+		change(&d)
+		return d
+	}
+
+	tests := []struct {
+		name     string
+		protocol uint32
+		header   []byte
+		want     dissected
+	}{
+		{"IPv4 over Ethernet", HeaderProtocolEthernet, cat(ethernet(EtherTypeIPv4), tcp4), tcp4Want},
+		{"IPv6 over Ethernet", HeaderProtocolEthernet, cat(ethernet(EtherTypeIPv6), udp6), udp6Want},
+		{"IPv6 in 802.1Q", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeIPv6, EtherTypeVLAN, 5<<13|100), udp6),
+			with(udp6Want, func(d *dissected) { d.VLANs = "[100]" })},
+		{"QinQ 802.1ad", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeIPv4, EtherTypeQinQ, 200, EtherTypeVLAN, 1<<12|300), tcp4),
+			with(tcp4Want, func(d *dissected) { d.VLANs = "[200 300]" })},
+		{"QinQ double 802.1Q", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeIPv6, EtherTypeVLAN, 10, EtherTypeVLAN, 4094), udp6),
+			with(udp6Want, func(d *dissected) { d.VLANs = "[10 4094]" })},
+		{"QinQ pre-standard", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeIPv4, EtherTypeQinQOld, 7, EtherTypeVLAN, 8), tcp4),
+			with(tcp4Want, func(d *dissected) { d.VLANs = "[7 8]" })},
+		{"MPLS label stack", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeMPLS), mplsEntry(16, false), mplsEntry(1048575, false), mplsEntry(3, true), tcp4),
+			with(tcp4Want, func(d *dissected) { d.Labels = "[16 1048575 3]"; d.EtherType = EtherTypeMPLS })},
+		{"MPLS in 802.1Q", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeMPLSMulti, EtherTypeVLAN, 42), mplsEntry(24000, true), udp6),
+			with(udp6Want, func(d *dissected) { d.VLANs = "[42]"; d.Labels = "[24000]"; d.EtherType = EtherTypeMPLSMulti })},
+		{"MPLS pseudowire", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeMPLS), mplsEntry(100, false), mplsEntry(200, true), be32(0),
+				ethernet(EtherTypeIPv4, EtherTypeVLAN, 30), tcp4),
+			with(tcp4Want, func(d *dissected) { d.VLANs = "[30]"; d.Labels = "[100 200]" })},
+		{"MPLS payload stripped", HeaderProtocolEthernet,
+			cat(ethernet(EtherTypeMPLS), mplsEntry(16, true)),
+			dissected{VLANs: "[]", Labels: "[16]", EtherType: EtherTypeMPLS}},
+		{"MPLS header protocol", HeaderProtocolMPLS,
+			cat(mplsEntry(17, false), mplsEntry(18, true), udp6),
+			with(udp6Want, func(d *dissected) { d.Labels = "[17 18]"; d.EtherType = 0 })},
+		{"raw IPv4", HeaderProtocolIPv4, tcp4, with(tcp4Want, func(d *dissected) { d.EtherType = 0 })},
+		{"raw IPv6", HeaderProtocolIPv6, udp6, with(udp6Want, func(d *dissected) { d.EtherType = 0 })},
+		{"raw IPv4 with options", HeaderProtocolIPv4,
+			ipv4(IPProtocolTCP, 0, "192.0.2.1", "192.0.2.2", make([]byte, 8), tcp(1, 2, tcpPSH)),
+			dissected{VLANs: "[]", Labels: "[]", IPVersion: 4, Src: "192.0.2.1", Dst: "192.0.2.2",
+				Protocol: IPProtocolTCP, SrcPort: 1, DstPort: 2, TCPFlags: tcpPSH}},
+		{"SCTP", HeaderProtocolIPv4, ipv4(IPProtocolSCTP, 0, "192.0.2.1", "192.0.2.2", nil, udp(3868, 3869, nil)),
+			dissected{VLANs: "[]", Labels: "[]", IPVersion: 4, Src: "192.0.2.1", Dst: "192.0.2.2",
+				Protocol: IPProtocolSCTP, SrcPort: 3868, DstPort: 3869}},
+		{"ICMP has no ports", HeaderProtocolIPv4, ipv4(1, 0, "192.0.2.1", "192.0.2.2", nil, make([]byte, 8)),
+			dissected{VLANs: "[]", Labels: "[]", IPVersion: 4, Src: "192.0.2.1", Dst: "192.0.2.2", Protocol: 1}},
+		{"ARP", HeaderProtocolEthernet, cat(ethernet(0x0806, EtherTypeVLAN, 9), make([]byte, 28)),
+			dissected{VLANs: "[9]", Labels: "[]", EtherType: 0x0806}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := DissectHeader(tt.protocol, tt.header, DissectOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dissectedOf(h); got != tt.want {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+			if tt.protocol == HeaderProtocolEthernet && (h.DstMAC.String() != "02:00:00:00:00:02" || h.SrcMAC.String() != "02:00:00:00:00:01") {
+				t.Errorf("MACs %v -> %v", h.SrcMAC, h.DstMAC)
+			}
+		})
+	}
+}
+
+func TestDissectIPv6ExtensionHeaders(t *testing.T) {
+	const src, dst = "2001:db8::7", "2001:db8:1::9"
+	fragment := func(next uint8, offset uint16, more bool) []byte {
+		h := make([]byte, 8)
+		h[0] = next
+		binary.BigEndian.PutUint16(h[2:], offset<<3)
+		if more {
+			h[3] |= 1
+		}
+		return h
+	}
+	ah := make([]byte, 16) // payload length 2: (2+2)*4 bytes
+	ah[0], ah[1] = IPProtocolTCP, 2
+
+	tests := []struct {
+		name     string
+		header   []byte
+		protocol uint8
+		fragment bool
+		srcPort  uint16
+		tcpFlags uint8
+	}{
+		{"hop-by-hop, routing, destination options", ipv6(0, 0, src, dst, cat(
+			ipv6Ext(43, 0), ipv6Ext(60, 2), ipv6Ext(IPProtocolTCP, 1), tcp(179, 40000, tcpACK|tcpPSH))),
+			IPProtocolTCP, false, 179, tcpACK | tcpPSH},
+		{"authentication header", ipv6(51, 0, src, dst, cat(ah, tcp(22, 40000, tcpACK))),
+			IPProtocolTCP, false, 22, tcpACK},
+		{"first fragment", ipv6(44, 0, src, dst, cat(fragment(IPProtocolUDP, 0, true), udp(53, 5353, nil))),
+			IPProtocolUDP, false, 53, 0},
+		{"later fragment", ipv6(44, 0, src, dst, cat(fragment(IPProtocolUDP, 185, false), make([]byte, 8))),
+			IPProtocolUDP, true, 0, 0},
+		{"no next header", ipv6(0, 0, src, dst, ipv6Ext(59, 0)), 59, false, 0, 0},
+		{"extension header past the sampled bytes", ipv6(0, 0, src, dst, ipv6Ext(IPProtocolTCP, 4)[:8]),
+			IPProtocolTCP, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := DissectHeader(HeaderProtocolIPv6, tt.header, DissectOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.IPVersion != 6 || h.SrcIP.String() != src || h.DstIP.String() != dst {
+				t.Errorf("IPv%d %v -> %v", h.IPVersion, h.SrcIP, h.DstIP)
+			}
+			if h.Protocol != tt.protocol || h.Fragment != tt.fragment || h.SrcPort != tt.srcPort || h.TCPFlags != tt.tcpFlags {
+				t.Errorf("protocol %d, fragment %v, source port %d, TCP flags %#x; want %d, %v, %d, %#x",
+					h.Protocol, h.Fragment, h.SrcPort, h.TCPFlags, tt.protocol, tt.fragment, tt.srcPort, tt.tcpFlags)
+			}
+		})
+	}
+
+	// An IPv4 fragment other than the first has no L4 header
+	frag := ipv4(IPProtocolUDP, 0, "192.0.2.1", "192.0.2.2", nil, udp(53, 5353, nil))
+	frag[7] = 185
+	if h, err := DissectHeader(HeaderProtocolIPv4, frag, DissectOptions{}); err != nil || !h.Fragment || h.SrcPort != 0 {
+		t.Errorf("IPv4 later fragment: %+v, %v", h, err)
+	}
+}
+
+// A header cut anywhere is an error while the link, VLAN, MPLS or IP header is
+// incomplete; once the IP header is complete the fields found so far are kept
+func TestDissectTruncated(t *testing.T) {
+	t.Run("Ethernet", func(t *testing.T) {
+		ip := ipv4(IPProtocolTCP, 0, "198.51.100.7", "203.0.113.9", nil, tcp(51000, 443, tcpSYN))
+		frame := cat(ethernet(EtherTypeMPLS, EtherTypeQinQ, 100, EtherTypeVLAN, 200),
+			mplsEntry(16, false), mplsEntry(17, true), ip)
+		const vlans, labels, l3 = 14 + 8, 14 + 8 + 8, 14 + 8 + 8
+		for n := 0; n <= len(frame); n++ {
+			h, err := DissectHeader(HeaderProtocolEthernet, frame[:n], DissectOptions{})
+			switch {
+			case n < vlans || (n > l3 && n < l3+20):
+				if err == nil {
+					t.Errorf("cut to %d bytes: no error", n)
+				}
+				continue
+			case n < labels:
+				if err == nil {
+					t.Errorf("cut to %d bytes in the label stack: no error", n)
+				}
+				continue
+			case err != nil:
+				t.Errorf("cut to %d bytes: %v", n, err)
+				continue
+			}
+			if fmt.Sprint(h.VLANs) != "[100 200]" || fmt.Sprint(h.MPLSLabels) != "[16 17]" {
+				t.Errorf("cut to %d bytes: VLANs %v, labels %v", n, h.VLANs, h.MPLSLabels)
+			}
+			wantVersion, wantPort, wantFlags := uint8(4), uint16(51000), uint8(tcpSYN)
+			if n == l3 {
+				wantVersion = 0 // Payload stripped after the label stack
+			}
+			if n < l3+20+4 {
+				wantPort = 0
+			}
+			if n < l3+20+14 {
+				wantFlags = 0
+			}
+			if h.IPVersion != wantVersion || h.SrcPort != wantPort || h.TCPFlags != wantFlags {
+				t.Errorf("cut to %d bytes: IPv%d, source port %d, TCP flags %#x; want IPv%d, %d, %#x",
+					n, h.IPVersion, h.SrcPort, h.TCPFlags, wantVersion, wantPort, wantFlags)
+			}
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		packet := ipv6(0, 0, "2001:db8::7", "2001:db8:1::9", cat(ipv6Ext(IPProtocolTCP, 0), tcp(179, 40000, tcpACK)))
+		for n := 0; n <= len(packet); n++ {
+			h, err := DissectHeader(HeaderProtocolIPv6, packet[:n], DissectOptions{})
+			if n < 40 {
+				if err == nil {
+					t.Errorf("cut to %d bytes: no error", n)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("cut to %d bytes: %v", n, err)
+			}
+			wantProtocol, wantPort, wantFlags := uint8(IPProtocolTCP), uint16(179), uint8(tcpACK)
+			if n < 42 {
+				wantProtocol = 0 // Hop-by-hop header cut before its length
+			}
+			if n < 48+4 {
+				wantPort = 0
+			}
+			if n < 48+14 {
+				wantFlags = 0
+			}
+			if h.Protocol != wantProtocol || h.SrcPort != wantPort || h.TCPFlags != wantFlags {
+				t.Errorf("cut to %d bytes: protocol %d, source port %d, TCP flags %#x; want %d, %d, %#x",
+					n, h.Protocol, h.SrcPort, h.TCPFlags, wantProtocol, wantPort, wantFlags)
+			}
+		}
+	})
+
+	for name, tt := range map[string]struct {
+		protocol uint32
+		header   []byte
+	}{
+		"PPP":             {HeaderProtocolPPP, make([]byte, 64)},
+		"empty IPv4":      {HeaderProtocolIPv4, nil},
+		"IPv4 IHL 4":      {HeaderProtocolIPv4, append([]byte{0x44}, make([]byte, 19)...)},
+		"empty MPLS":      {HeaderProtocolMPLS, nil},
+		"unknown version": {HeaderProtocolIPv6, append([]byte{0x50}, make([]byte, 39)...)},
+	} {
+		if _, err := DissectHeader(tt.protocol, tt.header, DissectOptions{}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// Decode recycles a HeaderInfo without leaking fields of the previous packet
+func TestHeaderInfoDecodeReuse(t *testing.T) {
+	var h HeaderInfo
+	qinq := cat(ethernet(EtherTypeMPLS, EtherTypeQinQ, 100, EtherTypeVLAN, 200), mplsEntry(16, true),
+		ipv4(IPProtocolTCP, 0, "198.51.100.7", "203.0.113.9", nil, tcp(51000, 443, tcpSYN)))
+	if err := h.Decode(HeaderProtocolEthernet, qinq, DissectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	udp6 := ipv6(IPProtocolUDP, 0, "2001:db8::7", "2001:db8:1::9", udp(5353, 53, nil))
+	if err := h.Decode(HeaderProtocolIPv6, udp6, DissectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := dissected{VLANs: "[]", Labels: "[]", IPVersion: 6, Src: "2001:db8::7", Dst: "2001:db8:1::9",
+		Protocol: IPProtocolUDP, SrcPort: 5353, DstPort: 53}
+	if got := dissectedOf(&h); got != want || h.SrcMAC != nil {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+const (
+	greChecksum = 0x8000
+	greKey      = 0x2000
+	greSequence = 0x1000
+)
+
+// gre returns a GRE header with the optional fields flags selects, followed by payload
+func gre(flags, protocol uint16, key uint32, payload []byte) []byte {
+	b := cat(be16(flags), be16(protocol))
+	if flags&greChecksum != 0 {
+		b = append(b, 0xbe, 0xef, 0, 0)
+	}
+	if flags&greKey != 0 {
+		b = append(b, be32(key)...)
+	}
+	if flags&greSequence != 0 {
+		b = append(b, be32(1)...)
+	}
+	return cat(b, payload)
+}
+
+// vxlan returns a UDP datagram carrying a VXLAN header and frame
+func vxlan(vni uint32, frame []byte) []byte {
+	return udp(49152, UDPPortVXLAN, cat([]byte{0x08, 0, 0, 0}, be32(vni<<8), frame))
+}
+
+// gtpuExt returns a GTP-U extension header of 4*units bytes
+func gtpuExt(units uint8) []byte {
+	e := make([]byte, 4*int(units))
+	e[0] = units
+	return e
+}
+
+// gtpu returns a GTPv1-U G-PDU in a UDP datagram from and to port 2152, with
+// the sequence number flag and extension headers if any are given
+func gtpu(teid uint32, sequence bool, exts [][]byte, payload []byte) []byte {
+	h := cat([]byte{0x30, 0xff}, be16(0), be32(teid))
+	if sequence || len(exts) > 0 {
+		next := byte(0)
+		if len(exts) > 0 {
+			h[0] |= 0x04
+			next = 0x85
+		}
+		if sequence {
+			h[0] |= 0x02
+		}
+		h = append(h, 0, 1, 0, next)
+	}
+	for i, e := range exts {
+		e = append([]byte{}, e...)
+		if i < len(exts)-1 {
+			e[len(e)-1] = 0x85
+		}
+		h = append(h, e...)
+	}
+	return udp(UDPPortGTPU, UDPPortGTPU, cat(h, payload))
+}
+
+func TestDissectTunnels(t *testing.T) {
+	const outerSrc, outerDst = "198.51.100.7", "203.0.113.9"
+	outer4 := func(protocol uint8, payload []byte) []byte {
+		return cat(ethernet(EtherTypeIPv4), ipv4(protocol, 0, outerSrc, outerDst, nil, payload))
+	}
+	outer6 := func(nextHeader uint8, payload []byte) []byte {
+		return cat(ethernet(EtherTypeIPv6), ipv6(nextHeader, 0, "2001:db8::7", "2001:db8:1::9", payload))
+	}
+	inner4 := ipv4(IPProtocolTCP, 0, "10.0.0.1", "10.1.2.3", nil, tcp(1234, 80, tcpSYN))
+	inner6 := ipv6(IPProtocolUDP, 0, "2001:db8:a::1", "2001:db8:b::1", udp(5000, 6000, nil))
+	inner4Want := &dissected{VLANs: "[]", Labels: "[]", IPVersion: 4, Src: "10.0.0.1", Dst: "10.1.2.3",
+		Protocol: IPProtocolTCP, SrcPort: 1234, DstPort: 80, TCPFlags: tcpSYN}
+	inner6Want := &dissected{VLANs: "[]", Labels: "[]", IPVersion: 6, Src: "2001:db8:a::1", Dst: "2001:db8:b::1",
+		Protocol: IPProtocolUDP, SrcPort: 5000, DstPort: 6000}
+	with := func(d *dissected, change func(*dissected)) *dissected {
+		c := *d
+		change(&c)
+		return &c
+	}
+	cut := func(b []byte, n int) []byte { return b[:len(b)-n] }
+
+	tests := []struct {
+		name   string
+		header []byte
+		tunnel TunnelType
+		id     uint32
+		inner  *dissected // nil: no inner header
+	}{
+		{"GRE", outer4(IPProtocolGRE, gre(0, EtherTypeIPv4, 0, inner4)), TunnelGRE, 0, inner4Want},
+		{"GRE key", outer4(IPProtocolGRE, gre(greKey, EtherTypeIPv4, 0xdeadbeef, inner4)), TunnelGRE, 0xdeadbeef, inner4Want},
+		{"GRE checksum, key and sequence", outer4(IPProtocolGRE, gre(greChecksum|greKey|greSequence, EtherTypeIPv6, 7, inner6)),
+			TunnelGRE, 7, inner6Want},
+		{"GRE checksum and sequence", outer4(IPProtocolGRE, gre(greChecksum|greSequence, EtherTypeIPv4, 0, inner4)),
+			TunnelGRE, 0, inner4Want},
+		{"NVGRE", outer4(IPProtocolGRE, gre(greKey, EtherTypeTransparentEthernet, 5000<<8, cat(ethernet(EtherTypeIPv4, EtherTypeVLAN, 12), inner4))),
+			TunnelGRE, 5000 << 8, with(inner4Want, func(d *dissected) { d.VLANs = "[12]"; d.EtherType = EtherTypeIPv4 })},
+		{"GRE MPLS", outer4(IPProtocolGRE, gre(0, EtherTypeMPLS, 0, cat(mplsEntry(299776, true), inner6))),
+			TunnelGRE, 0, with(inner6Want, func(d *dissected) { d.Labels = "[299776]" })},
+		{"GRE over IPv6", outer6(IPProtocolGRE, gre(greKey, EtherTypeIPv4, 1, inner4)), TunnelGRE, 1, inner4Want},
+		{"GRE in GRE decodes one level", outer4(IPProtocolGRE, gre(0, EtherTypeIPv4, 0,
+			ipv4(IPProtocolGRE, 0, "10.0.0.1", "10.1.2.3", nil, gre(0, EtherTypeIPv4, 0, inner4)))),
+			TunnelGRE, 0, &dissected{VLANs: "[]", Labels: "[]", IPVersion: 4, Src: "10.0.0.1", Dst: "10.1.2.3", Protocol: IPProtocolGRE}},
+		{"VXLAN", outer4(IPProtocolUDP, vxlan(5000, cat(ethernet(EtherTypeIPv4), inner4))),
+			TunnelVXLAN, 5000, with(inner4Want, func(d *dissected) { d.EtherType = EtherTypeIPv4 })},
+		{"VXLAN over IPv6", outer6(IPProtocolUDP, vxlan(1<<24-1, cat(ethernet(EtherTypeIPv6), inner6))),
+			TunnelVXLAN, 1<<24 - 1, with(inner6Want, func(d *dissected) { d.EtherType = EtherTypeIPv6 })},
+		{"IP-in-IP", outer4(IPProtocolIPIP, inner4), TunnelIPIP, 0, inner4Want},
+		{"6in4", outer4(IPProtocolIPv6, inner6), TunnelIPIP, 0, inner6Want},
+		{"4in6", outer6(IPProtocolIPIP, inner4), TunnelIPIP, 0, inner4Want},
+		{"6in6", outer6(IPProtocolIPv6, inner6), TunnelIPIP, 0, inner6Want},
+		{"GTP-U", outer4(IPProtocolUDP, gtpu(0x01020304, false, nil, inner4)), TunnelGTPU, 0x01020304, inner4Want},
+		{"GTP-U sequence number", outer4(IPProtocolUDP, gtpu(9, true, nil, inner6)), TunnelGTPU, 9, inner6Want},
+		{"GTP-U extension headers", outer4(IPProtocolUDP, gtpu(10, false, [][]byte{gtpuExt(1), gtpuExt(2)}, inner4)),
+			TunnelGTPU, 10, inner4Want},
+		{"GTP-U from port 2152", outer4(IPProtocolUDP, func() []byte {
+			b := gtpu(11, false, nil, inner4)
+			b[2], b[3] = 0xc0, 0x00 // destination port 49152
+			return b
+		}()), TunnelGTPU, 11, inner4Want},
+
+		// Not a supported encapsulation: outer header only
+		{"GRE version 1", outer4(IPProtocolGRE, gre(1, 0x880b, 0, inner4)), TunnelNone, 0, nil},
+		{"GRE unknown payload", outer4(IPProtocolGRE, gre(0, 0x88be, 0, inner4)), TunnelNone, 0, nil},
+		{"VXLAN without VNI flag", outer4(IPProtocolUDP, func() []byte {
+			b := vxlan(5000, cat(ethernet(EtherTypeIPv4), inner4))
+			b[8] = 0
+			return b
+		}()), TunnelNone, 0, nil},
+		{"GTP-U echo request", outer4(IPProtocolUDP, func() []byte {
+			b := gtpu(12, false, nil, inner4)
+			b[9] = 1
+			return b
+		}()), TunnelNone, 0, nil},
+		{"GTP'", outer4(IPProtocolUDP, func() []byte {
+			b := gtpu(12, false, nil, inner4)
+			b[8] &^= 0x10
+			return b
+		}()), TunnelNone, 0, nil},
+
+		// Truncated tunnel headers: outer header only
+		{"GRE header cut", outer4(IPProtocolGRE, []byte{0, 0, 0x08}), TunnelNone, 0, nil},
+		{"GRE key cut", outer4(IPProtocolGRE, cut(gre(greChecksum|greKey, EtherTypeIPv4, 1, nil), 1)), TunnelNone, 0, nil},
+		{"GRE sequence cut", outer4(IPProtocolGRE, cut(gre(greKey|greSequence, EtherTypeIPv4, 1, nil), 2)), TunnelNone, 0, nil},
+		{"VXLAN header cut", outer4(IPProtocolUDP, cut(vxlan(5000, nil), 1)), TunnelNone, 0, nil},
+		{"GTP-U header cut", outer4(IPProtocolUDP, cut(gtpu(13, false, nil, nil), 1)), TunnelNone, 0, nil},
+		{"GTP-U optional fields cut", outer4(IPProtocolUDP, cut(gtpu(13, true, nil, nil), 1)), TunnelNone, 0, nil},
+		{"GTP-U extension header cut", outer4(IPProtocolUDP, cut(gtpu(13, false, [][]byte{gtpuExt(1), gtpuExt(2)}, nil), 1)), TunnelNone, 0, nil},
+		{"GTP-U extension length 0", outer4(IPProtocolUDP, gtpu(13, false, [][]byte{{0, 0, 0, 0}}, inner4)), TunnelNone, 0, nil},
+
+		// Truncated inner headers: the tunnel is known, the inner header is not
+		{"GRE inner cut", outer4(IPProtocolGRE, gre(greKey, EtherTypeIPv4, 3, inner4[:19])), TunnelGRE, 3, nil},
+		{"NVGRE inner cut", outer4(IPProtocolGRE, gre(0, EtherTypeTransparentEthernet, 0, ethernet(EtherTypeIPv4)[:13])), TunnelGRE, 0, nil},
+		{"VXLAN inner cut", outer4(IPProtocolUDP, vxlan(6000, cat(ethernet(EtherTypeIPv4), inner4[:10]))), TunnelVXLAN, 6000, nil},
+		{"IP-in-IP inner cut", outer4(IPProtocolIPIP, inner4[:19]), TunnelIPIP, 0, nil},
+		{"6in4 inner cut", outer4(IPProtocolIPv6, inner6[:39]), TunnelIPIP, 0, nil},
+		{"GTP-U inner cut", outer4(IPProtocolUDP, gtpu(14, true, nil, inner6[:20])), TunnelGTPU, 14, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, err := DissectHeader(HeaderProtocolEthernet, tt.header, DissectOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain.Tunnel != TunnelNone || plain.Inner != nil {
+				t.Errorf("tunnel %v decoded without DecodeTunnels", plain.Tunnel)
+			}
+
+			h, err := DissectHeader(HeaderProtocolEthernet, tt.header, DissectOptions{DecodeTunnels: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantOuter := dissectedOf(plain)
+			wantOuter.Tunnel, wantOuter.TunnelID, wantOuter.HasInner = tt.tunnel, tt.id, tt.inner != nil
+			if got := dissectedOf(h); got != wantOuter {
+				t.Errorf("outer got  %+v\n      want %+v", got, wantOuter)
+			}
+			if tt.inner == nil {
+				if h.Innermost() != h {
+					t.Error("Innermost is not the outer header")
+				}
+				return
+			}
+			if got := dissectedOf(h.Inner); got != *tt.inner {
+				t.Errorf("inner got  %+v\n      want %+v", got, *tt.inner)
+			}
+			if h.Innermost() != h.Inner {
+				t.Error("Innermost is not the inner header")
+			}
+		})
+	}
+}
+
+// The recycled inner header does not outlive the tunnelled packet
+func TestHeaderInfoDecodeReuseTunnel(t *testing.T) {
+	var h HeaderInfo
+	opts := DissectOptions{DecodeTunnels: true}
+	tunnelled := cat(ethernet(EtherTypeIPv4), ipv4(IPProtocolIPIP, 0, "198.51.100.7", "203.0.113.9", nil,
+		ipv4(IPProtocolUDP, 0, "10.0.0.1", "10.1.2.3", nil, udp(1, 2, nil))))
+	if err := h.Decode(HeaderProtocolEthernet, tunnelled, opts); err != nil || h.Inner == nil {
+		t.Fatalf("tunnelled: inner %v, %v", h.Inner, err)
+	}
+	inner := h.Inner
+
+	if err := h.Decode(HeaderProtocolEthernet, cat(ethernet(EtherTypeIPv4), ipv4(IPProtocolTCP, 0, "198.51.100.7", "203.0.113.9", nil, tcp(1, 2, 0))), opts); err != nil {
+		t.Fatal(err)
+	}
+	if h.Inner != nil || h.Tunnel != TunnelNone || h.TunnelID != 0 {
+		t.Errorf("plain packet after tunnelled: tunnel %v %d, inner %v", h.Tunnel, h.TunnelID, h.Inner)
+	}
+
+	if err := h.Decode(HeaderProtocolEthernet, tunnelled, opts); err != nil || h.Inner != inner {
+		t.Errorf("inner header not recycled: %p, was %p, %v", h.Inner, inner, err)
+	}
+}
@@ -0,0 +1,152 @@
+package sflow
+
+import (
+	"encoding/binary"
+)
+
+// Interface value formats of flow sample input/output (sFlow v5: interface).
+// Compact samples keep the format in the top 2 bits of the value.
+const (
+	InterfaceFormatIfIndex  = 0 // ifIndex, 0 = unknown
+	InterfaceFormatDiscard  = 1 // packet discarded, value is the reason
+	InterfaceFormatMultiple = 2 // value is the number of output interfaces
+)
+
+const (
+	// ifIndex of the agent itself in input/output (sFlow v5: 0x3FFFFFFF = internal)
+	ifIndexInternal = 0x3FFFFFFF
+	// Compact source_id holds the index in its low 24 bits
+	maxCompactSourceIndex = 0x00FFFFFF
+)
+
+// remapInterface rewrites a flow sample interface value at packet[offset:]:
+// compact (format in the top 2 bits) or expanded (format field, then value)
+func remapInterface(packet []byte, offset int, expanded bool, remap func(uint32) (uint32, bool)) bool {
+	limit := uint32(ifIndexInternal)
+	if expanded {
+		if binary.BigEndian.Uint32(packet[offset:]) != InterfaceFormatIfIndex {
+			return false
+		}
+		offset += 4
+		limit = 0xFFFFFFFF
+	}
+	value := binary.BigEndian.Uint32(packet[offset:])
+	if value == 0 || value == ifIndexInternal || value > limit {
+		return false // unknown, internal, or not an ifIndex (compact format bits)
+	}
+	newIndex, ok := remap(value)
+	if !ok || newIndex == value || newIndex == 0 || newIndex == ifIndexInternal || newIndex >= limit {
+		return false
+	}
+	binary.BigEndian.PutUint32(packet[offset:], newIndex)
+	return true
+}
+
+// remapSourceID rewrites an ifIndex data source (source_id type 0) at packet[offset:]
+func remapSourceID(packet []byte, offset int, expanded bool, remap func(uint32) (uint32, bool)) bool {
+	if expanded {
+		if binary.BigEndian.Uint32(packet[offset:]) != 0 {
+			return false
+		}
+		index := binary.BigEndian.Uint32(packet[offset+4:])
+		newIndex, ok := remap(index)
+		if !ok || newIndex == index {
+			return false
+		}
+		binary.BigEndian.PutUint32(packet[offset+4:], newIndex)
+		return true
+	}
+
+	sourceID := binary.BigEndian.Uint32(packet[offset:])
+	if sourceID>>24 != 0 {
+		return false
+	}
+	newIndex, ok := remap(sourceID)
+	if !ok || newIndex == sourceID || newIndex > maxCompactSourceIndex {
+		return false
+	}
+	binary.BigEndian.PutUint32(packet[offset:], newIndex)
+	return true
+}
+
+// RemapIfIndex rewrites the ifIndex values of the sample at sampleOffset in place.
+// remap returns the new ifIndex for an old one, and false to leave it unchanged.
+// Flow samples: source_id (ifIndex data sources only), input and output
+// (single-interface values only). Counter samples: source_id and the ifIndex of
+// if_counters records. Compact and expanded encodings are handled; values that
+// do not fit the compact encoding are left unchanged.
+// Returns whether anything was rewritten.
+func RemapIfIndex(packet []byte, sampleOffset int, remap func(uint32) (uint32, bool)) bool {
+	if sampleOffset < 0 || sampleOffset+8 > len(packet) {
+		return false
+	}
+	header := binary.BigEndian.Uint32(packet[sampleOffset:])
+	sampleLen := int(binary.BigEndian.Uint32(packet[sampleOffset+4:]))
+	dataStart := sampleOffset + 8
+	if header>>12 != 0 || dataStart+sampleLen > len(packet) {
+		return false
+	}
+	data := packet[dataStart : dataStart+sampleLen]
+
+	changed := false
+	switch header & 0xFFF {
+	case SampleTypeFlowSample:
+		// seq, source_id, rate, pool, drops, input, output
+		if len(data) < 32 {
+			return false
+		}
+		changed = remapSourceID(data, 4, false, remap)
+		changed = remapInterface(data, 20, false, remap) || changed
+		changed = remapInterface(data, 24, false, remap) || changed
+	case SampleTypeExpandedFlowSample:
+		// seq, source_id(2), rate, pool, drops, input(2), output(2)
+		if len(data) < 44 {
+			return false
+		}
+		changed = remapSourceID(data, 4, true, remap)
+		changed = remapInterface(data, 24, true, remap) || changed
+		changed = remapInterface(data, 32, true, remap) || changed
+	case SampleTypeCounterSample, SampleTypeExpandedCounterSample:
+		expanded := header&0xFFF == SampleTypeExpandedCounterSample
+		var r CounterSampleReader
+		if err := r.Reset(data, expanded); err != nil {
+			return false
+		}
+		changed = remapSourceID(data, 4, expanded, remap)
+		for r.Next() {
+			record := r.Record()
+			if record.Enterprise != 0 || record.Format != CounterRecordGeneric || len(record.Data) < 4 {
+				continue
+			}
+			// if_counters starts with ifIndex
+			index := binary.BigEndian.Uint32(record.Data)
+			if newIndex, ok := remap(index); ok && newIndex != index {
+				binary.BigEndian.PutUint32(record.Data, newIndex)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// InputIfIndex returns the ifIndex of the interface the sampled packet arrived
+// on, if input is a single interface other than the agent itself
+func (fs *FlowSample) InputIfIndex() (uint32, bool) {
+	return interfaceIndex(fs.Expanded, fs.InputFormat, fs.Input)
+}
+
+// OutputIfIndex returns the ifIndex of the interface the sampled packet was
+// sent out of, if output is a single interface other than the agent itself
+func (fs *FlowSample) OutputIfIndex() (uint32, bool) {
+	return interfaceIndex(fs.Expanded, fs.OutputFormat, fs.Output)
+}
+
+func interfaceIndex(expanded bool, format, value uint32) (uint32, bool) {
+	if expanded && format != InterfaceFormatIfIndex {
+		return 0, false
+	}
+	if value == 0 || value == ifIndexInternal || (!expanded && value > ifIndexInternal) {
+		return 0, false
+	}
+	return value, true
+}
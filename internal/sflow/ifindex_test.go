@@ -0,0 +1,108 @@
+package sflow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// expandedFlowSampleFormats returns an expanded flow sample with the source_id
+// type and interface formats given
+func expandedFlowSampleFormats(sourceType, sourceIndex, inFormat, input, outFormat, output uint32) xdr {
+	body := xdr{}.u32(1, sourceType, sourceIndex, 512, 5120, 0, inFormat, input, outFormat, output, 0)
+	return xdr{}.dataFormat(0, SampleTypeExpandedFlowSample, body)
+}
+
+// compactInterface returns a compact input/output value of a format
+func compactInterface(format, value uint32) uint32 {
+	return format<<30 | value
+}
+
+func TestRemapIfIndex(t *testing.T) {
+	table := map[uint32]uint32{
+		3: 103,
+		4: 104,
+		5: 0,               // not an interface
+		6: ifIndexInternal, // the agent itself
+		7: 0x01000000,      // past the compact source_id index
+		8: 8,               // unchanged
+	}
+	remap := func(ifIndex uint32) (uint32, bool) {
+		newIndex, ok := table[ifIndex]
+		return newIndex, ok
+	}
+	const smonVLAN = 1 // source_id type of a VLAN data source
+
+	tests := []struct {
+		name   string
+		sample xdr
+		want   xdr // nil: unchanged
+	}{
+		{"flow", flowSample(1, 3, 512, 3, 4), flowSample(1, 103, 512, 103, 104)},
+		{"flow, VLAN data source", flowSample(1, smonVLAN<<24|3, 512, 3, 9), flowSample(1, smonVLAN<<24|3, 512, 103, 9)},
+		{"flow, discarded", flowSample(1, 9, 512, 4, compactInterface(InterfaceFormatDiscard, 3)),
+			flowSample(1, 9, 512, 104, compactInterface(InterfaceFormatDiscard, 3))},
+		{"flow, multiple outputs", flowSample(1, 9, 512, 9, compactInterface(InterfaceFormatMultiple, 3)), nil},
+		{"flow, unknown and internal", flowSample(1, 9, 512, 0, ifIndexInternal), nil},
+		{"flow, mapped to 0 and internal", flowSample(1, 9, 512, 5, 6), nil},
+		{"flow, source_id past 24 bits", flowSample(1, 7, 512, 9, 8), nil},
+		{"flow, nothing mapped", flowSample(1, 9, 512, 10, 11), nil},
+
+		{"expanded flow", expandedFlowSample(1, 3, 512, 3, 4), expandedFlowSample(1, 103, 512, 103, 104)},
+		{"expanded flow, VLAN data source", expandedFlowSampleFormats(smonVLAN, 3, 0, 3, 0, 9),
+			expandedFlowSampleFormats(smonVLAN, 3, 0, 103, 0, 9)},
+		{"expanded flow, discarded", expandedFlowSampleFormats(0, 9, 0, 4, InterfaceFormatDiscard, 3),
+			expandedFlowSampleFormats(0, 9, 0, 104, InterfaceFormatDiscard, 3)},
+		{"expanded flow, multiple outputs", expandedFlowSampleFormats(0, 9, 0, 9, InterfaceFormatMultiple, 3), nil},
+		{"expanded flow, mapped to 0 and internal", expandedFlowSample(1, 9, 512, 5, 6), nil},
+		{"expanded flow, source_id past 24 bits", expandedFlowSample(1, 7, 512, 9, 9), expandedFlowSample(1, 0x01000000, 512, 9, 9)},
+
+		{"counter", counterSample(false, 1, 3, ifCountersRecord(3, 1, 2)), counterSample(false, 1, 103, ifCountersRecord(103, 1, 2))},
+		{"expanded counter", counterSample(true, 1, 4, ifCountersRecord(4, 1, 2)), counterSample(true, 1, 104, ifCountersRecord(104, 1, 2))},
+		{"counter, other records", counterSample(false, 1, 9,
+			xdr{}.dataFormat(0, CounterRecordPortName, xdr{}.opaque([]byte("ge-0/0/3"))),
+			xdr{}.dataFormat(2011, CounterRecordGeneric, xdr{}.u32(3)),
+			ifCountersRecord(3, 1, 2)),
+			counterSample(false, 1, 9,
+				xdr{}.dataFormat(0, CounterRecordPortName, xdr{}.opaque([]byte("ge-0/0/3"))),
+				xdr{}.dataFormat(2011, CounterRecordGeneric, xdr{}.u32(3)),
+				ifCountersRecord(103, 1, 2))},
+		{"counter, VLAN data source", counterSample(false, 1, smonVLAN<<24|3), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := net.IP{192, 0, 2, 1}
+			data := datagramV4(agent, 1, tt.sample)
+			want := data
+			if tt.want != nil {
+				want = datagramV4(agent, 1, tt.want)
+			}
+			d, err := Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := append([]byte{}, data...)
+			if changed := RemapIfIndex(got, d.Samples[0].Offset, remap); changed != (tt.want != nil) {
+				t.Errorf("changed = %v", changed)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("remapped\n got %x\nwant %x", got, []byte(want))
+			}
+		})
+	}
+
+	// Offsets and lengths that do not describe a sample
+	data := datagramV4(net.IP{192, 0, 2, 1}, 1, flowSample(1, 3, 512, 3, 4))
+	for _, offset := range []int{-1, len(data) - 4, len(data)} {
+		if RemapIfIndex(append([]byte{}, data...), offset, remap) {
+			t.Errorf("remapped at offset %d", offset)
+		}
+	}
+	if RemapIfIndex(append([]byte{}, data[:len(data)-1]...), 28, remap) {
+		t.Error("remapped a sample past the datagram")
+	}
+	short := datagramV4(net.IP{192, 0, 2, 1}, 1, xdr{}.dataFormat(0, SampleTypeFlowSample, xdr{}.u32(1, 3, 512, 0, 0, 3, 4)))
+	if RemapIfIndex(short, 28, remap) {
+		t.Error("remapped a flow sample shorter than its header")
+	}
+}
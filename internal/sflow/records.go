@@ -0,0 +1,437 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ExtendedSwitch represents extended switch data (VLAN and 802.1p priority)
+type ExtendedSwitch struct {
+	SrcVLAN     uint32
+	SrcPriority uint32
+	DstVLAN     uint32
+	DstPriority uint32
+}
+
+// ExtendedRouter represents extended router data
+type ExtendedRouter struct {
+	NextHopType uint32
+	NextHop     net.IP
+	SrcMaskLen  uint32
+	DstMaskLen  uint32
+}
+
+// readAddress reads an sFlow v5 address union at offset.
+// Supports all RFC address_type values: UNKNOWN(0)=void, IP_V4(1)=4 bytes, IP_V6(2)=16 bytes.
+// Returns the address type, the address (nil for UNKNOWN) and the offset past the address.
+func readAddress(data []byte, offset int) (uint32, net.IP, int, error) {
+	if offset+4 > len(data) {
+		return 0, nil, offset, fmt.Errorf("data too short for address type")
+	}
+	addrType := binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	addrSize := nextHopAddrSize(addrType)
+	if addrSize < 0 {
+		return addrType, nil, offset, fmt.Errorf("unsupported address type: %d", addrType)
+	}
+	if offset+addrSize > len(data) {
+		return addrType, nil, offset, fmt.Errorf("data too short for address type %d", addrType)
+	}
+	if addrSize == 0 {
+		return addrType, nil, offset, nil
+	}
+	return addrType, net.IP(data[offset : offset+addrSize]), offset + addrSize, nil
+}
+
+// ParseExtendedSwitch parses extended switch record (16 bytes)
+func ParseExtendedSwitch(data []byte) (*ExtendedSwitch, error) {
+	if len(data) < 16 {
+		return nil, fmt.Errorf("extended switch data too short: %d bytes", len(data))
+	}
+
+	return &ExtendedSwitch{
+		SrcVLAN:     binary.BigEndian.Uint32(data[0:]),
+		SrcPriority: binary.BigEndian.Uint32(data[4:]),
+		DstVLAN:     binary.BigEndian.Uint32(data[8:]),
+		DstPriority: binary.BigEndian.Uint32(data[12:]),
+	}, nil
+}
+
+// ParseExtendedRouter parses extended router record
+// Supports all RFC address_type values: UNKNOWN(0)=void, IP_V4(1)=4 bytes, IP_V6(2)=16 bytes
+func ParseExtendedRouter(data []byte) (*ExtendedRouter, error) {
+	// Minimum: type(4) + void(0) + src_mask_len(4) + dst_mask_len(4) = 12 bytes (UNKNOWN nexthop)
+	if len(data) < 12 {
+		return nil, fmt.Errorf("extended router data too short: %d bytes", len(data))
+	}
+
+	er := &ExtendedRouter{}
+
+	nextHopType, nextHop, offset, err := readAddress(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("extended router next hop: %w", err)
+	}
+	er.NextHopType = nextHopType
+	er.NextHop = nextHop
+
+	if offset+8 > len(data) {
+		return nil, fmt.Errorf("extended router data too short for mask lengths")
+	}
+
+	er.SrcMaskLen = binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	er.DstMaskLen = binary.BigEndian.Uint32(data[offset:])
+
+	return er, nil
+}
+
+// SampledEthernet represents a sampled Ethernet frame record (sampled_ethernet)
+type SampledEthernet struct {
+	Length    uint32 // Frame length including MAC header
+	SrcMAC    net.HardwareAddr
+	DstMAC    net.HardwareAddr
+	EtherType uint32
+}
+
+// SampledIPv4 represents a sampled IPv4 packet record (sampled_ipv4)
+type SampledIPv4 struct {
+	Length   uint32 // IP packet length excluding lower layer encapsulations
+	Protocol uint32
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint32
+	DstPort  uint32
+	TCPFlags uint32
+	ToS      uint32
+}
+
+// SampledIPv6 represents a sampled IPv6 packet record (sampled_ipv6)
+type SampledIPv6 struct {
+	Length   uint32 // IP packet length excluding lower layer encapsulations
+	Protocol uint32 // IP next header
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint32
+	DstPort  uint32
+	TCPFlags uint32
+	Priority uint32
+}
+
+// ParseSampledEthernet parses sampled Ethernet frame record (24 bytes)
+// MAC addresses are XDR opaque<6>, padded to 8 bytes each.
+func ParseSampledEthernet(data []byte) (*SampledEthernet, error) {
+	if len(data) < 24 {
+		return nil, fmt.Errorf("sampled ethernet data too short: %d bytes", len(data))
+	}
+
+	return &SampledEthernet{
+		Length:    binary.BigEndian.Uint32(data[0:]),
+		SrcMAC:    net.HardwareAddr(data[4:10]),
+		DstMAC:    net.HardwareAddr(data[12:18]),
+		EtherType: binary.BigEndian.Uint32(data[20:]),
+	}, nil
+}
+
+// ParseSampledIPv4 parses sampled IPv4 record (32 bytes)
+func ParseSampledIPv4(data []byte) (*SampledIPv4, error) {
+	s4 := &SampledIPv4{}
+	if err := s4.Decode(data); err != nil {
+		return nil, err
+	}
+	return s4, nil
+}
+
+// Decode decodes a sampled IPv4 record body into s4 without allocating.
+// Addresses reference data.
+func (s4 *SampledIPv4) Decode(data []byte) error {
+	if len(data) < 32 {
+		return fmt.Errorf("sampled IPv4 data too short: %d bytes", len(data))
+	}
+
+	*s4 = SampledIPv4{
+		Length:   binary.BigEndian.Uint32(data[0:]),
+		Protocol: binary.BigEndian.Uint32(data[4:]),
+		SrcIP:    net.IP(data[8:12]),
+		DstIP:    net.IP(data[12:16]),
+		SrcPort:  binary.BigEndian.Uint32(data[16:]),
+		DstPort:  binary.BigEndian.Uint32(data[20:]),
+		TCPFlags: binary.BigEndian.Uint32(data[24:]),
+		ToS:      binary.BigEndian.Uint32(data[28:]),
+	}
+	return nil
+}
+
+// ParseSampledIPv6 parses sampled IPv6 record (56 bytes)
+func ParseSampledIPv6(data []byte) (*SampledIPv6, error) {
+	s6 := &SampledIPv6{}
+	if err := s6.Decode(data); err != nil {
+		return nil, err
+	}
+	return s6, nil
+}
+
+// Decode decodes a sampled IPv6 record body into s6 without allocating.
+// Addresses reference data.
+func (s6 *SampledIPv6) Decode(data []byte) error {
+	if len(data) < 56 {
+		return fmt.Errorf("sampled IPv6 data too short: %d bytes", len(data))
+	}
+
+	*s6 = SampledIPv6{
+		Length:   binary.BigEndian.Uint32(data[0:]),
+		Protocol: binary.BigEndian.Uint32(data[4:]),
+		SrcIP:    net.IP(data[8:24]),
+		DstIP:    net.IP(data[24:40]),
+		SrcPort:  binary.BigEndian.Uint32(data[40:]),
+		DstPort:  binary.BigEndian.Uint32(data[44:]),
+		TCPFlags: binary.BigEndian.Uint32(data[48:]),
+		Priority: binary.BigEndian.Uint32(data[52:]),
+	}
+	return nil
+}
+
+// ExtendedUser represents extended user data (extended_user).
+// Charsets are IANA MIBenum values; 0 if unknown.
+type ExtendedUser struct {
+	SrcCharset uint32
+	SrcUser    string
+	DstCharset uint32
+	DstUser    string
+}
+
+// ExtendedURL represents extended URL data (extended_url)
+type ExtendedURL struct {
+	Direction uint32 // URLDirectionSrc or URLDirectionDst
+	URL       string
+	Host      string // HTTP Host header
+}
+
+// ExtendedMPLS represents extended MPLS data (extended_mpls).
+// Label stacks hold label stack entries in the order they appear in the packet.
+type ExtendedMPLS struct {
+	NextHopType uint32
+	NextHop     net.IP
+	InStack     []uint32
+	OutStack    []uint32
+}
+
+// ExtendedNAT represents extended NAT data (extended_nat): the translated
+// source and destination addresses. An address that was not translated
+// equals the one reported in the packet header.
+type ExtendedNAT struct {
+	SrcAddrType uint32
+	SrcAddr     net.IP
+	DstAddrType uint32
+	DstAddr     net.IP
+}
+
+// ExtendedMPLSTunnel represents extended MPLS tunnel data (extended_mpls_tunnel)
+type ExtendedMPLSTunnel struct {
+	LSPName   string
+	TunnelID  uint32
+	TunnelCOS uint32
+}
+
+// ExtendedMPLSVC represents extended MPLS virtual circuit data (extended_mpls_vc)
+type ExtendedMPLSVC struct {
+	InstanceName string
+	VCID         uint32
+	VCLabelCOS   uint32
+}
+
+// ExtendedMPLSFTN represents extended MPLS FEC-to-NHLFE data (extended_mpls_FTN)
+type ExtendedMPLSFTN struct {
+	Description string
+	Mask        uint32
+}
+
+// readOpaque reads an XDR variable-length opaque (or string) at offset.
+// Returns the data (referencing data, without padding) and the offset past the padding.
+func readOpaque(data []byte, offset int) ([]byte, int, error) {
+	if offset+4 > len(data) {
+		return nil, offset, fmt.Errorf("data too short for opaque length")
+	}
+	length := binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	padded := (uint64(length) + 3) &^ 3
+	if uint64(offset)+padded > uint64(len(data)) {
+		return nil, offset, fmt.Errorf("opaque length %d exceeds remaining %d bytes", length, len(data)-offset)
+	}
+	return data[offset : offset+int(length)], offset + int(padded), nil
+}
+
+// readLabelStack reads an MPLS label_stack (XDR uint<>) at offset
+func readLabelStack(data []byte, offset int) ([]uint32, int, error) {
+	if offset+4 > len(data) {
+		return nil, offset, fmt.Errorf("data too short for label stack depth")
+	}
+	depth := binary.BigEndian.Uint32(data[offset:])
+	offset += 4
+
+	if uint64(offset)+uint64(depth)*4 > uint64(len(data)) {
+		return nil, offset, fmt.Errorf("label stack depth %d exceeds remaining %d bytes", depth, len(data)-offset)
+	}
+	stack := make([]uint32, depth)
+	for i := range stack {
+		stack[i] = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	}
+	return stack, offset, nil
+}
+
+// ParseExtendedUser parses extended user record
+func ParseExtendedUser(data []byte) (*ExtendedUser, error) {
+	eu := &ExtendedUser{}
+
+	if len(data) < 4 {
+		return nil, fmt.Errorf("extended user data too short: %d bytes", len(data))
+	}
+	eu.SrcCharset = binary.BigEndian.Uint32(data[0:])
+	srcUser, offset, err := readOpaque(data, 4)
+	if err != nil {
+		return nil, fmt.Errorf("extended user src_user: %w", err)
+	}
+	eu.SrcUser = string(srcUser)
+
+	if offset+4 > len(data) {
+		return nil, fmt.Errorf("extended user data too short for dst_charset")
+	}
+	eu.DstCharset = binary.BigEndian.Uint32(data[offset:])
+	dstUser, _, err := readOpaque(data, offset+4)
+	if err != nil {
+		return nil, fmt.Errorf("extended user dst_user: %w", err)
+	}
+	eu.DstUser = string(dstUser)
+
+	return eu, nil
+}
+
+// ParseExtendedURL parses extended URL record
+func ParseExtendedURL(data []byte) (*ExtendedURL, error) {
+	eu := &ExtendedURL{}
+
+	if len(data) < 4 {
+		return nil, fmt.Errorf("extended url data too short: %d bytes", len(data))
+	}
+	eu.Direction = binary.BigEndian.Uint32(data[0:])
+	url, offset, err := readOpaque(data, 4)
+	if err != nil {
+		return nil, fmt.Errorf("extended url url: %w", err)
+	}
+	eu.URL = string(url)
+
+	host, _, err := readOpaque(data, offset)
+	if err != nil {
+		return nil, fmt.Errorf("extended url host: %w", err)
+	}
+	eu.Host = string(host)
+
+	return eu, nil
+}
+
+// ParseExtendedMPLS parses extended MPLS record
+// Supports all RFC address_type values: UNKNOWN(0)=void, IP_V4(1)=4 bytes, IP_V6(2)=16 bytes
+func ParseExtendedMPLS(data []byte) (*ExtendedMPLS, error) {
+	em := &ExtendedMPLS{}
+
+	nextHopType, nextHop, offset, err := readAddress(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("extended mpls next hop: %w", err)
+	}
+	em.NextHopType = nextHopType
+	em.NextHop = nextHop
+
+	em.InStack, offset, err = readLabelStack(data, offset)
+	if err != nil {
+		return nil, fmt.Errorf("extended mpls in_stack: %w", err)
+	}
+	em.OutStack, _, err = readLabelStack(data, offset)
+	if err != nil {
+		return nil, fmt.Errorf("extended mpls out_stack: %w", err)
+	}
+
+	return em, nil
+}
+
+// ParseExtendedNAT parses extended NAT record
+// Supports all RFC address_type values: UNKNOWN(0)=void, IP_V4(1)=4 bytes, IP_V6(2)=16 bytes
+func ParseExtendedNAT(data []byte) (*ExtendedNAT, error) {
+	en := &ExtendedNAT{}
+	if err := en.Decode(data); err != nil {
+		return nil, err
+	}
+	return en, nil
+}
+
+// Decode decodes an extended NAT record body into en without allocating.
+// Addresses reference data.
+func (en *ExtendedNAT) Decode(data []byte) error {
+	*en = ExtendedNAT{}
+
+	srcType, srcAddr, offset, err := readAddress(data, 0)
+	if err != nil {
+		return fmt.Errorf("extended nat src address: %w", err)
+	}
+	dstType, dstAddr, _, err := readAddress(data, offset)
+	if err != nil {
+		return fmt.Errorf("extended nat dst address: %w", err)
+	}
+
+	en.SrcAddrType, en.SrcAddr = srcType, srcAddr
+	en.DstAddrType, en.DstAddr = dstType, dstAddr
+	return nil
+}
+
+// ParseExtendedMPLSTunnel parses extended MPLS tunnel record
+func ParseExtendedMPLSTunnel(data []byte) (*ExtendedMPLSTunnel, error) {
+	name, offset, err := readOpaque(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("extended mpls tunnel name: %w", err)
+	}
+	if offset+8 > len(data) {
+		return nil, fmt.Errorf("extended mpls tunnel data too short for tunnel id and cos")
+	}
+
+	return &ExtendedMPLSTunnel{
+		LSPName:   string(name),
+		TunnelID:  binary.BigEndian.Uint32(data[offset:]),
+		TunnelCOS: binary.BigEndian.Uint32(data[offset+4:]),
+	}, nil
+}
+
+// ParseExtendedMPLSVC parses extended MPLS virtual circuit record
+func ParseExtendedMPLSVC(data []byte) (*ExtendedMPLSVC, error) {
+	name, offset, err := readOpaque(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("extended mpls vc instance name: %w", err)
+	}
+	if offset+8 > len(data) {
+		return nil, fmt.Errorf("extended mpls vc data too short for vc id and cos")
+	}
+
+	return &ExtendedMPLSVC{
+		InstanceName: string(name),
+		VCID:         binary.BigEndian.Uint32(data[offset:]),
+		VCLabelCOS:   binary.BigEndian.Uint32(data[offset+4:]),
+	}, nil
+}
+
+// ParseExtendedMPLSFTN parses extended MPLS FTN record
+func ParseExtendedMPLSFTN(data []byte) (*ExtendedMPLSFTN, error) {
+	descr, offset, err := readOpaque(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("extended mpls ftn description: %w", err)
+	}
+	if offset+4 > len(data) {
+		return nil, fmt.Errorf("extended mpls ftn data too short for mask")
+	}
+
+	return &ExtendedMPLSFTN{
+		Description: string(descr),
+		Mask:        binary.BigEndian.Uint32(data[offset:]),
+	}, nil
+}
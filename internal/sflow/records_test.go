@@ -0,0 +1,227 @@
+package sflow
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseExtendedSwitch(t *testing.T) {
+	es, err := ParseExtendedSwitch(xdr{}.u32(100, 3, 200, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExtendedSwitch{SrcVLAN: 100, SrcPriority: 3, DstVLAN: 200, DstPriority: 5}); *es != want {
+		t.Errorf("extended_switch %+v, want %+v", *es, want)
+	}
+	if _, err := ParseExtendedSwitch(xdr{}.u32(100, 3, 200)); err == nil {
+		t.Error("short extended_switch parsed")
+	}
+}
+
+func TestParseExtendedRouter(t *testing.T) {
+	v4, v6 := net.IP{10, 0, 0, 1}, net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name    string
+		data    xdr
+		nhType  uint32
+		nextHop net.IP
+	}{
+		{"IPv4", xdr{}.u32(AddressTypeIPv4).raw(v4).u32(24, 16), AddressTypeIPv4, v4},
+		{"IPv6", xdr{}.u32(AddressTypeIPv6).raw(v6).u32(48, 32), AddressTypeIPv6, v6},
+		{"UNKNOWN", xdr{}.u32(AddressTypeUnknown).u32(24, 16), AddressTypeUnknown, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			er, err := ParseExtendedRouter(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if er.NextHopType != tt.nhType || !er.NextHop.Equal(tt.nextHop) || (tt.nextHop == nil) != (er.NextHop == nil) {
+				t.Errorf("next hop %d %v, want %d %v", er.NextHopType, er.NextHop, tt.nhType, tt.nextHop)
+			}
+			wantSrc, wantDst := uint32(24), uint32(16)
+			if tt.nhType == AddressTypeIPv6 {
+				wantSrc, wantDst = 48, 32
+			}
+			if er.SrcMaskLen != wantSrc || er.DstMaskLen != wantDst {
+				t.Errorf("mask lengths %d/%d, want %d/%d", er.SrcMaskLen, er.DstMaskLen, wantSrc, wantDst)
+			}
+
+			// Cut anywhere: in the address or the mask lengths
+			for n := 0; n < len(tt.data); n++ {
+				if _, err := ParseExtendedRouter(tt.data[:n]); err == nil {
+					t.Errorf("extended_router cut to %d bytes parsed", n)
+				}
+			}
+		})
+	}
+
+	if _, err := ParseExtendedRouter(xdr{}.u32(3, 0, 24, 16)); err == nil {
+		t.Error("extended_router with address type 3 parsed")
+	}
+}
+
+func TestParseSampledEthernet(t *testing.T) {
+	src := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	dst := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	// mac is opaque[6]: fixed size, padded to 8 bytes
+	data := xdr{}.u32(1518).raw(src).raw([]byte{0, 0}).raw(dst).raw([]byte{0, 0}).u32(0x86dd)
+	se, err := ParseSampledEthernet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se.Length != 1518 || se.SrcMAC.String() != src.String() || se.DstMAC.String() != dst.String() || se.EtherType != 0x86dd {
+		t.Errorf("sampled_ethernet %+v", *se)
+	}
+	if _, err := ParseSampledEthernet(data[:len(data)-1]); err == nil {
+		t.Error("short sampled_ethernet parsed")
+	}
+}
+
+func TestParseSampledIPv6(t *testing.T) {
+	src, dst := net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8:1::9")
+	data := xdr{}.u32(1280, 6).raw(src).raw(dst).u32(443, 51000, 0x12, 5)
+	s6, err := ParseSampledIPv6(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s6.Length != 1280 || s6.Protocol != 6 || !s6.SrcIP.Equal(src) || !s6.DstIP.Equal(dst) ||
+		s6.SrcPort != 443 || s6.DstPort != 51000 || s6.TCPFlags != 0x12 || s6.Priority != 5 {
+		t.Errorf("sampled_ipv6 %+v", *s6)
+	}
+
+	// Decode overwrites every field of a reused record
+	s6 = &SampledIPv6{Length: 1, SrcPort: 2, Priority: 3}
+	if err := s6.Decode(xdr{}.u32(60, 17).raw(dst).raw(src).u32(53, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if want := (SampledIPv6{Length: 60, Protocol: 17, SrcIP: dst, DstIP: src, SrcPort: 53}); s6.Length != want.Length ||
+		s6.Protocol != want.Protocol || !s6.SrcIP.Equal(want.SrcIP) || !s6.DstIP.Equal(want.DstIP) ||
+		s6.SrcPort != want.SrcPort || s6.DstPort != 0 || s6.TCPFlags != 0 || s6.Priority != 0 {
+		t.Errorf("decoded into reused record: %+v", *s6)
+	}
+
+	if _, err := ParseSampledIPv6(data[:55]); err == nil {
+		t.Error("short sampled_ipv6 parsed")
+	}
+}
+
+func TestReadOpaque(t *testing.T) {
+	for n := 0; n <= 9; n++ {
+		value := []byte("abcdefghi")[:n]
+		data := xdr{}.u32(7).opaque(value).u32(0xfeedface)
+		got, next, err := readOpaque(data, 4)
+		if err != nil {
+			t.Fatalf("length %d: %v", n, err)
+		}
+		if string(got) != string(value) || next != len(data)-4 {
+			t.Errorf("length %d: %q, next offset %d; want %q, %d", n, got, next, value, len(data)-4)
+		}
+	}
+
+	for name, data := range map[string]xdr{
+		"no length":                   xdr{0, 0, 0},
+		"length past the data":        xdr{}.u32(9).raw([]byte("abcdefgh")),
+		"padding missing":             xdr{}.u32(5).raw([]byte("abcde")),
+		"length overflowing int32":    xdr{}.u32(0x7fffffff).raw(make([]byte, 8)),
+		"length overflowing with pad": xdr{}.u32(0xffffffff).raw(make([]byte, 8)),
+	} {
+		if _, _, err := readOpaque(data, 0); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestReadLabelStack(t *testing.T) {
+	for _, stack := range [][]uint32{{}, {16<<12 | 0x100 | 64}, {16 << 12, 17 << 12, 18<<12 | 0x100}} {
+		data := xdr{}.u32(uint32(len(stack))).u32(stack...).u32(0xfeedface)
+		got, next, err := readLabelStack(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(stack) || next != len(data)-4 {
+			t.Errorf("stack %v, next offset %d; want %v, %d", got, next, stack, len(data)-4)
+		}
+	}
+
+	for name, data := range map[string]xdr{
+		"no depth":              {0, 0},
+		"depth past the data":   xdr{}.u32(3, 1, 2),
+		"depth overflowing *4":  xdr{}.u32(0x40000001, 1),
+		"depth overflowing int": xdr{}.u32(0xffffffff, 1, 2),
+	} {
+		if _, _, err := readLabelStack(data, 0); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// Each record parses to its fields, strings without their padding, and
+// fails cut anywhere
+func TestParseExtendedRecords(t *testing.T) {
+	v4, v6 := net.IP{10, 0, 0, 1}, net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name  string
+		data  xdr
+		parse func([]byte) (interface{}, error)
+		want  string
+	}{
+		{"extended_user", xdr{}.u32(106).opaque([]byte("alice")).u32(3).opaque([]byte("bob@example.org")),
+			func(b []byte) (interface{}, error) { return ParseExtendedUser(b) },
+			`{SrcCharset:106 SrcUser:alice DstCharset:3 DstUser:bob@example.org}`},
+		{"extended_user empty", xdr{}.u32(0).opaque(nil).u32(0).opaque(nil),
+			func(b []byte) (interface{}, error) { return ParseExtendedUser(b) },
+			`{SrcCharset:0 SrcUser: DstCharset:0 DstUser:}`},
+		{"extended_url", xdr{}.u32(URLDirectionSrc).opaque([]byte("/a?b=c")).opaque([]byte("example.org")),
+			func(b []byte) (interface{}, error) { return ParseExtendedURL(b) },
+			`{Direction:1 URL:/a?b=c Host:example.org}`},
+		{"extended_mpls IPv4", xdr{}.u32(AddressTypeIPv4).raw(v4).u32(2, 16<<12, 17<<12|0x100).u32(0),
+			func(b []byte) (interface{}, error) { return ParseExtendedMPLS(b) },
+			`{NextHopType:1 NextHop:10.0.0.1 InStack:[65536 69888] OutStack:[]}`},
+		{"extended_mpls IPv6", xdr{}.u32(AddressTypeIPv6).raw(v6).u32(0).u32(1, 3<<12|0x100),
+			func(b []byte) (interface{}, error) { return ParseExtendedMPLS(b) },
+			`{NextHopType:2 NextHop:2001:db8::1 InStack:[] OutStack:[12544]}`},
+		{"extended_mpls_tunnel", xdr{}.opaque([]byte("lsp-pe2")).u32(7, 3),
+			func(b []byte) (interface{}, error) { return ParseExtendedMPLSTunnel(b) },
+			`{LSPName:lsp-pe2 TunnelID:7 TunnelCOS:3}`},
+		{"extended_mpls_vc", xdr{}.opaque([]byte("vc-100")).u32(100, 5),
+			func(b []byte) (interface{}, error) { return ParseExtendedMPLSVC(b) },
+			`{InstanceName:vc-100 VCID:100 VCLabelCOS:5}`},
+		{"extended_mpls_FTN", xdr{}.opaque([]byte("to 192.0.2.0/24")).u32(0xffffff00),
+			func(b []byte) (interface{}, error) { return ParseExtendedMPLSFTN(b) },
+			`{Description:to 192.0.2.0/24 Mask:4294967040}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.parse(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimPrefix(fmt.Sprintf("%+v", v), "&"); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			for n := 0; n < len(tt.data); n++ {
+				if _, err := tt.parse(tt.data[:n]); err == nil {
+					t.Errorf("cut to %d bytes: no error", n)
+				}
+			}
+		})
+	}
+
+	// String lengths that would read past the record
+	for name, parse := range map[string]func() error{
+		"extended_user src_user": func() error { _, err := ParseExtendedUser(xdr{}.u32(0, 0xfffffffd, 0, 0)); return err },
+		"extended_user dst_user": func() error { _, err := ParseExtendedUser(xdr{}.u32(0, 0, 0, 64)); return err },
+		"extended_url host":      func() error { _, err := ParseExtendedURL(xdr{}.u32(0, 0, 0x80000000)); return err },
+		"extended_mpls in_stack": func() error { _, err := ParseExtendedMPLS(xdr{}.u32(0, 0x40000000, 0)); return err },
+		"extended_mpls_tunnel":   func() error { _, err := ParseExtendedMPLSTunnel(xdr{}.u32(0xffffffff, 0, 0)); return err },
+		"extended_mpls_vc":       func() error { _, err := ParseExtendedMPLSVC(xdr{}.u32(12, 0, 0)); return err },
+		"extended_mpls_FTN":      func() error { _, err := ParseExtendedMPLSFTN(xdr{}.u32(8, 0, 0)); return err },
+	} {
+		if parse() == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// splice replaces packet[start:end] with n bytes and returns the resized packet.
+// The caller writes the new bytes at packet[start:start+n]. If packet has spare
+// capacity it is resized in place and the returned slice shares its backing
+// array; otherwise a new packet is allocated.
+func splice(packet []byte, start, end, n int) []byte {
+	delta := n - (end - start)
+	newLen := len(packet) + delta
+
+	var newPacket []byte
+	if cap(packet) >= newLen {
+		newPacket = packet[:newLen]
+		if delta > 0 {
+			copy(newPacket[end+delta:], packet[end:])
+		} else {
+			copy(newPacket[start+n:], packet[end:])
+		}
+	} else {
+		newPacket = make([]byte, newLen)
+		copy(newPacket[:start], packet[:start])
+		copy(newPacket[start+n:], packet[end:])
+	}
+	return newPacket
+}
+
+// flowSampleNumRecordsOffset returns the offset of num_records within the data
+// of the sample at sampleOffset, or -1 if it is not a flow sample
+func flowSampleNumRecordsOffset(packet []byte, sampleOffset int) int {
+	header := binary.BigEndian.Uint32(packet[sampleOffset:])
+	if header>>12 != 0 {
+		return -1
+	}
+	switch header & 0xFFF {
+	case SampleTypeFlowSample:
+		return 28 // seq + source_id + rate + pool + drops + input + output
+	case SampleTypeExpandedFlowSample:
+		return 40 // seq + source_id(2) + rate + pool + drops + input(2) + output(2)
+	default:
+		return -1
+	}
+}
+
+// AppendFlowRecord appends a flow record (enterprise 0) to the flow sample at
+// sampleOffset, updating the sample length and num_records.
+// Returns the modified packet (may be resized) and success flag.
+// If packet has spare capacity it is grown in place and the returned slice shares
+// its backing array; otherwise a new packet is allocated.
+func AppendFlowRecord(packet []byte, sampleOffset int, format uint32, data []byte) ([]byte, bool) {
+	if len(data)%4 != 0 || format > 0xFFF {
+		return packet, false
+	}
+	if sampleOffset+8 > len(packet) {
+		return packet, false
+	}
+
+	sampleLen := binary.BigEndian.Uint32(packet[sampleOffset+4:])
+	sampleDataStart := sampleOffset + 8
+	sampleDataEnd := sampleDataStart + int(sampleLen)
+
+	if sampleDataEnd > len(packet) {
+		return packet, false
+	}
+
+	numRecordsOffset := flowSampleNumRecordsOffset(packet, sampleOffset)
+	if numRecordsOffset < 0 || numRecordsOffset+4 > int(sampleLen) {
+		return packet, false
+	}
+	numRecordsOffset += sampleDataStart
+
+	// Record: format(4) + length(4) + data, appended at the end of the sample
+	recordSize := 8 + len(data)
+	newPacket := splice(packet, sampleDataEnd, sampleDataEnd, recordSize)
+
+	binary.BigEndian.PutUint32(newPacket[sampleDataEnd:], format)
+	binary.BigEndian.PutUint32(newPacket[sampleDataEnd+4:], uint32(len(data)))
+	copy(newPacket[sampleDataEnd+8:], data)
+
+	// Update record count and sample length
+	numRecords := binary.BigEndian.Uint32(newPacket[numRecordsOffset:])
+	binary.BigEndian.PutUint32(newPacket[numRecordsOffset:], numRecords+1)
+	binary.BigEndian.PutUint32(newPacket[sampleOffset+4:], sampleLen+uint32(recordSize))
+
+	return newPacket, true
+}
+
+// SetAgentAddress replaces the agent address in the datagram header with an IPv4
+// or IPv6 address. When the address type changes the header is resized and all
+// samples move by the size difference. Other addresses (nil or malformed) are
+// not set.
+// Returns the modified packet (may be resized) and success flag.
+// If packet has spare capacity it is resized in place and the returned slice
+// shares its backing array; otherwise a new packet is allocated.
+func SetAgentAddress(packet []byte, agentAddr net.IP) ([]byte, bool) {
+	addrType := AddressType(agentAddr)
+	if addrType == AddressTypeUnknown {
+		return packet, false
+	}
+	addr := agentAddr.To4()
+	if addrType == AddressTypeIPv6 {
+		addr = agentAddr.To16()
+	}
+	if addr == nil {
+		return packet, false // neither IPv4 nor IPv6
+	}
+
+	if _, err := datagramHeaderLen(packet); err != nil {
+		return packet, false
+	}
+
+	// Replace type(4) + old address after the version
+	oldEnd := 8 + nextHopAddrSize(binary.BigEndian.Uint32(packet[4:]))
+	newPacket := splice(packet, 4, oldEnd, 4+len(addr))
+	binary.BigEndian.PutUint32(newPacket[4:], addrType)
+	copy(newPacket[8:], addr)
+
+	return newPacket, true
+}
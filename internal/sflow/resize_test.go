@@ -0,0 +1,265 @@
+package sflow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// resizeDatagram returns a datagram with two flow samples whose
+// extended_gateway records have records after them, followed by a counter
+// sample, so every resize moves records and samples
+func resizeDatagram(gateway0, gateway1 xdr) xdr {
+	src, dst := net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9}
+	return datagramV4(net.IP{192, 0, 2, 1}, 7,
+		flowSample(1, 3, 1000, 3, 4, rawHeaderRecord(1500, ipv4Header(src, dst)), gateway0, natRecord(src, dst)),
+		expandedFlowSample(2, 0x01000003, 512, 70000, 80000, gateway1, sampledIPv4Record(1500, src, dst)),
+		counterSample(false, 1, 3, ifCountersRecord(3, 1, 2)),
+	)
+}
+
+// gatewayOffsets returns the sample offset and record offset of the
+// extended_gateway record of sample i
+func gatewayOffsets(t *testing.T, data []byte, i int) (sampleOffset, recordOffset int) {
+	t.Helper()
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.Samples[i]
+	fs, err := ParseFlowSample(s.Data, s.Format == SampleTypeExpandedFlowSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fs.Records {
+		if r.Format == FlowRecordExtendedGateway {
+			return s.Offset, r.Offset
+		}
+	}
+	t.Fatalf("sample %d has no extended_gateway", i)
+	return 0, 0
+}
+
+// encodeEdited parses data into models, lets editSamples change the flow
+// samples and their extended_gateway records (nil for other samples) and
+// editDatagram the datagram, and encodes the result. Either edit may be nil.
+func encodeEdited(t *testing.T, data []byte, editSamples func(samples []*FlowSample, gateways []*ExtendedGateway), editDatagram func(*Datagram)) []byte {
+	t.Helper()
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make([]*FlowSample, len(d.Samples))
+	gateways := make([]*ExtendedGateway, len(d.Samples))
+	for i, s := range d.Samples {
+		if s.Format != SampleTypeFlowSample && s.Format != SampleTypeExpandedFlowSample {
+			continue
+		}
+		if samples[i], err = ParseFlowSample(s.Data, s.Format == SampleTypeExpandedFlowSample); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range samples[i].Records {
+			if r.Format == FlowRecordExtendedGateway {
+				if gateways[i], err = ParseExtendedGateway(r.Data); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if editSamples != nil {
+		editSamples(samples, gateways)
+	}
+	for i, fs := range samples {
+		if fs == nil {
+			continue
+		}
+		for j := range fs.Records {
+			if r := &fs.Records[j]; r.Format == FlowRecordExtendedGateway && gateways[i] != nil {
+				if r.Data, err = gateways[i].Encode(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if d.Samples[i], err = fs.Sample(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if editDatagram != nil {
+		editDatagram(d)
+	}
+
+	out, err := d.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// checkResize runs modify on data in a buffer with spare capacity, where it
+// resizes in place, and in one without, where it allocates, and checks both
+// results byte for byte against the encoding of the edited model
+func checkResize(t *testing.T, data []byte, modify func([]byte) ([]byte, bool),
+	editSamples func(samples []*FlowSample, gateways []*ExtendedGateway), editDatagram func(*Datagram)) {
+	t.Helper()
+	want := encodeEdited(t, data, editSamples, editDatagram)
+	for _, spare := range []int{256, 0} {
+		buf := make([]byte, len(data), len(data)+spare)
+		copy(buf, data)
+		got, ok := modify(buf)
+		if !ok {
+			t.Fatalf("spare capacity %d: not modified", spare)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("spare capacity %d: spliced datagram differs from the encoder's\n got %x\nwant %x", spare, got, want)
+		}
+		if _, err := Parse(got); err != nil {
+			t.Errorf("spare capacity %d: %v", spare, err)
+		}
+	}
+}
+
+// The packet modifiers splice the wire format in place for speed; each must
+// produce exactly what the encoder produces for the same change to the model
+func TestResizersMatchEncoder(t *testing.T) {
+	data := resizeDatagram(
+		gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, testCommunities, 100),
+		gatewayFlowRecord(net.ParseIP("2001:db8::2"), 64512, 0, 0, nil, nil, 0),
+	)
+	s0, r0 := gatewayOffsets(t, data, 0)
+	s1, r1 := gatewayOffsets(t, data, 1)
+	newPath := []ASPathSegment{{Type: ASPathSegmentSequence, ASNs: []uint32{64600, 64601, 64602}}}
+
+	tests := []struct {
+		name         string
+		modify       func([]byte) ([]byte, bool)
+		editSamples  func([]*FlowSample, []*ExtendedGateway)
+		editDatagram func(*Datagram)
+	}{
+		{"ModifyDstAS", func(p []byte) ([]byte, bool) { return ModifyDstAS(p, s1, r1, 64999) },
+			func(_ []*FlowSample, eg []*ExtendedGateway) {
+				eg[1].DstASPath = []ASPathSegment{{Type: ASPathSegmentSequence, ASNs: []uint32{64999}}}
+			}, nil},
+		{"ReplaceDstASPath", func(p []byte) ([]byte, bool) { return ReplaceDstASPath(p, s0, r0, newPath) },
+			func(_ []*FlowSample, eg []*ExtendedGateway) { eg[0].DstASPath = newPath }, nil},
+		{"ReplaceDstASPath empty", func(p []byte) ([]byte, bool) { return ReplaceDstASPath(p, s0, r0, nil) },
+			func(_ []*FlowSample, eg []*ExtendedGateway) { eg[0].DstASPath = nil }, nil},
+		{"PrependDstASPath", func(p []byte) ([]byte, bool) { return PrependDstASPath(p, s0, r0, []uint32{64512, 64512}) },
+			func(_ []*FlowSample, eg []*ExtendedGateway) {
+				eg[0].DstASPath[0].ASNs = append([]uint32{64512, 64512}, eg[0].DstASPath[0].ASNs...)
+			}, nil},
+		{"AddCommunities", func(p []byte) ([]byte, bool) {
+			return AddCommunities(p, s0, r0, []uint32{testCommunities[1], 64512<<16 | 300, 64512<<16 | 300, 64512<<16 | 400})
+		}, func(_ []*FlowSample, eg []*ExtendedGateway) {
+			eg[0].Communities = append(eg[0].Communities, 64512<<16|300, 64512<<16|400)
+		}, nil},
+		{"SetLocalPref", func(p []byte) ([]byte, bool) { return p, SetLocalPref(p, s0, r0, 250) },
+			func(_ []*FlowSample, eg []*ExtendedGateway) { eg[0].LocalPref = 250 }, nil},
+		{"SetNextHop", func(p []byte) ([]byte, bool) { return SetNextHop(p, s0, r0, net.ParseIP("2001:db8::3")) },
+			func(_ []*FlowSample, eg []*ExtendedGateway) {
+				eg[0].NextHopType, eg[0].NextHop = AddressTypeIPv6, net.ParseIP("2001:db8::3")
+			}, nil},
+		{"AppendFlowRecord", func(p []byte) ([]byte, bool) {
+			return AppendFlowRecord(p, s1, FlowRecordExtendedSwitch, xdr{}.u32(100, 0, 200, 0))
+		}, func(fs []*FlowSample, _ []*ExtendedGateway) {
+			fs[1].Records = append(fs[1].Records, NewFlowRecord(FlowRecordExtendedSwitch, xdr{}.u32(100, 0, 200, 0)))
+		}, nil},
+		{"SetAgentAddress", func(p []byte) ([]byte, bool) { return SetAgentAddress(p, net.ParseIP("2001:db8::1")) },
+			nil, func(d *Datagram) { d.AgentAddrType, d.AgentAddr = AddressTypeIPv6, net.ParseIP("2001:db8::1") }},
+		{"RemoveSample", func(p []byte) ([]byte, bool) { return RemoveSample(p, s0) },
+			nil, func(d *Datagram) { d.Samples = d.Samples[1:] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkResize(t, data, tt.modify, tt.editSamples, tt.editDatagram)
+		})
+	}
+}
+
+// A change of agent address type moves every sample; each must still parse
+// to what it was
+func TestSetAgentAddress(t *testing.T) {
+	v4, v6 := net.IP{192, 0, 2, 1}, net.ParseIP("2001:db8::1")
+	samples := []xdr{
+		flowSample(1, 3, 1000, 3, 4, rawHeaderRecord(1500, ipv4Header(net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9})),
+			gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, testCommunities, 100)),
+		expandedFlowSample(2, 0x01000003, 512, 70000, 80000, sampledIPv4Record(1500, net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9})),
+		counterSample(false, 1, 3, ifCountersRecord(3, 1, 2)),
+		counterSample(true, 2, 70000, ifCountersRecord(70000, 3, 4)),
+	}
+	tests := []struct {
+		name     string
+		data     xdr
+		agent    net.IP
+		addrType uint32
+	}{
+		{"IPv4 to IPv6", datagramV4(v4, 7, samples...), net.ParseIP("2001:db8::ff"), AddressTypeIPv6},
+		{"IPv6 to IPv4", datagramV6(v6, 7, samples...), net.IP{10, 255, 0, 1}, AddressTypeIPv4},
+		{"IPv4 to IPv4", datagramV4(v4, 7, samples...), net.IP{10, 255, 0, 1}, AddressTypeIPv4},
+		{"IPv6 to IPv6", datagramV6(v6, 7, samples...), net.ParseIP("2001:db8::ff"), AddressTypeIPv6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkResize(t, tt.data, func(p []byte) ([]byte, bool) { return SetAgentAddress(p, tt.agent) },
+				nil, func(d *Datagram) { d.AgentAddrType, d.AgentAddr = tt.addrType, tt.agent })
+
+			before, err := Parse(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, ok := SetAgentAddress(append([]byte{}, tt.data...), tt.agent)
+			if !ok {
+				t.Fatal("agent address not set")
+			}
+			after, err := Parse(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.AgentAddrType != tt.addrType || !after.AgentAddr.Equal(tt.agent) ||
+				after.SubAgentID != before.SubAgentID || after.SequenceNum != 7 || after.Uptime != before.Uptime {
+				t.Errorf("header %d %v sub-agent %d seq %d uptime %d", after.AgentAddrType, after.AgentAddr,
+					after.SubAgentID, after.SequenceNum, after.Uptime)
+			}
+			if len(after.Samples) != len(samples) {
+				t.Fatalf("%d samples, want %d", len(after.Samples), len(samples))
+			}
+			for i, s := range after.Samples {
+				if s.Format != before.Samples[i].Format || !bytes.Equal(s.Data, before.Samples[i].Data) {
+					t.Errorf("sample %d changed", i)
+				}
+				switch s.Format {
+				case SampleTypeFlowSample, SampleTypeExpandedFlowSample:
+					fs, err := ParseFlowSample(s.Data, s.Format == SampleTypeExpandedFlowSample)
+					if err != nil {
+						t.Fatalf("sample %d: %v", i, err)
+					}
+					for _, r := range fs.Records {
+						if r.Format == FlowRecordExtendedGateway {
+							if _, err := ParseExtendedGateway(r.Data); err != nil {
+								t.Errorf("sample %d: %v", i, err)
+							}
+						}
+					}
+				default:
+					cs, err := ParseCounterSample(s.Data, s.Format == SampleTypeExpandedCounterSample)
+					if err != nil {
+						t.Fatalf("sample %d: %v", i, err)
+					}
+					if _, err := ParseIfCounters(cs.Records[0].Data); err != nil {
+						t.Errorf("sample %d: %v", i, err)
+					}
+				}
+			}
+		})
+	}
+
+	data := datagramV4(v4, 7, samples...)
+	for name, agent := range map[string]net.IP{"nil": nil, "malformed": {1, 2, 3}} {
+		if out, ok := SetAgentAddress(append([]byte{}, data...), agent); ok || !bytes.Equal(out, data) {
+			t.Errorf("%s agent address: set %v", name, ok)
+		}
+	}
+	if _, ok := SetAgentAddress(data[:20], v6); ok {
+		t.Error("agent address set in a truncated header")
+	}
+}
@@ -0,0 +1,97 @@
+package sflow
+
+import (
+	"encoding/binary"
+)
+
+// flowSampleRateOffset returns the offset of sampling_rate within the data of the
+// sample at sampleOffset, or -1 if it is not a flow sample
+func flowSampleRateOffset(packet []byte, sampleOffset int) int {
+	header := binary.BigEndian.Uint32(packet[sampleOffset:])
+	if header>>12 != 0 {
+		return -1
+	}
+	switch header & 0xFFF {
+	case SampleTypeFlowSample:
+		return 8 // seq + source_id
+	case SampleTypeExpandedFlowSample:
+		return 12 // seq + source_id type + source_id index
+	default:
+		return -1
+	}
+}
+
+// flowSampleHeader checks that the sample at sampleOffset is a flow sample long
+// enough to hold its fixed fields and returns the absolute offset of its data
+// and of sampling_rate
+func flowSampleHeader(packet []byte, sampleOffset int) (dataStart, rateOffset int, ok bool) {
+	if sampleOffset < 0 || sampleOffset+8 > len(packet) {
+		return 0, 0, false
+	}
+	rateOffset = flowSampleRateOffset(packet, sampleOffset)
+	if rateOffset < 0 {
+		return 0, 0, false
+	}
+	sampleLen := int(binary.BigEndian.Uint32(packet[sampleOffset+4:]))
+	dataStart = sampleOffset + 8
+	if rateOffset+4 > sampleLen || dataStart+sampleLen > len(packet) {
+		return 0, 0, false
+	}
+	return dataStart, dataStart + rateOffset, true
+}
+
+// SetSamplingRate overwrites the sampling_rate of the flow sample at sampleOffset
+// (compact or expanded) in place
+func SetSamplingRate(packet []byte, sampleOffset int, rate uint32) bool {
+	_, rateOffset, ok := flowSampleHeader(packet, sampleOffset)
+	if !ok {
+		return false
+	}
+	binary.BigEndian.PutUint32(packet[rateOffset:], rate)
+	return true
+}
+
+// SetSamplePool overwrites the sample_pool (following sampling_rate) of the
+// flow sample at sampleOffset in place
+func SetSamplePool(packet []byte, sampleOffset int, pool uint32) bool {
+	dataStart, rateOffset, ok := flowSampleHeader(packet, sampleOffset)
+	if !ok || rateOffset+8 > dataStart+int(binary.BigEndian.Uint32(packet[sampleOffset+4:])) {
+		return false
+	}
+	binary.BigEndian.PutUint32(packet[rateOffset+4:], pool)
+	return true
+}
+
+// SetFlowSampleSequence overwrites the sequence_number of the flow sample at
+// sampleOffset in place
+func SetFlowSampleSequence(packet []byte, sampleOffset int, seq uint32) bool {
+	dataStart, _, ok := flowSampleHeader(packet, sampleOffset)
+	if !ok {
+		return false
+	}
+	binary.BigEndian.PutUint32(packet[dataStart:], seq)
+	return true
+}
+
+// RemoveSample removes the sample at sampleOffset from the datagram and
+// decrements num_samples. The packet shrinks in place: the returned slice shares
+// its backing array and later samples move to lower offsets.
+func RemoveSample(packet []byte, sampleOffset int) ([]byte, bool) {
+	headerLen, err := datagramHeaderLen(packet)
+	if err != nil || sampleOffset < headerLen || sampleOffset+8 > len(packet) {
+		return packet, false
+	}
+	sampleEnd := sampleOffset + 8 + int(binary.BigEndian.Uint32(packet[sampleOffset+4:]))
+	if sampleEnd > len(packet) {
+		return packet, false
+	}
+
+	numSamples := binary.BigEndian.Uint32(packet[headerLen-4:])
+	if numSamples == 0 {
+		return packet, false
+	}
+	newPacket := splice(packet, sampleOffset, sampleEnd, 0)
+	binary.BigEndian.PutUint32(newPacket[headerLen-4:], numSamples-1)
+
+	return newPacket, true
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+
+	"sflow-enricher/internal/aspath"
 )
 
 const (
@@ -16,9 +18,10 @@ const (
 	AddressTypeIPv6    = 2
 
 	// Sample types (enterprise 0)
-	SampleTypeFlowSample         = 1
-	SampleTypeCounterSample      = 2
-	SampleTypeExpandedFlowSample = 3
+	SampleTypeFlowSample            = 1
+	SampleTypeCounterSample         = 2
+	SampleTypeExpandedFlowSample    = 3
+	SampleTypeExpandedCounterSample = 4
 
 	// Flow record types (enterprise 0)
 	FlowRecordRawPacketHeader = 1
@@ -28,6 +31,21 @@ const (
 	FlowRecordExtendedSwitch  = 1001
 	FlowRecordExtendedRouter  = 1002
 	FlowRecordExtendedGateway = 1003
+	FlowRecordExtendedUser    = 1004
+	FlowRecordExtendedURL     = 1005
+	FlowRecordExtendedMPLS    = 1006
+	FlowRecordExtendedNAT     = 1007
+	FlowRecordMPLSTunnel      = 1008
+	FlowRecordMPLSVC          = 1009
+	FlowRecordMPLSFTN         = 1010
+
+	// extended_url direction (sFlow v5: enum url_direction)
+	URLDirectionSrc = 1 // URL is associated with the source address
+	URLDirectionDst = 2 // URL is associated with the destination address
+
+	// AS path segment types (sFlow v5: enum as_path_segment_type)
+	ASPathSegmentSet      = aspath.Set      // AS_SET: unordered set of ASs
+	ASPathSegmentSequence = aspath.Sequence // AS_SEQUENCE: ordered set of ASs
 )
 
 // Datagram represents an sFlow v5 datagram
@@ -60,10 +78,13 @@ type FlowSample struct {
 	SamplingRate  uint32
 	SamplePool    uint32
 	Drops         uint32
+	InputFormat   uint32 // Expanded samples only: interface_expanded format
 	Input         uint32
+	OutputFormat  uint32 // Expanded samples only: interface_expanded format
 	Output        uint32
 	NumRecords    uint32
 	Records       []FlowRecord
+	Expanded      bool // Parsed from an expanded flow sample (format 3)
 }
 
 // FlowRecord represents a flow record within a sample
@@ -75,191 +96,96 @@ type FlowRecord struct {
 	Offset     int // Offset within the sample data
 }
 
+// ASPathSegment represents one segment of the destination AS path
+type ASPathSegment = aspath.Segment
+
 // ExtendedGateway represents extended gateway data
 type ExtendedGateway struct {
-	NextHopType    uint32
-	NextHop        net.IP
-	AS             uint32 // Router's own AS
-	SrcAS          uint32 // Source AS
-	SrcPeerAS      uint32 // Source peer AS
-	DstASPathLen   uint32
-	DstASPath      []uint32
-	CommunitiesLen uint32
-	Communities    []uint32
-	LocalPref      uint32
+	NextHopType       uint32
+	NextHop           net.IP
+	AS                uint32 // Router's own AS
+	SrcAS             uint32 // Source AS
+	SrcPeerAS         uint32 // Source peer AS
+	DstASPathSegments uint32 // Number of AS path segments (not ASNs)
+	DstASPath         []ASPathSegment
+	CommunitiesLen    uint32
+	Communities       []uint32
+	LocalPref         uint32
 }
 
-// Parse parses an sFlow v5 datagram
-func Parse(data []byte) (*Datagram, error) {
-	if len(data) < 28 {
-		return nil, fmt.Errorf("packet too short: %d bytes", len(data))
-	}
-
-	d := &Datagram{Raw: make([]byte, len(data))}
-	copy(d.Raw, data)
-
-	offset := 0
-
-	// Version
-	d.Version = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-	if d.Version != SFlowVersion5 {
-		return nil, fmt.Errorf("unsupported sFlow version: %d", d.Version)
+// DstASPathASNs returns all ASNs of the destination AS path, flattened in wire order
+func (eg *ExtendedGateway) DstASPathASNs() []uint32 {
+	var asns []uint32
+	for _, seg := range eg.DstASPath {
+		asns = append(asns, seg.ASNs...)
 	}
+	return asns
+}
 
-	// Agent address type
-	d.AgentAddrType = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// Agent address
-	switch d.AgentAddrType {
-	case AddressTypeIPv4:
-		if len(data) < 28 { // 4+4+4+4+4+4+4 = 28 bytes minimum for IPv4 header
-			return nil, fmt.Errorf("packet too short for IPv4 agent: %d bytes", len(data))
+// DstPeerAS returns the first ASN of the destination AS path (the neighbor AS), 0 if empty
+func (eg *ExtendedGateway) DstPeerAS() uint32 {
+	for _, seg := range eg.DstASPath {
+		if len(seg.ASNs) > 0 {
+			return seg.ASNs[0]
 		}
-		d.AgentAddr = net.IP(data[offset : offset+4])
-		offset += 4
-	case AddressTypeIPv6:
-		if len(data) < 40 { // 4+4+16+4+4+4+4 = 40 bytes minimum for IPv6 header
-			return nil, fmt.Errorf("packet too short for IPv6 agent: %d bytes", len(data))
-		}
-		d.AgentAddr = net.IP(data[offset : offset+16])
-		offset += 16
-	default:
-		return nil, fmt.Errorf("unsupported agent address type: %d", d.AgentAddrType)
 	}
+	return 0
+}
 
-	// Sub-agent ID
-	d.SubAgentID = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// Sequence number
-	d.SequenceNum = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// Uptime
-	d.Uptime = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// Number of samples
-	d.NumSamples = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// Parse samples
-	for i := uint32(0); i < d.NumSamples && offset < len(data); i++ {
-		if offset+8 > len(data) {
-			break
-		}
-
-		sampleHeader := binary.BigEndian.Uint32(data[offset:])
-		sampleLen := binary.BigEndian.Uint32(data[offset+4:])
-
-		sample := Sample{
-			Enterprise: sampleHeader >> 12,
-			Format:     sampleHeader & 0xFFF,
-			Length:     sampleLen,
-			Offset:     offset,
-		}
-
-		offset += 8
-
-		if offset+int(sampleLen) > len(data) {
-			break
+// DstAS returns the origin AS: the last ASN of the last AS_SEQUENCE segment, 0 if none.
+// A trailing AS_SET (aggregated route) has no single origin and is skipped.
+func (eg *ExtendedGateway) DstAS() uint32 {
+	for i := len(eg.DstASPath) - 1; i >= 0; i-- {
+		seg := eg.DstASPath[i]
+		if seg.Type == ASPathSegmentSequence && len(seg.ASNs) > 0 {
+			return seg.ASNs[len(seg.ASNs)-1]
 		}
-
-		sample.Data = data[offset : offset+int(sampleLen)]
-		offset += int(sampleLen)
-
-		d.Samples = append(d.Samples, sample)
 	}
-
-	return d, nil
+	return 0
 }
 
-// ParseFlowSample parses flow sample data
-func ParseFlowSample(data []byte, expanded bool) (*FlowSample, error) {
-	minLen := 32 // standard flow_sample: 8 fields * 4 bytes
-	if expanded {
-		minLen = 44 // expanded: 11 fields * 4 bytes (source_id split + input/output expanded)
-	}
-	if len(data) < minLen {
-		return nil, fmt.Errorf("flow sample too short: %d bytes (need %d)", len(data), minLen)
+// Parse parses an sFlow v5 datagram.
+// It is a convenience wrapper around DatagramReader that copies the packet into
+// Raw and collects all samples; truncated trailing samples are dropped silently.
+func Parse(data []byte) (*Datagram, error) {
+	var r DatagramReader
+	if err := r.Reset(data); err != nil {
+		return nil, err
 	}
 
-	fs := &FlowSample{}
-	offset := 0
-
-	fs.SequenceNum = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	if expanded {
-		fs.SourceIDType = binary.BigEndian.Uint32(data[offset:])
-		offset += 4
-		fs.SourceIDIndex = binary.BigEndian.Uint32(data[offset:])
-		offset += 4
-	} else {
-		sourceID := binary.BigEndian.Uint32(data[offset:])
-		fs.SourceIDType = sourceID >> 24
-		fs.SourceIDIndex = sourceID & 0x00FFFFFF
-		offset += 4
+	d := &Datagram{
+		Version:       r.Version,
+		AgentAddrType: r.AgentAddrType,
+		AgentAddr:     r.AgentAddr,
+		SubAgentID:    r.SubAgentID,
+		SequenceNum:   r.SequenceNum,
+		Uptime:        r.Uptime,
+		NumSamples:    r.NumSamples,
+		Raw:           make([]byte, len(data)),
 	}
+	copy(d.Raw, data)
 
-	fs.SamplingRate = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	fs.SamplePool = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	fs.Drops = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	if expanded {
-		// Expanded: interface_expanded = {format(4), value(4)}
-		offset += 4 // skip input format
-		fs.Input = binary.BigEndian.Uint32(data[offset:])
-		offset += 4
-		offset += 4 // skip output format
-		fs.Output = binary.BigEndian.Uint32(data[offset:])
-		offset += 4
-	} else {
-		fs.Input = binary.BigEndian.Uint32(data[offset:])
-		offset += 4
-		fs.Output = binary.BigEndian.Uint32(data[offset:])
-		offset += 4
+	for r.Next() {
+		d.Samples = append(d.Samples, r.Sample())
 	}
 
-	fs.NumRecords = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// Parse flow records
-	for i := uint32(0); i < fs.NumRecords && offset < len(data); i++ {
-		if offset+8 > len(data) {
-			break
-		}
-
-		recordHeader := binary.BigEndian.Uint32(data[offset:])
-		recordLen := binary.BigEndian.Uint32(data[offset+4:])
-
-		record := FlowRecord{
-			Enterprise: recordHeader >> 12,
-			Format:     recordHeader & 0xFFF,
-			Length:     recordLen,
-			Offset:     offset,
-		}
-
-		offset += 8
-
-		if offset+int(recordLen) > len(data) {
-			break
-		}
+	return d, nil
+}
 
-		record.Data = data[offset : offset+int(recordLen)]
-		offset += int(recordLen)
+// ParseFlowSample parses flow sample data.
+// It is a convenience wrapper around FlowSampleReader; truncated trailing records are dropped silently.
+func ParseFlowSample(data []byte, expanded bool) (*FlowSample, error) {
+	var r FlowSampleReader
+	if err := r.Reset(data, expanded); err != nil {
+		return nil, err
+	}
 
-		fs.Records = append(fs.Records, record)
+	fs := r.FlowSample
+	for r.Next() {
+		fs.Records = append(fs.Records, r.Record())
 	}
 
-	return fs, nil
+	return &fs, nil
 }
 
 // ParseExtendedGateway parses extended gateway record
@@ -311,28 +237,32 @@ func ParseExtendedGateway(data []byte) (*ExtendedGateway, error) {
 
 	// Parse AS path segments if present
 	if offset+4 <= len(data) {
-		eg.DstASPathLen = binary.BigEndian.Uint32(data[offset:])
+		eg.DstASPathSegments = binary.BigEndian.Uint32(data[offset:])
 		offset += 4
 
-		for i := uint32(0); i < eg.DstASPathLen && offset+8 <= len(data); i++ {
+		for i := uint32(0); i < eg.DstASPathSegments; i++ {
 			// AS path segment: type (4 bytes) + length (4 bytes) + ASNs
-			segType := binary.BigEndian.Uint32(data[offset:])
+			if offset+8 > len(data) {
+				return nil, fmt.Errorf("extended gateway AS path truncated at segment %d", i)
+			}
+			seg := ASPathSegment{Type: binary.BigEndian.Uint32(data[offset:])}
 			offset += 4
-			_ = segType // segment type (AS_SET, AS_SEQUENCE)
 
 			segLen := binary.BigEndian.Uint32(data[offset:])
 			offset += 4
 
-			// Validate that all ASNs in this segment fit within the data
-			if offset+int(segLen)*4 > len(data) {
-				break // Truncated segment, stop parsing
+			// All ASNs in this segment must fit, otherwise the fields that follow
+			// (communities, local_pref) would be read from the wrong boundary
+			if uint64(offset)+uint64(segLen)*4 > uint64(len(data)) {
+				return nil, fmt.Errorf("extended gateway AS path segment %d truncated: %d ASNs", i, segLen)
 			}
 
-			for j := uint32(0); j < segLen && offset+4 <= len(data); j++ {
-				asn := binary.BigEndian.Uint32(data[offset:])
+			seg.ASNs = make([]uint32, segLen)
+			for j := range seg.ASNs {
+				seg.ASNs[j] = binary.BigEndian.Uint32(data[offset:])
 				offset += 4
-				eg.DstASPath = append(eg.DstASPath, asn)
 			}
+			eg.DstASPath = append(eg.DstASPath, seg)
 		}
 	}
 
@@ -341,7 +271,11 @@ func ParseExtendedGateway(data []byte) (*ExtendedGateway, error) {
 		eg.CommunitiesLen = binary.BigEndian.Uint32(data[offset:])
 		offset += 4
 
-		for i := uint32(0); i < eg.CommunitiesLen && offset+4 <= len(data); i++ {
+		if uint64(offset)+uint64(eg.CommunitiesLen)*4 > uint64(len(data)) {
+			return nil, fmt.Errorf("extended gateway communities truncated: %d communities", eg.CommunitiesLen)
+		}
+
+		for i := uint32(0); i < eg.CommunitiesLen; i++ {
 			comm := binary.BigEndian.Uint32(data[offset:])
 			offset += 4
 			eg.Communities = append(eg.Communities, comm)
@@ -355,113 +289,26 @@ func ParseExtendedGateway(data []byte) (*ExtendedGateway, error) {
 	return eg, nil
 }
 
-// GetSrcDstIPFromRawPacket extracts source and destination IP from raw packet header record
+// GetSrcDstIPFromRawPacket extracts source and destination IP from raw packet header record.
+// The header is walked by DissectHeader, so VLAN/QinQ, MPLS and raw IP headers are supported.
 func GetSrcDstIPFromRawPacket(data []byte) (srcIP, dstIP net.IP) {
-	if len(data) < 20 {
+	rh, err := ParseRawPacketHeader(data)
+	if err != nil {
 		return nil, nil
 	}
 
-	offset := 0
-	protocol := binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-	_ = protocol
-
-	offset += 4 // frame_length
-	offset += 4 // stripped
-
-	headerLen := binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	if offset+int(headerLen) > len(data) || headerLen < 20 {
+	h, err := DissectHeader(rh.Protocol, rh.Header, DissectOptions{})
+	if err != nil || h.IPVersion == 0 {
 		return nil, nil
 	}
 
-	header := data[offset : offset+int(headerLen)]
-
-	if len(header) >= 34 {
-		etherType := binary.BigEndian.Uint16(header[12:14])
-
-		switch etherType {
-		case 0x0800: // IPv4
-			if len(header) >= 34 {
-				srcIP = net.IP(header[26:30])
-				dstIP = net.IP(header[30:34])
-				return
-			}
-		case 0x86DD: // IPv6
-			if len(header) >= 54 {
-				srcIP = net.IP(header[22:38])
-				dstIP = net.IP(header[38:54])
-				return
-			}
-		case 0x8100: // VLAN tagged
-			if len(header) >= 38 {
-				innerType := binary.BigEndian.Uint16(header[16:18])
-				if innerType == 0x0800 && len(header) >= 38 {
-					srcIP = net.IP(header[30:34])
-					dstIP = net.IP(header[34:38])
-					return
-				}
-			}
-		}
-	}
-
-	return nil, nil
+	return h.SrcIP, h.DstIP
 }
 
 // GetSrcIPFromRawPacket extracts source IP from raw packet header record (legacy)
 func GetSrcIPFromRawPacket(data []byte) net.IP {
-	if len(data) < 20 {
-		return nil
-	}
-
-	// Raw packet header format:
-	// protocol (4) + frame_length (4) + stripped (4) + header_length (4) + header...
-	offset := 0
-
-	protocol := binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-	_ = protocol
-
-	// frame_length
-	offset += 4
-	// stripped
-	offset += 4
-
-	headerLen := binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	if offset+int(headerLen) > len(data) || headerLen < 20 {
-		return nil
-	}
-
-	header := data[offset : offset+int(headerLen)]
-
-	// Check if it's an Ethernet frame (look for IPv4/IPv6)
-	// Ethernet header: dst(6) + src(6) + type(2) = 14 bytes
-	if len(header) >= 34 {
-		etherType := binary.BigEndian.Uint16(header[12:14])
-
-		switch etherType {
-		case 0x0800: // IPv4
-			if len(header) >= 34 {
-				return net.IP(header[26:30]) // Source IP in IPv4 header
-			}
-		case 0x86DD: // IPv6
-			if len(header) >= 54 {
-				return net.IP(header[22:38]) // Source IP in IPv6 header
-			}
-		case 0x8100: // VLAN tagged
-			if len(header) >= 38 {
-				innerType := binary.BigEndian.Uint16(header[16:18])
-				if innerType == 0x0800 && len(header) >= 38 {
-					return net.IP(header[30:34])
-				}
-			}
-		}
-	}
-
-	return nil
+	srcIP, _ := GetSrcDstIPFromRawPacket(data)
+	return srcIP
 }
 
 // nextHopAddrSize returns the address size in bytes for a given nexthop address_type.
@@ -481,9 +328,11 @@ func nextHopAddrSize(nextHopType uint32) int {
 }
 
 // ModifyDstAS inserts destination AS into an empty DstASPath
-// Returns the modified packet (may be resized) and success flag
+// Returns the modified packet (may be resized) and success flag.
+// If packet has spare capacity it is grown in place and the returned slice shares
+// its backing array; otherwise a new packet is allocated.
 func ModifyDstAS(packet []byte, sampleOffset int, recordOffset int, newAS uint32) ([]byte, bool) {
-	// Calculate absolute offset to DstASPathLen field
+	// Calculate absolute offset to DstASPathSegments field
 	if sampleOffset+8 > len(packet) {
 		return packet, false
 	}
@@ -517,36 +366,34 @@ func ModifyDstAS(packet []byte, sampleOffset int, recordOffset int, newAS uint32
 	if addrSize < 0 {
 		return packet, false
 	}
-	// DstASPathLen offset: type(4) + addr(addrSize) + AS(4) + SrcAS(4) + SrcPeerAS(4)
-	dstASPathLenOffset := recordDataStart + 4 + addrSize + 4 + 4 + 4
+	// DstASPathSegments offset: type(4) + addr(addrSize) + AS(4) + SrcAS(4) + SrcPeerAS(4)
+	dstASPathSegmentsOffset := recordDataStart + 4 + addrSize + 4 + 4 + 4
 
-	if dstASPathLenOffset+4 > len(packet) {
+	if dstASPathSegmentsOffset+4 > len(packet) {
 		return packet, false
 	}
 
-	// Check current DstASPathLen
-	currentPathLen := binary.BigEndian.Uint32(packet[dstASPathLenOffset:])
-	if currentPathLen != 0 {
+	// Check current segment count
+	currentSegments := binary.BigEndian.Uint32(packet[dstASPathSegmentsOffset:])
+	if currentSegments != 0 {
 		// Already has AS path, don't modify
 		return packet, false
 	}
 
-	// Insert AS path segment: pathLen(4) + segType(4) + segLen(4) + ASN(4) = 12 bytes to insert
-	// But we're replacing pathLen=0 with pathLen=1, so we need to insert 12 bytes after pathLen
-	insertPoint := dstASPathLenOffset + 4
-	insertData := make([]byte, 12)
-	binary.BigEndian.PutUint32(insertData[0:], 2)     // AS_SEQUENCE type
-	binary.BigEndian.PutUint32(insertData[4:], 1)     // 1 ASN in segment
-	binary.BigEndian.PutUint32(insertData[8:], newAS) // The ASN
+	// Insert AS path segment: segType(4) + segLen(4) + ASN(4) = 12 bytes
+	// The segment count goes from 0 to 1, so the segment is inserted right after it
+	insertPoint := dstASPathSegmentsOffset + 4
+
+	// Grow in place when the buffer has spare capacity (pooled receive buffers),
+	// otherwise allocate a new packet
+	newPacket := splice(packet, insertPoint, insertPoint, 12)
 
-	// Create new packet with inserted data
-	newPacket := make([]byte, len(packet)+12)
-	copy(newPacket[:insertPoint], packet[:insertPoint])
-	copy(newPacket[insertPoint:insertPoint+12], insertData)
-	copy(newPacket[insertPoint+12:], packet[insertPoint:])
+	binary.BigEndian.PutUint32(newPacket[insertPoint:], ASPathSegmentSequence)
+	binary.BigEndian.PutUint32(newPacket[insertPoint+4:], 1)     // 1 ASN in segment
+	binary.BigEndian.PutUint32(newPacket[insertPoint+8:], newAS) // The ASN
 
-	// Update DstASPathLen to 1
-	binary.BigEndian.PutUint32(newPacket[dstASPathLenOffset:], 1)
+	// Update segment count to 1
+	binary.BigEndian.PutUint32(newPacket[dstASPathSegmentsOffset:], 1)
 
 	// Update record length (+12)
 	newRecordLen := recordLen + 12
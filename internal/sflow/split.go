@@ -0,0 +1,97 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// datagramHeaderLen returns the datagram header length (up to and including
+// num_samples) from the agent address type
+func datagramHeaderLen(packet []byte) (int, error) {
+	if len(packet) < 8 {
+		return 0, fmt.Errorf("packet too short: %d bytes", len(packet))
+	}
+	addrSize := nextHopAddrSize(binary.BigEndian.Uint32(packet[4:]))
+	if addrSize <= 0 {
+		return 0, fmt.Errorf("unsupported agent address type: %d", binary.BigEndian.Uint32(packet[4:]))
+	}
+	headerLen := 8 + addrSize + 16
+	if len(packet) < headerLen {
+		return 0, fmt.Errorf("packet too short for header: %d bytes", len(packet))
+	}
+	return headerLen, nil
+}
+
+// SetSequenceNum overwrites the datagram sequence number in place
+func SetSequenceNum(packet []byte, seq uint32) error {
+	headerLen, err := datagramHeaderLen(packet)
+	if err != nil {
+		return err
+	}
+	// sequence_number is followed by uptime and num_samples
+	binary.BigEndian.PutUint32(packet[headerLen-12:], seq)
+	return nil
+}
+
+// SplitDatagram splits a datagram into datagrams of at most maxSize bytes.
+// Each part repeats the agent header (including the original sequence number)
+// with num_samples recounted; samples are never split and keep their order.
+// A single sample too large for maxSize is sent alone in an oversize part.
+// If packet already fits, it is returned as the only part without copying.
+func SplitDatagram(packet []byte, maxSize int) ([][]byte, error) {
+	if len(packet) <= maxSize {
+		return [][]byte{packet}, nil
+	}
+
+	headerLen, err := datagramHeaderLen(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts [][]byte
+	var part []byte
+	numSamples := uint32(0)
+
+	flush := func() {
+		if numSamples == 0 {
+			return
+		}
+		binary.BigEndian.PutUint32(part[headerLen-4:], numSamples)
+		parts = append(parts, part)
+		part = nil
+		numSamples = 0
+	}
+
+	var reader DatagramReader
+	if err := reader.Reset(packet); err != nil {
+		return nil, err
+	}
+	for reader.Next() {
+		sample := reader.Sample()
+		sampleLen := 8 + len(sample.Data)
+
+		if part != nil && len(part)+sampleLen > maxSize {
+			flush()
+		}
+		if part == nil {
+			size := headerLen + sampleLen
+			if size < maxSize {
+				size = maxSize
+			}
+			part = make([]byte, headerLen, size)
+			copy(part, packet[:headerLen])
+		}
+		part = append(part, packet[sample.Offset:sample.Offset+sampleLen]...)
+		numSamples++
+	}
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	// Nothing but trailing bytes beyond the header: keep the datagram as is
+	if len(parts) == 0 {
+		return [][]byte{packet}, nil
+	}
+	return parts, nil
+}
@@ -0,0 +1,100 @@
+package sflow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSplitDatagram(t *testing.T) {
+	src, dst := net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9}
+	small := func(seq uint32) xdr {
+		return flowSample(seq, 3, 1000, 3, 4, sampledIPv4Record(1500, src, dst))
+	}
+	large := flowSample(9, 3, 1000, 3, 4, rawHeaderRecord(1500, ipv4Header(src, dst)),
+		gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, testCommunities, 100))
+	counters := counterSample(false, 1, 3, ifCountersRecord(3, 1e9, 2e9))
+
+	v4 := func(samples ...xdr) xdr { return datagramV4(net.IP{192, 0, 2, 1}, 77, samples...) }
+	v6 := func(samples ...xdr) xdr { return datagramV6(net.ParseIP("2001:db8::1"), 77, samples...) }
+
+	tests := []struct {
+		name    string
+		data    xdr
+		maxSize int
+		parts   [][]xdr // samples of each part
+	}{
+		{"fits", v4(small(1), counters), 1500, [][]xdr{{small(1), counters}}},
+		{"exactly the limit", v4(small(1), counters), len(v4(small(1), counters)), [][]xdr{{small(1), counters}}},
+		{"two parts", v4(small(1), small(2), counters), len(v4(small(1), small(2))), [][]xdr{{small(1), small(2)}, {counters}}},
+		{"one sample per part", v4(small(1), small(2), small(3)), len(v4(small(1))), [][]xdr{{small(1)}, {small(2)}, {small(3)}}},
+		{"single oversize sample", v4(small(1), large, small(2)), len(v4(small(1), small(2))), [][]xdr{{small(1)}, {large}, {small(2)}}},
+		{"oversize sample alone", v4(large), len(v4(small(1))), [][]xdr{{large}}},
+		{"IPv6 agent", v6(small(1), counters, small(2)), len(v6(small(1), counters)), [][]xdr{{small(1), counters}, {small(2)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.data)
+			parts, err := SplitDatagram(data, tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != len(tt.parts) {
+				t.Fatalf("%d parts, want %d", len(parts), len(tt.parts))
+			}
+			if len(data) <= tt.maxSize && &parts[0][0] != &data[0] {
+				t.Error("datagram that fits was copied")
+			}
+
+			orig, err := Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, part := range parts {
+				if p := Validate(part); p != nil {
+					t.Fatalf("part %d: %v", i, p)
+				}
+				d, err := Parse(part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d.NumSamples != uint32(len(tt.parts[i])) || len(d.Samples) != len(tt.parts[i]) {
+					t.Fatalf("part %d: num_samples %d with %d samples, want %d", i, d.NumSamples, len(d.Samples), len(tt.parts[i]))
+				}
+				if !d.AgentAddr.Equal(orig.AgentAddr) || d.SubAgentID != orig.SubAgentID ||
+					d.SequenceNum != orig.SequenceNum || d.Uptime != orig.Uptime {
+					t.Errorf("part %d header %+v, want that of %+v", i, d, orig)
+				}
+				for j, s := range d.Samples {
+					if got := part[s.Offset : s.Offset+8+len(s.Data)]; !bytes.Equal(got, tt.parts[i][j]) {
+						t.Errorf("part %d sample %d differs", i, j)
+					}
+				}
+				if len(part) > tt.maxSize && len(tt.parts[i]) != 1 {
+					t.Errorf("part %d is %d bytes with %d samples, limit %d", i, len(part), len(tt.parts[i]), tt.maxSize)
+				}
+			}
+		})
+	}
+}
+
+func TestSetSequenceNum(t *testing.T) {
+	for _, data := range []xdr{
+		datagramV4(net.IP{192, 0, 2, 1}, 1),
+		datagramV6(net.ParseIP("2001:db8::1"), 1),
+	} {
+		if err := SetSequenceNum(data, 4242); err != nil {
+			t.Fatal(err)
+		}
+		d, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.SequenceNum != 4242 || d.NumSamples != 0 || d.Uptime != 123456 {
+			t.Errorf("header %+v after SetSequenceNum", d)
+		}
+	}
+	if err := SetSequenceNum(make([]byte, 20), 1); err == nil {
+		t.Error("SetSequenceNum accepted a truncated header")
+	}
+}
@@ -0,0 +1,288 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ProblemKind identifies a class of structural problem found by Validate
+type ProblemKind string
+
+const (
+	ProblemTruncatedHeader     ProblemKind = "truncated_header"      // datagram or sample header cut short
+	ProblemUnsupportedVersion  ProblemKind = "unsupported_version"   // datagram version is not 5
+	ProblemUnknownAddressType  ProblemKind = "unknown_address_type"  // address type not UNKNOWN, IPv4 or IPv6
+	ProblemSampleCountMismatch ProblemKind = "sample_count_mismatch" // num_samples differs from samples present
+	ProblemBadSampleLength     ProblemKind = "bad_sample_length"     // sample length overruns datagram or is unaligned
+	ProblemRecordCountMismatch ProblemKind = "record_count_mismatch" // num_records differs from records present
+	ProblemBadRecordLength     ProblemKind = "bad_record_length"     // record length overruns sample or is unaligned
+	ProblemTrailingBytes       ProblemKind = "trailing_bytes"        // bytes after the last sample or record
+)
+
+// ProblemKinds lists all problem kinds, e.g. to pre-register counters
+var ProblemKinds = []ProblemKind{
+	ProblemTruncatedHeader,
+	ProblemUnsupportedVersion,
+	ProblemUnknownAddressType,
+	ProblemSampleCountMismatch,
+	ProblemBadSampleLength,
+	ProblemRecordCountMismatch,
+	ProblemBadRecordLength,
+	ProblemTrailingBytes,
+}
+
+// Problem describes one structural problem of a datagram
+type Problem struct {
+	Kind   ProblemKind
+	Sample int // sample index, -1 for datagram-level problems
+	Offset int // byte offset in the datagram
+	Detail string
+}
+
+func (p Problem) String() string {
+	if p.Sample < 0 {
+		return fmt.Sprintf("%s at offset %d: %s", p.Kind, p.Offset, p.Detail)
+	}
+	return fmt.Sprintf("%s in sample %d at offset %d: %s", p.Kind, p.Sample, p.Offset, p.Detail)
+}
+
+// Validate checks the structure of an sFlow v5 datagram: header, address types,
+// sample and record lengths and counts, and trailing bytes. Flow and counter
+// samples are checked record by record; other samples only by length.
+// It returns nil for a well-formed datagram and does not allocate in that case.
+func Validate(data []byte) []Problem {
+	v := validator{data: data}
+	v.run()
+	return v.problems
+}
+
+// Repair validates data and, if possible, rewrites it in place so that it is
+// well-formed: samples with broken records are removed, samples and datagram are
+// trimmed to the data actually described, and num_samples / num_records are fixed.
+// It returns the repaired datagram (sharing data's backing array), the problems
+// found, and ok=false if the datagram cannot be repaired (bad header) or no
+// sample survives.
+func Repair(data []byte) (repaired []byte, problems []Problem, ok bool) {
+	v := validator{data: data, repair: true}
+	if !v.run() {
+		return data, v.problems, false
+	}
+	if len(v.problems) == 0 {
+		return data, nil, true
+	}
+	if len(v.kept) == 0 {
+		return data, v.problems, false
+	}
+
+	// Compact kept samples towards the header. Kept spans are in increasing
+	// order and never move forward, so copy (memmove) is safe.
+	offset := v.headerLen
+	for _, k := range v.kept {
+		binary.BigEndian.PutUint32(data[offset:], binary.BigEndian.Uint32(data[k.offset:]))
+		binary.BigEndian.PutUint32(data[offset+4:], uint32(k.length))
+		copy(data[offset+8:], data[k.offset+8:k.offset+8+k.length])
+		if k.numRecordsOffset >= 0 {
+			binary.BigEndian.PutUint32(data[offset+8+k.numRecordsOffset:], k.numRecords)
+		}
+		offset += 8 + k.length
+	}
+	binary.BigEndian.PutUint32(data[v.headerLen-4:], uint32(len(v.kept)))
+
+	return data[:offset], v.problems, true
+}
+
+// keptSample is a sample that survives repair
+type keptSample struct {
+	offset           int    // sample header offset in the original datagram
+	length           int    // (possibly trimmed) sample data length
+	numRecordsOffset int    // offset of num_records in sample data, -1 if not a flow/counter sample
+	numRecords       uint32 // records actually present
+}
+
+type validator struct {
+	data      []byte
+	repair    bool
+	headerLen int
+	problems  []Problem
+	kept      []keptSample
+}
+
+func (v *validator) add(kind ProblemKind, sample, offset int, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Kind: kind, Sample: sample, Offset: offset, Detail: fmt.Sprintf(format, args...)})
+}
+
+// run validates the datagram. It returns false if the datagram header is unusable.
+func (v *validator) run() bool {
+	data := v.data
+	if len(data) < 8 {
+		v.add(ProblemTruncatedHeader, -1, 0, "datagram is %d bytes", len(data))
+		return false
+	}
+	if version := binary.BigEndian.Uint32(data); version != SFlowVersion5 {
+		v.add(ProblemUnsupportedVersion, -1, 0, "version %d", version)
+		return false
+	}
+
+	addrType := binary.BigEndian.Uint32(data[4:])
+	addrSize := nextHopAddrSize(addrType)
+	if addrSize <= 0 {
+		// UNKNOWN is valid XDR but an agent must identify itself
+		v.add(ProblemUnknownAddressType, -1, 4, "agent address type %d", addrType)
+		return false
+	}
+	v.headerLen = 8 + addrSize + 16
+	if len(data) < v.headerLen {
+		v.add(ProblemTruncatedHeader, -1, 0, "datagram is %d bytes, header needs %d", len(data), v.headerLen)
+		return false
+	}
+
+	numSamples := binary.BigEndian.Uint32(data[v.headerLen-4:])
+	offset := v.headerLen
+	found := 0
+	badLength := false
+	for offset < len(data) && uint32(found) < numSamples {
+		if offset+8 > len(data) {
+			break
+		}
+		length := binary.BigEndian.Uint32(data[offset+4:])
+		if uint64(offset)+8+uint64(length) > uint64(len(data)) {
+			v.add(ProblemBadSampleLength, found, offset, "length %d exceeds remaining %d bytes", length, len(data)-offset-8)
+			badLength = true
+			break
+		}
+		if length%4 != 0 {
+			v.add(ProblemBadSampleLength, found, offset, "length %d is not 4-byte aligned", length)
+			badLength = true
+			break
+		}
+		v.sample(found, offset, int(length))
+		offset += 8 + int(length)
+		found++
+	}
+
+	if uint32(found) != numSamples {
+		v.add(ProblemSampleCountMismatch, -1, v.headerLen-4, "num_samples %d, found %d", numSamples, found)
+	}
+	// Data after a bad sample length is reported by that problem, not as trailing
+	if offset < len(data) && !badLength {
+		v.add(ProblemTrailingBytes, -1, offset, "%d bytes after last sample", len(data)-offset)
+	}
+	return true
+}
+
+// sample validates one sample and records whether (and how) it is kept
+func (v *validator) sample(index, offset, length int) {
+	header := binary.BigEndian.Uint32(v.data[offset:])
+	enterprise, format := header>>12, header&0xFFF
+	data := v.data[offset+8 : offset+8+length]
+
+	// Records start after the sample header; num_records is its last field
+	recordsStart := 0
+	if enterprise == 0 {
+		switch format {
+		case SampleTypeFlowSample:
+			recordsStart = 32
+		case SampleTypeExpandedFlowSample:
+			recordsStart = 44
+		case SampleTypeCounterSample:
+			recordsStart = 12
+		case SampleTypeExpandedCounterSample:
+			recordsStart = 16
+		}
+	}
+	if recordsStart == 0 {
+		// Opaque to us: the length check is all we can do
+		v.keep(keptSample{offset: offset, length: length, numRecordsOffset: -1})
+		return
+	}
+
+	if length < recordsStart {
+		v.add(ProblemTruncatedHeader, index, offset, "sample format %d is %d bytes, header needs %d", format, length, recordsStart)
+		return
+	}
+
+	isFlow := format == SampleTypeFlowSample || format == SampleTypeExpandedFlowSample
+	numRecords := binary.BigEndian.Uint32(data[recordsStart-4:])
+	recOffset := recordsStart
+	var found uint32
+	valid := true
+	for recOffset < len(data) && found < numRecords {
+		if recOffset+8 > len(data) {
+			break
+		}
+		recLength := binary.BigEndian.Uint32(data[recOffset+4:])
+		if uint64(recOffset)+8+uint64(recLength) > uint64(len(data)) {
+			v.add(ProblemBadRecordLength, index, offset+8+recOffset, "record length %d exceeds remaining %d bytes", recLength, len(data)-recOffset-8)
+			valid = false
+			break
+		}
+		if recLength%4 != 0 {
+			v.add(ProblemBadRecordLength, index, offset+8+recOffset, "record length %d is not 4-byte aligned", recLength)
+			valid = false
+			break
+		}
+		if isFlow {
+			recHeader := binary.BigEndian.Uint32(data[recOffset:])
+			recData := data[recOffset+8 : recOffset+8+int(recLength)]
+			if !v.flowRecordAddresses(index, offset+8+recOffset, recHeader, recData) {
+				valid = false
+			}
+		}
+		recOffset += 8 + int(recLength)
+		found++
+	}
+
+	if valid && found != numRecords {
+		v.add(ProblemRecordCountMismatch, index, offset+8+recordsStart-4, "num_records %d, found %d", numRecords, found)
+	}
+	if valid && recOffset < len(data) {
+		v.add(ProblemTrailingBytes, index, offset+8+recOffset, "%d bytes after last record", len(data)-recOffset)
+	}
+
+	if valid {
+		v.keep(keptSample{offset: offset, length: recOffset, numRecordsOffset: recordsStart - 4, numRecords: found})
+	}
+}
+
+// flowRecordAddresses checks the address types of flow records that carry addresses.
+// It returns false if an address type is unknown or the record is too short for it.
+func (v *validator) flowRecordAddresses(index, offset int, header uint32, data []byte) bool {
+	if header>>12 != 0 {
+		return true
+	}
+
+	// Leading address of the record, and for extended_nat the second one
+	numAddrs := 0
+	switch header & 0xFFF {
+	case FlowRecordExtendedRouter, FlowRecordExtendedGateway, FlowRecordExtendedMPLS:
+		numAddrs = 1
+	case FlowRecordExtendedNAT:
+		numAddrs = 2
+	}
+
+	addrOffset := 0
+	for i := 0; i < numAddrs; i++ {
+		if addrOffset+4 > len(data) {
+			v.add(ProblemBadRecordLength, index, offset, "flow record %d too short for address", header&0xFFF)
+			return false
+		}
+		addrType := binary.BigEndian.Uint32(data[addrOffset:])
+		addrSize := nextHopAddrSize(addrType)
+		if addrSize < 0 {
+			v.add(ProblemUnknownAddressType, index, offset, "flow record %d address type %d", header&0xFFF, addrType)
+			return false
+		}
+		addrOffset += 4 + addrSize
+		if addrOffset > len(data) {
+			v.add(ProblemBadRecordLength, index, offset, "flow record %d too short for address type %d", header&0xFFF, addrType)
+			return false
+		}
+	}
+	return true
+}
+
+func (v *validator) keep(k keptSample) {
+	if v.repair {
+		v.kept = append(v.kept, k)
+	}
+}
@@ -0,0 +1,158 @@
+package sflow
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// patch returns a copy of b with the 32-bit word at offset set to v
+func patch(b xdr, offset int, v uint32) xdr {
+	c := append(xdr(nil), b...)
+	binary.BigEndian.PutUint32(c[offset:], v)
+	return c
+}
+
+func TestValidateRepair(t *testing.T) {
+	agent := net.IP{192, 0, 2, 1}
+	src, dst := net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9}
+	flow := flowSample(1, 3, 1000, 3, 4,
+		rawHeaderRecord(1500, ipv4Header(src, dst)),
+		gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, testCommunities, 100))
+	counters := counterSample(false, 1, 3, ifCountersRecord(3, 1e9, 2e9))
+	good := datagramV4(agent, 1, flow, counters)
+
+	// Offset of num_records in a compact flow sample
+	const numRecords = 8 + 28
+
+	type problem struct {
+		kind   ProblemKind
+		sample int
+	}
+	tests := []struct {
+		name string
+		data xdr
+		want []problem
+		kept int // samples left by Repair, -1 if not repairable
+	}{
+		{"well-formed", good, nil, 2},
+		{"short datagram", xdr{}.u32(SFlowVersion5), []problem{{ProblemTruncatedHeader, -1}}, -1},
+		{"truncated IPv6 header", datagramV6(net.ParseIP("2001:db8::1"), 1)[:30], []problem{{ProblemTruncatedHeader, -1}}, -1},
+		{"version 4", patch(good, 0, 4), []problem{{ProblemUnsupportedVersion, -1}}, -1},
+		{"unknown agent address type", patch(good, 4, AddressTypeUnknown), []problem{{ProblemUnknownAddressType, -1}}, -1},
+		{"num_samples too high", patch(good, 24, 3), []problem{{ProblemSampleCountMismatch, -1}}, 2},
+		{"num_samples too low", patch(good, 24, 1), []problem{{ProblemTrailingBytes, -1}}, 1},
+		{"sample overruns datagram",
+			datagramV4(agent, 1, flow, xdr{}.u32(SampleTypeCounterSample, 1000)),
+			[]problem{{ProblemBadSampleLength, 1}, {ProblemSampleCountMismatch, -1}}, 1},
+		{"unaligned sample length",
+			datagramV4(agent, 1, flow, xdr{}.dataFormat(0, SampleTypeCounterSample, xdr{1, 2, 3})),
+			[]problem{{ProblemBadSampleLength, 1}, {ProblemSampleCountMismatch, -1}}, 1},
+		{"truncated flow sample header",
+			datagramV4(agent, 1, xdr{}.dataFormat(0, SampleTypeFlowSample, xdr{}.u32(1, 3, 1000)), counters),
+			[]problem{{ProblemTruncatedHeader, 0}}, 1},
+		{"num_records too high",
+			datagramV4(agent, 1, patch(flow, numRecords, 3), counters),
+			[]problem{{ProblemRecordCountMismatch, 0}}, 2},
+		{"record overruns sample",
+			datagramV4(agent, 1, counters, flowSample(1, 3, 1000, 3, 4, xdr{}.u32(FlowRecordIPv4, 500))),
+			[]problem{{ProblemBadRecordLength, 1}}, 1},
+		{"unaligned record length",
+			datagramV4(agent, 1, flowSample(1, 3, 1000, 3, 4, xdr{}.u32(FlowRecordIPv4, 3).raw([]byte{1, 2, 3, 0})), counters),
+			[]problem{{ProblemBadRecordLength, 0}}, 1},
+		{"gateway next hop type unknown",
+			datagramV4(agent, 1, flowSample(1, 3, 1000, 3, 4, xdr{}.dataFormat(0, FlowRecordExtendedGateway, xdr{}.u32(9, 0))), counters),
+			[]problem{{ProblemUnknownAddressType, 0}}, 1},
+		{"gateway too short for next hop",
+			datagramV4(agent, 1, flowSample(1, 3, 1000, 3, 4, xdr{}.dataFormat(0, FlowRecordExtendedGateway, xdr{}.u32(AddressTypeIPv6, 1))), counters),
+			[]problem{{ProblemBadRecordLength, 0}}, 1},
+		{"trailing bytes after last sample", good.u32(0, 0), []problem{{ProblemTrailingBytes, -1}}, 2},
+		{"trailing bytes after last record",
+			datagramV4(agent, 1, patch(flow, numRecords, 1), counters),
+			[]problem{{ProblemTrailingBytes, 0}}, 2},
+		{"no sample survives",
+			datagramV4(agent, 1, flowSample(1, 3, 1000, 3, 4, xdr{}.u32(FlowRecordIPv4, 500))),
+			[]problem{{ProblemBadRecordLength, 0}}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := Validate(tt.data)
+			var got []problem
+			for _, p := range problems {
+				got = append(got, problem{p.Kind, p.Sample})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Validate = %v, want %v", problems, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Validate = %v, want %v", problems, tt.want)
+				}
+			}
+
+			data := append([]byte(nil), tt.data...)
+			repaired, repairProblems, ok := Repair(data)
+			if len(repairProblems) != len(problems) {
+				t.Errorf("Repair found %v, Validate %v", repairProblems, problems)
+			}
+			if ok != (tt.kept >= 0) {
+				t.Fatalf("Repair ok = %v, want %v", ok, tt.kept >= 0)
+			}
+			if !ok {
+				return
+			}
+			if p := Validate(repaired); p != nil {
+				t.Fatalf("repaired datagram has problems: %v", p)
+			}
+			checkRepaired(t, repaired, tt.kept)
+		})
+	}
+}
+
+// checkRepaired checks that the counts in a repaired datagram describe its content
+func checkRepaired(t *testing.T, data []byte, kept int) {
+	t.Helper()
+	d, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.NumSamples != uint32(kept) || len(d.Samples) != kept {
+		t.Fatalf("num_samples %d with %d samples, want %d", d.NumSamples, len(d.Samples), kept)
+	}
+	for i, s := range d.Samples {
+		switch s.Format {
+		case SampleTypeFlowSample:
+			fs, err := ParseFlowSample(s.Data, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fs.NumRecords != uint32(len(fs.Records)) {
+				t.Errorf("sample %d: num_records %d with %d records", i, fs.NumRecords, len(fs.Records))
+			}
+		case SampleTypeCounterSample:
+			cs, err := ParseCounterSample(s.Data, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cs.NumRecords != uint32(len(cs.Records)) {
+				t.Errorf("sample %d: num_records %d with %d records", i, cs.NumRecords, len(cs.Records))
+			}
+		}
+	}
+}
+
+func TestValidateDoesNotAllocate(t *testing.T) {
+	data := []byte(datagramV4(net.IP{192, 0, 2, 1}, 1,
+		flowSample(1, 3, 1000, 3, 4,
+			rawHeaderRecord(1500, ipv4Header(net.IP{198, 51, 100, 7}, net.IP{203, 0, 113, 9})),
+			gatewayFlowRecord(net.IP{10, 0, 0, 1}, 64512, 3356, 3356, testPath, testCommunities, 100)),
+		counterSample(true, 1, 3, ifCountersRecord(3, 1e9, 2e9))))
+	allocs := testing.AllocsPerRun(100, func() {
+		if p := Validate(data); p != nil {
+			t.Fatal(p)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Validate allocates %.1f times for a well-formed datagram, want 0", allocs)
+	}
+}